@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/initialed85/glue/pkg/dissect"
+	"github.com/initialed85/glue/pkg/helpers"
+	"github.com/initialed85/glue/pkg/network"
+)
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	read := flag.String("read", "", "pcap / pcapng capture to read (otherwise listen for live traffic)")
+	interfaceName := flag.String("interface", "", "interface to join the discovery multicast group on (live only)")
+	rawDiscoveryAddress := flag.String("discoveryAddress", "239.192.137.1:27320", "discovery address (its port is always let through); 0 for none")
+	rawPorts := flag.String("ports", "", "comma-separated listen ports to let through as well as the discovery port (default all ports)")
+	endpoint := flag.String("endpoint", "", "only show traffic from or to this endpoint (name or ID)")
+	topic := flag.String("topic", "", "only show (reassembled) messages on this topic")
+
+	flag.Parse()
+
+	filter := dissect.Filter{
+		Endpoint: *endpoint,
+		Topic:    *topic,
+	}
+
+	for _, rawPort := range strings.Split(*rawPorts, ",") {
+		rawPort = strings.TrimSpace(rawPort)
+		if rawPort == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(rawPort)
+		if err != nil {
+			log.Fatalf("failed to parse -ports=%#v: %v", *rawPorts, err)
+		}
+
+		filter.Ports = append(filter.Ports, port)
+	}
+
+	groupAddrs := make([]*net.UDPAddr, 0)
+
+	if *rawDiscoveryAddress != "0" {
+		discoveryAddress, err := network.GetAddress(*rawDiscoveryAddress)
+		if err != nil {
+			log.Fatalf("failed to parse -discoveryAddress=%#v: %v", *rawDiscoveryAddress, err)
+		}
+
+		groupAddrs = append(groupAddrs, discoveryAddress)
+
+		if len(filter.Ports) > 0 {
+			filter.Ports = append(filter.Ports, discoveryAddress.Port)
+		}
+	}
+
+	dissector := dissect.NewDissector(os.Stdout, filter)
+
+	if *read != "" {
+		file, err := os.Open(*read)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = dissect.ReadCapture(file, dissector.Handle)
+		_ = file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	listener := dissect.NewListener(*interfaceName, groupAddrs, dissector.Handle)
+
+	err := listener.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("press Ctrl + C to exit...")
+	helpers.WaitForCtrlC()
+
+	listener.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/helpers"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/registry"
+)
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	networkID, err := helpers.GetNetworkIDFromEnv()
+	if err != nil {
+		networkID = 1
+	}
+
+	registryID := ksuid.New()
+
+	registryName, err := helpers.GetEndpointNameFromEnv()
+	if err != nil {
+		registryName = fmt.Sprintf("Registry_%v", registryID)
+	}
+
+	listenAddress, err := helpers.GetRegistryListenAddressFromEnv()
+	if err != nil || listenAddress == nil {
+		listenAddress, _ = net.ResolveUDPAddr("udp4", "0.0.0.0:27320")
+	}
+
+	listenInterface, err := helpers.GetListenInterfaceFromEnv()
+	if err != nil {
+		listenInterface, err = network.GetDefaultInterfaceName()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	peerAddresses, err := helpers.GetRegistryPeerAddressesFromEnv()
+	if err != nil {
+		peerAddresses = nil
+	}
+
+	healthAddress, err := helpers.GetRegistryHealthAddressFromEnv()
+	if err != nil {
+		healthAddress = "0.0.0.0:27380"
+	}
+
+	discoveryRate, err := helpers.GetDiscoveryRateFromEnv()
+	if err != nil {
+		discoveryRate = time.Second * 1
+	}
+
+	discoveryRateTimeoutMultiplier, err := helpers.GetDiscoveryRateTimeoutMultiplierFromEnv()
+	if err != nil {
+		discoveryRateTimeoutMultiplier = 2.0
+	}
+
+	log.Printf("registry; networkID: %v", networkID)
+	log.Printf("registry; registryID: %v", registryID)
+	log.Printf("registry; registryName: %v", registryName)
+	log.Printf("registry; listenAddress: %v", listenAddress)
+	log.Printf("registry; listenInterface: %v", listenInterface)
+	log.Printf("registry; peerAddresses: %v", peerAddresses)
+	log.Printf("registry; healthAddress: %v", healthAddress)
+	log.Printf("registry; discoveryRate: %v", discoveryRate)
+	log.Printf("registry; discoveryRateTimeoutMultiplier: %v", discoveryRateTimeoutMultiplier)
+
+	networkManager := network.NewManager()
+
+	registryManager := registry.NewManager(
+		networkID,
+		registryID,
+		registryName,
+		listenAddress,
+		listenInterface,
+		peerAddresses,
+		discoveryRate,
+		discoveryRateTimeoutMultiplier,
+		networkManager,
+	)
+
+	networkManager.Start()
+	registryManager.Start()
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", registryManager)
+
+	server := &http.Server{
+		Addr:    healthAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("warning: health server failed: %v", err)
+		}
+	}()
+
+	log.Print("press Ctrl + C to exit...")
+	helpers.WaitForCtrlC()
+
+	_ = server.Close()
+
+	registryManager.Stop()
+	networkManager.Stop()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/helpers"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/relay"
+)
+
+// getSide reads GLUE_RELAY_(side)_*; the defaults are the same as for an endpoint, but the interface must be given as
+// the whole point is that the sides are on different networks
+func getSide(side string) *relay.Side {
+	listenAddress, err := helpers.GetRelayListenAddressFromEnv(side)
+	if err != nil || listenAddress == nil {
+		listenPort, err := network.GetFreePort()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		listenAddress, _ = net.ResolveUDPAddr("udp4", fmt.Sprintf("0.0.0.0:%v", listenPort))
+	}
+
+	listenInterface, err := helpers.GetRelayListenInterfaceFromEnv(side)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	discoveryListenAddress, err := helpers.GetRelayDiscoveryListenAddressFromEnv(side)
+	if err != nil || discoveryListenAddress == nil {
+		discoveryListenAddress, _ = net.ResolveUDPAddr("udp4", "239.192.137.1:27320")
+	}
+
+	discoveryTargetAddress, err := helpers.GetRelayDiscoveryTargetAddressFromEnv(side)
+	if err != nil {
+		discoveryTargetAddress, _ = net.ResolveUDPAddr("udp4", "239.192.137.1:27320")
+	}
+
+	discoverySeedAddresses, err := helpers.GetRelayDiscoverySeedAddressesFromEnv(side)
+	if err != nil {
+		discoverySeedAddresses = nil
+	}
+
+	log.Printf("relay; side %v listenAddress: %v", side, listenAddress)
+	log.Printf("relay; side %v listenInterface: %v", side, listenInterface)
+	log.Printf("relay; side %v discoveryListenAddress: %v", side, discoveryListenAddress)
+	log.Printf("relay; side %v discoveryTargetAddress: %v", side, discoveryTargetAddress)
+	log.Printf("relay; side %v discoverySeedAddresses: %v", side, discoverySeedAddresses)
+
+	return relay.NewSide(
+		side,
+		listenAddress,
+		discoveryListenAddress,
+		discoveryTargetAddress,
+		discoverySeedAddresses,
+		listenInterface,
+	)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	networkID, err := helpers.GetNetworkIDFromEnv()
+	if err != nil {
+		networkID = 1
+	}
+
+	relayID := ksuid.New()
+
+	relayName, err := helpers.GetEndpointNameFromEnv()
+	if err != nil {
+		relayName = fmt.Sprintf("Relay_%v", relayID)
+	}
+
+	discoveryRate, err := helpers.GetDiscoveryRateFromEnv()
+	if err != nil {
+		discoveryRate = time.Second * 1
+	}
+
+	discoveryRateTimeoutMultiplier, err := helpers.GetDiscoveryRateTimeoutMultiplierFromEnv()
+	if err != nil {
+		discoveryRateTimeoutMultiplier = 2.0
+	}
+
+	log.Printf("relay; networkID: %v", networkID)
+	log.Printf("relay; relayID: %v", relayID)
+	log.Printf("relay; relayName: %v", relayName)
+	log.Printf("relay; discoveryRate: %v", discoveryRate)
+	log.Printf("relay; discoveryRateTimeoutMultiplier: %v", discoveryRateTimeoutMultiplier)
+
+	sideA := getSide("A")
+	sideB := getSide("B")
+
+	networkManager := network.NewManager()
+
+	relayManager := relay.NewManager(
+		networkID,
+		relayID,
+		relayName,
+		sideA,
+		sideB,
+		discoveryRate,
+		discoveryRateTimeoutMultiplier,
+		networkManager,
+	)
+
+	networkManager.OnInterfaceChange(relayManager.HandleNetworkChange)
+
+	networkManager.Start()
+	relayManager.Start()
+
+	log.Print("press Ctrl + C to exit...")
+	helpers.WaitForCtrlC()
+
+	relayManager.Stop()
+	networkManager.Stop()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/initialed85/glue/pkg/endpoint"
+	"github.com/initialed85/glue/pkg/gateway"
+	"github.com/initialed85/glue/pkg/helpers"
+)
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	listenAddress, err := helpers.GetWSGatewayListenAddressFromEnv()
+	if err != nil {
+		listenAddress = "0.0.0.0:27390"
+	}
+
+	allowedOrigins, err := helpers.GetWSGatewayAllowedOriginsFromEnv()
+	if err != nil {
+		allowedOrigins = nil
+	}
+
+	log.Printf("gateway; listenAddress: %v", listenAddress)
+	log.Printf("gateway; allowedOrigins: %v", allowedOrigins)
+
+	endpointManager, err := endpoint.NewManagerSimple()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gatewayManager := gateway.NewManager(
+		endpointManager,
+		allowedOrigins,
+	)
+
+	endpointManager.Start()
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", gatewayManager)
+
+	server := &http.Server{
+		Addr:    listenAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("gateway server failed: %v", err)
+		}
+	}()
+
+	log.Print("press Ctrl + C to exit...")
+	helpers.WaitForCtrlC()
+
+	_ = server.Close()
+
+	gatewayManager.Stop()
+	endpointManager.Stop()
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/initialed85/glue/pkg/endpoint"
@@ -65,15 +66,24 @@ func main() {
 
 	lastTimestamp := time.Now()
 	var lastSequence int64 = 0
-	var lostSyncCount int64 = 0
 
 	if *sendMessages {
 		scheduleWorker.Start()
 	} else {
+		// OnSampleLost and the callback run on the subscriber's goroutine, so the count is kept here rather than read from the
+		// handle (which isn't ours until SubscribeWithOptions returns)
+		var lostSyncCount int64
 
-		err := endpointManager.Subscribe(
+		_, err = endpointManager.SubscribeWithOptions(
 			*topicName,
 			"some_type",
+			&topics.SubscriptionOptions{
+				Ordered: true,
+				OnSampleLost: func(lost *topics.SampleLost) {
+					atomic.AddInt64(&lostSyncCount, lost.Count())
+					log.Printf("warning: lost %v message(s) from %#+v: %v", lost.Count(), lost.EndpointName, lost)
+				},
+			},
 			func(message *topics.Message) {
 				rawPayload := bytes.NewBuffer(message.Payload)
 
@@ -92,14 +102,10 @@ func main() {
 						message.Timestamp.Sub(lastTimestamp),
 						sequence,
 						sequence-lastSequence,
-						lostSyncCount,
+						atomic.LoadInt64(&lostSyncCount),
 					)
 				}
 
-				if sequence-lastSequence > 1 {
-					lostSyncCount += sequence - lastSequence - 1
-				}
-
 				lastTimestamp = message.Timestamp
 				lastSequence = sequence
 			},
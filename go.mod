@@ -3,8 +3,10 @@ module github.com/initialed85/glue
 go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.0
 	github.com/segmentio/ksuid v1.0.4
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/net v0.20.0
 )
 
 require (
@@ -13,5 +15,6 @@ require (
 	github.com/vmihailenco/msgpack/v5 v5.4.1
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	golang.org/x/exp v0.0.0-20240318143956-a85f2c67cd81
+	golang.org/x/sys v0.16.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -14,62 +14,123 @@ import (
 )
 
 type Announcer struct {
-	scheduledWorker        *worker.ScheduledWorker
-	networkID              int64
-	endpointID             ksuid.KSUID
-	endpointName           string
-	listenAddress          *net.UDPAddr
-	discoveryListenAddress *net.UDPAddr
-	discoveryTargetAddress *net.UDPAddr
-	interfaceName          string
-	rate                   time.Duration
-	networkManager         *network.Manager
-	onSend                 func(*types.Container)
+	adaptiveWorker           *worker.AdaptiveWorker
+	networkID                int64
+	endpointID               ksuid.KSUID
+	endpointName             string
+	priority                 int64
+	listenAddress            *net.UDPAddr
+	discoveryListenAddress   *net.UDPAddr
+	discoveryTargetAddress   *net.UDPAddr
+	interfaceName            string
+	rate                     time.Duration
+	burstRate                time.Duration
+	networkManager           network.Network
+	getDirectTargetAddresses func() []*net.UDPAddr
+	getIncarnation           func() uint64
+	getKnownEndpointsDigest  func() []byte
+	onSend                   func(*types.Container)
+	hostID                   string
+	localManager             *network.StreamManager
+	streamManager            *network.StreamManager
 }
 
 func NewAnnouncer(
 	networkID int64,
 	endpointID ksuid.KSUID,
 	endpointName string,
+	priority int64,
 	listenAddress *net.UDPAddr,
 	discoveryListenAddress *net.UDPAddr,
 	discoveryTargetAddress *net.UDPAddr,
 	interfaceName string,
 	rate time.Duration,
-	networkManager *network.Manager,
+	burstRate time.Duration,
+	networkManager network.Network,
+	getDirectTargetAddresses func() []*net.UDPAddr,
+	getIncarnation func() uint64,
+	getKnownEndpointsDigest func() []byte,
 	onSend func(*types.Container),
 ) *Announcer {
 	a := Announcer{
-		networkID:              networkID,
-		endpointID:             endpointID,
-		endpointName:           endpointName,
-		listenAddress:          listenAddress,
-		discoveryListenAddress: discoveryListenAddress,
-		discoveryTargetAddress: discoveryTargetAddress,
-		interfaceName:          interfaceName,
-		rate:                   rate,
-		networkManager:         networkManager,
-		onSend:                 onSend,
+		networkID:                networkID,
+		endpointID:               endpointID,
+		endpointName:             endpointName,
+		priority:                 priority,
+		listenAddress:            listenAddress,
+		discoveryListenAddress:   discoveryListenAddress,
+		discoveryTargetAddress:   discoveryTargetAddress,
+		interfaceName:            interfaceName,
+		rate:                     rate,
+		burstRate:                burstRate,
+		networkManager:           networkManager,
+		getDirectTargetAddresses: getDirectTargetAddresses,
+		getIncarnation:           getIncarnation,
+		getKnownEndpointsDigest:  getKnownEndpointsDigest,
+		onSend:                   onSend,
 	}
 
-	a.scheduledWorker = worker.NewScheduledWorker(
+	// starts out announcing at the burst rate and backs off to the (steady-state) rate; a burst rate of 0 means just
+	// announce at the rate
+	a.adaptiveWorker = worker.NewAdaptiveWorker(
 		func() {},
 		a.work,
 		func() {},
+		burstRate,
 		rate,
 	)
 
 	return &a
 }
 
-func (a *Announcer) work() {
-	if a.discoveryTargetAddress == nil {
-		return
+// UseLocal adds our host ID and the address of our Unix domain socket to our announcements, so that endpoints on the same
+// host can send to us that way; it should be called before Start
+func (a *Announcer) UseLocal(hostID string, localManager *network.StreamManager) {
+	a.hostID = hostID
+	a.localManager = localManager
+}
+
+// UseStream adds the address of our TCP listener to our announcements, so that endpoints can send to us that way; it should
+// be called before Start
+func (a *Announcer) UseStream(streamManager *network.StreamManager) {
+	a.streamManager = streamManager
+}
+
+// getStreamAddress is our TCP listener's address as seen from the given source IP (as it's likely listening on all of them)
+func (a *Announcer) getStreamAddress(srcIP net.IP) string {
+	rawListenAddress := a.streamManager.GetListenAddress()
+	if rawListenAddress == "" {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(rawListenAddress)
+	if err != nil {
+		return ""
 	}
 
-	srcAddr, err := a.networkManager.GetRawSrcAddr(a.discoveryTargetAddress)
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		host = srcIP.String()
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// getSentRate is the rate we tell receivers we're announcing at (for their expiry); while backing off that's the
+// interval after the next one, so that (like at the steady-state rate) a single lost announcement doesn't expire us
+func (a *Announcer) getSentRate() time.Duration {
+	sentRate := a.adaptiveWorker.NextDuration() * 2
+	if sentRate > a.adaptiveWorker.MaxDuration() {
+		sentRate = a.adaptiveWorker.MaxDuration()
+	}
+
+	return sentRate
+}
+
+func (a *Announcer) announce(discoveryTargetAddress *net.UDPAddr, sentRate time.Duration) {
+	srcAddr, err := a.networkManager.GetRawSrcAddr(discoveryTargetAddress)
 	if err != nil {
-		log.Printf("warning: announcer failed to get src addr for %v: %v", a.discoveryTargetAddress.String(), err)
+		log.Printf("warning: announcer failed to get src addr for %v: %v", discoveryTargetAddress.String(), err)
 		return
 	}
 
@@ -91,13 +152,25 @@ func (a *Announcer) work() {
 		a.networkID,
 		a.endpointID,
 		a.endpointName,
-		a.rate,
+		sentRate,
 		discoveryListenAddr,
-		a.discoveryTargetAddress,
+		discoveryTargetAddress,
 		listenAddr,
 	)
 
-	container.SentTo = a.discoveryTargetAddress.String()
+	container.SentTo = discoveryTargetAddress.String()
+	container.Announcement.Incarnation = a.getIncarnation()
+	container.Announcement.Priority = a.priority
+	container.Announcement.KnownEndpointsDigest = a.getKnownEndpointsDigest()
+
+	if a.localManager != nil {
+		container.Announcement.HostID = a.hostID
+		container.Announcement.LocalAddress = a.localManager.GetListenAddress()
+	}
+
+	if a.streamManager != nil {
+		container.Announcement.StreamAddress = a.getStreamAddress(srcAddr.IP)
+	}
 
 	data, err := serialization.Serialize(container)
 	if err != nil {
@@ -105,19 +178,48 @@ func (a *Announcer) work() {
 		return
 	}
 
-	// log.Printf("%v -> %v; send announcement for %v", srcAddr.String(), a.discoveryTargetAddress.String(), container.SourceEndpointName)
+	// log.Printf("%v -> %v; send announcement for %v", srcAddr.String(), discoveryTargetAddress.String(), container.SourceEndpointName)
 
-	err = a.networkManager.Send(a.discoveryTargetAddress, data)
+	err = a.networkManager.Send(discoveryTargetAddress, data)
 	if err != nil {
 		log.Printf("warning: %v", err)
 		return
 	}
+
+	a.onSend(container)
+}
+
+func (a *Announcer) work() {
+	sentRate := a.getSentRate()
+
+	if a.discoveryTargetAddress != nil {
+		a.announce(a.discoveryTargetAddress, sentRate)
+	}
+
+	// seeds (and registries) are announced to directly, as if each were a unicast discovery target
+	for _, directTargetAddress := range a.getDirectTargetAddresses() {
+		if a.discoveryTargetAddress != nil && directTargetAddress.String() == a.discoveryTargetAddress.String() {
+			continue
+		}
+
+		a.announce(directTargetAddress, sentRate)
+	}
+}
+
+// AnnounceNow announces straight away (rather than waiting for the next announcement), e.g. because our address has changed
+func (a *Announcer) AnnounceNow() {
+	a.work()
+}
+
+// Trigger goes back to announcing at the burst rate (e.g. because something about the topology has changed)
+func (a *Announcer) Trigger() {
+	a.adaptiveWorker.Trigger()
 }
 
 func (a *Announcer) Start() {
-	a.scheduledWorker.Start()
+	a.adaptiveWorker.Start()
 }
 
 func (a *Announcer) Stop() {
-	a.scheduledWorker.Stop()
+	a.adaptiveWorker.Stop()
 }
@@ -0,0 +1,35 @@
+package discovery
+
+// Backend is a means of advertising this endpoint and of learning about others; everything a Backend learns is handed
+// to the Manager as an announcement container (via the onReceive it was built with)
+type Backend interface {
+	Start()
+	Stop()
+}
+
+// AnnouncementBackend is the native glue mechanism; an Announcer sends announcement containers to the discovery target
+// address (and any seeds) and a Listener receives them on the discovery listen address
+type AnnouncementBackend struct {
+	announcer *Announcer
+	listener  *Listener
+}
+
+func NewAnnouncementBackend(
+	announcer *Announcer,
+	listener *Listener,
+) *AnnouncementBackend {
+	return &AnnouncementBackend{
+		announcer: announcer,
+		listener:  listener,
+	}
+}
+
+func (b *AnnouncementBackend) Start() {
+	b.listener.Start()
+	b.announcer.Start()
+}
+
+func (b *AnnouncementBackend) Stop() {
+	b.listener.Stop()
+	b.announcer.Stop()
+}
@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/types"
+)
+
+// ClaimWins is the rule every endpoint applies to settle two endpoints claiming the same EndpointName; the higher
+// priority wins and otherwise the older endpoint (i.e. the lower KSUID) wins
+func ClaimWins(a *types.Container, b *types.Container) bool {
+	if a.Announcement.Priority != b.Announcement.Priority {
+		return a.Announcement.Priority > b.Announcement.Priority
+	}
+
+	return bytes.Compare(a.SourceEndpointID.Bytes(), b.SourceEndpointID.Bytes()) < 0
+}
+
+// getSelfClaim is just enough of an announcement container about us to compare claims with
+func (m *Manager) getSelfClaim() *types.Container {
+	return &types.Container{
+		NetworkID:          m.networkID,
+		SourceEndpointID:   m.endpointID,
+		SourceEndpointName: m.endpointName,
+		Announcement: &types.Announcement{
+			SentRate:    m.rate,
+			ListenAddr:  m.listenAddress,
+			Incarnation: m.failureDetector.Incarnation(),
+			Priority:    m.priority,
+		},
+	}
+}
+
+type conflict struct {
+	lastSeenTimestamp time.Time
+	expireDuration    time.Duration
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) reportConflict(winner *types.Container, loser *types.Container, now time.Time) {
+	existingConflict, ok := m.conflictByLoserEndpointID[loser.SourceEndpointID]
+
+	m.conflictByLoserEndpointID[loser.SourceEndpointID] = &conflict{
+		lastSeenTimestamp: now,
+		expireDuration:    m.getExpireDuration(winner),
+	}
+
+	// only tell people once for as long as the clash continues
+	if ok && now.Sub(existingConflict.lastSeenTimestamp) < existingConflict.expireDuration {
+		return
+	}
+
+	if loser.SourceEndpointID == m.endpointID {
+		log.Printf(
+			"warning: lost EndpointName %#v to %v (priority %v vs our %v); we will be ignored by other endpoints",
+			m.endpointName,
+			winner.String(),
+			winner.Announcement.Priority,
+			m.priority,
+		)
+	} else if winner.SourceEndpointID == m.endpointID {
+		log.Printf(
+			"warning: EndpointName %#v clash; we win over %v (it will be ignored)",
+			m.endpointName,
+			loser.String(),
+		)
+	} else {
+		log.Printf(
+			"warning: EndpointName %#v clash; %v wins over %v",
+			winner.SourceEndpointName,
+			winner.String(),
+			loser.String(),
+		)
+	}
+
+	for w := range m.watchers {
+		w.push(Event{
+			Type:      EventTypeConflict,
+			Container: winner,
+			Loser:     loser,
+		})
+	}
+}
+
+// handleClaim settles any EndpointName clash the container causes; it returns false if the container lost (and so should
+// be ignored)
+func (m *Manager) handleClaim(container *types.Container) bool {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if container.SourceEndpointName == m.endpointName {
+		selfClaim := m.getSelfClaim()
+
+		if ClaimWins(container, selfClaim) {
+			m.reportConflict(container, selfClaim, now)
+		} else {
+			m.reportConflict(selfClaim, container, now)
+		}
+
+		// either way there's no sense in us knowing about someone else by our own name
+		return false
+	}
+
+	var existingContainer *types.Container
+	for _, otherContainer := range m.lastAnnouncementContainerByEndpointID {
+		if otherContainer.SourceEndpointName == container.SourceEndpointName &&
+			otherContainer.SourceEndpointID != container.SourceEndpointID {
+			existingContainer = otherContainer
+			break
+		}
+	}
+
+	if existingContainer == nil {
+		return true
+	}
+
+	if !ClaimWins(container, existingContainer) {
+		m.reportConflict(existingContainer, container, now)
+		return false
+	}
+
+	// the newcomer has the better claim; the existing endpoint has to go
+	delete(m.lastAnnouncementContainerByEndpointID, existingContainer.SourceEndpointID)
+	m.publish(EventTypeRemoved, existingContainer)
+	m.reportConflict(container, existingContainer, now)
+
+	log.Printf("removed (lost EndpointName): %v", existingContainer.String())
+
+	// TODO: fix unbounded goroutine use
+	go m.onRemoved(existingContainer)
+
+	return true
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) expireConflicts(now time.Time) {
+	for endpointID, existingConflict := range m.conflictByLoserEndpointID {
+		if now.Sub(existingConflict.lastSeenTimestamp) < existingConflict.expireDuration {
+			continue
+		}
+
+		delete(m.conflictByLoserEndpointID, endpointID)
+	}
+}
+
+// IsConflictLoser is true if the event is a conflict that we lost (i.e. someone else has our EndpointName)
+func (e Event) IsConflictLoser(endpointID ksuid.KSUID) bool {
+	return e.Type == EventTypeConflict && e.Loser != nil && e.Loser.SourceEndpointID == endpointID
+}
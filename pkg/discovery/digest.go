@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"hash/fnv"
+
+	"github.com/segmentio/ksuid"
+)
+
+// a known endpoints digest is a bloom filter of endpoint IDs, so that it can go out in every announcement however many
+// endpoints there are; it's sized for a false positive rate of under 1% up to the size limit, after which it degrades
+// gracefully (a false positive only means an endpoint that can't hear us looks like it can)
+const (
+	digestBitsPerEndpoint = 10
+	digestHashCount       = 7
+	digestMinSize         = 8
+	DigestMaxSize         = 8192
+)
+
+// getDigestHashes are the two hashes that every bit index is derived from (as in Kirsch and Mitzenmacher)
+func getDigestHashes(endpointID ksuid.KSUID) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write(endpointID.Bytes())
+	sum := h.Sum64()
+
+	// the second hash is odd so that the indexes it steps through don't cycle early
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// getKnownDigest is a digest of the given endpoint IDs (see isInKnownDigest)
+func getKnownDigest(endpointIDs []ksuid.KSUID) []byte {
+	size := (len(endpointIDs)*digestBitsPerEndpoint + 7) / 8
+	if size < digestMinSize {
+		size = digestMinSize
+	}
+	if size > DigestMaxSize {
+		size = DigestMaxSize
+	}
+
+	digest := make([]byte, size)
+	bitCount := uint32(size * 8)
+
+	for _, endpointID := range endpointIDs {
+		h1, h2 := getDigestHashes(endpointID)
+
+		for i := uint32(0); i < digestHashCount; i++ {
+			bit := (h1 + i*h2) % bitCount
+			digest[bit/8] |= 1 << (bit % 8)
+		}
+	}
+
+	return digest
+}
+
+// isInKnownDigest is true if the endpoint ID is (probably) in the digest; it's never false for one that is
+func isInKnownDigest(digest []byte, endpointID ksuid.KSUID) bool {
+	if len(digest) == 0 {
+		return false
+	}
+
+	bitCount := uint32(len(digest) * 8)
+
+	h1, h2 := getDigestHashes(endpointID)
+
+	for i := uint32(0); i < digestHashCount; i++ {
+		bit := (h1 + i*h2) % bitCount
+		if digest[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
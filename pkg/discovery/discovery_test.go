@@ -1,9 +1,15 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +17,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
 	"github.com/initialed85/glue/pkg/types"
 )
 
@@ -43,6 +50,7 @@ func getThings(endpointName string, listenPort int, address string) (*network.Ma
 		func(container *types.Container) {
 			removed <- container
 		},
+		nil,
 	)
 
 	return networkManager, discoveryManager, added, removed
@@ -149,3 +157,893 @@ func TestIntegration_Manager(t *testing.T) {
 		stopThings(networkManager0, discoveryManager0)
 	})
 }
+
+func TestParseSeedAddresses(t *testing.T) {
+	addrs, err := ParseSeedAddresses(strings.NewReader(`
+# some comment
+10.0.0.1:27320
+10.0.0.2:27320, 10.0.0.3:27320 # trailing comment
+
+`))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	actual := make([]string, 0)
+	for _, addr := range addrs {
+		actual = append(actual, addr.String())
+	}
+
+	assert.Equal(t, []string{"10.0.0.1:27320", "10.0.0.2:27320", "10.0.0.3:27320"}, actual)
+
+	_, err = ParseSeedAddresses(strings.NewReader("not an address"))
+	assert.Error(t, err)
+}
+
+func TestSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+
+	err := os.WriteFile(path, []byte("10.0.0.2:27320\n10.0.0.3:27320\n"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	staticAddress, _ := net.ResolveUDPAddr("udp4", "10.0.0.1:27320")
+	duplicateAddress, _ := net.ResolveUDPAddr("udp4", "10.0.0.2:27320")
+
+	seeds := NewSeeds([]*net.UDPAddr{staticAddress, duplicateAddress}, path)
+	seeds.Start()
+	defer seeds.Stop()
+
+	getAddresses := func() []string {
+		actual := make([]string, 0)
+		for _, addr := range seeds.Addresses() {
+			actual = append(actual, addr.String())
+		}
+
+		return actual
+	}
+
+	assert.Equal(t, []string{"10.0.0.1:27320", "10.0.0.2:27320", "10.0.0.3:27320"}, getAddresses())
+
+	err = os.WriteFile(path, []byte("10.0.0.4:27320\n"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Eventually(
+		t,
+		func() bool {
+			return strings.Join(getAddresses(), ",") == "10.0.0.1:27320,10.0.0.2:27320,10.0.0.4:27320"
+		},
+		time.Second*5,
+		time.Millisecond*100,
+	)
+
+	// a bad file keeps what was read before, and isn't read again until it changes
+	err = os.WriteFile(path, []byte("10.0.0.5:27320\nnot an address\n"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Eventually(
+		t,
+		func() bool {
+			seeds.mu.Lock()
+			defer seeds.mu.Unlock()
+
+			return seeds.lastModTime.Equal(info.ModTime()) && seeds.lastSize == info.Size()
+		},
+		time.Second*5,
+		time.Millisecond*100,
+	)
+
+	assert.Equal(t, []string{"10.0.0.1:27320", "10.0.0.2:27320", "10.0.0.4:27320"}, getAddresses())
+}
+
+func TestMDNSResponseAndParse(t *testing.T) {
+	endpointID := ksuid.New()
+	listenAddr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:27321")
+	srcAddr, _ := net.ResolveUDPAddr("udp4", "192.168.1.3:5353")
+
+	data, err := getMDNSResponse(1, endpointID, "some.endpoint", 2, listenAddr, time.Second, mdnsTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	isQuery, records, err := parseMDNSMessage(srcAddr, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.False(t, isQuery)
+	assert.Len(t, records, 1)
+	assert.Equal(t, int64(1), records[0].networkID)
+	assert.Equal(t, endpointID, records[0].endpointID)
+	assert.Equal(t, "some.endpoint", records[0].endpointName)
+	assert.Equal(t, int64(2), records[0].priority)
+	assert.Equal(t, time.Second, records[0].sentRate)
+	assert.Equal(t, "192.168.1.2:27321", records[0].listenAddr.String())
+	assert.Equal(t, uint32(mdnsTTL), records[0].ttl)
+}
+
+// getMulticastInterfaceName is the first interface that's up and can do IPv4 multicast (skipping the test if there isn't
+// one)
+func getMulticastInterfaceName(t *testing.T) string {
+	intfcs, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("failed to list interfaces: %v", err)
+	}
+
+	for _, intfc := range intfcs {
+		if intfc.Flags&net.FlagUp == 0 || intfc.Flags&net.FlagMulticast == 0 || intfc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := intfc.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() != nil {
+				return intfc.Name
+			}
+		}
+	}
+
+	t.Skip("no interface that can do IPv4 multicast")
+
+	return ""
+}
+
+func TestManager_MDNS(t *testing.T) {
+	interfaceName := getMulticastInterfaceName(t)
+
+	// something else on the network watching the mDNS traffic
+	observer := network.NewManager()
+	observer.Start()
+	defer observer.Stop()
+
+	mdnsAddress, _ := network.GetAddress(MDNSAddress)
+
+	var mu sync.Mutex
+	responsePortsByEndpointID := make(map[ksuid.KSUID][]int)
+
+	err := observer.RegisterCallback(mdnsAddress, interfaceName, func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		isQuery, records, err := parseMDNSMessage(srcAddr, data)
+		if err != nil || isQuery {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, record := range records {
+			responsePortsByEndpointID[record.endpointID] = append(responsePortsByEndpointID[record.endpointID], srcAddr.Port)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	getMDNSThings := func(endpointName string, listenPort int, discoveryPort int) (*network.Manager, *Manager, chan *types.Container) {
+		networkManager := network.NewManager()
+
+		added := make(chan *types.Container, 65536)
+
+		listenAddress, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("0.0.0.0:%v", listenPort))
+
+		// announcing only to ourselves, so that the only way to find the other is via mDNS
+		discoveryAddress, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", discoveryPort))
+
+		discoveryManager := NewManager(
+			1,
+			ksuid.New(),
+			endpointName,
+			listenAddress,
+			discoveryAddress,
+			discoveryAddress,
+			interfaceName,
+			time.Millisecond*100,
+			3,
+			networkManager,
+			func(container *types.Container) {
+				added <- container
+			},
+			func(container *types.Container) {},
+			&ManagerOptions{
+				EnableMDNS: true,
+			},
+		)
+
+		return networkManager, discoveryManager, added
+	}
+
+	networkManager1, discoveryManager1, added1 := getMDNSThings("A", 27381, 27383)
+	startThings(networkManager1, discoveryManager1)
+	defer stopThings(networkManager1, discoveryManager1)
+
+	networkManager2, discoveryManager2, added2 := getMDNSThings("B", 27382, 27384)
+	startThings(networkManager2, discoveryManager2)
+	defer stopThings(networkManager2, discoveryManager2)
+
+	waitForAdded := func(added chan *types.Container, endpointName string) *types.Container {
+		timeout := time.After(time.Second * 5)
+
+		for {
+			select {
+			case container := <-added:
+				if container.SourceEndpointName == endpointName {
+					return container
+				}
+			case <-timeout:
+				log.Fatalf("timed out waiting to find %v via mDNS", endpointName)
+			}
+		}
+	}
+
+	container := waitForAdded(added1, "B")
+	assert.Equal(t, discoveryManager2.endpointID, container.SourceEndpointID)
+	assert.Equal(t, 27382, container.Announcement.ListenAddr.Port)
+
+	container = waitForAdded(added2, "A")
+	assert.Equal(t, discoveryManager1.endpointID, container.SourceEndpointID)
+	assert.Equal(t, 27381, container.Announcement.ListenAddr.Port)
+
+	// responses come from the mDNS port (or other responders, e.g. avahi, would ignore them)
+	for _, endpointID := range []ksuid.KSUID{discoveryManager1.endpointID, discoveryManager2.endpointID} {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return len(responsePortsByEndpointID[endpointID]) > 0
+		}, time.Second*5, time.Millisecond*10)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, ports := range responsePortsByEndpointID {
+		for _, port := range ports {
+			assert.Equal(t, mdnsAddress.Port, port)
+		}
+	}
+}
+
+type failureDetectorThings struct {
+	networkManager  *network.Manager
+	failureDetector *FailureDetector
+	container       *types.Container
+	listenAddress   *net.UDPAddr
+	callback        func(*net.UDPAddr, *net.UDPAddr, []byte)
+	dead            chan ksuid.KSUID
+}
+
+func getFailureDetectorThings(endpointName string, listenPort int, getMembers func() []*types.Container) *failureDetectorThings {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", listenPort))
+
+	things := failureDetectorThings{
+		networkManager: network.NewManager(),
+		container: types.GetAnnouncementContainer(
+			time.Now(),
+			listenAddress.String(),
+			1,
+			ksuid.New(),
+			endpointName,
+			time.Millisecond*50,
+			listenAddress,
+			listenAddress,
+			listenAddress,
+		),
+		listenAddress: listenAddress,
+		dead:          make(chan ksuid.KSUID, 65536),
+	}
+
+	things.failureDetector = NewFailureDetector(
+		1,
+		things.container.SourceEndpointID,
+		endpointName,
+		time.Millisecond*50,
+		3,
+		things.networkManager,
+		getMembers,
+		func(endpointID ksuid.KSUID) {
+			things.dead <- endpointID
+		},
+	)
+
+	things.callback = func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		container, err := serialization.Deserialize(data)
+		if err != nil || container.Probe == nil {
+			return
+		}
+
+		go things.failureDetector.HandleProbe(container)
+	}
+
+	return &things
+}
+
+func TestFailureDetector(t *testing.T) {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	var mu sync.Mutex
+	allThings := make([]*failureDetectorThings, 0)
+
+	getMembers := func() []*types.Container {
+		mu.Lock()
+		defer mu.Unlock()
+
+		containers := make([]*types.Container, 0)
+		for _, things := range allThings {
+			containers = append(containers, things.container)
+		}
+
+		return containers
+	}
+
+	mu.Lock()
+	for i, endpointName := range []string{"A", "B", "C"} {
+		allThings = append(allThings, getFailureDetectorThings(endpointName, 27361+i, getMembers))
+	}
+	mu.Unlock()
+
+	for _, things := range allThings {
+		things.networkManager.Start()
+
+		err := things.networkManager.RegisterCallback(things.listenAddress, "lo", things.callback)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		things.failureDetector.Start()
+	}
+
+	a, b, c := allThings[0], allThings[1], allThings[2]
+
+	defer func() {
+		for _, things := range []*failureDetectorThings{a, b} {
+			things.failureDetector.Stop()
+			things.networkManager.Stop()
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 500)
+
+	for _, things := range allThings {
+		for _, other := range allThings {
+			if other == things {
+				continue
+			}
+
+			assert.False(t, things.failureDetector.IsSuspect(other.container.SourceEndpointID))
+		}
+	}
+
+	assert.WithinDuration(t, time.Now(), a.failureDetector.LastAliveTimestamp(b.container.SourceEndpointID), time.Millisecond*500)
+
+	// C goes away without a word; A and B should both come to the conclusion it's dead
+	c.failureDetector.Stop()
+	c.networkManager.Stop()
+
+	for _, things := range []*failureDetectorThings{a, b} {
+		select {
+		case endpointID := <-things.dead:
+			assert.Equal(t, c.container.SourceEndpointID, endpointID)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "timed out waiting for C to be declared dead")
+		}
+	}
+
+	// someone suspecting A should cause A to refute it with a higher incarnation
+	incarnation := a.failureDetector.Incarnation()
+
+	a.failureDetector.HandleProbe(types.GetProbeContainer(
+		1,
+		b.container.SourceEndpointID,
+		"B",
+		types.ProbeTypeAck,
+		0,
+		b.failureDetector.Incarnation(),
+		ksuid.Nil,
+		nil,
+		[]*types.MemberUpdate{
+			{
+				EndpointID:  a.container.SourceEndpointID,
+				Incarnation: incarnation,
+				State:       types.MemberStateSuspect,
+			},
+		},
+	))
+
+	assert.Equal(t, incarnation+1, a.failureDetector.Incarnation())
+}
+
+func getUnstartedManager(endpointName string) *Manager {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27371")
+
+	return NewManager(
+		1,
+		ksuid.New(),
+		endpointName,
+		listenAddress,
+		listenAddress,
+		nil,
+		"lo",
+		time.Second,
+		3,
+		network.NewManager(),
+		func(container *types.Container) {},
+		func(container *types.Container) {},
+		nil,
+	)
+}
+
+func getReceivedContainer(endpointID ksuid.KSUID, endpointName string, priority int64, listenAddress *net.UDPAddr) *types.Container {
+	container := types.GetAnnouncementContainer(
+		time.Now(),
+		listenAddress.String(),
+		1,
+		endpointID,
+		endpointName,
+		time.Second,
+		listenAddress,
+		listenAddress,
+		listenAddress,
+	)
+	container.Announcement.Priority = priority
+	container.ReceivedTimestamp = time.Now()
+
+	return container
+}
+
+func TestManager_Watch(t *testing.T) {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27371")
+	otherListenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27372")
+
+	discoveryManager := getUnstartedManager("A")
+
+	getContainer := func(endpointID ksuid.KSUID, endpointName string, listenAddress *net.UDPAddr) *types.Container {
+		return getReceivedContainer(endpointID, endpointName, 0, listenAddress)
+	}
+
+	endpointIDB := ksuid.New()
+	endpointIDC := ksuid.New()
+
+	discoveryManager.onReceive(getContainer(endpointIDB, "B", otherListenAddress))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := discoveryManager.Watch(ctx)
+
+	discoveryManager.onReceive(getContainer(endpointIDB, "B", otherListenAddress)) // no change, so no event
+	discoveryManager.onReceive(getContainer(endpointIDC, "C", otherListenAddress))
+	discoveryManager.onReceive(getContainer(endpointIDB, "B", listenAddress))
+	discoveryManager.onDead(endpointIDC)
+
+	expected := []struct {
+		eventType  EventType
+		endpointID ksuid.KSUID
+		snapshot   bool
+	}{
+		{EventTypeAdded, endpointIDB, true},
+		{EventTypeAdded, endpointIDC, false},
+		{EventTypeUpdated, endpointIDB, false},
+		{EventTypeRemoved, endpointIDC, false},
+	}
+
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			assert.Equal(t, e.eventType, event.Type)
+			assert.Equal(t, e.endpointID, event.Container.SourceEndpointID)
+			assert.Equal(t, e.snapshot, event.Snapshot)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for event")
+		}
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for events to be closed")
+	}
+}
+
+func TestIsAnnouncementChanged(t *testing.T) {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27371")
+	otherListenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27372")
+
+	volatile := map[string]bool{
+		"SentRate":             true,
+		"KnownEndpointIDs":     true,
+		"KnownEndpointsDigest": true,
+		"Forwarded":            true,
+		"ForwardedBy":          true,
+	}
+
+	a := getReceivedContainer(ksuid.New(), "A", 0, listenAddress)
+	a.Announcement.DiscoveryListenAddr = listenAddress
+	a.Announcement.DiscoveryTargetAddr = listenAddress
+
+	assert.False(t, isAnnouncementChanged(a, a))
+
+	// every field (so one added later can't be forgotten about)
+	announcementType := reflect.TypeOf(types.Announcement{})
+	for i := 0; i < announcementType.NumField(); i++ {
+		field := announcementType.Field(i)
+
+		b := *a
+		b.Announcement = a.Announcement.Copy()
+
+		value := reflect.ValueOf(b.Announcement).Elem().Field(i)
+
+		switch value.Interface().(type) {
+		case string:
+			value.SetString(value.String() + "-changed")
+		case bool:
+			value.SetBool(!value.Bool())
+		case int, int64, time.Duration:
+			value.SetInt(value.Int() + 1)
+		case uint64:
+			value.SetUint(value.Uint() + 1)
+		case *net.UDPAddr:
+			value.Set(reflect.ValueOf(otherListenAddress))
+		case ksuid.KSUID:
+			value.Set(reflect.ValueOf(ksuid.New()))
+		case []ksuid.KSUID:
+			value.Set(reflect.ValueOf([]ksuid.KSUID{ksuid.New()}))
+		case []byte:
+			value.SetBytes([]byte{1})
+		default:
+			assert.Failf(t, "unhandled field", "%v is a %v", field.Name, field.Type)
+			continue
+		}
+
+		assert.Equal(t, !volatile[field.Name], isAnnouncementChanged(a, &b), field.Name)
+	}
+
+	b := *a
+	b.SourceEndpointName = "B"
+	assert.True(t, isAnnouncementChanged(a, &b))
+}
+
+func TestWatcher_Overflow(t *testing.T) {
+	w := newWatcher([]Event{{Type: EventTypeAdded, Snapshot: true}})
+
+	// the snapshot doesn't count towards the limit...
+	for i := 0; i < watcherQueueLimit; i++ {
+		w.push(Event{Type: EventTypeUpdated})
+	}
+
+	select {
+	case <-w.done:
+		assert.Fail(t, "closed too soon")
+	default:
+	}
+
+	// ... but anything more is too much
+	w.push(Event{Type: EventTypeUpdated})
+
+	select {
+	case <-w.done:
+	default:
+		assert.Fail(t, "not closed")
+	}
+
+	// and the consumer finds out
+	events := make(chan Event)
+	go w.run(context.Background(), events)
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case _, ok := <-events:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			assert.Fail(t, "timed out waiting for events to be closed")
+		}
+
+		break
+	}
+}
+
+func TestManager_NetworkChange(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager := fabric.NewNode(net.ParseIP("10.0.0.1"))
+	otherNetworkManager := fabric.NewNode(net.ParseIP("10.0.0.2"))
+
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "0.0.0.0:27373")
+	discoveryAddress, _ := net.ResolveUDPAddr("udp4", "10.0.0.2:27374")
+
+	// announcing so rarely that anything we hear is down to the change
+	discoveryManager := NewManager(
+		1,
+		ksuid.New(),
+		"A",
+		listenAddress,
+		listenAddress,
+		discoveryAddress,
+		"",
+		time.Hour,
+		3,
+		networkManager,
+		func(container *types.Container) {},
+		func(container *types.Container) {},
+		nil,
+	)
+
+	announced := make(chan *types.Container, 16)
+
+	err := otherNetworkManager.RegisterCallback(discoveryAddress, "", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		container, err := serialization.Deserialize(data)
+		if err != nil {
+			return
+		}
+
+		announced <- container
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := discoveryManager.Watch(ctx)
+
+	discoveryManager.HandleNetworkChange()
+
+	select {
+	case container := <-announced:
+		assert.Equal(t, "A", container.SourceEndpointName)
+		assert.Equal(t, "10.0.0.1:27373", container.Announcement.ListenAddr.String())
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for announcement")
+	}
+
+	select {
+	case event := <-events:
+		assert.Equal(t, EventTypeNetworkChanged, event.Type)
+		assert.Nil(t, event.Container)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for event")
+	}
+}
+
+func TestManager_Conflict(t *testing.T) {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27372")
+
+	olderEndpointID, _ := ksuid.NewRandomWithTime(time.Now().Add(-time.Hour))
+	newerEndpointID, _ := ksuid.NewRandomWithTime(time.Now().Add(time.Hour))
+
+	assert.True(t, ClaimWins(
+		getReceivedContainer(olderEndpointID, "A", 0, listenAddress),
+		getReceivedContainer(newerEndpointID, "A", 0, listenAddress),
+	))
+
+	assert.True(t, ClaimWins(
+		getReceivedContainer(newerEndpointID, "A", 1, listenAddress),
+		getReceivedContainer(olderEndpointID, "A", 0, listenAddress),
+	))
+
+	discoveryManager := getUnstartedManager("A")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := discoveryManager.Watch(ctx)
+
+	getEvent := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for event")
+		}
+
+		return Event{}
+	}
+
+	// an older endpoint with our name; we lose
+	discoveryManager.onReceive(getReceivedContainer(olderEndpointID, "A", 0, listenAddress))
+
+	event := getEvent()
+	assert.True(t, event.IsConflictLoser(discoveryManager.endpointID))
+	assert.Equal(t, olderEndpointID, event.Container.SourceEndpointID)
+
+	// a newer endpoint with a higher priority takes a name from an older one
+	endpointIDB1 := ksuid.New()
+	endpointIDB2 := ksuid.New()
+
+	discoveryManager.onReceive(getReceivedContainer(endpointIDB1, "B", 0, listenAddress))
+	discoveryManager.onReceive(getReceivedContainer(endpointIDB2, "B", 1, listenAddress))
+
+	event = getEvent()
+	assert.Equal(t, EventTypeAdded, event.Type)
+	assert.Equal(t, endpointIDB1, event.Container.SourceEndpointID)
+
+	event = getEvent()
+	assert.Equal(t, EventTypeRemoved, event.Type)
+	assert.Equal(t, endpointIDB1, event.Container.SourceEndpointID)
+
+	event = getEvent()
+	assert.Equal(t, EventTypeConflict, event.Type)
+	assert.Equal(t, endpointIDB2, event.Container.SourceEndpointID)
+	assert.Equal(t, endpointIDB1, event.Loser.SourceEndpointID)
+
+	event = getEvent()
+	assert.Equal(t, EventTypeAdded, event.Type)
+	assert.Equal(t, endpointIDB2, event.Container.SourceEndpointID)
+
+	// the loser carrying on doesn't change anything (or cause more events)
+	discoveryManager.onReceive(getReceivedContainer(endpointIDB1, "B", 0, listenAddress))
+
+	container, err := discoveryManager.GetLastAnnouncementContainerByEndpointName("B")
+	assert.NoError(t, err)
+	assert.Equal(t, endpointIDB2, container.SourceEndpointID)
+
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected event", event.String())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestManager_Partition(t *testing.T) {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27372")
+
+	discoveryManager := getUnstartedManager("A")
+
+	endpointIDs := []ksuid.KSUID{ksuid.New(), ksuid.New(), ksuid.New(), ksuid.New()}
+	for i, endpointID := range endpointIDs {
+		discoveryManager.onReceive(getReceivedContainer(endpointID, fmt.Sprintf("B%v", i), 0, listenAddress))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := discoveryManager.Watch(ctx)
+	for range endpointIDs {
+		<-events // snapshot
+	}
+
+	checkPartition := func(now time.Time) {
+		discoveryManager.mu.Lock()
+		discoveryManager.checkPartition(now)
+		discoveryManager.mu.Unlock()
+	}
+
+	getEvent := func() Event {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Type == EventTypePartitionSuspected || event.Type == EventTypePartitionHealed {
+					return event
+				}
+			case <-timeout:
+				assert.Fail(t, "timed out waiting for event")
+				return Event{}
+			}
+		}
+	}
+
+	// one endpoint going away is just churn
+	discoveryManager.onDead(endpointIDs[0])
+	checkPartition(time.Now())
+
+	// but losing another at about the same time is half the network
+	discoveryManager.onDead(endpointIDs[1])
+	checkPartition(time.Now())
+
+	event := getEvent()
+	assert.Equal(t, EventTypePartitionSuspected, event.Type)
+	assert.Equal(t, 2, len(event.Endpoints))
+
+	for i, endpointID := range endpointIDs[0:2] {
+		discoveryManager.onReceive(getReceivedContainer(endpointID, fmt.Sprintf("B%v", i), 0, listenAddress))
+	}
+	checkPartition(time.Now())
+
+	event = getEvent()
+	assert.Equal(t, EventTypePartitionHealed, event.Type)
+	assert.Equal(t, 2, len(event.Endpoints))
+
+	// an endpoint we hear that doesn't hear us
+	oneWayContainer := getReceivedContainer(endpointIDs[2], "B2", 0, listenAddress)
+	oneWayContainer.Announcement.KnownEndpointsDigest = getKnownDigest([]ksuid.KSUID{endpointIDs[2]})
+	discoveryManager.onReceive(oneWayContainer)
+
+	now := time.Now()
+	checkPartition(now)
+	checkPartition(now.Add(discoveryManager.getPartitionWindow()))
+
+	event = getEvent()
+	assert.Equal(t, EventTypePartitionSuspected, event.Type)
+	assert.Equal(t, 1, len(event.Endpoints))
+	assert.Equal(t, endpointIDs[2], event.Endpoints[0].SourceEndpointID)
+
+	twoWayContainer := getReceivedContainer(endpointIDs[2], "B2", 0, listenAddress)
+	twoWayContainer.Announcement.KnownEndpointsDigest = getKnownDigest([]ksuid.KSUID{endpointIDs[2], discoveryManager.endpointID})
+	discoveryManager.onReceive(twoWayContainer)
+	checkPartition(time.Now())
+
+	event = getEvent()
+	assert.Equal(t, EventTypePartitionHealed, event.Type)
+
+	// an endpoint that stops acknowledging while still announcing
+	discoveryManager.ReportAckTimeout(endpointIDs[3])
+	time.Sleep(time.Millisecond)
+	discoveryManager.onReceive(getReceivedContainer(endpointIDs[3], "B3", 0, listenAddress))
+
+	now = time.Now()
+	checkPartition(now)
+	checkPartition(now.Add(discoveryManager.getPartitionWindow()))
+
+	event = getEvent()
+	assert.Equal(t, EventTypePartitionSuspected, event.Type)
+	assert.Equal(t, endpointIDs[3], event.Endpoints[0].SourceEndpointID)
+
+	discoveryManager.ReportAck(endpointIDs[3])
+	checkPartition(time.Now())
+
+	event = getEvent()
+	assert.Equal(t, EventTypePartitionHealed, event.Type)
+}
+
+func TestKnownDigest(t *testing.T) {
+	listenAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27320")
+
+	for _, count := range []int{1, 100, 10000} {
+		endpointIDs := make([]ksuid.KSUID, 0, count)
+		for i := 0; i < count; i++ {
+			endpointIDs = append(endpointIDs, ksuid.New())
+		}
+
+		digest := getKnownDigest(endpointIDs)
+		assert.LessOrEqual(t, len(digest), DigestMaxSize)
+
+		// never a false negative...
+		for _, endpointID := range endpointIDs {
+			assert.True(t, isInKnownDigest(digest, endpointID))
+		}
+
+		// ... and not many false positives
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if isInKnownDigest(digest, ksuid.New()) {
+				falsePositives++
+			}
+		}
+
+		assert.Less(t, falsePositives, 1000, "%v false positives for %v endpoints", falsePositives, count)
+
+		// however many endpoints there are, an announcement still fits in a datagram
+		container := getReceivedContainer(ksuid.New(), "A", 0, listenAddress)
+		container.Announcement.KnownEndpointsDigest = digest
+
+		data, err := serialization.Serialize(container)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		assert.Less(t, len(data), network.MaxDatagramSize)
+	}
+
+	assert.False(t, isInKnownDigest(nil, ksuid.New()))
+}
@@ -14,7 +14,7 @@ type Listener struct {
 	networkID              int64
 	discoveryListenAddress *net.UDPAddr
 	interfaceName          string
-	networkManager         *network.Manager
+	networkManager         network.Network
 	onReceive              func(*types.Container)
 }
 
@@ -22,7 +22,7 @@ func NewListener(
 	networkID int64,
 	discoveryListenAddress *net.UDPAddr,
 	interfaceName string,
-	networkManager *network.Manager,
+	networkManager network.Network,
 	onReceive func(*types.Container),
 ) *Listener {
 	return &Listener{
@@ -21,22 +21,65 @@ type Manager struct {
 	scheduledWorker                       *worker.ScheduledWorker
 	announcer                             *Announcer
 	listener                              *Listener
+	seeds                                 *Seeds
+	backends                              []Backend
+	failureDetector                       *FailureDetector
 	mu                                    sync.Mutex
 	lastAnnouncementContainerByEndpointID map[ksuid.KSUID]*types.Container
+	watchers                              map[*watcher]struct{}
+	conflictByLoserEndpointID             map[ksuid.KSUID]*conflict
+	recentRemovals                        []removal
+	oneWaySinceByEndpointID               map[ksuid.KSUID]time.Time
+	ackTimeoutByEndpointID                map[ksuid.KSUID]time.Time
+	partition                             *partition
+	registryIndex                         int
+	lastRegistryHeartbeatTimestamp        time.Time
+	lastRegistrySwitchTimestamp           time.Time
 	networkID                             int64
 	endpointID                            ksuid.KSUID
 	endpointName                          string
+	priority                              int64
 	listenAddress                         *net.UDPAddr
 	discoveryListenAddress                *net.UDPAddr
 	discoveryTargetAddress                *net.UDPAddr
+	seedAddresses                         []*net.UDPAddr
+	seedsPath                             string
+	registryAddresses                     []*net.UDPAddr
+	enableMDNS                            bool
+	enableSWIM                            bool
 	interfaceName                         string
 	rate                                  time.Duration
+	burstRate                             time.Duration
 	rateTimeoutMultiplier                 float64
-	networkManager                        *network.Manager
+	networkManager                        network.Network
 	onAdded                               func(*types.Container)
 	onRemoved                             func(*types.Container)
 }
 
+// ManagerOptions are the extras for a discovery manager; the zero value (or nil) is plain multicast / broadcast discovery
+type ManagerOptions struct {
+	// wins name conflicts against endpoints with a lower priority
+	Priority int64
+
+	// unicast addresses to announce to directly (e.g. across subnets that multicast doesn't reach), along with a file of
+	// them that's re-read as it changes
+	SeedAddresses []*net.UDPAddr
+	SeedsPath     string
+
+	// registries to register with and learn about everything else from (the first that answers; the rest are failovers)
+	RegistryAddresses []*net.UDPAddr
+
+	// also announce and browse via mDNS / DNS-SD
+	EnableMDNS bool
+
+	// also probe peers SWIM-style so failures are noticed sooner than the announcement timeout
+	EnableSWIM bool
+
+	// start out announcing at this rate and back off to the rate (and again after topology changes) so peers find us
+	// sooner; 0 means just announce at the rate
+	BurstRate time.Duration
+}
+
 func NewManager(
 	networkID int64,
 	endpointID ksuid.KSUID,
@@ -47,43 +90,77 @@ func NewManager(
 	interfaceName string,
 	rate time.Duration,
 	rateTimeoutMultiplier float64,
-	networkManager *network.Manager,
+	networkManager network.Network,
 	onAdded func(*types.Container),
 	onRemoved func(*types.Container),
+	options *ManagerOptions,
 ) *Manager {
+	if options == nil {
+		options = &ManagerOptions{}
+	}
+
 	m := Manager{
 		lastAnnouncementContainerByEndpointID: make(map[ksuid.KSUID]*types.Container),
+		watchers:                              make(map[*watcher]struct{}),
+		conflictByLoserEndpointID:             make(map[ksuid.KSUID]*conflict),
+		recentRemovals:                        make([]removal, 0),
+		oneWaySinceByEndpointID:               make(map[ksuid.KSUID]time.Time),
+		ackTimeoutByEndpointID:                make(map[ksuid.KSUID]time.Time),
 		networkID:                             networkID,
 		endpointID:                            endpointID,
 		endpointName:                          endpointName,
+		priority:                              options.Priority,
 		listenAddress:                         listenAddress,
 		discoveryListenAddress:                discoveryListenAddress,
 		discoveryTargetAddress:                discoveryTargetAddress,
+		seedAddresses:                         options.SeedAddresses,
+		seedsPath:                             options.SeedsPath,
+		registryAddresses:                     options.RegistryAddresses,
+		enableMDNS:                            options.EnableMDNS,
+		enableSWIM:                            options.EnableSWIM,
 		interfaceName:                         interfaceName,
 		rate:                                  rate,
+		burstRate:                             options.BurstRate,
 		rateTimeoutMultiplier:                 rateTimeoutMultiplier,
 		networkManager:                        networkManager,
 		onAdded:                               onAdded,
 		onRemoved:                             onRemoved,
 	}
 
+	// a registry failover has to happen within the grace period (see RegistryGraceMultiplier), which is a few of our
+	// timeouts, so we can't check any less often than we announce
+	workRate := scheduledWorkerRate
+	if m.rate > 0 && m.rate < workRate {
+		workRate = m.rate
+	}
+
 	m.scheduledWorker = worker.NewScheduledWorker(
 		func() {},
 		m.work,
 		func() {},
-		scheduledWorkerRate,
+		workRate,
+	)
+
+	m.seeds = NewSeeds(
+		m.seedAddresses,
+		m.seedsPath,
 	)
 
 	m.announcer = NewAnnouncer(
 		m.networkID,
 		m.endpointID,
 		m.endpointName,
+		m.priority,
 		m.listenAddress,
 		m.discoveryListenAddress,
 		m.discoveryTargetAddress,
 		m.interfaceName,
 		m.rate,
+		m.burstRate,
 		m.networkManager,
+		m.getDirectTargetAddresses,
+		m.getIncarnation,
+		m.getKnownEndpointsDigest,
 		m.onSend,
 	)
 
@@ -95,19 +172,81 @@ func NewManager(
 		m.onReceive,
 	)
 
+	// always built so that we answer probes, but only started (i.e. probing others) if enabled
+	m.failureDetector = NewFailureDetector(
+		m.networkID,
+		m.endpointID,
+		m.endpointName,
+		m.rate,
+		m.rateTimeoutMultiplier,
+		m.networkManager,
+		func() []*types.Container {
+			return m.GetAllAnnouncementContainers()
+		},
+		m.onDead,
+	)
+
+	m.backends = []Backend{
+		NewAnnouncementBackend(m.announcer, m.listener),
+	}
+
+	if m.enableMDNS {
+		m.backends = append(m.backends, NewMDNSBackend(
+			m.networkID,
+			m.endpointID,
+			m.endpointName,
+			m.priority,
+			m.listenAddress,
+			m.interfaceName,
+			m.rate,
+			m.networkManager,
+			m.onReceive,
+		))
+	}
+
 	return &m
 }
 
+func (m *Manager) getExpireDuration(container *types.Container) time.Duration {
+	return time.Millisecond * time.Duration(float64(container.Announcement.SentRate.Milliseconds())*m.rateTimeoutMultiplier)
+}
+
 func (m *Manager) work() {
 	now := time.Now()
 
+	// fail over first, so that the new registry gets a chance to vouch for what the old one told us
+	m.checkRegistry(now)
+
 	toRemove := make([]*types.Container, 0)
 
 	m.mu.Lock()
 
+	m.expireConflicts(now)
+
 	for _, container := range m.lastAnnouncementContainerByEndpointID {
-		expireDuration := time.Millisecond * time.Duration(float64(container.Announcement.SentRate.Milliseconds())*m.rateTimeoutMultiplier)
-		expireTimestamp := container.ReceivedTimestamp.Add(expireDuration)
+		expireDuration := m.getExpireDuration(container)
+
+		// give a registry failover a chance to happen before we give up on what the registry told us
+		if container.Announcement.ForwardedBy != ksuid.Nil {
+			expireDuration *= RegistryGraceMultiplier
+		}
+
+		lastHeardTimestamp := container.ReceivedTimestamp
+
+		// with the failure detector, missing announcements aren't enough on their own; an answered probe counts as
+		// hearing from the endpoint and a suspect endpoint is left for the failure detector to decide on
+		if m.enableSWIM && container.Announcement.ForwardedBy == ksuid.Nil {
+			if m.failureDetector.IsSuspect(container.SourceEndpointID) {
+				continue
+			}
+
+			lastAliveTimestamp := m.failureDetector.LastAliveTimestamp(container.SourceEndpointID)
+			if lastAliveTimestamp.After(lastHeardTimestamp) {
+				lastHeardTimestamp = lastAliveTimestamp
+			}
+		}
+
+		expireTimestamp := lastHeardTimestamp.Add(expireDuration)
 		if now.Before(expireTimestamp) {
 			continue
 		}
@@ -117,8 +256,12 @@ func (m *Manager) work() {
 
 	for _, container := range toRemove {
 		delete(m.lastAnnouncementContainerByEndpointID, container.SourceEndpointID)
+		m.publish(EventTypeRemoved, container)
 	}
 
+	m.noteRemovals(now, toRemove)
+	m.checkPartition(now)
+
 	for _, container := range toRemove {
 		log.Printf("removed: %v", container.String())
 
@@ -133,39 +276,86 @@ func (m *Manager) onSend(container *types.Container) {
 	_ = container // noop
 }
 
+func (m *Manager) getIncarnation() uint64 {
+	return m.failureDetector.Incarnation()
+}
+
+// onDead is called when the failure detector declares an endpoint dead
+func (m *Manager) onDead(endpointID ksuid.KSUID) {
+	m.mu.Lock()
+	container, ok := m.lastAnnouncementContainerByEndpointID[endpointID]
+	if !ok || endpointID == m.endpointID {
+		m.mu.Unlock()
+		return
+	}
+
+	delete(m.lastAnnouncementContainerByEndpointID, endpointID)
+	m.publish(EventTypeRemoved, container)
+	m.noteRemovals(time.Now(), []*types.Container{container})
+	m.mu.Unlock()
+
+	m.failureDetector.Forget(endpointID)
+
+	log.Printf("removed (dead): %v", container.String())
+
+	// TODO: fix unbounded goroutine use
+	go m.onRemoved(container)
+}
+
+// HandleProbe is for failure detector probes, which arrive on the unicast data listen address (i.e. via transport)
+func (m *Manager) HandleProbe(container *types.Container) {
+	m.failureDetector.HandleProbe(container)
+}
+
 func (m *Manager) onReceive(container *types.Container) {
-	if container.SourceEndpointID != m.endpointID {
-		if container.SourceEndpointName == m.endpointName {
-			log.Printf("warning: ignoring %v because of EndpointName clash with us (%v)", container.String(), m.endpointName)
-			return
-		}
+	if container.Announcement.Registry {
+		m.handleRegistryHeartbeat(container)
+		return
+	}
 
-		possiblyClashingAnnouncementContainer, err := m.GetLastAnnouncementContainerByEndpointName(container.SourceEndpointName)
-		if err == nil {
-			if possiblyClashingAnnouncementContainer.SourceEndpointID != container.SourceEndpointID {
-				log.Printf("warning: ignoring %v because of EndpointName clash with existing endpoint %v",
-					container.String(),
-					possiblyClashingAnnouncementContainer.String(),
-				)
-				return
-			}
-		}
+	if container.Announcement.Withdrawn {
+		m.handleWithdrawn(container)
+		return
+	}
+
+	// no need to be told about ourselves second-hand
+	if container.Announcement.Forwarded && container.SourceEndpointID == m.endpointID {
+		return
+	}
+
+	if container.SourceEndpointID != m.endpointID && !m.handleClaim(container) {
+		return
 	}
 
 	m.mu.Lock()
-	_, endpointExists := m.lastAnnouncementContainerByEndpointID[container.SourceEndpointID]
+	lastContainer, endpointExists := m.lastAnnouncementContainerByEndpointID[container.SourceEndpointID]
 	m.lastAnnouncementContainerByEndpointID[container.SourceEndpointID] = container
+	if container.SourceEndpointID != m.endpointID {
+		if !endpointExists {
+			m.publish(EventTypeAdded, container)
+		} else if isAnnouncementChanged(lastContainer, container) {
+			m.publish(EventTypeUpdated, container)
+		}
+	}
 	m.mu.Unlock()
 
+	if m.enableSWIM {
+		m.failureDetector.HandleAnnouncement(container)
+	}
+
 	if !endpointExists && container.SourceEndpointID != m.endpointID {
 		log.Printf("added: %v", container.String())
 
+		// make sure the newcomer hears about us promptly
+		m.announcer.Trigger()
+
 		// TODO: maybe some sort of background worker pool vs unbounded amount of goroutines
 		go m.onAdded(container)
 	}
 
 	// an announcement sent directly to us requires us to flush all our known announcements back to it
-	if container.Announcement.DiscoveryTargetAddr != nil &&
+	if !container.Announcement.Forwarded &&
+		container.Announcement.DiscoveryTargetAddr != nil &&
 		!container.Announcement.DiscoveryTargetAddr.IP.IsMulticast() &&
 		container.Announcement.DiscoveryListenAddr != nil {
 
@@ -196,6 +386,35 @@ func (m *Manager) onReceive(container *types.Container) {
 	}
 }
 
+// UseLocal advertises our Unix domain socket to endpoints on the same host (see Announcer.UseLocal); it should be called
+// before Start
+func (m *Manager) UseLocal(hostID string, localManager *network.StreamManager) {
+	m.announcer.UseLocal(hostID, localManager)
+}
+
+// UseStream advertises our TCP listener (see Announcer.UseStream); it should be called before Start
+func (m *Manager) UseStream(streamManager *network.StreamManager) {
+	m.announcer.UseStream(streamManager)
+}
+
+// TriggerAnnouncements goes back to announcing at the burst rate (e.g. because something about the topology has changed)
+func (m *Manager) TriggerAnnouncements() {
+	m.announcer.Trigger()
+}
+
+// HandleNetworkChange is for when our interfaces or addresses have changed (see network.Manager.OnInterfaceChange); we
+// announce straight away (and at the burst rate for a while) so that everyone learns our new address, and tell watchers
+func (m *Manager) HandleNetworkChange() {
+	log.Printf("network changed; re-announcing")
+
+	m.announcer.Trigger()
+	m.announcer.AnnounceNow()
+
+	m.mu.Lock()
+	m.publish(EventTypeNetworkChanged, nil)
+	m.mu.Unlock()
+}
+
 func (m *Manager) GetLastAnnouncementContainerByEndpointName(endpointName string) (*types.Container, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -232,12 +451,28 @@ func (m *Manager) GetAllAnnouncementContainers(includeSelf ...bool) []*types.Con
 
 func (m *Manager) Start() {
 	m.scheduledWorker.Start()
-	m.listener.Start()
-	m.announcer.Start()
+	m.seeds.Start()
+
+	for _, backend := range m.backends {
+		backend.Start()
+	}
+
+	if m.enableSWIM {
+		m.failureDetector.Start()
+	}
 }
 
 func (m *Manager) Stop() {
 	m.scheduledWorker.Stop()
-	m.listener.Stop()
-	m.announcer.Stop()
+	m.closeWatchers()
+
+	if m.enableSWIM {
+		m.failureDetector.Stop()
+	}
+
+	for _, backend := range m.backends {
+		backend.Stop()
+	}
+
+	m.seeds.Stop()
 }
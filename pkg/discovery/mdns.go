@@ -0,0 +1,501 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+const MDNSAddress = "224.0.0.251:5353"
+const MDNSServiceName = "_glue._udp.local."
+
+const mdnsServicesName = "_services._dns-sd._udp.local."
+const mdnsTTL = 120
+
+// the top bit of the class means "cache flush" for responses (and "unicast response" for questions)
+const mdnsCacheFlush = 1 << 15
+
+const (
+	mdnsNetworkIDKey    = "network_id"
+	mdnsEndpointIDKey   = "endpoint_id"
+	mdnsEndpointNameKey = "endpoint_name"
+	mdnsSentRateKey     = "sent_rate_ms"
+	mdnsPriorityKey     = "priority"
+)
+
+type mdnsRecord struct {
+	networkID    int64
+	endpointID   ksuid.KSUID
+	endpointName string
+	priority     int64
+	sentRate     time.Duration
+	listenAddr   *net.UDPAddr
+	ttl          uint32
+}
+
+func getMDNSInstanceLabel(endpointName string) string {
+	// DNS-SD permits dots in instance names but only escaped; easier to avoid them (the TXT record has the real name)
+	label := strings.ReplaceAll(endpointName, ".", "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+
+	return label
+}
+
+func getMDNSResponse(
+	networkID int64,
+	endpointID ksuid.KSUID,
+	endpointName string,
+	priority int64,
+	listenAddr *net.UDPAddr,
+	rate time.Duration,
+	ttl uint32,
+) ([]byte, error) {
+	serviceName, err := dnsmessage.NewName(MDNSServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	servicesName, err := dnsmessage.NewName(mdnsServicesName)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceName, err := dnsmessage.NewName(fmt.Sprintf("%v.%v", getMDNSInstanceLabel(endpointName), MDNSServiceName))
+	if err != nil {
+		return nil, err
+	}
+
+	hostName, err := dnsmessage.NewName(fmt.Sprintf("%v.local.", endpointID.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	err = b.StartAnswers()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedHeader := func(name dnsmessage.Name, resourceType dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: resourceType, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	uniqueHeader := func(name dnsmessage.Name, resourceType dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: resourceType, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl}
+	}
+
+	err = b.PTRResource(sharedHeader(servicesName, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: serviceName})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.PTRResource(sharedHeader(serviceName, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instanceName})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.SRVResource(
+		uniqueHeader(instanceName, dnsmessage.TypeSRV),
+		dnsmessage.SRVResource{Port: uint16(listenAddr.Port), Target: hostName},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.TXTResource(
+		uniqueHeader(instanceName, dnsmessage.TypeTXT),
+		dnsmessage.TXTResource{TXT: []string{
+			fmt.Sprintf("%v=%v", mdnsNetworkIDKey, networkID),
+			fmt.Sprintf("%v=%v", mdnsEndpointIDKey, endpointID.String()),
+			fmt.Sprintf("%v=%v", mdnsEndpointNameKey, endpointName),
+			fmt.Sprintf("%v=%v", mdnsSentRateKey, rate.Milliseconds()),
+			fmt.Sprintf("%v=%v", mdnsPriorityKey, priority),
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip4 := listenAddr.IP.To4(); ip4 != nil && !ip4.IsUnspecified() {
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip4)
+
+		err = b.AResource(uniqueHeader(hostName, dnsmessage.TypeA), a)
+		if err != nil {
+			return nil, err
+		}
+	} else if ip16 := listenAddr.IP.To16(); ip16 != nil && !ip16.IsUnspecified() {
+		aaaa := dnsmessage.AAAAResource{}
+		copy(aaaa.AAAA[:], ip16)
+
+		err = b.AAAAResource(uniqueHeader(hostName, dnsmessage.TypeAAAA), aaaa)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// parseMDNSMessage returns whether the message was a query for glue endpoints and (for a response) any glue endpoint
+// records it contained; an endpoint without an address record gets srcAddr's IP
+func parseMDNSMessage(srcAddr *net.UDPAddr, data []byte) (bool, []*mdnsRecord, error) {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(data)
+	if err != nil {
+		return false, nil, err
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !header.Response {
+		for _, question := range questions {
+			if question.Type != dnsmessage.TypePTR && question.Type != dnsmessage.TypeALL {
+				continue
+			}
+
+			name := strings.ToLower(question.Name.String())
+			if name == MDNSServiceName || name == mdnsServicesName {
+				return true, nil, nil
+			}
+		}
+
+		return false, nil, nil
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return false, nil, err
+	}
+
+	err = p.SkipAllAuthorities()
+	if err != nil {
+		return false, nil, err
+	}
+
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return false, nil, err
+	}
+
+	srvByName := make(map[string]*dnsmessage.SRVResource)
+	txtByName := make(map[string]*dnsmessage.TXTResource)
+	ttlByName := make(map[string]uint32)
+	ipByHostName := make(map[string]net.IP)
+	instanceNames := make([]string, 0)
+
+	for _, resource := range append(answers, additionals...) {
+		name := strings.ToLower(resource.Header.Name.String())
+
+		switch body := resource.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == MDNSServiceName {
+				instanceNames = append(instanceNames, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srvByName[name] = body
+			ttlByName[name] = resource.Header.TTL
+		case *dnsmessage.TXTResource:
+			txtByName[name] = body
+		case *dnsmessage.AResource:
+			ipByHostName[name] = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			_, ok := ipByHostName[name]
+			if !ok {
+				ipByHostName[name] = net.IP(body.AAAA[:])
+			}
+		}
+	}
+
+	// unsolicited announcements don't always include the PTR
+	for name := range srvByName {
+		if strings.HasSuffix(name, "."+MDNSServiceName) {
+			instanceNames = append(instanceNames, name)
+		}
+	}
+
+	seen := make(map[string]struct{})
+	records := make([]*mdnsRecord, 0)
+
+	for _, instanceName := range instanceNames {
+		_, ok := seen[instanceName]
+		if ok {
+			continue
+		}
+		seen[instanceName] = struct{}{}
+
+		srv, ok := srvByName[instanceName]
+		if !ok {
+			continue
+		}
+
+		txt, ok := txtByName[instanceName]
+		if !ok {
+			continue
+		}
+
+		record := &mdnsRecord{
+			ttl: ttlByName[instanceName],
+		}
+
+		for _, entry := range txt.TXT {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			switch parts[0] {
+			case mdnsNetworkIDKey:
+				record.networkID, err = strconv.ParseInt(parts[1], 10, 64)
+			case mdnsEndpointIDKey:
+				record.endpointID, err = ksuid.Parse(parts[1])
+			case mdnsEndpointNameKey:
+				record.endpointName = parts[1]
+			case mdnsSentRateKey:
+				var sentRate int64
+				sentRate, err = strconv.ParseInt(parts[1], 10, 64)
+				record.sentRate = time.Millisecond * time.Duration(sentRate)
+			case mdnsPriorityKey:
+				record.priority, err = strconv.ParseInt(parts[1], 10, 64)
+			}
+
+			if err != nil {
+				return false, nil, fmt.Errorf("failed to parse TXT entry %#+v for %v: %v", entry, instanceName, err)
+			}
+		}
+
+		if record.endpointID == ksuid.Nil || record.endpointName == "" || record.sentRate <= 0 {
+			continue
+		}
+
+		ip, ok := ipByHostName[strings.ToLower(srv.Target.String())]
+		if !ok {
+			ip = srcAddr.IP
+		}
+
+		record.listenAddr = &net.UDPAddr{
+			IP:   ip,
+			Port: int(srv.Port),
+			Zone: srcAddr.Zone,
+		}
+
+		records = append(records, record)
+	}
+
+	return false, records, nil
+}
+
+// MDNSBackend advertises this endpoint as a DNS-SD service (so that standard tools like avahi-browse can see it) and
+// browses for other endpoints doing the same
+type MDNSBackend struct {
+	scheduledWorker *worker.ScheduledWorker
+	networkID       int64
+	endpointID      ksuid.KSUID
+	endpointName    string
+	priority        int64
+	listenAddress   *net.UDPAddr
+	interfaceName   string
+	rate            time.Duration
+	networkManager  network.Network
+	onReceive       func(*types.Container)
+	mdnsAddress     *net.UDPAddr
+}
+
+func NewMDNSBackend(
+	networkID int64,
+	endpointID ksuid.KSUID,
+	endpointName string,
+	priority int64,
+	listenAddress *net.UDPAddr,
+	interfaceName string,
+	rate time.Duration,
+	networkManager network.Network,
+	onReceive func(*types.Container),
+) *MDNSBackend {
+	mdnsAddress, _ := network.GetAddress(MDNSAddress)
+
+	b := MDNSBackend{
+		networkID:      networkID,
+		endpointID:     endpointID,
+		endpointName:   endpointName,
+		priority:       priority,
+		listenAddress:  listenAddress,
+		interfaceName:  interfaceName,
+		rate:           rate,
+		networkManager: networkManager,
+		onReceive:      onReceive,
+		mdnsAddress:    mdnsAddress,
+	}
+
+	b.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		b.work,
+		func() {},
+		rate,
+	)
+
+	return &b
+}
+
+func (b *MDNSBackend) respond(dstAddr *net.UDPAddr, ttl uint32) {
+	_, _, srcAddr, err := network.GetAddressesAndInterfaces(b.interfaceName, MDNSAddress)
+	if err != nil {
+		log.Printf("warning: mdns backend failed to get src addr: %v", err)
+		return
+	}
+
+	listenAddr := &net.UDPAddr{
+		IP:   srcAddr.IP,
+		Port: b.listenAddress.Port,
+		Zone: srcAddr.Zone,
+	}
+
+	data, err := getMDNSResponse(b.networkID, b.endpointID, b.endpointName, b.priority, listenAddr, b.rate, ttl)
+	if err != nil {
+		log.Printf("warning: mdns backend failed to build response: %v", err)
+		return
+	}
+
+	// responses must come from port 5353 or other responders (e.g. avahi) will ignore them
+	err = b.networkManager.SendFrom(b.mdnsAddress, b.interfaceName, dstAddr, data)
+	if err != nil {
+		log.Printf("warning: mdns backend failed to send response: %v", err)
+		return
+	}
+}
+
+func (b *MDNSBackend) query() {
+	serviceName, err := dnsmessage.NewName(MDNSServiceName)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{})
+
+	err = builder.StartQuestions()
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	err = builder.Question(dnsmessage.Question{Name: serviceName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	data, err := builder.Finish()
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	err = b.networkManager.SendFrom(b.mdnsAddress, b.interfaceName, b.mdnsAddress, data)
+	if err != nil {
+		log.Printf("warning: mdns backend failed to send query: %v", err)
+		return
+	}
+}
+
+func (b *MDNSBackend) work() {
+	b.respond(b.mdnsAddress, mdnsTTL)
+}
+
+func (b *MDNSBackend) callback(
+	srcAddr *net.UDPAddr,
+	dstAddr *net.UDPAddr,
+	data []byte,
+) {
+	receivedTimestamp := time.Now()
+
+	isQuery, records, err := parseMDNSMessage(srcAddr, data)
+	if err != nil {
+		// plenty of other things use mDNS; no need to be noisy about what we can't parse
+		return
+	}
+
+	if isQuery {
+		// a query from a port other than 5353 is a "legacy unicast" query and wants a unicast response
+		if srcAddr.Port != b.mdnsAddress.Port {
+			b.respond(srcAddr, mdnsTTL)
+		} else {
+			b.respond(b.mdnsAddress, mdnsTTL)
+		}
+
+		return
+	}
+
+	for _, record := range records {
+		if record.networkID != b.networkID {
+			continue
+		}
+
+		// a goodbye; let expiry take care of it
+		if record.ttl == 0 {
+			continue
+		}
+
+		container := types.GetAnnouncementContainer(
+			receivedTimestamp,
+			srcAddr.String(),
+			record.networkID,
+			record.endpointID,
+			record.endpointName,
+			record.sentRate,
+			b.mdnsAddress,
+			b.mdnsAddress,
+			record.listenAddr,
+		)
+
+		container.Announcement.Priority = record.priority
+		container.SentTo = dstAddr.String()
+		container.ReceivedTimestamp = receivedTimestamp
+		container.ReceivedFrom = srcAddr.String()
+		container.ReceivedBy = dstAddr.String()
+
+		// TODO: maybe some sort of background worker pool vs unbounded amount of goroutines
+		go b.onReceive(container)
+	}
+}
+
+func (b *MDNSBackend) Start() {
+	err := b.networkManager.RegisterCallback(b.mdnsAddress, b.interfaceName, b.callback)
+	if err != nil {
+		log.Printf("warning: attempt to register callback failed stating: %v", err)
+	}
+
+	b.query()
+
+	b.scheduledWorker.Start()
+}
+
+func (b *MDNSBackend) Stop() {
+	b.scheduledWorker.Stop()
+
+	// a goodbye so that other responders drop us straight away
+	b.respond(b.mdnsAddress, 0)
+
+	err := b.networkManager.UnregisterCallback(b.mdnsAddress, b.interfaceName, b.callback)
+	if err != nil {
+		log.Printf("warning: attempt to unregister callback failed stating: %v", err)
+	}
+}
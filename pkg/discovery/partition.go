@@ -0,0 +1,275 @@
+package discovery
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/types"
+)
+
+const (
+	// a sudden drop is at least this many endpoints (and this fraction of the membership) removed within one expiry
+	// window; anything less looks like ordinary churn
+	partitionMinimumDrop  = 2
+	partitionDropFraction = 1.0 / 3.0
+
+	// an endpoint on the other side of a partition that hasn't come back after this many expiry windows is assumed to have
+	// actually gone away
+	partitionForgetMultiplier = 10
+)
+
+type removal struct {
+	timestamp time.Time
+	container *types.Container
+}
+
+type partition struct {
+	suspectedTimestamp            time.Time
+	affectedContainerByEndpointID map[ksuid.KSUID]*types.Container
+}
+
+func (m *Manager) getPartitionWindow() time.Duration {
+	return time.Millisecond * time.Duration(float64(m.rate.Milliseconds())*m.rateTimeoutMultiplier)
+}
+
+// getKnownEndpointsDigest is a digest of who we know about other than via a registry or relay (and ourselves, so that it's
+// never empty); it goes out in our announcements so that others can tell if we don't know about them
+func (m *Manager) getKnownEndpointsDigest() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	knownEndpointIDs := []ksuid.KSUID{m.endpointID}
+
+	for endpointID, container := range m.lastAnnouncementContainerByEndpointID {
+		if endpointID == m.endpointID || container.Announcement.ForwardedBy != ksuid.Nil {
+			continue
+		}
+
+		knownEndpointIDs = append(knownEndpointIDs, endpointID)
+	}
+
+	return getKnownDigest(knownEndpointIDs)
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) noteRemovals(now time.Time, containers []*types.Container) {
+	for _, container := range containers {
+		m.recentRemovals = append(m.recentRemovals, removal{
+			timestamp: now,
+			container: container,
+		})
+	}
+}
+
+// ReportAck is for the transport to tell us an endpoint acknowledged something we sent it
+func (m *Manager) ReportAck(endpointID ksuid.KSUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.ackTimeoutByEndpointID, endpointID)
+}
+
+// ReportAckTimeout is for the transport to tell us an endpoint never acknowledged something we sent it
+func (m *Manager) ReportAckTimeout(endpointID ksuid.KSUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ackTimeoutByEndpointID[endpointID] = time.Now()
+}
+
+// isOneWay is true if we hear an endpoint but it doesn't seem to hear us; either it says as much in its announcements or
+// it has stopped acknowledging what we send it (while still announcing)
+//
+// be sure you're holding the mutex before calling this
+func (m *Manager) isOneWay(container *types.Container) bool {
+	// second-hand announcements say nothing about whether we can reach each other
+	if container.Announcement.Forwarded || container.Announcement.ForwardedBy != ksuid.Nil {
+		return false
+	}
+
+	ackTimeoutTimestamp, ok := m.ackTimeoutByEndpointID[container.SourceEndpointID]
+	if ok && container.ReceivedTimestamp.After(ackTimeoutTimestamp) {
+		return true
+	}
+
+	// nothing to go on for an endpoint that doesn't send one
+	if len(container.Announcement.KnownEndpointsDigest) == 0 {
+		return false
+	}
+
+	return !isInKnownDigest(container.Announcement.KnownEndpointsDigest, m.endpointID)
+}
+
+func getSortedContainers(containerByEndpointID map[ksuid.KSUID]*types.Container) []*types.Container {
+	containers := make([]*types.Container, 0, len(containerByEndpointID))
+	for _, container := range containerByEndpointID {
+		containers = append(containers, container)
+	}
+
+	sort.Slice(containers, func(i, j int) bool {
+		return bytes.Compare(containers[i].SourceEndpointID.Bytes(), containers[j].SourceEndpointID.Bytes()) < 0
+	})
+
+	return containers
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) publishPartition(eventType EventType, containerByEndpointID map[ksuid.KSUID]*types.Container) {
+	endpoints := getSortedContainers(containerByEndpointID)
+
+	for w := range m.watchers {
+		w.push(Event{
+			Type:      eventType,
+			Endpoints: endpoints,
+		})
+	}
+}
+
+// checkPartition tells "one endpoint went away" apart from "we lost part of the network"; a sudden drop in membership or
+// an endpoint we can hear that can't hear us is suspected as a partition, which is healed once every affected endpoint is
+// back (and can hear us)
+//
+// be sure you're holding the mutex before calling this
+func (m *Manager) checkPartition(now time.Time) {
+	window := m.getPartitionWindow()
+
+	recentRemovals := make([]removal, 0)
+	for _, r := range m.recentRemovals {
+		if now.Sub(r.timestamp) >= window {
+			continue
+		}
+
+		// it came back (e.g. flapping); that's not a drop
+		_, ok := m.lastAnnouncementContainerByEndpointID[r.container.SourceEndpointID]
+		if ok {
+			continue
+		}
+
+		recentRemovals = append(recentRemovals, r)
+	}
+	m.recentRemovals = recentRemovals
+
+	for endpointID := range m.ackTimeoutByEndpointID {
+		_, ok := m.lastAnnouncementContainerByEndpointID[endpointID]
+		if !ok {
+			delete(m.ackTimeoutByEndpointID, endpointID)
+		}
+	}
+
+	suspectedContainerByEndpointID := make(map[ksuid.KSUID]*types.Container)
+
+	// one-way reachability has to persist for a window so that a newcomer has had the chance to hear us
+	memberCount := 0
+	for endpointID, container := range m.lastAnnouncementContainerByEndpointID {
+		if endpointID == m.endpointID {
+			continue
+		}
+
+		memberCount++
+
+		if !m.isOneWay(container) {
+			delete(m.oneWaySinceByEndpointID, endpointID)
+			continue
+		}
+
+		oneWaySince, ok := m.oneWaySinceByEndpointID[endpointID]
+		if !ok {
+			m.oneWaySinceByEndpointID[endpointID] = now
+			continue
+		}
+
+		if now.Sub(oneWaySince) >= window {
+			suspectedContainerByEndpointID[endpointID] = container
+		}
+	}
+
+	for endpointID := range m.oneWaySinceByEndpointID {
+		_, ok := m.lastAnnouncementContainerByEndpointID[endpointID]
+		if !ok {
+			delete(m.oneWaySinceByEndpointID, endpointID)
+		}
+	}
+
+	dropCount := len(m.recentRemovals)
+	if dropCount >= partitionMinimumDrop && float64(dropCount) >= partitionDropFraction*float64(memberCount+dropCount) {
+		for _, r := range m.recentRemovals {
+			suspectedContainerByEndpointID[r.container.SourceEndpointID] = r.container
+		}
+
+		// these are accounted for now; only further drops should count towards another
+		m.recentRemovals = make([]removal, 0)
+	}
+
+	if m.partition == nil && len(suspectedContainerByEndpointID) > 0 {
+		m.partition = &partition{
+			suspectedTimestamp:            now,
+			affectedContainerByEndpointID: make(map[ksuid.KSUID]*types.Container),
+		}
+	}
+
+	if m.partition == nil {
+		return
+	}
+
+	grown := false
+	for endpointID, container := range suspectedContainerByEndpointID {
+		_, ok := m.partition.affectedContainerByEndpointID[endpointID]
+		m.partition.affectedContainerByEndpointID[endpointID] = container
+		if !ok {
+			grown = true
+		}
+	}
+
+	if grown {
+		m.partition.suspectedTimestamp = now
+
+		log.Printf(
+			"warning: partition suspected; %v endpoint(s) unreachable: %v",
+			len(m.partition.affectedContainerByEndpointID),
+			getSortedContainers(m.partition.affectedContainerByEndpointID),
+		)
+
+		m.publishPartition(EventTypePartitionSuspected, m.partition.affectedContainerByEndpointID)
+
+		return
+	}
+
+	forgetDuration := window * partitionForgetMultiplier
+
+	for endpointID := range m.partition.affectedContainerByEndpointID {
+		container, ok := m.lastAnnouncementContainerByEndpointID[endpointID]
+		if ok && !m.isOneWay(container) {
+			continue
+		}
+
+		if !ok && now.Sub(m.partition.suspectedTimestamp) >= forgetDuration {
+			continue
+		}
+
+		// still on the other side
+		return
+	}
+
+	healedContainerByEndpointID := make(map[ksuid.KSUID]*types.Container)
+	for endpointID := range m.partition.affectedContainerByEndpointID {
+		container, ok := m.lastAnnouncementContainerByEndpointID[endpointID]
+		if ok {
+			healedContainerByEndpointID[endpointID] = container
+		}
+	}
+
+	log.Printf(
+		"partition healed; %v of %v endpoint(s) back: %v",
+		len(healedContainerByEndpointID),
+		len(m.partition.affectedContainerByEndpointID),
+		getSortedContainers(healedContainerByEndpointID),
+	)
+
+	m.publishPartition(EventTypePartitionHealed, healedContainerByEndpointID)
+
+	m.partition = nil
+}
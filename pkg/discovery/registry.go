@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/types"
+)
+
+// RegistryGraceMultiplier is how much longer than usual something learned via a registry is held for after the
+// registry has gone quiet (i.e. long enough for clients to fail over to another registry)
+const RegistryGraceMultiplier = 3
+
+// getDirectTargetAddresses is everything the Announcer should announce to directly (as well as the discovery target
+// address); that's the seeds and the registry we're currently using (if any)
+func (m *Manager) getDirectTargetAddresses() []*net.UDPAddr {
+	addrs := m.seeds.Addresses()
+
+	m.mu.Lock()
+	if len(m.registryAddresses) > 0 {
+		addrs = append(addrs, m.registryAddresses[m.registryIndex%len(m.registryAddresses)])
+	}
+	m.mu.Unlock()
+
+	return addrs
+}
+
+// checkRegistry fails over to the next registry if the one we're using has stopped sending us heartbeats
+func (m *Manager) checkRegistry(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.registryAddresses) == 0 {
+		return
+	}
+
+	timeout := time.Millisecond * time.Duration(float64(m.rate.Milliseconds())*m.rateTimeoutMultiplier)
+
+	if m.lastRegistrySwitchTimestamp.IsZero() {
+		m.lastRegistrySwitchTimestamp = now
+	}
+
+	if now.Sub(m.lastRegistryHeartbeatTimestamp) < timeout || now.Sub(m.lastRegistrySwitchTimestamp) < timeout {
+		return
+	}
+
+	lastRegistryAddress := m.registryAddresses[m.registryIndex%len(m.registryAddresses)]
+	m.registryIndex = (m.registryIndex + 1) % len(m.registryAddresses)
+	m.lastRegistrySwitchTimestamp = now
+
+	// get ourselves in front of the new registry promptly
+	m.announcer.Trigger()
+
+	log.Printf(
+		"warning: no heartbeat from registry %v for %v; failing over to %v",
+		lastRegistryAddress.String(),
+		timeout,
+		m.registryAddresses[m.registryIndex].String(),
+	)
+}
+
+// handleRegistryHeartbeat keeps alive everything the registry has told us about and still vouches for
+func (m *Manager) handleRegistryHeartbeat(container *types.Container) {
+	knownEndpointIDs := make(map[ksuid.KSUID]struct{})
+	for _, endpointID := range container.Announcement.KnownEndpointIDs {
+		knownEndpointIDs[endpointID] = struct{}{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastRegistryHeartbeatTimestamp = container.ReceivedTimestamp
+
+	for endpointID, knownContainer := range m.lastAnnouncementContainerByEndpointID {
+		if knownContainer.Announcement.ForwardedBy != container.SourceEndpointID {
+			continue
+		}
+
+		_, ok := knownEndpointIDs[endpointID]
+		if !ok {
+			continue
+		}
+
+		refreshedContainer := knownContainer.Copy()
+		refreshedContainer.ReceivedTimestamp = container.ReceivedTimestamp
+
+		m.lastAnnouncementContainerByEndpointID[endpointID] = refreshedContainer
+	}
+}
+
+// handleWithdrawn removes an endpoint a registry has told us has gone away (provided that's the registry we heard about
+// it from)
+func (m *Manager) handleWithdrawn(container *types.Container) {
+	if container.Announcement.ForwardedBy == ksuid.Nil || container.SourceEndpointID == m.endpointID {
+		return
+	}
+
+	m.mu.Lock()
+	knownContainer, ok := m.lastAnnouncementContainerByEndpointID[container.SourceEndpointID]
+	if !ok || knownContainer.Announcement.ForwardedBy != container.Announcement.ForwardedBy {
+		m.mu.Unlock()
+		return
+	}
+
+	delete(m.lastAnnouncementContainerByEndpointID, container.SourceEndpointID)
+	m.publish(EventTypeRemoved, knownContainer)
+	m.mu.Unlock()
+
+	log.Printf("removed (withdrawn): %v", knownContainer.String())
+
+	// TODO: fix unbounded goroutine use
+	go m.onRemoved(knownContainer)
+}
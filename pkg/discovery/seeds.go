@@ -0,0 +1,181 @@
+package discovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+const seedsScheduledWorkerRate = time.Second * 1
+
+// ParseSeedAddresses parses one seed address per line (or comma-separated); blank lines and anything after a "#" are
+// ignored
+func ParseSeedAddresses(r io.Reader) ([]*net.UDPAddr, error) {
+	addrs := make([]*net.UDPAddr, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		commentIndex := strings.Index(line, "#")
+		if commentIndex >= 0 {
+			line = line[:commentIndex]
+		}
+
+		for _, rawAddr := range strings.Split(line, ",") {
+			rawAddr = strings.TrimSpace(rawAddr)
+			if rawAddr == "" {
+				continue
+			}
+
+			addr, err := network.GetAddress(rawAddr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse seed address %#+v: %v", rawAddr, err)
+			}
+
+			addrs = append(addrs, addr)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return addrs, nil
+}
+
+// Seeds is a set of peer discovery addresses to announce to directly; it's made up of some static addresses and
+// (optionally) the addresses in a file that is watched for changes
+type Seeds struct {
+	scheduledWorker *worker.ScheduledWorker
+	mu              sync.Mutex
+	staticAddresses []*net.UDPAddr
+	path            string
+	lastModTime     time.Time
+	lastSize        int64
+	pathAddresses   []*net.UDPAddr
+	statWarned      bool
+}
+
+func NewSeeds(
+	staticAddresses []*net.UDPAddr,
+	path string,
+) *Seeds {
+	s := Seeds{
+		staticAddresses: staticAddresses,
+		path:            path,
+		pathAddresses:   make([]*net.UDPAddr, 0),
+	}
+
+	s.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		s.work,
+		func() {},
+		seedsScheduledWorkerRate,
+	)
+
+	return &s
+}
+
+func (s *Seeds) work() {
+	if s.path == "" {
+		return
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		s.mu.Lock()
+		if !s.statWarned {
+			log.Printf("warning: failed to stat seeds file %#+v: %v", s.path, err)
+			s.statWarned = true
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	changed := !info.ModTime().Equal(s.lastModTime) || info.Size() != s.lastSize
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		log.Printf("warning: failed to open seeds file %#+v: %v", s.path, err)
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	addrs, err := ParseSeedAddresses(f)
+
+	// recorded either way, so that a bad file is only complained about (and re-read) once it's changed again
+	s.mu.Lock()
+	s.lastModTime = info.ModTime()
+	s.lastSize = info.Size()
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Printf("warning: failed to parse seeds file %#+v (keeping the addresses read before): %v", s.path, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.pathAddresses = addrs
+	s.statWarned = false
+	s.mu.Unlock()
+
+	log.Printf("seeds file %#+v loaded: %v addresses", s.path, len(addrs))
+}
+
+// Addresses returns the de-duplicated union of the static addresses and those most recently read from the seeds file
+func (s *Seeds) Addresses() []*net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	addrs := make([]*net.UDPAddr, 0)
+
+	for _, addrsGroup := range [][]*net.UDPAddr{s.staticAddresses, s.pathAddresses} {
+		for _, addr := range addrsGroup {
+			if addr == nil {
+				continue
+			}
+
+			_, ok := seen[addr.String()]
+			if ok {
+				continue
+			}
+
+			seen[addr.String()] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+func (s *Seeds) Start() {
+	// make sure the seeds file is read before the first announcement goes out
+	s.work()
+
+	s.scheduledWorker.Start()
+}
+
+func (s *Seeds) Stop() {
+	s.scheduledWorker.Stop()
+}
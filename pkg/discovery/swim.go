@@ -0,0 +1,631 @@
+package discovery
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+const (
+	// how many times per protocol period the failure detector wakes up to check on outstanding probes
+	probeTicksPerPeriod = 4
+
+	// how many other members are asked to ping a member that didn't answer us directly
+	indirectProbeCount = 3
+
+	// scales how many times a piece of gossip is piggybacked (by the log of the member count)
+	retransmitMultiplier = 3
+
+	// the most gossip piggybacked on a single probe
+	maxPiggybackedUpdates = 8
+)
+
+type memberState struct {
+	incarnation        uint64
+	state              types.MemberState
+	suspectedTimestamp time.Time
+	lastAliveTimestamp time.Time
+}
+
+type pendingProbe struct {
+	targetEndpointID        ksuid.KSUID
+	targetAddr              *net.UDPAddr
+	sentTimestamp           time.Time
+	indirect                bool
+	requesterEndpointID     ksuid.KSUID
+	requesterAddr           *net.UDPAddr
+	requesterSequenceNumber uint64
+}
+
+type gossip struct {
+	update        *types.MemberUpdate
+	transmitCount int
+}
+
+// FailureDetector is a SWIM-style failure detector; each protocol period (the discovery rate) it pings one member
+// directly, asks some other members to ping it if it doesn't answer in time and otherwise marks it suspect; a suspect
+// member that doesn't refute the suspicion (by raising its incarnation) is declared dead. Membership changes are
+// gossiped by piggybacking them on the probes.
+type FailureDetector struct {
+	scheduledWorker              *worker.ScheduledWorker
+	mu                           sync.Mutex
+	incarnation                  uint64
+	sequenceNumber               uint64
+	lastProbeTimestamp           time.Time
+	probeOrder                   []ksuid.KSUID
+	pendingProbeBySequenceNumber map[uint64]*pendingProbe
+	memberStateByEndpointID      map[ksuid.KSUID]*memberState
+	gossipByEndpointID           map[ksuid.KSUID]*gossip
+	networkID                    int64
+	endpointID                   ksuid.KSUID
+	endpointName                 string
+	rate                         time.Duration
+	rateTimeoutMultiplier        float64
+	networkManager               network.Network
+	getMembers                   func() []*types.Container
+	onDead                       func(ksuid.KSUID)
+}
+
+func NewFailureDetector(
+	networkID int64,
+	endpointID ksuid.KSUID,
+	endpointName string,
+	rate time.Duration,
+	rateTimeoutMultiplier float64,
+	networkManager network.Network,
+	getMembers func() []*types.Container,
+	onDead func(ksuid.KSUID),
+) *FailureDetector {
+	f := FailureDetector{
+		pendingProbeBySequenceNumber: make(map[uint64]*pendingProbe),
+		memberStateByEndpointID:      make(map[ksuid.KSUID]*memberState),
+		gossipByEndpointID:           make(map[ksuid.KSUID]*gossip),
+		networkID:                    networkID,
+		endpointID:                   endpointID,
+		endpointName:                 endpointName,
+		rate:                         rate,
+		rateTimeoutMultiplier:        rateTimeoutMultiplier,
+		networkManager:               networkManager,
+		getMembers:                   getMembers,
+		onDead:                       onDead,
+	}
+
+	f.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		f.work,
+		func() {},
+		rate/probeTicksPerPeriod,
+	)
+
+	return &f
+}
+
+func getLogScale(memberCount int) float64 {
+	return math.Max(1, math.Ceil(math.Log10(float64(memberCount+1))))
+}
+
+// getSuspicionTimeout is how long a member stays suspect before it's declared dead; the usual discovery timeout,
+// scaled up for bigger groups (as gossip takes longer to get around)
+func (f *FailureDetector) getSuspicionTimeout(memberCount int) time.Duration {
+	return time.Duration(float64(f.rate) * f.rateTimeoutMultiplier * getLogScale(memberCount))
+}
+
+// Incarnation is our own incarnation (only we get to raise it, to refute suspicion about us)
+func (f *FailureDetector) Incarnation() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.incarnation
+}
+
+// IsSuspect is true if the member hasn't answered a probe (directly or indirectly) and hasn't yet refuted that
+func (f *FailureDetector) IsSuspect(endpointID ksuid.KSUID) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.memberStateByEndpointID[endpointID]
+
+	return ok && state.state == types.MemberStateSuspect
+}
+
+// LastAliveTimestamp is the last time we had first-hand evidence the member was alive (i.e. it answered a probe or sent
+// us one)
+func (f *FailureDetector) LastAliveTimestamp(endpointID ksuid.KSUID) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.memberStateByEndpointID[endpointID]
+	if !ok {
+		return time.Time{}
+	}
+
+	return state.lastAliveTimestamp
+}
+
+// Forget drops everything we know about a member (e.g. because discovery has given up on it)
+func (f *FailureDetector) Forget(endpointID ksuid.KSUID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.memberStateByEndpointID, endpointID)
+	delete(f.gossipByEndpointID, endpointID)
+}
+
+func (f *FailureDetector) getListenAddr(endpointID ksuid.KSUID) *net.UDPAddr {
+	for _, member := range f.getMembers() {
+		if member.SourceEndpointID == endpointID {
+			return member.Announcement.ListenAddr
+		}
+	}
+
+	return nil
+}
+
+func (f *FailureDetector) getMemberState(endpointID ksuid.KSUID) *memberState {
+	state, ok := f.memberStateByEndpointID[endpointID]
+	if !ok {
+		state = &memberState{state: types.MemberStateAlive}
+		f.memberStateByEndpointID[endpointID] = state
+	}
+
+	return state
+}
+
+func (f *FailureDetector) enqueueGossip(update *types.MemberUpdate) {
+	f.gossipByEndpointID[update.EndpointID] = &gossip{update: update}
+}
+
+// getPiggybackedUpdates takes the least-transmitted gossip (and forgets gossip that has been transmitted enough)
+func (f *FailureDetector) getPiggybackedUpdates(memberCount int) []*types.MemberUpdate {
+	retransmitLimit := int(retransmitMultiplier * getLogScale(memberCount))
+
+	gossips := make([]*gossip, 0, len(f.gossipByEndpointID))
+	for _, g := range f.gossipByEndpointID {
+		gossips = append(gossips, g)
+	}
+
+	sort.Slice(gossips, func(i, j int) bool {
+		return gossips[i].transmitCount < gossips[j].transmitCount
+	})
+
+	updates := make([]*types.MemberUpdate, 0)
+
+	for _, g := range gossips {
+		if len(updates) >= maxPiggybackedUpdates {
+			break
+		}
+
+		updates = append(updates, g.update)
+
+		g.transmitCount++
+		if g.transmitCount >= retransmitLimit {
+			delete(f.gossipByEndpointID, g.update.EndpointID)
+		}
+	}
+
+	return updates
+}
+
+func (f *FailureDetector) send(
+	probeType types.ProbeType,
+	sequenceNumber uint64,
+	targetEndpointID ksuid.KSUID,
+	targetAddr *net.UDPAddr,
+	dstAddr *net.UDPAddr,
+) {
+	f.mu.Lock()
+	container := types.GetProbeContainer(
+		f.networkID,
+		f.endpointID,
+		f.endpointName,
+		probeType,
+		sequenceNumber,
+		f.incarnation,
+		targetEndpointID,
+		targetAddr,
+		f.getPiggybackedUpdates(len(f.memberStateByEndpointID)),
+	)
+	f.mu.Unlock()
+
+	container.SentTo = dstAddr.String()
+
+	data, err := serialization.Serialize(container)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	err = f.networkManager.Send(dstAddr, data)
+	if err != nil {
+		log.Printf("warning: failed to send %v to %v: %v", container.Probe.String(), dstAddr.String(), err)
+	}
+}
+
+// applyUpdate merges a piece of gossip (or first-hand knowledge) into our view; it returns true if the member should be
+// declared dead
+func (f *FailureDetector) applyUpdate(update *types.MemberUpdate, now time.Time) bool {
+	if update.EndpointID == f.endpointID {
+		// someone thinks we're in trouble; refute it by raising our incarnation
+		if update.State != types.MemberStateAlive && update.Incarnation >= f.incarnation {
+			f.incarnation = update.Incarnation + 1
+
+			log.Printf("refuting %v suspicion of us with incarnation %v", update.State, f.incarnation)
+
+			f.enqueueGossip(&types.MemberUpdate{
+				EndpointID:  f.endpointID,
+				Incarnation: f.incarnation,
+				State:       types.MemberStateAlive,
+			})
+		}
+
+		return false
+	}
+
+	state, ok := f.memberStateByEndpointID[update.EndpointID]
+	if !ok {
+		// we only track members discovery has told us about
+		return false
+	}
+
+	if state.state == types.MemberStateDead {
+		return false
+	}
+
+	switch update.State {
+	case types.MemberStateAlive:
+		if update.Incarnation <= state.incarnation {
+			return false
+		}
+
+		state.state = types.MemberStateAlive
+		state.incarnation = update.Incarnation
+
+	case types.MemberStateSuspect:
+		if update.Incarnation < state.incarnation ||
+			(update.Incarnation == state.incarnation && state.state == types.MemberStateSuspect) {
+			return false
+		}
+
+		state.state = types.MemberStateSuspect
+		state.incarnation = update.Incarnation
+		state.suspectedTimestamp = now
+
+	case types.MemberStateDead:
+		if update.Incarnation < state.incarnation {
+			return false
+		}
+
+		state.state = types.MemberStateDead
+		state.incarnation = update.Incarnation
+	}
+
+	f.enqueueGossip(update)
+
+	return state.state == types.MemberStateDead
+}
+
+func (f *FailureDetector) markAlive(endpointID ksuid.KSUID, incarnation uint64, now time.Time) {
+	state, ok := f.memberStateByEndpointID[endpointID]
+	if !ok || state.state == types.MemberStateDead {
+		return
+	}
+
+	state.lastAliveTimestamp = now
+
+	if incarnation > state.incarnation || (incarnation == state.incarnation && state.state == types.MemberStateSuspect) {
+		wasSuspect := state.state == types.MemberStateSuspect
+
+		state.state = types.MemberStateAlive
+		state.incarnation = incarnation
+
+		if wasSuspect {
+			log.Printf("no longer suspect: %v", endpointID)
+		}
+
+		f.enqueueGossip(&types.MemberUpdate{
+			EndpointID:  endpointID,
+			Incarnation: incarnation,
+			State:       types.MemberStateAlive,
+		})
+	}
+}
+
+// HandleAnnouncement treats an announcement as first-hand evidence that the member is alive at its incarnation
+func (f *FailureDetector) HandleAnnouncement(container *types.Container) {
+	if container.Announcement.Forwarded || container.SourceEndpointID == f.endpointID {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.getMemberState(container.SourceEndpointID)
+
+	f.markAlive(container.SourceEndpointID, container.Announcement.Incarnation, container.ReceivedTimestamp)
+}
+
+// HandleProbe handles a probe received on the unicast data listen address
+func (f *FailureDetector) HandleProbe(container *types.Container) {
+	now := time.Now()
+
+	// we only answer members we know how to reach
+	replyAddr := f.getListenAddr(container.SourceEndpointID)
+
+	toDeclareDead := make([]ksuid.KSUID, 0)
+
+	f.mu.Lock()
+
+	f.markAlive(container.SourceEndpointID, container.Probe.Incarnation, now)
+
+	for _, update := range container.Probe.Updates {
+		if f.applyUpdate(update, now) {
+			toDeclareDead = append(toDeclareDead, update.EndpointID)
+		}
+	}
+
+	var relayTo *pendingProbe
+
+	if container.Probe.Type == types.ProbeTypeAck {
+		pending, ok := f.pendingProbeBySequenceNumber[container.Probe.SequenceNumber]
+		if ok && pending.targetEndpointID == container.Probe.TargetEndpointID {
+			delete(f.pendingProbeBySequenceNumber, container.Probe.SequenceNumber)
+
+			if pending.requesterEndpointID != ksuid.Nil {
+				relayTo = pending
+			} else {
+				// an ack relayed by someone else is as good as one from the member itself
+				f.markAlive(pending.targetEndpointID, f.getMemberState(pending.targetEndpointID).incarnation, now)
+			}
+		}
+	}
+
+	f.mu.Unlock()
+
+	for _, endpointID := range toDeclareDead {
+		log.Printf("dead (gossip): %v", endpointID)
+		f.onDead(endpointID)
+	}
+
+	switch container.Probe.Type {
+	case types.ProbeTypePing:
+		if replyAddr == nil {
+			return
+		}
+
+		f.send(types.ProbeTypeAck, container.Probe.SequenceNumber, f.endpointID, nil, replyAddr)
+
+	case types.ProbeTypePingReq:
+		if container.Probe.TargetAddr == nil || replyAddr == nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.sequenceNumber++
+		sequenceNumber := f.sequenceNumber
+		f.pendingProbeBySequenceNumber[sequenceNumber] = &pendingProbe{
+			targetEndpointID:        container.Probe.TargetEndpointID,
+			targetAddr:              container.Probe.TargetAddr,
+			sentTimestamp:           now,
+			indirect:                true,
+			requesterEndpointID:     container.SourceEndpointID,
+			requesterAddr:           replyAddr,
+			requesterSequenceNumber: container.Probe.SequenceNumber,
+		}
+		f.mu.Unlock()
+
+		f.send(types.ProbeTypePing, sequenceNumber, container.Probe.TargetEndpointID, nil, container.Probe.TargetAddr)
+
+	case types.ProbeTypeAck:
+		if relayTo == nil {
+			return
+		}
+
+		f.send(types.ProbeTypeAck, relayTo.requesterSequenceNumber, relayTo.targetEndpointID, nil, relayTo.requesterAddr)
+	}
+}
+
+// getNextProbeTarget walks the members in a random order, reshuffling once they've all been probed
+func (f *FailureDetector) getNextProbeTarget(memberByEndpointID map[ksuid.KSUID]*types.Container) *types.Container {
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(f.probeOrder) > 0 {
+			endpointID := f.probeOrder[0]
+			f.probeOrder = f.probeOrder[1:]
+
+			member, ok := memberByEndpointID[endpointID]
+			if ok {
+				return member
+			}
+		}
+
+		for endpointID := range memberByEndpointID {
+			f.probeOrder = append(f.probeOrder, endpointID)
+		}
+
+		rand.Shuffle(len(f.probeOrder), func(i, j int) {
+			f.probeOrder[i], f.probeOrder[j] = f.probeOrder[j], f.probeOrder[i]
+		})
+	}
+
+	return nil
+}
+
+func (f *FailureDetector) work() {
+	now := time.Now()
+
+	memberByEndpointID := make(map[ksuid.KSUID]*types.Container)
+	for _, member := range f.getMembers() {
+		if member.SourceEndpointID == f.endpointID || member.Announcement.ListenAddr == nil {
+			continue
+		}
+
+		// second-hand members (via a registry or relay) may well not be reachable directly; their forwarder vouches for them
+		if member.Announcement.ForwardedBy != ksuid.Nil {
+			continue
+		}
+
+		memberByEndpointID[member.SourceEndpointID] = member
+	}
+
+	type send struct {
+		probeType        types.ProbeType
+		sequenceNumber   uint64
+		targetEndpointID ksuid.KSUID
+		targetAddr       *net.UDPAddr
+		dstAddr          *net.UDPAddr
+	}
+
+	toSend := make([]send, 0)
+	toDeclareDead := make([]ksuid.KSUID, 0)
+
+	f.mu.Lock()
+
+	for endpointID := range f.memberStateByEndpointID {
+		_, ok := memberByEndpointID[endpointID]
+		if !ok {
+			delete(f.memberStateByEndpointID, endpointID)
+		}
+	}
+
+	for endpointID := range memberByEndpointID {
+		f.getMemberState(endpointID)
+	}
+
+	directTimeout := f.rate / probeTicksPerPeriod
+
+	for sequenceNumber, pending := range f.pendingProbeBySequenceNumber {
+		age := now.Sub(pending.sentTimestamp)
+
+		if pending.requesterEndpointID != ksuid.Nil {
+			if age > f.rate {
+				delete(f.pendingProbeBySequenceNumber, sequenceNumber)
+			}
+
+			continue
+		}
+
+		// no ack directly; ask some others to try
+		if !pending.indirect && age > directTimeout {
+			pending.indirect = true
+
+			helpers := make([]*types.Container, 0)
+			for endpointID, member := range memberByEndpointID {
+				if endpointID == pending.targetEndpointID {
+					continue
+				}
+
+				if f.getMemberState(endpointID).state != types.MemberStateAlive {
+					continue
+				}
+
+				helpers = append(helpers, member)
+			}
+
+			rand.Shuffle(len(helpers), func(i, j int) {
+				helpers[i], helpers[j] = helpers[j], helpers[i]
+			})
+
+			if len(helpers) > indirectProbeCount {
+				helpers = helpers[:indirectProbeCount]
+			}
+
+			for _, helper := range helpers {
+				toSend = append(toSend, send{
+					probeType:        types.ProbeTypePingReq,
+					sequenceNumber:   sequenceNumber,
+					targetEndpointID: pending.targetEndpointID,
+					targetAddr:       pending.targetAddr,
+					dstAddr:          helper.Announcement.ListenAddr,
+				})
+			}
+
+			continue
+		}
+
+		if age <= f.rate {
+			continue
+		}
+
+		// no ack directly or indirectly by the end of the protocol period
+		delete(f.pendingProbeBySequenceNumber, sequenceNumber)
+
+		state, ok := f.memberStateByEndpointID[pending.targetEndpointID]
+		if !ok || state.state != types.MemberStateAlive {
+			continue
+		}
+
+		log.Printf("suspect: %v", pending.targetEndpointID)
+
+		f.applyUpdate(&types.MemberUpdate{
+			EndpointID:  pending.targetEndpointID,
+			Incarnation: state.incarnation,
+			State:       types.MemberStateSuspect,
+		}, now)
+	}
+
+	suspicionTimeout := f.getSuspicionTimeout(len(memberByEndpointID))
+
+	for endpointID, state := range f.memberStateByEndpointID {
+		if state.state != types.MemberStateSuspect || now.Sub(state.suspectedTimestamp) <= suspicionTimeout {
+			continue
+		}
+
+		if f.applyUpdate(&types.MemberUpdate{
+			EndpointID:  endpointID,
+			Incarnation: state.incarnation,
+			State:       types.MemberStateDead,
+		}, now) {
+			toDeclareDead = append(toDeclareDead, endpointID)
+		}
+	}
+
+	if now.Sub(f.lastProbeTimestamp) >= f.rate {
+		target := f.getNextProbeTarget(memberByEndpointID)
+		if target != nil {
+			f.lastProbeTimestamp = now
+			f.sequenceNumber++
+
+			f.pendingProbeBySequenceNumber[f.sequenceNumber] = &pendingProbe{
+				targetEndpointID: target.SourceEndpointID,
+				targetAddr:       target.Announcement.ListenAddr,
+				sentTimestamp:    now,
+			}
+
+			toSend = append(toSend, send{
+				probeType:        types.ProbeTypePing,
+				sequenceNumber:   f.sequenceNumber,
+				targetEndpointID: target.SourceEndpointID,
+				dstAddr:          target.Announcement.ListenAddr,
+			})
+		}
+	}
+
+	f.mu.Unlock()
+
+	for _, endpointID := range toDeclareDead {
+		log.Printf("dead (suspicion timeout): %v", endpointID)
+		f.onDead(endpointID)
+	}
+
+	for _, s := range toSend {
+		f.send(s.probeType, s.sequenceNumber, s.targetEndpointID, s.targetAddr, s.dstAddr)
+	}
+}
+
+func (f *FailureDetector) Start() {
+	f.scheduledWorker.Start()
+}
+
+func (f *FailureDetector) Stop() {
+	f.scheduledWorker.Stop()
+}
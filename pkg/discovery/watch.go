@@ -0,0 +1,244 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/initialed85/glue/pkg/types"
+)
+
+type EventType int
+
+const (
+	EventTypeAdded EventType = iota
+	EventTypeUpdated
+	EventTypeRemoved
+	EventTypeConflict
+	EventTypePartitionSuspected
+	EventTypePartitionHealed
+	EventTypeNetworkChanged
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventTypeAdded:
+		return "added"
+	case EventTypeUpdated:
+		return "updated"
+	case EventTypeRemoved:
+		return "removed"
+	case EventTypeConflict:
+		return "conflict"
+	case EventTypePartitionSuspected:
+		return "partition suspected"
+	case EventTypePartitionHealed:
+		return "partition healed"
+	case EventTypeNetworkChanged:
+		return "network changed"
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// Event is a change in membership; Container is the latest announcement for the endpoint in question (for a removal,
+// the last one we had) and is nil for a partition or a change to our own interfaces / addresses
+type Event struct {
+	Type      EventType
+	Container *types.Container
+
+	// part of the initial snapshot given to a new watcher (rather than something that just happened)
+	Snapshot bool
+
+	// for a conflict; the endpoint that lost its claim on Container.SourceEndpointName to Container
+	Loser *types.Container
+
+	// for a partition; the endpoints on the other side of it when suspected (the last announcement we had for each) and
+	// those that came back when healed
+	Endpoints []*types.Container
+}
+
+func (e Event) String() string {
+	snapshot := ""
+	if e.Snapshot {
+		snapshot = " (snapshot)"
+	}
+
+	if e.Container == nil {
+		return fmt.Sprintf("Event[%v%v; %v endpoint(s)]", e.Type, snapshot, len(e.Endpoints))
+	}
+
+	return fmt.Sprintf("Event[%v%v; %v]", e.Type, snapshot, e.Container.String())
+}
+
+// watcherQueueLimit is how many events (beyond the initial snapshot) a watcher may have waiting for its consumer; past
+// that the consumer has fallen too far behind to catch up and the watcher is closed (so the consumer can tell, and
+// Watch again for a fresh snapshot)
+const watcherQueueLimit = 65536
+
+// isAnnouncementChanged is true if the announcement says something different about the endpoint (rather than just being
+// a more recent copy); the volatile fields aren't considered (SentRate changes as an endpoint backs off from its burst
+// rate, what an endpoint knows about changes with everybody else, and Forwarded / ForwardedBy depend on the way the
+// announcement reached us rather than on the endpoint)
+func isAnnouncementChanged(a *types.Container, b *types.Container) bool {
+	return a.SourceEndpointName != b.SourceEndpointName ||
+		a.Announcement.ListenPort != b.Announcement.ListenPort ||
+		a.Announcement.ListenAddr.String() != b.Announcement.ListenAddr.String() ||
+		a.Announcement.DiscoveryListenAddress != b.Announcement.DiscoveryListenAddress ||
+		a.Announcement.DiscoveryListenAddr.String() != b.Announcement.DiscoveryListenAddr.String() ||
+		a.Announcement.DiscoveryTargetAddress != b.Announcement.DiscoveryTargetAddress ||
+		a.Announcement.DiscoveryTargetAddr.String() != b.Announcement.DiscoveryTargetAddr.String() ||
+		a.Announcement.Registry != b.Announcement.Registry ||
+		a.Announcement.Withdrawn != b.Announcement.Withdrawn ||
+		a.Announcement.Incarnation != b.Announcement.Incarnation ||
+		a.Announcement.Priority != b.Announcement.Priority ||
+		a.Announcement.HostID != b.Announcement.HostID ||
+		a.Announcement.LocalAddress != b.Announcement.LocalAddress ||
+		a.Announcement.StreamAddress != b.Announcement.StreamAddress
+}
+
+// watcher buffers events for a single Watch call so that a slow consumer never holds up discovery (or other watchers)
+type watcher struct {
+	mu     sync.Mutex
+	queue  []Event
+	limit  int
+	notify chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newWatcher(snapshot []Event) *watcher {
+	w := watcher{
+		queue:  snapshot,
+		limit:  len(snapshot) + watcherQueueLimit,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	return &w
+}
+
+func (w *watcher) push(event Event) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	w.mu.Lock()
+
+	if len(w.queue) >= w.limit {
+		w.mu.Unlock()
+
+		log.Printf("warning: closing watcher with %v events waiting; its consumer has fallen too far behind", w.limit)
+		w.close()
+
+		return
+	}
+
+	w.queue = append(w.queue, event)
+
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pop() []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := w.queue
+	w.queue = make([]Event, 0)
+
+	return events
+}
+
+func (w *watcher) close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *watcher) run(ctx context.Context, events chan Event) {
+	defer close(events)
+
+	for {
+		for _, event := range w.pop() {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			case <-w.done:
+				return
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) publish(eventType EventType, container *types.Container) {
+	for w := range m.watchers {
+		w.push(Event{
+			Type:      eventType,
+			Container: container,
+		})
+	}
+}
+
+// Watch returns a channel of membership events, in the order they happened, starting with an Added event (flagged as
+// Snapshot) for every endpoint already known; the channel is closed when the context is done, the Manager is stopped or
+// the consumer falls so far behind that events would have to be dropped (see watcherQueueLimit)
+func (m *Manager) Watch(ctx context.Context) <-chan Event {
+	events := make(chan Event)
+
+	m.mu.Lock()
+
+	snapshot := make([]Event, 0)
+	for _, container := range m.lastAnnouncementContainerByEndpointID {
+		if container.SourceEndpointID == m.endpointID {
+			continue
+		}
+
+		snapshot = append(snapshot, Event{
+			Type:      EventTypeAdded,
+			Container: container,
+			Snapshot:  true,
+		})
+	}
+
+	w := newWatcher(snapshot)
+	m.watchers[w] = struct{}{}
+
+	m.mu.Unlock()
+
+	go func() {
+		w.run(ctx, events)
+
+		m.mu.Lock()
+		delete(m.watchers, w)
+		m.mu.Unlock()
+	}()
+
+	return events
+}
+
+func (m *Manager) closeWatchers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for w := range m.watchers {
+		w.close()
+	}
+}
@@ -0,0 +1,314 @@
+package dissect
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/initialed85/glue/pkg/fragmentation"
+	"github.com/initialed85/glue/pkg/serialization"
+	"github.com/initialed85/glue/pkg/topics"
+	"github.com/initialed85/glue/pkg/types"
+)
+
+const timestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Datagram is a UDP datagram as seen on the wire (or in a capture)
+type Datagram struct {
+	Timestamp time.Time
+	SrcAddr   *net.UDPAddr
+	DstAddr   *net.UDPAddr
+	Data      []byte
+}
+
+// Filter narrows down what gets printed; the zero value lets everything through
+type Filter struct {
+	// only datagrams to or from these ports
+	Ports []int
+
+	// only containers from or to this endpoint (name or ID) and messages from it
+	Endpoint string
+
+	// only messages on this topic (and none of the containers that carried them)
+	Topic string
+}
+
+func (f *Filter) matchesPorts(datagram *Datagram) bool {
+	if len(f.Ports) == 0 {
+		return true
+	}
+
+	return slices.Contains(f.Ports, datagram.SrcAddr.Port) || slices.Contains(f.Ports, datagram.DstAddr.Port)
+}
+
+func (f *Filter) matchesEndpoint(endpointName string, endpointID ksuid.KSUID) bool {
+	if f.Endpoint == "" {
+		return true
+	}
+
+	return endpointName == f.Endpoint || (endpointID != ksuid.Nil && endpointID.String() == f.Endpoint)
+}
+
+func (f *Filter) matchesContainer(container *types.Container) bool {
+	if f.matchesEndpoint(container.SourceEndpointName, container.SourceEndpointID) {
+		return true
+	}
+
+	if container.Frame != nil {
+		return f.matchesEndpoint(container.Frame.DestinationEndpointName, container.Frame.DestinationEndpointID)
+	}
+
+	return false
+}
+
+type fragments struct {
+	firstSeen              time.Time
+	payloadByFragmentIndex map[int64][]byte
+}
+
+// Dissector pretty-prints the glue containers in datagrams and, once all the fragments of one have turned up, the
+// topics.Message they carry
+type Dissector struct {
+	mu                     sync.Mutex
+	w                      io.Writer
+	filter                 Filter
+	fragmentsByCorrelation map[ksuid.KSUID]*fragments
+}
+
+func NewDissector(
+	w io.Writer,
+	filter Filter,
+) *Dissector {
+	d := Dissector{
+		w:                      w,
+		filter:                 filter,
+		fragmentsByCorrelation: make(map[ksuid.KSUID]*fragments),
+	}
+
+	return &d
+}
+
+// Handle dissects a datagram; anything that isn't a glue container is skipped
+func (d *Dissector) Handle(datagram *Datagram) {
+	if !d.filter.matchesPorts(datagram) {
+		return
+	}
+
+	container, err := serialization.Deserialize(datagram.Data)
+	if err != nil || (container.Announcement == nil && container.Frame == nil && container.Probe == nil) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	containerMatches := d.filter.matchesContainer(container)
+
+	if containerMatches && d.filter.Topic == "" {
+		d.printf("%v %v -> %v %v", formatTimestamp(datagram.Timestamp), datagram.SrcAddr, datagram.DstAddr, FormatContainer(container))
+	}
+
+	if container.Frame == nil || container.Frame.IsAck {
+		return
+	}
+
+	payload := d.reassemble(datagram.Timestamp, container.Frame)
+	if payload == nil {
+		return
+	}
+
+	var message topics.Message
+
+	err = msgpack.Unmarshal(payload, &message)
+	if err != nil {
+		if containerMatches && d.filter.Topic == "" {
+			d.printf("    payload of %v bytes isn't a topics message: %v", len(payload), err)
+		}
+
+		return
+	}
+
+	if !containerMatches && !d.filter.matchesEndpoint(message.EndpointName, message.EndpointID) {
+		return
+	}
+
+	if d.filter.Topic != "" && message.TopicName != d.filter.Topic {
+		return
+	}
+
+	if d.filter.Topic != "" {
+		d.printf("%v %v -> %v %v", formatTimestamp(datagram.Timestamp), datagram.SrcAddr, datagram.DstAddr, FormatMessage(&message))
+	} else {
+		d.printf("    %v", FormatMessage(&message))
+	}
+}
+
+// reassemble keeps a frame's payload and returns the whole payload if that was the last fragment missing
+func (d *Dissector) reassemble(timestamp time.Time, frame *types.Frame) []byte {
+	if frame.FragmentCount <= 1 {
+		return frame.Payload
+	}
+
+	for correlationID, otherFragments := range d.fragmentsByCorrelation {
+		if timestamp.Sub(otherFragments.firstSeen) > FragmentExpiry {
+			delete(d.fragmentsByCorrelation, correlationID)
+		}
+	}
+
+	thisFragments, ok := d.fragmentsByCorrelation[frame.CorrelationID]
+	if !ok {
+		thisFragments = &fragments{
+			firstSeen:              timestamp,
+			payloadByFragmentIndex: make(map[int64][]byte),
+		}
+
+		d.fragmentsByCorrelation[frame.CorrelationID] = thisFragments
+	}
+
+	thisFragments.payloadByFragmentIndex[frame.FragmentIndex] = frame.Payload
+
+	if int64(len(thisFragments.payloadByFragmentIndex)) < frame.FragmentCount {
+		return nil
+	}
+
+	delete(d.fragmentsByCorrelation, frame.CorrelationID)
+
+	payloads := make([][]byte, 0, frame.FragmentCount)
+	for i := int64(0); i < frame.FragmentCount; i++ {
+		payload, ok := thisFragments.payloadByFragmentIndex[i]
+		if !ok {
+			return nil
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	payload, err := fragmentation.Defragment(payloads)
+	if err != nil {
+		return nil
+	}
+
+	return payload
+}
+
+func (d *Dissector) printf(format string, a ...any) {
+	_, _ = fmt.Fprintf(d.w, format+"\n", a...)
+}
+
+func formatTimestamp(timestamp time.Time) string {
+	if timestamp.IsZero() {
+		return "-"
+	}
+
+	return timestamp.UTC().Format(timestampFormat)
+}
+
+// FormatContainer is a one-line (if long) description of everything interesting in a container
+func FormatContainer(container *types.Container) string {
+	parts := []string{
+		fmt.Sprintf("network=%v", container.NetworkID),
+		fmt.Sprintf("from=%v (%v)", container.SourceEndpointName, container.SourceEndpointID),
+	}
+
+	if container.Announcement != nil {
+		announcement := container.Announcement
+
+		kind := "announcement"
+		if announcement.Withdrawn {
+			kind = "announcement (withdrawn)"
+		} else if announcement.Registry {
+			kind = "announcement (registry)"
+		}
+
+		parts = append([]string{kind}, parts...)
+		parts = append(
+			parts,
+			fmt.Sprintf("listen_port=%v", announcement.ListenPort),
+			fmt.Sprintf("rate=%v", announcement.SentRate),
+			fmt.Sprintf("incarnation=%v", announcement.Incarnation),
+		)
+
+		if announcement.Forwarded {
+			parts = append(parts, fmt.Sprintf("forwarded_by=%v", announcement.ForwardedBy))
+		}
+
+		if announcement.StreamAddress != "" {
+			parts = append(parts, fmt.Sprintf("stream=%v", announcement.StreamAddress))
+		}
+
+		if announcement.HostID != "" {
+			parts = append(parts, fmt.Sprintf("host=%v", announcement.HostID))
+		}
+	} else if container.Frame != nil {
+		frame := container.Frame
+
+		kind := "frame"
+		if frame.IsAck {
+			kind = "ack"
+		}
+
+		parts = append([]string{fmt.Sprintf("%v %v/%v", kind, frame.FragmentIndex+1, frame.FragmentCount)}, parts...)
+		parts = append(
+			parts,
+			fmt.Sprintf("to=%v (%v)", frame.DestinationEndpointName, frame.DestinationEndpointID),
+			fmt.Sprintf("frame=%v", frame.FrameID),
+			fmt.Sprintf("correlation=%v", frame.CorrelationID),
+			fmt.Sprintf("needs_ack=%v", frame.NeedsAck),
+			fmt.Sprintf("payload=%v bytes", len(frame.Payload)),
+		)
+	} else if container.Probe != nil {
+		probe := container.Probe
+
+		parts = append([]string{fmt.Sprintf("probe %v", probe.Type)}, parts...)
+		parts = append(
+			parts,
+			fmt.Sprintf("sequence=%v", probe.SequenceNumber),
+			fmt.Sprintf("incarnation=%v", probe.Incarnation),
+		)
+
+		if probe.TargetEndpointID != ksuid.Nil {
+			parts = append(parts, fmt.Sprintf("target=%v @ %v", probe.TargetEndpointID, probe.TargetAddress))
+		}
+
+		parts = append(parts, fmt.Sprintf("updates=%v", len(probe.Updates)))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// FormatMessage is a one-line description of a (reassembled) topics.Message
+func FormatMessage(message *topics.Message) string {
+	kind := fmt.Sprintf("%v", message.MessageType)
+
+	switch message.MessageType {
+	case topics.StandardMessageType:
+		kind = "standard"
+	case topics.ForwardedMessageType:
+		kind = "forwarded"
+	case topics.LateJoinerMessagesRequestType:
+		kind = "late joiner request"
+	case topics.LateJoinerMessagesResponseType:
+		kind = "late joiner response"
+	case topics.InterestMessageType:
+		kind = "interest"
+	}
+
+	return fmt.Sprintf(
+		"message %v topic=%v type=%v from=%v (%v) sequence=%v expiry=%v payload=%v bytes",
+		kind,
+		message.TopicName,
+		message.TopicType,
+		message.EndpointName,
+		message.EndpointID,
+		message.SequenceNumber,
+		message.Expiry,
+		len(message.Payload),
+	)
+}
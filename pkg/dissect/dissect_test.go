@@ -0,0 +1,217 @@
+package dissect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/initialed85/glue/pkg/fragmentation"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
+	"github.com/initialed85/glue/pkg/topics"
+	"github.com/initialed85/glue/pkg/types"
+)
+
+var (
+	endpointID1 = ksuid.New()
+	endpointID2 = ksuid.New()
+	srcAddr, _  = net.ResolveUDPAddr("udp4", "192.168.1.2:27321")
+	dstAddr, _  = net.ResolveUDPAddr("udp4", "192.168.1.3:27322")
+	groupAddr   = &net.UDPAddr{IP: net.ParseIP("239.192.137.1"), Port: 27320}
+)
+
+// getDatagrams is an announcement and then a message on some_topic in 3 fragments (and an ack for the last one)
+func getDatagrams(t *testing.T) [][]byte {
+	datagrams := make([][]byte, 0)
+
+	add := func(container *types.Container) {
+		data, err := serialization.Serialize(container)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		datagrams = append(datagrams, data)
+	}
+
+	add(types.GetAnnouncementContainer(time.Now(), srcAddr.String(), 1, endpointID1, "endpoint-1", time.Second, groupAddr, groupAddr, srcAddr))
+
+	payload, err := msgpack.Marshal(topics.Message{
+		EndpointID:     endpointID1,
+		EndpointName:   "endpoint-1",
+		SequenceNumber: 42,
+		TopicName:      "some_topic",
+		TopicType:      "some_type",
+		MessageType:    topics.StandardMessageType,
+		Payload:        bytes.Repeat([]byte("Hello, world!"), 1000),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fragments, err := fragmentation.Fragment(payload, 5000)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Equal(t, 3, len(fragments))
+
+	correlationID := ksuid.New()
+
+	for i, fragment := range fragments {
+		add(types.GetFrameContainer(time.Second, time.Second, 1, endpointID1, "endpoint-1", correlationID, int64(len(fragments)), int64(i), endpointID2, "endpoint-2", true, false, fragment))
+	}
+
+	add(types.GetFrameContainer(time.Second, time.Second, 1, endpointID2, "endpoint-2", correlationID, int64(len(fragments)), 2, endpointID1, "endpoint-1", false, true, []byte{}))
+
+	return datagrams
+}
+
+func dissectCapture(t *testing.T, path string, filter Filter) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	output := bytes.NewBuffer(nil)
+
+	err = ReadCapture(file, NewDissector(output, filter).Handle)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSpace(output.String()), "\n")
+}
+
+func TestDissector_Pcapng(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glue.pcapng")
+
+	capture := network.NewCapture(path, 0, serialization.Describe)
+
+	err := capture.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	datagrams := getDatagrams(t)
+
+	capture.Write(network.CaptureOutbound, srcAddr, groupAddr, datagrams[0])
+	for _, datagram := range datagrams[1:4] {
+		capture.Write(network.CaptureOutbound, srcAddr, dstAddr, datagram)
+	}
+	capture.Write(network.CaptureInbound, dstAddr, srcAddr, datagrams[4])
+
+	capture.Write(network.CaptureInbound, dstAddr, srcAddr, []byte("not glue"))
+
+	capture.Close()
+
+	lines := dissectCapture(t, path, Filter{})
+	assert.Equal(t, 6, len(lines))
+	assert.Contains(t, lines[0], "192.168.1.2:27321 -> 239.192.137.1:27320 announcement network=1 from=endpoint-1")
+	assert.Contains(t, lines[1], "192.168.1.2:27321 -> 192.168.1.3:27322 frame 1/3 network=1 from=endpoint-1")
+	assert.Contains(t, lines[3], "frame 3/3")
+	assert.Contains(t, lines[4], "message standard topic=some_topic type=some_type from=endpoint-1")
+	assert.Contains(t, lines[4], "sequence=42")
+	assert.Contains(t, lines[4], "payload=13000 bytes")
+	assert.Contains(t, lines[5], "192.168.1.3:27322 -> 192.168.1.2:27321 ack 3/3 network=1 from=endpoint-2")
+
+	lines = dissectCapture(t, path, Filter{Topic: "some_topic"})
+	assert.Equal(t, 1, len(lines))
+	assert.Contains(t, lines[0], "192.168.1.2:27321 -> 192.168.1.3:27322 message standard topic=some_topic")
+
+	lines = dissectCapture(t, path, Filter{Topic: "other_topic"})
+	assert.Equal(t, []string{""}, lines)
+
+	lines = dissectCapture(t, path, Filter{Endpoint: endpointID2.String(), Ports: []int{27322}})
+	assert.Equal(t, 5, len(lines))
+	assert.Contains(t, lines[0], "frame 1/3")
+}
+
+// getEthernetIPv4Fragments is a UDP datagram in Ethernet frames, split into IP fragments of (at most) size
+func getEthernetIPv4Fragments(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte, size int) [][]byte {
+	udp := make([]byte, 0)
+	udp = binary.BigEndian.AppendUint16(udp, uint16(srcAddr.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dstAddr.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(8+len(data)))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, data...)
+
+	frames := make([][]byte, 0)
+
+	for offset := 0; offset < len(udp); offset += size {
+		end := offset + size
+		flagsAndOffset := uint16(0x2000 | offset/8)
+		if end >= len(udp) {
+			end = len(udp)
+			flagsAndOffset = uint16(offset / 8)
+		}
+
+		frame := make([]byte, 12)
+		frame = binary.BigEndian.AppendUint16(frame, 0x0800)
+		frame = append(frame, 0x45, 0)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(20+end-offset))
+		frame = binary.BigEndian.AppendUint16(frame, 1234)
+		frame = binary.BigEndian.AppendUint16(frame, flagsAndOffset)
+		frame = append(frame, 64, 17, 0, 0)
+		frame = append(frame, srcAddr.IP.To4()...)
+		frame = append(frame, dstAddr.IP.To4()...)
+		frame = append(frame, udp[offset:end]...)
+
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
+
+func TestDissector_PcapIPFragments(t *testing.T) {
+	datagrams := getDatagrams(t)
+
+	// a classic (tcpdump) capture of Ethernet frames, in which the 5 KB glue fragments are IP fragments on a 1500 byte MTU
+	capture := make([]byte, 0)
+	capture = binary.LittleEndian.AppendUint32(capture, 0xA1B2C3D4)
+	capture = binary.LittleEndian.AppendUint16(capture, 2)
+	capture = binary.LittleEndian.AppendUint16(capture, 4)
+	capture = append(capture, make([]byte, 8)...)
+	capture = binary.LittleEndian.AppendUint32(capture, 65535)
+	capture = binary.LittleEndian.AppendUint32(capture, 1)
+
+	// out of order, as they might be on the wire
+	frames := make([][]byte, 0)
+	for _, datagram := range datagrams[1:4] {
+		fragments := getEthernetIPv4Fragments(srcAddr, dstAddr, datagram, 1480)
+		frames = append(frames, fragments[len(fragments)-1])
+		frames = append(frames, fragments[:len(fragments)-1]...)
+	}
+
+	for i, frame := range frames {
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(1700000000+i))
+		capture = binary.LittleEndian.AppendUint32(capture, 0)
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(len(frame)))
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(len(frame)))
+		capture = append(capture, frame...)
+	}
+
+	path := filepath.Join(t.TempDir(), "glue.pcap")
+
+	err := os.WriteFile(path, capture, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lines := dissectCapture(t, path, Filter{Topic: "some_topic"})
+	assert.Equal(t, 1, len(lines))
+	assert.Contains(t, lines[0], "192.168.1.2:27321 -> 192.168.1.3:27322 message standard topic=some_topic")
+}
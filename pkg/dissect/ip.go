@@ -0,0 +1,219 @@
+package dissect
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+)
+
+// FragmentExpiry is how long (in capture time) we hang on to part of an IP packet or a glue message waiting for the rest
+const FragmentExpiry = time.Second * 30
+
+const protocolUDP = 17
+
+type ipFragmentKey struct {
+	srcIP          string
+	dstIP          string
+	identification uint32
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+type ipFragments struct {
+	firstSeen time.Time
+	fragments []ipFragment
+	length    int // known once the last fragment turns up
+}
+
+// reassembler puts IP fragments (e.g. of glue's 8 KiB topic fragments on a 1500 byte MTU) back together
+type reassembler struct {
+	fragmentsByKey map[ipFragmentKey]*ipFragments
+}
+
+func newReassembler() *reassembler {
+	r := reassembler{
+		fragmentsByKey: make(map[ipFragmentKey]*ipFragments),
+	}
+
+	return &r
+}
+
+// getDatagram is the UDP datagram in a captured frame; nil if it isn't one (or it's a fragment of one we don't have all
+// of yet)
+func (r *reassembler) getDatagram(timestamp time.Time, linkType int, data []byte) *Datagram {
+	packet := getIPPacket(linkType, data)
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		return r.getIPv4Datagram(timestamp, packet)
+	case 6:
+		return r.getIPv6Datagram(timestamp, packet)
+	}
+
+	return nil
+}
+
+func (r *reassembler) getIPv4Datagram(timestamp time.Time, packet []byte) *Datagram {
+	if len(packet) < 20 {
+		return nil
+	}
+
+	headerLength := int(packet[0]&0x0F) * 4
+	totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLength < 20 || totalLength < headerLength || totalLength > len(packet) {
+		return nil
+	}
+
+	if packet[9] != protocolUDP {
+		return nil
+	}
+
+	srcIP := net.IP(append([]byte{}, packet[12:16]...))
+	dstIP := net.IP(append([]byte{}, packet[16:20]...))
+
+	payload := packet[headerLength:totalLength]
+
+	flagsAndOffset := binary.BigEndian.Uint16(packet[6:8])
+	moreFragments := flagsAndOffset&0x2000 != 0
+	offset := int(flagsAndOffset&0x1FFF) * 8
+
+	if moreFragments || offset != 0 {
+		key := ipFragmentKey{
+			srcIP:          srcIP.String(),
+			dstIP:          dstIP.String(),
+			identification: uint32(binary.BigEndian.Uint16(packet[4:6])),
+		}
+
+		payload = r.add(timestamp, key, offset, payload, moreFragments)
+		if payload == nil {
+			return nil
+		}
+	}
+
+	return getUDPDatagram(timestamp, srcIP, dstIP, payload)
+}
+
+func (r *reassembler) getIPv6Datagram(timestamp time.Time, packet []byte) *Datagram {
+	if len(packet) < 40 {
+		return nil
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+	if 40+payloadLength > len(packet) {
+		return nil
+	}
+
+	srcIP := net.IP(append([]byte{}, packet[8:24]...))
+	dstIP := net.IP(append([]byte{}, packet[24:40]...))
+
+	nextHeader := packet[6]
+	payload := packet[40 : 40+payloadLength]
+
+	for {
+		switch nextHeader {
+		case protocolUDP:
+			return getUDPDatagram(timestamp, srcIP, dstIP, payload)
+
+		case 0, 43, 60: // hop-by-hop options, routing, destination options
+			if len(payload) < 8 {
+				return nil
+			}
+
+			length := (int(payload[1]) + 1) * 8
+			if length > len(payload) {
+				return nil
+			}
+
+			nextHeader = payload[0]
+			payload = payload[length:]
+
+		case 44: // fragment
+			if len(payload) < 8 {
+				return nil
+			}
+
+			nextHeader = payload[0]
+			offsetAndFlags := binary.BigEndian.Uint16(payload[2:4])
+
+			key := ipFragmentKey{
+				srcIP:          srcIP.String(),
+				dstIP:          dstIP.String(),
+				identification: binary.BigEndian.Uint32(payload[4:8]),
+			}
+
+			payload = r.add(timestamp, key, int(offsetAndFlags&0xFFF8), payload[8:], offsetAndFlags&0x0001 != 0)
+			if payload == nil {
+				return nil
+			}
+
+		default:
+			return nil
+		}
+	}
+}
+
+// add keeps a fragment and returns the whole payload if that was the last piece missing
+func (r *reassembler) add(timestamp time.Time, key ipFragmentKey, offset int, data []byte, moreFragments bool) []byte {
+	for otherKey, fragments := range r.fragmentsByKey {
+		if timestamp.Sub(fragments.firstSeen) > FragmentExpiry {
+			delete(r.fragmentsByKey, otherKey)
+		}
+	}
+
+	fragments, ok := r.fragmentsByKey[key]
+	if !ok {
+		fragments = &ipFragments{
+			firstSeen: timestamp,
+			length:    -1,
+		}
+
+		r.fragmentsByKey[key] = fragments
+	}
+
+	fragments.fragments = append(fragments.fragments, ipFragment{
+		offset: offset,
+		data:   append([]byte{}, data...),
+	})
+
+	if !moreFragments {
+		fragments.length = offset + len(data)
+	}
+
+	if fragments.length < 0 {
+		return nil
+	}
+
+	sort.Slice(fragments.fragments, func(i, j int) bool {
+		return fragments.fragments[i].offset < fragments.fragments[j].offset
+	})
+
+	payload := make([]byte, fragments.length)
+
+	covered := 0
+	for _, fragment := range fragments.fragments {
+		if fragment.offset > covered {
+			return nil
+		}
+
+		copy(payload[fragment.offset:], fragment.data)
+
+		if fragment.offset+len(fragment.data) > covered {
+			covered = fragment.offset + len(fragment.data)
+		}
+	}
+
+	if covered < fragments.length {
+		return nil
+	}
+
+	delete(r.fragmentsByKey, key)
+
+	return payload
+}
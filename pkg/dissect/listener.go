@@ -0,0 +1,227 @@
+package dissect
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+// Listener sees UDP datagrams arriving at this host without getting in their way (via raw sockets, which get a copy of
+// everything; so it needs root or CAP_NET_RAW); it only sees what's delivered to this host, so it joins any multicast
+// groups it's given (e.g. the discovery address) in case nothing else on the host has
+type Listener struct {
+	interfaceName string
+	groupAddrs    []*net.UDPAddr
+	handle        func(*Datagram)
+	mu            sync.Mutex
+	conn4         *ipv4.RawConn
+	conn6         *ipv6.PacketConn
+	workers       []*worker.BlockedWorker
+}
+
+func NewListener(
+	interfaceName string,
+	groupAddrs []*net.UDPAddr,
+	handle func(*Datagram),
+) *Listener {
+	l := Listener{
+		interfaceName: interfaceName,
+		groupAddrs:    groupAddrs,
+		handle:        handle,
+	}
+
+	return &l
+}
+
+func (l *Listener) open() error {
+	var intfc *net.Interface
+
+	if l.interfaceName != "" {
+		var err error
+
+		intfc, err = net.InterfaceByName(l.interfaceName)
+		if err != nil {
+			return fmt.Errorf("failed to get interface because %v", err)
+		}
+	}
+
+	packetConn, err := net.ListenPacket("ip4:udp", "0.0.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to open raw IPv4 socket (needs root or CAP_NET_RAW) because %v", err)
+	}
+
+	l.conn4, err = ipv4.NewRawConn(packetConn)
+	if err != nil {
+		_ = packetConn.Close()
+		return fmt.Errorf("failed to open raw IPv4 socket because %v", err)
+	}
+
+	// IPv6 is a nice-to-have (e.g. it may be disabled)
+	packetConn, err = net.ListenPacket("ip6:udp", "::")
+	if err != nil {
+		log.Printf("warning: failed to open raw IPv6 socket; only IPv4 will be seen: %v", err)
+	} else {
+		l.conn6 = ipv6.NewPacketConn(packetConn)
+
+		err = l.conn6.SetControlMessage(ipv6.FlagDst, true)
+		if err != nil {
+			log.Printf("warning: failed to ask for IPv6 destination addresses: %v", err)
+		}
+	}
+
+	for _, groupAddr := range l.groupAddrs {
+		if !groupAddr.IP.IsMulticast() {
+			continue
+		}
+
+		group := &net.UDPAddr{IP: groupAddr.IP}
+
+		if network.GetNetwork(groupAddr.String()) == network.UDPv6 {
+			if l.conn6 != nil {
+				err = l.conn6.JoinGroup(intfc, group)
+			}
+		} else {
+			err = l.conn4.JoinGroup(intfc, group)
+		}
+		if err != nil {
+			log.Printf("warning: failed to join multicast group %v: %v", groupAddr.String(), err)
+		}
+	}
+
+	return nil
+}
+
+func (l *Listener) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn4 != nil {
+		return fmt.Errorf("cannot open, already opened")
+	}
+
+	err := l.open()
+	if err != nil {
+		l.close()
+		return err
+	}
+
+	l.workers = append(l.workers, worker.NewBlockedWorker(func() {}, l.work4, func() {}))
+
+	if l.conn6 != nil {
+		l.workers = append(l.workers, worker.NewBlockedWorker(func() {}, l.work6, func() {}))
+	}
+
+	for _, thisWorker := range l.workers {
+		thisWorker.Start()
+	}
+
+	return nil
+}
+
+func (l *Listener) work4() {
+	l.mu.Lock()
+	conn := l.conn4
+	l.mu.Unlock()
+
+	if conn == nil {
+		time.Sleep(network.Timeout)
+		return
+	}
+
+	err := conn.SetReadDeadline(time.Now().Add(network.Timeout))
+	if err != nil {
+		return
+	}
+
+	b := make([]byte, network.MaxDatagramSize+8)
+
+	// the kernel has already put any IP fragments back together
+	header, payload, _, err := conn.ReadFrom(b)
+	if err != nil {
+		if !strings.Contains(err.Error(), "timeout") && !strings.Contains(err.Error(), "closed") {
+			log.Printf("warning: listener had error trying to read: %v", err)
+		}
+		return
+	}
+
+	datagram := getUDPDatagram(time.Now(), header.Src, header.Dst, payload)
+	if datagram != nil {
+		l.handle(datagram)
+	}
+}
+
+func (l *Listener) work6() {
+	l.mu.Lock()
+	conn := l.conn6
+	l.mu.Unlock()
+
+	if conn == nil {
+		time.Sleep(network.Timeout)
+		return
+	}
+
+	err := conn.SetReadDeadline(time.Now().Add(network.Timeout))
+	if err != nil {
+		return
+	}
+
+	b := make([]byte, network.MaxDatagramSize+8)
+
+	n, cm, srcAddr, err := conn.ReadFrom(b)
+	if err != nil {
+		if !strings.Contains(err.Error(), "timeout") && !strings.Contains(err.Error(), "closed") {
+			log.Printf("warning: listener had error trying to read: %v", err)
+		}
+		return
+	}
+
+	var dstIP net.IP
+	if cm != nil {
+		dstIP = cm.Dst
+	}
+
+	ipAddr, ok := srcAddr.(*net.IPAddr)
+	if !ok {
+		return
+	}
+
+	datagram := getUDPDatagram(time.Now(), ipAddr.IP, dstIP, b[:n])
+	if datagram != nil {
+		l.handle(datagram)
+	}
+}
+
+func (l *Listener) close() {
+	if l.conn4 != nil {
+		_ = l.conn4.Close()
+	}
+
+	if l.conn6 != nil {
+		_ = l.conn6.Close()
+	}
+
+	l.conn4 = nil
+	l.conn6 = nil
+}
+
+func (l *Listener) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, thisWorker := range l.workers {
+		thisWorker.Stop()
+	}
+
+	l.workers = nil
+
+	l.close()
+}
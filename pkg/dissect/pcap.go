@@ -0,0 +1,360 @@
+package dissect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// link types we know how to get an IP packet out of (see https://www.tcpdump.org/linktypes.html)
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+// pcapng block types and options we care about
+const (
+	pcapngSectionHeaderBlock   = 0x0A0D0D0A
+	pcapngInterfaceDescription = 0x00000001
+	pcapngSimplePacketBlock    = 0x00000003
+	pcapngEnhancedPacketBlock  = 0x00000006
+	pcapngByteOrderMagic       = 0x1A2B3C4D
+	pcapngOptEndOfOpt          = 0
+	pcapngOptIFTSResol         = 9
+)
+
+// ReadCapture reads a pcap or pcapng capture (e.g. from tcpdump, Wireshark or network.Capture) and hands on every UDP
+// datagram in it (IP fragments reassembled); anything that isn't UDP over IP is skipped
+func ReadCapture(r io.Reader, handle func(*Datagram)) error {
+	reader := bufio.NewReader(r)
+
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return fmt.Errorf("failed to read capture header because %v", err)
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeaderBlock {
+		return readPcapng(reader, handle)
+	}
+
+	return readPcap(reader, handle)
+}
+
+func readPcap(r io.Reader, handle func(*Datagram)) error {
+	header := make([]byte, 24)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return fmt.Errorf("failed to read pcap header because %v", err)
+	}
+
+	var byteOrder binary.ByteOrder
+	var resolution time.Duration
+
+	switch {
+	case binary.LittleEndian.Uint32(header[0:4]) == 0xA1B2C3D4:
+		byteOrder, resolution = binary.LittleEndian, time.Microsecond
+	case binary.BigEndian.Uint32(header[0:4]) == 0xA1B2C3D4:
+		byteOrder, resolution = binary.BigEndian, time.Microsecond
+	case binary.LittleEndian.Uint32(header[0:4]) == 0xA1B23C4D:
+		byteOrder, resolution = binary.LittleEndian, time.Nanosecond
+	case binary.BigEndian.Uint32(header[0:4]) == 0xA1B23C4D:
+		byteOrder, resolution = binary.BigEndian, time.Nanosecond
+	default:
+		return fmt.Errorf("not a pcap or pcapng capture (magic %x)", header[0:4])
+	}
+
+	linkType := int(byteOrder.Uint32(header[20:24]) & 0xFFFF)
+
+	reassembler := newReassembler()
+
+	for {
+		recordHeader := make([]byte, 16)
+
+		_, err = io.ReadFull(r, recordHeader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read pcap record header because %v", err)
+		}
+
+		timestamp := time.Unix(int64(byteOrder.Uint32(recordHeader[0:4])), 0).Add(
+			time.Duration(byteOrder.Uint32(recordHeader[4:8])) * resolution,
+		)
+
+		data := make([]byte, byteOrder.Uint32(recordHeader[8:12]))
+
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return fmt.Errorf("failed to read pcap record because %v", err)
+		}
+
+		datagram := reassembler.getDatagram(timestamp, linkType, data)
+		if datagram != nil {
+			handle(datagram)
+		}
+	}
+}
+
+type pcapngInterface struct {
+	linkType   int
+	resolution time.Duration
+}
+
+func readPcapng(r io.Reader, handle func(*Datagram)) error {
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	interfaces := make([]pcapngInterface, 0)
+
+	reassembler := newReassembler()
+
+	for {
+		blockHeader := make([]byte, 8)
+
+		_, err := io.ReadFull(r, blockHeader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read pcapng block header because %v", err)
+		}
+
+		blockType := byteOrder.Uint32(blockHeader[0:4])
+
+		// the section header block says what the byte order (of it and everything after it) is
+		if binary.LittleEndian.Uint32(blockHeader[0:4]) == pcapngSectionHeaderBlock {
+			blockType = pcapngSectionHeaderBlock
+
+			magic := make([]byte, 4)
+
+			_, err = io.ReadFull(r, magic)
+			if err != nil {
+				return fmt.Errorf("failed to read pcapng section header because %v", err)
+			}
+
+			if binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic {
+				byteOrder = binary.LittleEndian
+			} else if binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic {
+				byteOrder = binary.BigEndian
+			} else {
+				return fmt.Errorf("not a pcapng capture (byte order magic %x)", magic)
+			}
+
+			// a new section has its own interfaces
+			interfaces = make([]pcapngInterface, 0)
+
+			blockHeader = append(blockHeader, magic...)
+		}
+
+		length := int(byteOrder.Uint32(blockHeader[4:8]))
+		if length < len(blockHeader)+4 {
+			return fmt.Errorf("pcapng block length %v too short", length)
+		}
+
+		body := make([]byte, length-len(blockHeader))
+
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return fmt.Errorf("failed to read pcapng block because %v", err)
+		}
+
+		// leave off the trailing copy of the length
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngInterfaceDescription:
+			if len(body) < 8 {
+				return fmt.Errorf("pcapng interface description block too short")
+			}
+
+			intfc := pcapngInterface{
+				linkType:   int(byteOrder.Uint16(body[0:2])),
+				resolution: time.Microsecond,
+			}
+
+			for _, option := range getOptions(byteOrder, body[8:]) {
+				if option.code == pcapngOptIFTSResol && len(option.value) == 1 {
+					intfc.resolution = getResolution(option.value[0])
+				}
+			}
+
+			interfaces = append(interfaces, intfc)
+
+		case pcapngEnhancedPacketBlock:
+			if len(body) < 20 {
+				return fmt.Errorf("pcapng enhanced packet block too short")
+			}
+
+			interfaceID := int(byteOrder.Uint32(body[0:4]))
+			if interfaceID >= len(interfaces) {
+				return fmt.Errorf("pcapng enhanced packet block for unknown interface %v", interfaceID)
+			}
+
+			intfc := interfaces[interfaceID]
+
+			ticks := uint64(byteOrder.Uint32(body[4:8]))<<32 | uint64(byteOrder.Uint32(body[8:12]))
+			timestamp := time.Unix(0, 0).Add(time.Duration(ticks) * intfc.resolution)
+
+			capturedLength := int(byteOrder.Uint32(body[12:16]))
+			if 20+capturedLength > len(body) {
+				return fmt.Errorf("pcapng enhanced packet block captured length %v too long", capturedLength)
+			}
+
+			datagram := reassembler.getDatagram(timestamp, intfc.linkType, body[20:20+capturedLength])
+			if datagram != nil {
+				handle(datagram)
+			}
+
+		case pcapngSimplePacketBlock:
+			if len(body) < 4 || len(interfaces) == 0 {
+				continue
+			}
+
+			capturedLength := int(byteOrder.Uint32(body[0:4]))
+			if 4+capturedLength > len(body) {
+				capturedLength = len(body) - 4
+			}
+
+			// no timestamp in a simple packet block
+			datagram := reassembler.getDatagram(time.Time{}, interfaces[0].linkType, body[4:4+capturedLength])
+			if datagram != nil {
+				handle(datagram)
+			}
+		}
+	}
+}
+
+type option struct {
+	code  uint16
+	value []byte
+}
+
+func getOptions(byteOrder binary.ByteOrder, b []byte) []option {
+	options := make([]option, 0)
+
+	for len(b) >= 4 {
+		code := byteOrder.Uint16(b[0:2])
+		length := int(byteOrder.Uint16(b[2:4]))
+
+		if code == pcapngOptEndOfOpt || 4+length > len(b) {
+			break
+		}
+
+		options = append(options, option{code: code, value: b[4 : 4+length]})
+
+		b = b[4+length+getPaddingLength(length):]
+	}
+
+	return options
+}
+
+func getPaddingLength(length int) int {
+	return (4 - length%4) % 4
+}
+
+// getResolution is the duration of a timestamp tick for an if_tsresol option (a power of 10, or of 2 if the top bit is set)
+func getResolution(tsresol byte) time.Duration {
+	exponent := int(tsresol & 0x7F)
+
+	resolution := float64(time.Second)
+	for i := 0; i < exponent; i++ {
+		if tsresol&0x80 != 0 {
+			resolution /= 2
+		} else {
+			resolution /= 10
+		}
+	}
+
+	if resolution < 1 {
+		return 1
+	}
+
+	return time.Duration(resolution)
+}
+
+// getIPPacket strips the link layer (if any) off a captured frame
+func getIPPacket(linkType int, data []byte) []byte {
+	var etherType uint16
+
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return data
+
+	case linkTypeNull:
+		// the address family in host byte order (of the capturing host), which is never more than a byte's worth
+		if len(data) < 4 {
+			return nil
+		}
+
+		return data[4:]
+
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+
+		// VLAN tags (possibly stacked)
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+
+	default:
+		return nil
+	}
+
+	if etherType != 0x0800 && etherType != 0x86DD {
+		return nil
+	}
+
+	return data
+}
+
+// getUDPDatagram is the datagram in a UDP header and payload
+func getUDPDatagram(timestamp time.Time, srcIP net.IP, dstIP net.IP, udp []byte) *Datagram {
+	if len(udp) < 8 {
+		return nil
+	}
+
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		length = len(udp)
+	}
+
+	data := make([]byte, length-8)
+	copy(data, udp[8:length])
+
+	return &Datagram{
+		Timestamp: timestamp,
+		SrcAddr:   &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(udp[0:2]))},
+		DstAddr:   &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(udp[2:4]))},
+		Data:      data,
+	}
+}
@@ -1,9 +1,14 @@
 package endpoint
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/segmentio/ksuid"
@@ -11,29 +16,111 @@ import (
 	"github.com/initialed85/glue/pkg/discovery"
 	"github.com/initialed85/glue/pkg/helpers"
 	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
 	"github.com/initialed85/glue/pkg/topics"
 	"github.com/initialed85/glue/pkg/transport"
 	"github.com/initialed85/glue/pkg/types"
 )
 
+// NameConflictPolicy is what an endpoint does when it loses its EndpointName to another endpoint (see
+// discovery.ClaimWins); there's no policy to rename in place, as every layer (discovery, transport and topics) takes the
+// name at construction, so to rename, stop on a conflict (or watch for one, see discovery.Event.IsConflictLoser) and
+// start a new Manager with another name
+type NameConflictPolicy string
+
+const (
+	// keep running (the other endpoints will ignore us)
+	NameConflictPolicyIgnore NameConflictPolicy = "ignore"
+
+	// stop the endpoint
+	NameConflictPolicyStop NameConflictPolicy = "stop"
+)
+
 type Manager struct {
+	ctx                            context.Context
+	cancel                         context.CancelFunc
+	stopOnce                       sync.Once
 	networkID                      int64
 	endpointID                     ksuid.KSUID
 	endpointName                   string
+	endpointPriority               int64
+	nameConflictPolicy             NameConflictPolicy
 	listenAddress                  *net.UDPAddr
 	discoveryListenAddress         *net.UDPAddr
 	discoveryTargetAddress         *net.UDPAddr
+	discoverySeedAddresses         []*net.UDPAddr
+	discoverySeedsPath             string
+	discoveryRegistryAddresses     []*net.UDPAddr
+	discoveryMDNS                  bool
+	discoverySWIM                  bool
 	listenInterface                string
+	sharedSocket                   bool
+	multicastOptions               network.MulticastOptions
+	discoveryDSCP                  int
+	ackDSCP                        int
+	hostID                         string
+	localAddress                   string
+	streamAddress                  string
 	discoveryRate                  time.Duration
+	discoveryBurstRate             time.Duration
 	discoveryRateTimeoutMultiplier float64
+	capturePath                    string
+	captureMaxSize                 int64
+	labels                         map[string]string
 	onAdded                        func(*types.Container)
 	onRemoved                      func(*types.Container)
 	networkManager                 *network.Manager
+	capture                        *network.Capture
+	localManager                   *network.StreamManager
+	streamManager                  *network.StreamManager
 	discoveryManager               *discovery.Manager
 	transportManager               *transport.Manager
 	topicsManager                  *topics.Manager
 }
 
+// ManagerOptions are the extras for an endpoint manager; the zero value (or nil) is a plain endpoint (multicast /
+// broadcast discovery, UDP only)
+type ManagerOptions struct {
+	// wins name conflicts against endpoints with a lower priority, and what to do on losing one (empty for
+	// NameConflictPolicyIgnore)
+	Priority           int64
+	NameConflictPolicy NameConflictPolicy
+
+	// see discovery.ManagerOptions
+	DiscoverySeedAddresses     []*net.UDPAddr
+	DiscoverySeedsPath         string
+	DiscoveryRegistryAddresses []*net.UDPAddr
+	DiscoveryMDNS              bool
+	DiscoverySWIM              bool
+	DiscoveryBurstRate         time.Duration
+
+	// share one socket between discovery and data (see network.Manager.UseSharedSocket)
+	SharedSocket bool
+
+	// nil for network.DefaultMulticastOptions
+	MulticastOptions *network.MulticastOptions
+
+	// the DSCP announcements (and probes etc) and acks are marked with; 0 is best effort
+	DiscoveryDSCP int
+	AckDSCP       int
+
+	// identifies the host, for endpoints on the same host to send to each other via the Unix domain socket at
+	// LocalAddress (empty for UDP only)
+	HostID       string
+	LocalAddress string
+
+	// the TCP address to listen on, for endpoints that both do TCP to send to each other that way (empty for UDP only)
+	StreamAddress string
+
+	// write everything sent and received over UDP to a pcapng file at CapturePath (empty for no capture), rotated once
+	// it's bigger than CaptureMaxSize (0 for never)
+	CapturePath    string
+	CaptureMaxSize int64
+
+	// carried by everything we publish, for subscribers to filter on
+	Labels map[string]string
+}
+
 func NewManager(
 	networkID int64,
 	endpointID ksuid.KSUID,
@@ -46,32 +133,118 @@ func NewManager(
 	discoveryRateTimeoutMultiplier float64,
 	onAdded func(*types.Container),
 	onRemoved func(*types.Container),
+	options *ManagerOptions,
 ) *Manager {
+	if options == nil {
+		options = &ManagerOptions{}
+	}
+
+	endpointPriority := options.Priority
+
+	nameConflictPolicy := options.NameConflictPolicy
+	if nameConflictPolicy == "" {
+		nameConflictPolicy = NameConflictPolicyIgnore
+	}
+
+	discoverySeedAddresses := options.DiscoverySeedAddresses
+	discoverySeedsPath := options.DiscoverySeedsPath
+	discoveryRegistryAddresses := options.DiscoveryRegistryAddresses
+	discoveryMDNS := options.DiscoveryMDNS
+	discoverySWIM := options.DiscoverySWIM
+	discoveryBurstRate := options.DiscoveryBurstRate
+	sharedSocket := options.SharedSocket
+
+	multicastOptions := network.DefaultMulticastOptions()
+	if options.MulticastOptions != nil {
+		multicastOptions = *options.MulticastOptions
+	}
+
+	discoveryDSCP := options.DiscoveryDSCP
+	ackDSCP := options.AckDSCP
+	hostID := options.HostID
+	localAddress := options.LocalAddress
+	streamAddress := options.StreamAddress
+	capturePath := options.CapturePath
+	captureMaxSize := options.CaptureMaxSize
+	labels := options.Labels
+
 	log.Printf("endpoint; networkID: %v", networkID)
 	log.Printf("endpoint; endpointID: %v", endpointID)
 	log.Printf("endpoint; endpointName: %v", endpointName)
+	log.Printf("endpoint; endpointPriority: %v", endpointPriority)
+	log.Printf("endpoint; nameConflictPolicy: %v", nameConflictPolicy)
 	log.Printf("endpoint; listenAddress: %v", listenAddress)
 	log.Printf("endpoint; discoveryListenAddress: %v", discoveryListenAddress)
 	log.Printf("endpoint; discoveryTargetAddress: %v", discoveryTargetAddress)
+	log.Printf("endpoint; discoverySeedAddresses: %v", discoverySeedAddresses)
+	log.Printf("endpoint; discoverySeedsPath: %v", discoverySeedsPath)
+	log.Printf("endpoint; discoveryRegistryAddresses: %v", discoveryRegistryAddresses)
+	log.Printf("endpoint; discoveryMDNS: %v", discoveryMDNS)
+	log.Printf("endpoint; discoverySWIM: %v", discoverySWIM)
 	log.Printf("endpoint; listenInterface: %v", listenInterface)
+	log.Printf("endpoint; sharedSocket: %v", sharedSocket)
+	log.Printf("endpoint; multicastOptions: %+v", multicastOptions)
+	log.Printf("endpoint; discoveryDSCP: %v", discoveryDSCP)
+	log.Printf("endpoint; ackDSCP: %v", ackDSCP)
+	log.Printf("endpoint; hostID: %v", hostID)
+	log.Printf("endpoint; localAddress: %v", localAddress)
+	log.Printf("endpoint; streamAddress: %v", streamAddress)
 	log.Printf("endpoint; discoveryRate: %v", discoveryRate)
+	log.Printf("endpoint; discoveryBurstRate: %v", discoveryBurstRate)
 	log.Printf("endpoint; discoveryRateTimeoutMultiplier: %v", discoveryRateTimeoutMultiplier)
+	log.Printf("endpoint; capturePath: %v", capturePath)
+	log.Printf("endpoint; captureMaxSize: %v", captureMaxSize)
+	log.Printf("endpoint; labels: %v", labels)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	m := Manager{
+		ctx:                            ctx,
+		cancel:                         cancel,
 		networkID:                      networkID,
 		endpointID:                     endpointID,
 		endpointName:                   endpointName,
+		endpointPriority:               endpointPriority,
+		nameConflictPolicy:             nameConflictPolicy,
 		listenAddress:                  listenAddress,
 		discoveryListenAddress:         discoveryListenAddress,
 		discoveryTargetAddress:         discoveryTargetAddress,
+		discoverySeedAddresses:         discoverySeedAddresses,
+		discoverySeedsPath:             discoverySeedsPath,
+		discoveryRegistryAddresses:     discoveryRegistryAddresses,
+		discoveryMDNS:                  discoveryMDNS,
+		discoverySWIM:                  discoverySWIM,
 		listenInterface:                listenInterface,
+		sharedSocket:                   sharedSocket,
+		multicastOptions:               multicastOptions,
+		discoveryDSCP:                  discoveryDSCP,
+		ackDSCP:                        ackDSCP,
+		hostID:                         hostID,
+		localAddress:                   localAddress,
+		streamAddress:                  streamAddress,
 		discoveryRate:                  discoveryRate,
+		discoveryBurstRate:             discoveryBurstRate,
 		discoveryRateTimeoutMultiplier: discoveryRateTimeoutMultiplier,
+		capturePath:                    capturePath,
+		captureMaxSize:                 captureMaxSize,
+		labels:                         labels,
 		onAdded:                        onAdded,
 		onRemoved:                      onRemoved,
 		networkManager:                 network.NewManager(),
 	}
 
+	if sharedSocket {
+		m.networkManager.UseSharedSocket(listenAddress, listenInterface)
+	}
+
+	m.networkManager.UseMulticastOptions(multicastOptions)
+
+	// everything we send and receive over UDP is written to a pcapng file (annotated with what kind of container it is)
+	if capturePath != "" {
+		m.capture = network.NewCapture(capturePath, captureMaxSize, serialization.Describe)
+		m.networkManager.UseCapture(m.capture)
+	}
+
 	m.discoveryManager = discovery.NewManager(
 		networkID,
 		endpointID,
@@ -82,9 +255,18 @@ func NewManager(
 		listenInterface,
 		discoveryRate,
 		discoveryRateTimeoutMultiplier,
-		m.networkManager,
+		m.networkManager.WithDSCP(discoveryDSCP), // announcements, probes etc all go out marked
 		onAdded,
 		onRemoved,
+		&discovery.ManagerOptions{
+			Priority:          endpointPriority,
+			SeedAddresses:     discoverySeedAddresses,
+			SeedsPath:         discoverySeedsPath,
+			RegistryAddresses: discoveryRegistryAddresses,
+			EnableMDNS:        discoveryMDNS,
+			EnableSWIM:        discoverySWIM,
+			BurstRate:         discoveryBurstRate,
+		},
 	)
 
 	m.transportManager = transport.NewManager(
@@ -100,12 +282,48 @@ func NewManager(
 		},
 	)
 
+	m.transportManager.UseAckDSCP(ackDSCP)
+
+	// endpoints on the same host send to each other via a Unix domain socket instead (whole, but still acked in case the connection goes away)
+	if localAddress != "" {
+		m.localManager = network.NewStreamManager(
+			"unix",
+			localAddress,
+			func(srcAddress string, data []byte) {
+				m.transportManager.HandleLocalReceive(srcAddress, data)
+			},
+		)
+
+		m.discoveryManager.UseLocal(hostID, m.localManager)
+		m.transportManager.UseLocal(hostID, m.localManager)
+	}
+
+	// endpoints that both do TCP send to each other that way instead (whole, but still acked in case the connection goes away)
+	if streamAddress != "" {
+		m.streamManager = network.NewStreamManager(
+			"tcp",
+			streamAddress,
+			func(srcAddress string, data []byte) {
+				m.transportManager.HandleStreamReceive(srcAddress, data)
+			},
+		)
+
+		m.discoveryManager.UseStream(m.streamManager)
+		m.transportManager.UseStream(m.streamManager)
+	}
+
+	// the network manager rebinds its sockets when our interfaces or addresses change; we then need to tell everyone
+	m.networkManager.OnInterfaceChange(m.discoveryManager.HandleNetworkChange)
+
 	m.topicsManager = topics.NewManager(
 		endpointID,
 		endpointName,
 		m.transportManager,
 	)
 
+	// everything we publish carries our labels, for subscribers to filter on
+	m.topicsManager.UseLabels(labels)
+
 	return &m
 }
 
@@ -125,6 +343,22 @@ func NewManagerSimple() (*Manager, error) {
 		endpointName = fmt.Sprintf("Endpoint_%v", endpointID)
 	}
 
+	endpointPriority, err := helpers.GetEndpointPriorityFromEnv()
+	if err != nil {
+		endpointPriority = 0
+	}
+
+	nameConflictPolicy := NameConflictPolicyIgnore
+
+	rawNameConflictPolicy, err := helpers.GetEndpointNameConflictPolicyFromEnv()
+	if err == nil {
+		nameConflictPolicy = NameConflictPolicy(rawNameConflictPolicy)
+	}
+
+	if nameConflictPolicy != NameConflictPolicyIgnore && nameConflictPolicy != NameConflictPolicyStop {
+		return nil, fmt.Errorf("unknown name conflict policy %#v", nameConflictPolicy)
+	}
+
 	listenAddress, err := helpers.GetListenAddressFromEnv()
 	if err != nil {
 		listenPort, err := network.GetFreePort()
@@ -150,6 +384,39 @@ func NewManagerSimple() (*Manager, error) {
 		discoveryListenAddress, _ = net.ResolveUDPAddr("udp4", "239.192.137.1:27320")
 	}
 
+	discoverySeedAddresses, err := helpers.GetDiscoverySeedAddressesFromEnv()
+	if err != nil {
+		if !errors.Is(err, helpers.ErrEmptyOrUnset) {
+			return nil, err
+		}
+
+		discoverySeedAddresses = nil
+	}
+
+	discoverySeedsPath, err := helpers.GetDiscoverySeedsPathFromEnv()
+	if err != nil {
+		discoverySeedsPath = ""
+	}
+
+	discoveryRegistryAddresses, err := helpers.GetDiscoveryRegistryAddressesFromEnv()
+	if err != nil {
+		if !errors.Is(err, helpers.ErrEmptyOrUnset) {
+			return nil, err
+		}
+
+		discoveryRegistryAddresses = nil
+	}
+
+	discoveryMDNS, err := helpers.GetDiscoveryMDNSFromEnv()
+	if err != nil {
+		discoveryMDNS = false
+	}
+
+	discoverySWIM, err := helpers.GetDiscoverySWIMFromEnv()
+	if err != nil {
+		discoverySWIM = false
+	}
+
 	listenInterface, err := helpers.GetListenInterfaceFromEnv()
 	if err != nil {
 		listenInterface, err = network.GetDefaultInterfaceName()
@@ -158,16 +425,116 @@ func NewManagerSimple() (*Manager, error) {
 		}
 	}
 
+	sharedSocket, err := helpers.GetSharedSocketFromEnv()
+	if err != nil {
+		sharedSocket = false
+	}
+
+	multicastOptions := network.DefaultMulticastOptions()
+
+	multicastTTL, err := helpers.GetMulticastTTLFromEnv()
+	if err == nil {
+		multicastOptions.TTL = multicastTTL
+	}
+
+	if multicastOptions.TTL < 0 || multicastOptions.TTL > 255 {
+		return nil, fmt.Errorf("multicast TTL %v not between 0 and 255", multicastOptions.TTL)
+	}
+
+	multicastLoopback, err := helpers.GetMulticastLoopbackFromEnv()
+	if err == nil {
+		multicastOptions.Loopback = multicastLoopback
+	}
+
+	multicastInterface, err := helpers.GetMulticastInterfaceFromEnv()
+	if err == nil {
+		multicastOptions.InterfaceName = multicastInterface
+	}
+
+	discoveryDSCP, err := helpers.GetDiscoveryDSCPFromEnv()
+	if err != nil {
+		discoveryDSCP = 0
+	}
+
+	err = network.CheckDSCP(discoveryDSCP)
+	if err != nil {
+		return nil, err
+	}
+
+	ackDSCP, err := helpers.GetAckDSCPFromEnv()
+	if err != nil {
+		ackDSCP = 0
+	}
+
+	err = network.CheckDSCP(ackDSCP)
+	if err != nil {
+		return nil, err
+	}
+
+	hostID, err := helpers.GetHostIDFromEnv()
+	if err != nil {
+		hostID, err = network.GetHostID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	local, err := helpers.GetLocalFromEnv()
+	if err != nil {
+		local = false
+	}
+
+	localAddress := ""
+	if local {
+		localAddress, err = helpers.GetLocalAddressFromEnv()
+		if err != nil {
+			localAddress = filepath.Join(os.TempDir(), fmt.Sprintf("glue-%v.sock", endpointID))
+		}
+	}
+
+	stream, err := helpers.GetStreamFromEnv()
+	if err != nil {
+		stream = false
+	}
+
+	streamAddress := ""
+	if stream {
+		streamAddress, err = helpers.GetStreamAddressFromEnv()
+		if err != nil {
+			streamAddress = net.JoinHostPort(listenAddress.IP.String(), fmt.Sprintf("%v", listenAddress.Port))
+		}
+	}
+
 	discoveryRate, err := helpers.GetDiscoveryRateFromEnv()
 	if err != nil {
 		discoveryRate = time.Second * 1
 	}
 
+	discoveryBurstRate, err := helpers.GetDiscoveryBurstRateFromEnv()
+	if err != nil {
+		discoveryBurstRate = 0
+	}
+
 	discoveryRateTimeoutMultiplier, err := helpers.GetDiscoveryRateTimeoutMultiplierFromEnv()
 	if err != nil {
 		discoveryRateTimeoutMultiplier = 2.0
 	}
 
+	capturePath, err := helpers.GetCapturePathFromEnv()
+	if err != nil {
+		capturePath = ""
+	}
+
+	captureMaxSize, err := helpers.GetCaptureMaxSizeFromEnv()
+	if err != nil {
+		captureMaxSize = 100 * 1024 * 1024
+	}
+
+	labels, err := helpers.GetEndpointLabelsFromEnv()
+	if err != nil {
+		labels = nil
+	}
+
 	return NewManager(
 		networkID,
 		endpointID,
@@ -180,6 +547,26 @@ func NewManagerSimple() (*Manager, error) {
 		discoveryRateTimeoutMultiplier,
 		func(container *types.Container) {},
 		func(container *types.Container) {},
+		&ManagerOptions{
+			Priority:                   endpointPriority,
+			NameConflictPolicy:         nameConflictPolicy,
+			DiscoverySeedAddresses:     discoverySeedAddresses,
+			DiscoverySeedsPath:         discoverySeedsPath,
+			DiscoveryRegistryAddresses: discoveryRegistryAddresses,
+			DiscoveryMDNS:              discoveryMDNS,
+			DiscoverySWIM:              discoverySWIM,
+			DiscoveryBurstRate:         discoveryBurstRate,
+			SharedSocket:               sharedSocket,
+			MulticastOptions:           &multicastOptions,
+			DiscoveryDSCP:              discoveryDSCP,
+			AckDSCP:                    ackDSCP,
+			HostID:                     hostID,
+			LocalAddress:               localAddress,
+			StreamAddress:              streamAddress,
+			CapturePath:                capturePath,
+			CaptureMaxSize:             captureMaxSize,
+			Labels:                     labels,
+		},
 	), nil
 }
 
@@ -191,6 +578,13 @@ func (m *Manager) EndpointName() string {
 	return m.endpointName
 }
 
+// Watch returns an ordered channel of membership events (see discovery.Manager.Watch)
+func (m *Manager) Watch(ctx context.Context) <-chan discovery.Event {
+	return m.discoveryManager.Watch(ctx)
+}
+
+// Publish sends the payload to everything subscribed to the topic (or a pattern that matches it); the topic name can't
+// have the wildcards "+" or "#" in it (see topics.CheckTopicName)
 func (m *Manager) Publish(
 	topicName string,
 	topicType string,
@@ -205,11 +599,43 @@ func (m *Manager) Publish(
 	)
 }
 
+// PublishWithHeaders is Publish with some headers for subscribers to filter on (see topics.Filter.Headers)
+func (m *Manager) PublishWithHeaders(
+	topicName string,
+	topicType string,
+	expiry time.Duration,
+	headers map[string]string,
+	payload []byte,
+) error {
+	return m.topicsManager.PublishWithHeaders(
+		topicName,
+		topicType,
+		expiry,
+		headers,
+		payload,
+	)
+}
+
+// SetDSCP marks what we publish to the topic with the given DSCP (e.g. so that switches prioritise time-critical control
+// topics over bulk data); 0 is best effort
+func (m *Manager) SetDSCP(
+	topicName string,
+	dscp int,
+) error {
+	return m.topicsManager.SetDSCP(
+		topicName,
+		dscp,
+	)
+}
+
+// Subscribe has messages on the topic passed to onReceive until the returned handle is unsubscribed; the topic name may be
+// an MQTT-style pattern (e.g. "sensors/+/temperature" or "site/a/#") and the topic type may be empty for any type (see
+// topics.Manager.Subscribe)
 func (m *Manager) Subscribe(
 	topicName string,
 	topicType string,
 	onReceive func(*topics.Message),
-) error {
+) (*topics.SubscriptionHandle, error) {
 	return m.topicsManager.Subscribe(
 		topicName,
 		topicType,
@@ -217,22 +643,109 @@ func (m *Manager) Subscribe(
 	)
 }
 
+// SubscribeWithFilter is Subscribe for only the messages that get through the filter (e.g. just the one device's readings
+// on a busy topic); see topics.Filter
+func (m *Manager) SubscribeWithFilter(
+	topicName string,
+	topicType string,
+	filter *topics.Filter,
+	onReceive func(*topics.Message),
+) (*topics.SubscriptionHandle, error) {
+	return m.topicsManager.SubscribeWithFilter(
+		topicName,
+		topicType,
+		filter,
+		onReceive,
+	)
+}
+
+// SubscribeWithOptions is Subscribe with a filter, each publisher's messages in order and / or a callback for messages
+// that never turned up; see topics.SubscriptionOptions
+func (m *Manager) SubscribeWithOptions(
+	topicName string,
+	topicType string,
+	options *topics.SubscriptionOptions,
+	onReceive func(*topics.Message),
+) (*topics.SubscriptionHandle, error) {
+	return m.topicsManager.SubscribeWithOptions(
+		topicName,
+		topicType,
+		options,
+		onReceive,
+	)
+}
+
+// Unsubscribe tears the topic down for every handle (including those belonging to other parts of the program, whose
+// callbacks just stop being called)
+//
+// Deprecated: use topics.SubscriptionHandle.Unsubscribe, which only removes the one handle
 func (m *Manager) Unsubscribe(
 	topicName string,
 ) error {
 	return m.topicsManager.Unsubscribe(topicName)
 }
 
+// handleNameConflicts applies the name conflict policy should we lose our EndpointName
+func (m *Manager) handleNameConflicts() {
+	for event := range m.discoveryManager.Watch(m.ctx) {
+		if !event.IsConflictLoser(m.endpointID) {
+			continue
+		}
+
+		if m.nameConflictPolicy == NameConflictPolicyStop {
+			log.Printf("error: lost EndpointName %#v to %v; stopping", m.endpointName, event.Container.String())
+			m.Stop()
+			return
+		}
+	}
+}
+
 func (m *Manager) Start() {
+	if m.capture != nil {
+		err := m.capture.Open()
+		if err != nil {
+			log.Printf("warning: failed to open capture: %v", err)
+		}
+	}
+
 	m.networkManager.Start()
+
+	if m.localManager != nil {
+		m.localManager.Start()
+	}
+
+	if m.streamManager != nil {
+		m.streamManager.Start()
+	}
+
 	m.discoveryManager.Start()
 	m.transportManager.Start()
 	m.topicsManager.Start()
+
+	if m.nameConflictPolicy != NameConflictPolicyIgnore {
+		go m.handleNameConflicts()
+	}
 }
 
 func (m *Manager) Stop() {
-	m.networkManager.Stop()
-	m.discoveryManager.Stop()
-	m.transportManager.Stop()
-	m.topicsManager.Stop()
+	// may already have been stopped by the name conflict policy
+	m.stopOnce.Do(func() {
+		m.cancel()
+		m.networkManager.Stop()
+		m.discoveryManager.Stop()
+		m.transportManager.Stop()
+		m.topicsManager.Stop()
+
+		if m.localManager != nil {
+			m.localManager.Stop()
+		}
+
+		if m.streamManager != nil {
+			m.streamManager.Stop()
+		}
+
+		if m.capture != nil {
+			m.capture.Close()
+		}
+	})
 }
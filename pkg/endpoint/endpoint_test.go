@@ -40,7 +40,7 @@ func TestIntegration_ManagerSimple(t *testing.T) {
 
 	consumed1 := make(chan []byte, 65536)
 
-	err := endpointManager1.Subscribe(
+	_, err := endpointManager1.Subscribe(
 		"some_topic",
 		"some_type",
 		func(message *topics.Message) {
@@ -84,7 +84,7 @@ func TestIntegration_ManagerSimpleSingleEndpointTalkingToItself(t *testing.T) {
 
 	consumed := make(chan *topics.Message, 65536)
 
-	err := endpointManager.Subscribe(
+	_, err := endpointManager.Subscribe(
 		"some_topic",
 		"some_type",
 		func(message *topics.Message) {
@@ -126,7 +126,7 @@ func TestIntegration_ManagerSimpleSingleEndpointTalkingToItselfWithWildcardSubsc
 
 	consumed := make(chan *topics.Message, 65536)
 
-	err := endpointManager.Subscribe(
+	_, err := endpointManager.Subscribe(
 		"#",
 		"some_type",
 		func(message *topics.Message) {
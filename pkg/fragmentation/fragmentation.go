@@ -4,6 +4,7 @@ import (
 	"fmt"
 )
 
+// Fragment splits payload into fragments of (at most) fragmentSize; the fragments share payload's memory
 func Fragment(payload []byte, fragmentSize int) ([][]byte, error) {
 	if fragmentSize < 0 {
 		return [][]byte{}, fmt.Errorf("fragmentSize must be 0 or above")
@@ -13,33 +14,39 @@ func Fragment(payload []byte, fragmentSize int) ([][]byte, error) {
 		return [][]byte{payload}, nil
 	}
 
-	fragments := make([][]byte, 0)
+	fragments := make([][]byte, 0, GetFragmentCount(len(payload), fragmentSize))
 
-	fragment := make([]byte, 0)
-
-	for _, c := range payload {
-		if len(fragment) == fragmentSize {
-			fragments = append(fragments, fragment)
-			fragment = make([]byte, 0)
+	for i := 0; i < len(payload); i += fragmentSize {
+		end := i + fragmentSize
+		if end > len(payload) {
+			end = len(payload)
 		}
 
-		fragment = append(fragment, c)
+		fragments = append(fragments, payload[i:end:end])
 	}
 
-	if len(fragment) > 0 {
-		fragments = append(fragments, fragment)
+	return fragments, nil
+}
+
+// GetFragmentCount is how many fragments Fragment would split a payload of payloadSize into
+func GetFragmentCount(payloadSize int, fragmentSize int) int {
+	if fragmentSize <= 0 {
+		return 1
 	}
 
-	return fragments, nil
+	return (payloadSize + fragmentSize - 1) / fragmentSize
 }
 
 func Defragment(fragments [][]byte) ([]byte, error) {
-	payload := make([]byte, 0)
+	size := 0
+	for _, fragment := range fragments {
+		size += len(fragment)
+	}
+
+	payload := make([]byte, 0, size)
 
 	for _, fragment := range fragments {
-		for _, c := range fragment {
-			payload = append(payload, c)
-		}
+		payload = append(payload, fragment...)
 	}
 
 	return payload, nil
@@ -22,3 +22,14 @@ func TestFragmentAndDefragment(t *testing.T) {
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestGetFragmentCount(t *testing.T) {
+	for _, payloadSize := range []int{0, 1, 4, 5, 6, 12, 15} {
+		fragments, err := Fragment(make([]byte, payloadSize), 5)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		assert.Equal(t, len(fragments), GetFragmentCount(payloadSize, 5))
+	}
+}
@@ -0,0 +1,397 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/initialed85/glue/pkg/topics"
+)
+
+const (
+	// from the client
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+	ActionPublish     = "publish"
+
+	// from the gateway
+	ActionSubscribed   = "subscribed"
+	ActionUnsubscribed = "unsubscribed"
+	ActionPublished    = "published"
+	ActionMessage      = "message"
+	ActionDropped      = "dropped"
+	ActionError        = "error"
+)
+
+// DefaultExpiry is the expiry of a publish that doesn't say
+const DefaultExpiry = time.Second * 1
+
+// QueueSize is how many messages can be waiting to go to a connection; any more (i.e. a browser that can't keep up) are
+// dropped and the client told how many with a dropped envelope
+const QueueSize = 256
+
+// writeTimeout is how long a client has to take a write before it's disconnected (i.e. a browser that's stopped reading
+// altogether)
+const writeTimeout = time.Second * 10
+
+// Envelope is what goes back and forth over a WebSocket (as JSON); it's a topics.Message (payload base64 encoded, expiry in
+// nanoseconds) plus what to do with it
+type Envelope struct {
+	topics.Message
+
+	// see the Action constants
+	Action string `json:"action"`
+
+	// for an error envelope, what went wrong
+	Error string `json:"error,omitempty"`
+
+	// for a dropped envelope, how many messages the client missed since the last one
+	DroppedCount int64 `json:"dropped_count,omitempty"`
+}
+
+// Endpoint is what the gateway needs from an endpoint.Manager
+type Endpoint interface {
+	Publish(topicName string, topicType string, expiry time.Duration, payload []byte) error
+	Subscribe(topicName string, topicType string, onReceive func(*topics.Message)) (*topics.SubscriptionHandle, error)
+}
+
+type connection struct {
+	conn         *websocket.Conn
+	queue        chan *Envelope
+	droppedCount int64
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+// push queues a message for the connection, dropping it if the connection can't keep up
+func (c *connection) push(envelope *Envelope) {
+	select {
+	case c.queue <- envelope:
+	default:
+		atomic.AddInt64(&c.droppedCount, 1)
+	}
+}
+
+// reply queues a response to something the client asked for; unlike messages these aren't dropped (the client is
+// waiting on them)
+func (c *connection) reply(envelope *Envelope) {
+	select {
+	case c.queue <- envelope:
+	case <-c.done:
+	}
+}
+
+type topic struct {
+	topicType   string
+	handle      *topics.SubscriptionHandle
+	connections map[*connection]struct{}
+}
+
+// Manager exposes an endpoint's topics to WebSocket clients (e.g. browsers); each connection has its own subscriptions,
+// which the gateway shares a single endpoint subscription between
+type Manager struct {
+	mu             sync.Mutex
+	subscribeMu    sync.Mutex
+	upgrader       websocket.Upgrader
+	endpoint       Endpoint
+	topicByName    map[string]*topic
+	connections    map[*connection]struct{}
+	allowedOrigins []string
+}
+
+// NewManager serves the given endpoint; a WebSocket may only be opened from a page on the same origin as the gateway or
+// one of allowedOrigins ("*" allows any)
+func NewManager(
+	endpoint Endpoint,
+	allowedOrigins []string,
+) *Manager {
+	m := Manager{
+		endpoint:       endpoint,
+		topicByName:    make(map[string]*topic),
+		connections:    make(map[*connection]struct{}),
+		allowedOrigins: allowedOrigins,
+	}
+
+	m.upgrader = websocket.Upgrader{
+		CheckOrigin: m.checkOrigin,
+	}
+
+	return &m
+}
+
+func (m *Manager) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	// not a browser
+	if origin == "" {
+		return true
+	}
+
+	for _, allowedOrigin := range m.allowedOrigins {
+		if allowedOrigin == "*" || allowedOrigin == origin {
+			return true
+		}
+	}
+
+	return origin == "http://"+r.Host || origin == "https://"+r.Host
+}
+
+// handleMessage fans a message the endpoint received for a topic (or pattern, see topics.CheckTopicPattern) out to every
+// connection subscribed to it; a connection with overlapping subscriptions (e.g. "a/b" and "a/#") gets a copy for each
+func (m *Manager) handleMessage(topicName string, message *topics.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.topicByName[topicName]
+	if !ok {
+		return
+	}
+
+	for c := range t.connections {
+		c.push(&Envelope{
+			Message: *message,
+			Action:  ActionMessage,
+		})
+	}
+}
+
+// subscribe and unsubscribe don't hold the mutex while (un)subscribing the endpoint, as the endpoint holds its own lock
+// while calling handleMessage; subscribeMu keeps them from racing each other instead
+func (m *Manager) subscribe(c *connection, topicName string, topicType string) error {
+	m.subscribeMu.Lock()
+	defer m.subscribeMu.Unlock()
+
+	m.mu.Lock()
+	t, ok := m.topicByName[topicName]
+	if ok {
+		defer m.mu.Unlock()
+
+		if t.topicType != topicType {
+			return fmt.Errorf("cannot subscribe to %#v as %#v; already subscribed to as %#v", topicName, topicType, t.topicType)
+		}
+
+		t.connections[c] = struct{}{}
+
+		return nil
+	}
+	m.mu.Unlock()
+
+	// the first connection to want a topic subscribes the endpoint to it
+	handle, err := m.endpoint.Subscribe(topicName, topicType, func(message *topics.Message) {
+		m.handleMessage(topicName, message)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.topicByName[topicName] = &topic{
+		topicType: topicType,
+		handle:    handle,
+		connections: map[*connection]struct{}{
+			c: {},
+		},
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) unsubscribe(c *connection, topicName string) error {
+	m.subscribeMu.Lock()
+	defer m.subscribeMu.Unlock()
+
+	m.mu.Lock()
+	t, ok := m.topicByName[topicName]
+	if !ok {
+		m.mu.Unlock()
+		return nil
+	}
+
+	delete(t.connections, c)
+
+	if len(t.connections) > 0 {
+		m.mu.Unlock()
+		return nil
+	}
+
+	delete(m.topicByName, topicName)
+	m.mu.Unlock()
+
+	// and the last connection to lose interest unsubscribes it (leaving anything else in the process subscribed to the
+	// topic be)
+	return t.handle.Unsubscribe()
+}
+
+// unsubscribeAll is for when a connection goes away (its subscriptions go with it)
+func (m *Manager) unsubscribeAll(c *connection) {
+	m.mu.Lock()
+	topicNames := make([]string, 0)
+	for topicName, t := range m.topicByName {
+		_, ok := t.connections[c]
+		if ok {
+			topicNames = append(topicNames, topicName)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, topicName := range topicNames {
+		err := m.unsubscribe(c, topicName)
+		if err != nil {
+			log.Printf("warning: gateway failed to unsubscribe from %#v: %v", topicName, err)
+		}
+	}
+}
+
+func (m *Manager) handleRequest(c *connection, request *Envelope) {
+	response := &Envelope{
+		Message: topics.Message{
+			TopicName: request.TopicName,
+			TopicType: request.TopicType,
+		},
+	}
+
+	var err error
+
+	switch request.Action {
+	case ActionSubscribe:
+		response.Action = ActionSubscribed
+		err = m.subscribe(c, request.TopicName, request.TopicType)
+	case ActionUnsubscribe:
+		response.Action = ActionUnsubscribed
+		err = m.unsubscribe(c, request.TopicName)
+	case ActionPublish:
+		response.Action = ActionPublished
+		expiry := request.Expiry
+		if expiry <= 0 {
+			expiry = DefaultExpiry
+		}
+		err = m.endpoint.Publish(request.TopicName, request.TopicType, expiry, request.Payload)
+	default:
+		err = fmt.Errorf("unknown action %#v", request.Action)
+	}
+
+	if err != nil {
+		response.Action = ActionError
+		response.Error = err.Error()
+	}
+
+	c.reply(response)
+}
+
+func (m *Manager) write(c *connection) {
+	defer c.close()
+
+	for {
+		var envelope *Envelope
+
+		select {
+		case <-c.done:
+			return
+		case envelope = <-c.queue:
+		}
+
+		// let the client know what it missed before what comes next
+		droppedCount := atomic.SwapInt64(&c.droppedCount, 0)
+		if droppedCount > 0 {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := c.conn.WriteJSON(&Envelope{
+				Action:       ActionDropped,
+				DroppedCount: droppedCount,
+			})
+			if err != nil {
+				return
+			}
+		}
+
+		_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := c.conn.WriteJSON(envelope)
+		if err != nil {
+			log.Printf("warning: gateway failed to write to %v: %v", c.conn.RemoteAddr().String(), err)
+			return
+		}
+	}
+}
+
+func (m *Manager) read(c *connection) {
+	defer c.close()
+
+	for {
+		var request Envelope
+
+		err := c.conn.ReadJSON(&request)
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return
+			}
+
+			select {
+			case <-c.done:
+			default:
+				log.Printf("warning: gateway failed to read from %v: %v", c.conn.RemoteAddr().String(), err)
+			}
+
+			return
+		}
+
+		m.handleRequest(c, &request)
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and serves it until it's closed
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("warning: gateway failed to upgrade %v: %v", r.RemoteAddr, err)
+		return
+	}
+
+	c := &connection{
+		conn:  conn,
+		queue: make(chan *Envelope, QueueSize),
+		done:  make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.connections[c] = struct{}{}
+	m.mu.Unlock()
+
+	log.Printf("gateway connection from %v opened", conn.RemoteAddr().String())
+
+	go m.write(c)
+	m.read(c)
+
+	m.unsubscribeAll(c)
+
+	m.mu.Lock()
+	delete(m.connections, c)
+	m.mu.Unlock()
+
+	log.Printf("gateway connection from %v closed", conn.RemoteAddr().String())
+}
+
+// Stop closes every connection
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	connections := make([]*connection, 0, len(m.connections))
+	for c := range m.connections {
+		connections = append(connections, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range connections {
+		c.close()
+	}
+}
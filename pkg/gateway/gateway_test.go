@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/initialed85/glue/pkg/topics"
+	"github.com/initialed85/glue/pkg/types"
+)
+
+// fakeEndpoint delivers what's published to whoever's subscribed (as an endpoint does for its own publications)
+type fakeEndpoint struct {
+	subscriber *topics.Subscriber
+}
+
+func newFakeEndpoint() *fakeEndpoint {
+	var publisher *topics.Publisher
+
+	e := fakeEndpoint{
+		subscriber: topics.NewSubscriber(ksuid.New(), "fake", nil, &publisher),
+	}
+
+	return &e
+}
+
+func (e *fakeEndpoint) Publish(topicName string, topicType string, expiry time.Duration, payload []byte) error {
+	b, err := msgpack.Marshal(&topics.Message{
+		Timestamp:   time.Now(),
+		Expiry:      expiry,
+		TopicName:   topicName,
+		TopicType:   topicType,
+		MessageType: topics.StandardMessageType,
+		Payload:     payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	e.subscriber.HandleReceive(types.GetFrameContainer(0, 0, 0, ksuid.New(), "fake", ksuid.New(), 0, 0, ksuid.Nil, "", false, false, b))
+
+	return nil
+}
+
+func (e *fakeEndpoint) Subscribe(topicName string, topicType string, onReceive func(*topics.Message)) (*topics.SubscriptionHandle, error) {
+	return e.subscriber.Subscribe(topicName, topicType, onReceive)
+}
+
+func (e *fakeEndpoint) isSubscribed(topicName string) bool {
+	return e.subscriber.IsSubscribed(topicName)
+}
+
+func dial(server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return conn
+}
+
+func request(conn *websocket.Conn, envelope *Envelope) *Envelope {
+	err := conn.WriteJSON(envelope)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return receive(conn)
+}
+
+func receive(conn *websocket.Conn) *Envelope {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var envelope Envelope
+	err := conn.ReadJSON(&envelope)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &envelope
+}
+
+func TestManager(t *testing.T) {
+	endpoint := newFakeEndpoint()
+	defer endpoint.subscriber.Stop()
+
+	m := NewManager(endpoint, nil)
+	defer m.Stop()
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	conn1 := dial(server)
+	defer conn1.Close()
+
+	conn2 := dial(server)
+	defer conn2.Close()
+
+	subscribe := &Envelope{
+		Message: topics.Message{TopicName: "some_topic", TopicType: "some_type"},
+		Action:  ActionSubscribe,
+	}
+
+	response := request(conn1, subscribe)
+	assert.Equal(t, ActionSubscribed, response.Action)
+	assert.True(t, endpoint.isSubscribed("some_topic"))
+
+	// one endpoint subscription per topic, so one type per topic
+	response = request(conn2, &Envelope{
+		Message: topics.Message{TopicName: "some_topic", TopicType: "some_other_type"},
+		Action:  ActionSubscribe,
+	})
+	assert.Equal(t, ActionError, response.Action)
+	assert.NotEmpty(t, response.Error)
+
+	response = request(conn2, subscribe)
+	assert.Equal(t, ActionSubscribed, response.Action)
+
+	// conn2's publication comes back to both connections (conn2's reply and message in whatever order)
+	err := conn2.WriteJSON(&Envelope{
+		Message: topics.Message{TopicName: "some_topic", TopicType: "some_type", Payload: []byte("Some payload")},
+		Action:  ActionPublish,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	message := receive(conn1)
+	assert.Equal(t, ActionMessage, message.Action)
+	assert.Equal(t, "some_topic", message.TopicName)
+	assert.Equal(t, []byte("Some payload"), message.Payload)
+	assert.Equal(t, DefaultExpiry, message.Expiry)
+
+	actions := []string{receive(conn2).Action, receive(conn2).Action}
+	assert.ElementsMatch(t, []string{ActionPublished, ActionMessage}, actions)
+
+	response = request(conn1, &Envelope{
+		Message: topics.Message{TopicName: "some_topic"},
+		Action:  ActionUnsubscribe,
+	})
+	assert.Equal(t, ActionUnsubscribed, response.Action)
+	assert.True(t, endpoint.isSubscribed("some_topic"))
+
+	// the last subscriber going away takes the endpoint subscription with it
+	_ = conn2.Close()
+
+	assert.Eventually(t, func() bool {
+		return !endpoint.isSubscribed("some_topic")
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestConnection_Backpressure(t *testing.T) {
+	c := &connection{
+		queue: make(chan *Envelope, QueueSize),
+		done:  make(chan struct{}),
+	}
+
+	// nothing's draining the queue (i.e. a browser that can't keep up)
+	for i := 0; i < QueueSize+10; i++ {
+		c.push(&Envelope{Action: ActionMessage})
+	}
+
+	assert.Equal(t, QueueSize, len(c.queue))
+	assert.Equal(t, int64(10), c.droppedCount)
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -14,6 +15,10 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
+// ErrEmptyOrUnset is what the Get*FromEnv functions (that can tell) return for a variable that isn't set, as opposed to
+// one that's set to something that can't be parsed
+var ErrEmptyOrUnset = errors.New("empty or unset")
+
 func WaitForCtrlC() {
 	var wg sync.WaitGroup
 
@@ -45,7 +50,7 @@ func getKSUIDFromEnv(key string) (ksuid.KSUID, error) {
 func getStringFromEnv(key string) (string, error) {
 	value := strings.TrimSpace(os.Getenv(key))
 	if value == "" {
-		return "", fmt.Errorf("empty or unset %v", key)
+		return "", fmt.Errorf("%w %v", ErrEmptyOrUnset, key)
 	}
 
 	return value, nil
@@ -62,6 +67,17 @@ func getIntFromEnv(key string) (int, error) {
 	return int(value), nil
 }
 
+func getBoolFromEnv(key string) (bool, error) {
+	rawValue := strings.TrimSpace(os.Getenv(key))
+
+	value, err := strconv.ParseBool(rawValue)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %v=%#+v as bool: %v", key, rawValue, err)
+	}
+
+	return value, nil
+}
+
 func getInt64FromEnv(key string) (int64, error) {
 	value, err := getIntFromEnv(key)
 	if err != nil {
@@ -74,7 +90,7 @@ func getInt64FromEnv(key string) (int64, error) {
 func getAddrFromEnv(key string) (*net.UDPAddr, error) {
 	rawValue := strings.TrimSpace(os.Getenv(key))
 	if rawValue == "" {
-		return nil, fmt.Errorf("empty or unset %v", key)
+		return nil, fmt.Errorf("%w %v", ErrEmptyOrUnset, key)
 	}
 
 	if rawValue == "0" {
@@ -89,6 +105,72 @@ func getAddrFromEnv(key string) (*net.UDPAddr, error) {
 	return addr, nil
 }
 
+func getAddrsFromEnv(key string) ([]*net.UDPAddr, error) {
+	rawValue := strings.TrimSpace(os.Getenv(key))
+	if rawValue == "" {
+		return nil, fmt.Errorf("%w %v", ErrEmptyOrUnset, key)
+	}
+
+	addrs := make([]*net.UDPAddr, 0)
+
+	for _, rawAddr := range strings.Split(rawValue, ",") {
+		rawAddr = strings.TrimSpace(rawAddr)
+		if rawAddr == "" {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr(network.GetNetwork(rawAddr), rawAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v=%#+v as UDP addresses: %v", key, rawValue, err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+func getStringsFromEnv(key string) ([]string, error) {
+	rawValue := strings.TrimSpace(os.Getenv(key))
+	if rawValue == "" {
+		return nil, fmt.Errorf("%w %v", ErrEmptyOrUnset, key)
+	}
+
+	values := make([]string, 0)
+
+	for _, value := range strings.Split(rawValue, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// getLabelsFromEnv parses e.g. "site=a, role=sensor"
+func getLabelsFromEnv(key string) (map[string]string, error) {
+	values, err := getStringsFromEnv(key)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("failed to parse %v=%#+v as key=value", key, value)
+		}
+
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return labels, nil
+}
+
 func getDurationFromEnv(key string) (time.Duration, error) {
 	rawValue := os.Getenv(key)
 
@@ -123,6 +205,18 @@ func GetEndpointNameFromEnv() (string, error) {
 	return getStringFromEnv("GLUE_ENDPOINT_NAME")
 }
 
+func GetEndpointPriorityFromEnv() (int64, error) {
+	return getInt64FromEnv("GLUE_ENDPOINT_PRIORITY")
+}
+
+func GetEndpointNameConflictPolicyFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_ENDPOINT_NAME_CONFLICT_POLICY")
+}
+
+func GetEndpointLabelsFromEnv() (map[string]string, error) {
+	return getLabelsFromEnv("GLUE_ENDPOINT_LABELS")
+}
+
 func GetListenAddressFromEnv() (*net.UDPAddr, error) {
 	return getAddrFromEnv("GLUE_LISTEN_ADDRESS")
 }
@@ -131,6 +225,58 @@ func GetListenInterfaceFromEnv() (string, error) {
 	return getStringFromEnv("GLUE_LISTEN_INTERFACE")
 }
 
+func GetSharedSocketFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_SHARED_SOCKET")
+}
+
+func GetMulticastTTLFromEnv() (int, error) {
+	return getIntFromEnv("GLUE_MULTICAST_TTL")
+}
+
+func GetMulticastLoopbackFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_MULTICAST_LOOPBACK")
+}
+
+func GetMulticastInterfaceFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_MULTICAST_INTERFACE")
+}
+
+func GetDiscoveryDSCPFromEnv() (int, error) {
+	return getIntFromEnv("GLUE_DISCOVERY_DSCP")
+}
+
+func GetAckDSCPFromEnv() (int, error) {
+	return getIntFromEnv("GLUE_ACK_DSCP")
+}
+
+func GetLocalFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_LOCAL")
+}
+
+func GetLocalAddressFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_LOCAL_ADDRESS")
+}
+
+func GetStreamFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_STREAM")
+}
+
+func GetStreamAddressFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_STREAM_ADDRESS")
+}
+
+func GetHostIDFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_HOST_ID")
+}
+
+func GetCapturePathFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_CAPTURE_PATH")
+}
+
+func GetCaptureMaxSizeFromEnv() (int64, error) {
+	return getInt64FromEnv("GLUE_CAPTURE_MAX_SIZE_BYTES")
+}
+
 func GetDiscoveryTargetAddressFromEnv() (*net.UDPAddr, error) {
 	return getAddrFromEnv("GLUE_DISCOVERY_TARGET_ADDRESS")
 }
@@ -139,10 +285,74 @@ func GetDiscoveryListenAddressFromEnv() (*net.UDPAddr, error) {
 	return getAddrFromEnv("GLUE_DISCOVERY_LISTEN_ADDRESS")
 }
 
+func GetDiscoverySeedAddressesFromEnv() ([]*net.UDPAddr, error) {
+	return getAddrsFromEnv("GLUE_DISCOVERY_SEED_ADDRESSES")
+}
+
+func GetDiscoverySeedsPathFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_DISCOVERY_SEEDS_PATH")
+}
+
+func GetDiscoveryRegistryAddressesFromEnv() ([]*net.UDPAddr, error) {
+	return getAddrsFromEnv("GLUE_DISCOVERY_REGISTRY_ADDRESSES")
+}
+
+func GetDiscoveryMDNSFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_DISCOVERY_MDNS")
+}
+
+func GetDiscoverySWIMFromEnv() (bool, error) {
+	return getBoolFromEnv("GLUE_DISCOVERY_SWIM")
+}
+
 func GetDiscoveryRateFromEnv() (time.Duration, error) {
 	return getDurationFromEnv("GLUE_DISCOVERY_RATE_MILLISECONDS")
 }
 
+func GetDiscoveryBurstRateFromEnv() (time.Duration, error) {
+	return getDurationFromEnv("GLUE_DISCOVERY_BURST_RATE_MILLISECONDS")
+}
+
 func GetDiscoveryRateTimeoutMultiplierFromEnv() (float64, error) {
 	return getFloat64FromEnv("GLUE_DISCOVERY_RATE_TIMEOUT_MULTIPLIER")
 }
+
+func GetRegistryListenAddressFromEnv() (*net.UDPAddr, error) {
+	return getAddrFromEnv("GLUE_REGISTRY_LISTEN_ADDRESS")
+}
+
+func GetRegistryPeerAddressesFromEnv() ([]*net.UDPAddr, error) {
+	return getAddrsFromEnv("GLUE_REGISTRY_PEER_ADDRESSES")
+}
+
+func GetRegistryHealthAddressFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_REGISTRY_HEALTH_ADDRESS")
+}
+
+func GetRelayListenAddressFromEnv(side string) (*net.UDPAddr, error) {
+	return getAddrFromEnv(fmt.Sprintf("GLUE_RELAY_%v_LISTEN_ADDRESS", side))
+}
+
+func GetRelayListenInterfaceFromEnv(side string) (string, error) {
+	return getStringFromEnv(fmt.Sprintf("GLUE_RELAY_%v_LISTEN_INTERFACE", side))
+}
+
+func GetRelayDiscoveryListenAddressFromEnv(side string) (*net.UDPAddr, error) {
+	return getAddrFromEnv(fmt.Sprintf("GLUE_RELAY_%v_DISCOVERY_LISTEN_ADDRESS", side))
+}
+
+func GetRelayDiscoveryTargetAddressFromEnv(side string) (*net.UDPAddr, error) {
+	return getAddrFromEnv(fmt.Sprintf("GLUE_RELAY_%v_DISCOVERY_TARGET_ADDRESS", side))
+}
+
+func GetRelayDiscoverySeedAddressesFromEnv(side string) ([]*net.UDPAddr, error) {
+	return getAddrsFromEnv(fmt.Sprintf("GLUE_RELAY_%v_DISCOVERY_SEED_ADDRESSES", side))
+}
+
+func GetWSGatewayListenAddressFromEnv() (string, error) {
+	return getStringFromEnv("GLUE_WS_GATEWAY_LISTEN_ADDRESS")
+}
+
+func GetWSGatewayAllowedOriginsFromEnv() ([]string, error) {
+	return getStringsFromEnv("GLUE_WS_GATEWAY_ALLOWED_ORIGINS")
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// BatchSize is the most datagrams read or written per syscall (on platforms with recvmmsg / sendmmsg; elsewhere a batch
+// is just a loop)
+const BatchSize = 64
+
+// bufferPool is where read buffers go when a read batch shrinks (and come from when one grows), so that a burst on one
+// socket after another doesn't mean allocating a fresh MaxDatagramSize buffer per message each time
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, MaxDatagramSize)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
+
+// a read batch that's been mostly empty for this many reads in a row (timeouts included) is halved
+const readBatchShrinkAfter = 16
+
+// batchConn is what ipv4.PacketConn and ipv6.PacketConn have in common (their Message types are the same type)
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func getBatchConn(conn *net.UDPConn) batchConn {
+	if GetNetwork(conn.LocalAddr().String()) == UDPv6 {
+		return ipv6.NewPacketConn(conn)
+	}
+
+	return ipv4.NewPacketConn(conn)
+}
+
+// readBatch is the messages a receiver reads into; every message needs room for the biggest datagram there could be, so
+// it starts out as just the one and only grows (up to BatchSize) while reads keep filling it, shrinking again once they
+// stop (so a quiet socket holds on to one MaxDatagramSize buffer rather than BatchSize of them, with the rest back in
+// bufferPool); it belongs to whatever goroutine is doing the reading
+type readBatch struct {
+	messages  []ipv4.Message
+	buffers   []*[]byte
+	underused int
+}
+
+func newReadBatch() *readBatch {
+	b := readBatch{
+		messages: make([]ipv4.Message, 0, BatchSize),
+		buffers:  make([]*[]byte, 0, BatchSize),
+	}
+
+	b.resize(1)
+
+	return &b
+}
+
+func (b *readBatch) resize(size int) {
+	// the dropped messages are cleared (rather than just sliced off) so that their buffers can go back to the pool
+	for i := size; i < len(b.messages); i++ {
+		putBuffer(b.buffers[i])
+		b.buffers[i] = nil
+		b.messages[i] = ipv4.Message{}
+	}
+
+	if size < len(b.messages) {
+		b.messages = b.messages[:size]
+		b.buffers = b.buffers[:size]
+		return
+	}
+
+	// within the capacity made up front, so growing never copies the messages
+	for len(b.messages) < size {
+		buffer := getBuffer()
+
+		b.buffers = append(b.buffers, buffer)
+		b.messages = append(b.messages, ipv4.Message{
+			Buffers: [][]byte{*buffer},
+		})
+	}
+}
+
+// update sizes the batch for the next read, given how many messages the last read got
+func (b *readBatch) update(n int) {
+	size := len(b.messages)
+
+	if n == size && size < BatchSize {
+		b.underused = 0
+		b.resize(min(size*2, BatchSize))
+		return
+	}
+
+	if n > size/4 || size == 1 {
+		b.underused = 0
+		return
+	}
+
+	b.underused++
+	if b.underused < readBatchShrinkAfter {
+		return
+	}
+
+	b.underused = 0
+	b.resize(size / 2)
+}
+
+// writeBatch writes all of bs (to dstAddr, or to wherever the conn is connected to if dstAddr is nil), as few syscalls
+// as it takes; oob (if any) is the control message for every datagram
+func writeBatch(conn batchConn, dstAddr *net.UDPAddr, bs [][]byte, oob []byte) error {
+	messages := make([]ipv4.Message, 0, len(bs))
+	for _, b := range bs {
+		message := ipv4.Message{
+			Buffers: [][]byte{b},
+			OOB:     oob,
+		}
+
+		if dstAddr != nil {
+			message.Addr = dstAddr
+		}
+
+		messages = append(messages, message)
+	}
+
+	for len(messages) > 0 {
+		batch := messages
+		if len(batch) > BatchSize {
+			batch = batch[:BatchSize]
+		}
+
+		n, err := conn.WriteBatch(batch, 0)
+		if err != nil {
+			return err
+		}
+
+		messages = messages[n:]
+	}
+
+	return nil
+}
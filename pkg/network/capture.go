@@ -0,0 +1,382 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureFiles is how many capture files are kept (the one being written included); the oldest is deleted to make room
+const CaptureFiles = 5
+
+// pcapng block types, options and link type (see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html)
+const (
+	pcapngSectionHeaderBlock   = 0x0A0D0D0A
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacketBlock  = 0x00000006
+	pcapngByteOrderMagic       = 0x1A2B3C4D
+	pcapngOptEndOfOpt          = 0
+	pcapngOptComment           = 1
+	pcapngOptSHBUserAppl       = 4
+	pcapngOptIFName            = 2
+	pcapngOptEPBFlags          = 2
+	pcapngFlagInbound          = 1
+	pcapngFlagOutbound         = 2
+	linkTypeRaw                = 101 // raw IPv4 / IPv6 (no link layer)
+)
+
+type CaptureDirection int
+
+const (
+	CaptureInbound CaptureDirection = iota
+	CaptureOutbound
+)
+
+// Capture writes datagrams to a pcapng file as raw IP packets (with the IP and UDP headers as they'd have been on the
+// wire, checksums and all) so that it can be opened in Wireshark; each packet carries a comment (see annotate) saying
+// what's in it; when the file gets bigger than maxSize it's rotated (to path.1, path.2 etc, see CaptureFiles)
+type Capture struct {
+	path     string
+	maxSize  int64
+	annotate func([]byte) string
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	ipID     uint16
+}
+
+func NewCapture(
+	path string,
+	maxSize int64,
+	annotate func([]byte) string,
+) *Capture {
+	c := Capture{
+		path:     path,
+		maxSize:  maxSize,
+		annotate: annotate,
+	}
+
+	return &c
+}
+
+func (c *Capture) open() error {
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file %v because %v", c.path, err)
+	}
+
+	c.file = file
+	c.writer = bufio.NewWriter(file)
+	c.size = 0
+
+	err = c.writeBlock(pcapngSectionHeaderBlock, getSectionHeaderBody())
+	if err != nil {
+		c.close()
+		return err
+	}
+
+	err = c.writeBlock(pcapngInterfaceDescription, getInterfaceDescriptionBody())
+	if err != nil {
+		c.close()
+		return err
+	}
+
+	log.Printf("capture opened: path=%#+v", c.path)
+
+	return nil
+}
+
+func (c *Capture) Open() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		return fmt.Errorf("cannot open, already opened")
+	}
+
+	return c.open()
+}
+
+// rotate shifts path to path.1 (path.1 to path.2 and so on, dropping the oldest) and starts a new path
+func (c *Capture) rotate() error {
+	c.close()
+
+	_ = os.Remove(fmt.Sprintf("%v.%v", c.path, CaptureFiles-1))
+
+	for i := CaptureFiles - 2; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%v.%v", c.path, i), fmt.Sprintf("%v.%v", c.path, i+1))
+	}
+
+	if CaptureFiles > 1 {
+		err := os.Rename(c.path, fmt.Sprintf("%v.1", c.path))
+		if err != nil {
+			return fmt.Errorf("failed to rotate capture file %v because %v", c.path, err)
+		}
+	}
+
+	return c.open()
+}
+
+func (c *Capture) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+
+	_, err := c.writer.Write(block)
+	if err != nil {
+		return fmt.Errorf("failed to write to capture file %v because %v", c.path, err)
+	}
+
+	c.size += int64(length)
+
+	return nil
+}
+
+// Write records a datagram that went from srcAddr to dstAddr; it never fails (a capture shouldn't get in the way of the
+// traffic it's capturing), problems are only logged
+func (c *Capture) Write(
+	direction CaptureDirection,
+	srcAddr *net.UDPAddr,
+	dstAddr *net.UDPAddr,
+	b []byte,
+) {
+	comment := ""
+	if c.annotate != nil {
+		comment = c.annotate(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return
+	}
+
+	c.ipID++
+	packet := getPacket(srcAddr, dstAddr, b, c.ipID)
+
+	body := getEnhancedPacketBody(time.Now(), direction, packet, comment)
+
+	if c.maxSize > 0 && c.size+int64(len(body)+12) > c.maxSize {
+		err := c.rotate()
+		if err != nil {
+			log.Printf("warning: failed to rotate capture: %v", err)
+			return
+		}
+	}
+
+	err := c.writeBlock(pcapngEnhancedPacketBlock, body)
+	if err != nil {
+		log.Printf("warning: failed to write capture: %v", err)
+		return
+	}
+
+	// so that a capture is usable even if we don't get to close it cleanly
+	err = c.writer.Flush()
+	if err != nil {
+		log.Printf("warning: failed to flush capture: %v", err)
+	}
+}
+
+func (c *Capture) close() {
+	if c.file == nil {
+		return
+	}
+
+	_ = c.writer.Flush()
+	_ = c.file.Close()
+
+	log.Printf("capture closed: path=%#+v", c.path)
+
+	c.file = nil
+	c.writer = nil
+	c.size = 0
+}
+
+func (c *Capture) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.close()
+}
+
+// appendOption appends a pcapng option (padded to 32 bits)
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+
+	return appendPadding(b, len(value))
+}
+
+func appendPadding(b []byte, length int) []byte {
+	for i := length; i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+func getSectionHeaderBody() []byte {
+	b := make([]byte, 0)
+	b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1) // major version
+	b = binary.LittleEndian.AppendUint16(b, 0) // minor version
+	b = binary.LittleEndian.AppendUint64(b, 0xFFFFFFFFFFFFFFFF)
+	b = appendOption(b, pcapngOptSHBUserAppl, []byte("glue"))
+	b = appendOption(b, pcapngOptEndOfOpt, nil)
+
+	return b
+}
+
+func getInterfaceDescriptionBody() []byte {
+	b := make([]byte, 0)
+	b = binary.LittleEndian.AppendUint16(b, linkTypeRaw)
+	b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+	b = binary.LittleEndian.AppendUint32(b, 0) // no snap length
+	b = appendOption(b, pcapngOptIFName, []byte("glue"))
+	b = appendOption(b, pcapngOptEndOfOpt, nil)
+
+	return b
+}
+
+func getEnhancedPacketBody(timestamp time.Time, direction CaptureDirection, packet []byte, comment string) []byte {
+	// the default timestamp resolution is microseconds
+	micros := uint64(timestamp.UnixMicro())
+
+	flags := uint32(pcapngFlagInbound)
+	if direction == CaptureOutbound {
+		flags = pcapngFlagOutbound
+	}
+
+	b := make([]byte, 0, 20+len(packet)+len(comment)+24)
+	b = binary.LittleEndian.AppendUint32(b, 0) // interface ID
+	b = binary.LittleEndian.AppendUint32(b, uint32(micros>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(micros))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet))) // captured length
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet))) // original length
+	b = append(b, packet...)
+	b = appendPadding(b, len(packet))
+
+	if comment != "" {
+		b = appendOption(b, pcapngOptComment, []byte(comment))
+	}
+
+	b = appendOption(b, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	b = appendOption(b, pcapngOptEndOfOpt, nil)
+
+	return b
+}
+
+// getPacket wraps the datagram in the UDP and IP headers it'd have had on the wire (IPv4 if both addresses are IPv4,
+// otherwise IPv6)
+func getPacket(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, b []byte, ipID uint16) []byte {
+	srcIP, dstIP := getIP(srcAddr), getIP(dstAddr)
+
+	udpLength := 8 + len(b)
+
+	udp := make([]byte, 0, udpLength)
+	udp = binary.BigEndian.AppendUint16(udp, uint16(getPort(srcAddr)))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(getPort(dstAddr)))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLength))
+	udp = binary.BigEndian.AppendUint16(udp, 0) // checksum (filled in below)
+	udp = append(udp, b...)
+
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+
+		pseudoHeader := make([]byte, 0, 12)
+		pseudoHeader = append(pseudoHeader, srcIP...)
+		pseudoHeader = append(pseudoHeader, dstIP...)
+		pseudoHeader = append(pseudoHeader, 0, 17)
+		pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(udpLength))
+
+		binary.BigEndian.PutUint16(udp[6:8], getUDPChecksum(pseudoHeader, udp))
+
+		ip := make([]byte, 0, 20+udpLength)
+		ip = append(ip, 0x45, 0) // version 4, 5 x 32-bit words of header; TOS
+		ip = binary.BigEndian.AppendUint16(ip, uint16(20+udpLength))
+		ip = binary.BigEndian.AppendUint16(ip, ipID)
+		ip = binary.BigEndian.AppendUint16(ip, 0x4000) // don't fragment
+		ip = append(ip, 64, 17)                        // TTL; protocol (UDP)
+		ip = binary.BigEndian.AppendUint16(ip, 0)      // checksum (filled in below)
+		ip = append(ip, srcIP...)
+		ip = append(ip, dstIP...)
+
+		binary.BigEndian.PutUint16(ip[10:12], ^getOnesComplementSum(0, ip))
+
+		return append(ip, udp...)
+	}
+
+	srcIP, dstIP = srcIP.To16(), dstIP.To16()
+
+	pseudoHeader := make([]byte, 0, 40)
+	pseudoHeader = append(pseudoHeader, srcIP...)
+	pseudoHeader = append(pseudoHeader, dstIP...)
+	pseudoHeader = binary.BigEndian.AppendUint32(pseudoHeader, uint32(udpLength))
+	pseudoHeader = append(pseudoHeader, 0, 0, 0, 17)
+
+	binary.BigEndian.PutUint16(udp[6:8], getUDPChecksum(pseudoHeader, udp))
+
+	ip := make([]byte, 0, 40+udpLength)
+	ip = binary.BigEndian.AppendUint32(ip, 0x60000000) // version 6; traffic class; flow label
+	ip = binary.BigEndian.AppendUint16(ip, uint16(udpLength))
+	ip = append(ip, 17, 64) // next header (UDP); hop limit
+	ip = append(ip, srcIP...)
+	ip = append(ip, dstIP...)
+
+	return append(ip, udp...)
+}
+
+func getIP(addr *net.UDPAddr) net.IP {
+	if addr == nil || addr.IP == nil {
+		return net.IPv4zero
+	}
+
+	return addr.IP
+}
+
+func getPort(addr *net.UDPAddr) int {
+	if addr == nil {
+		return 0
+	}
+
+	return addr.Port
+}
+
+func getOnesComplementSum(sum uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	for sum > 0xFFFF {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+
+	return uint16(sum)
+}
+
+func getUDPChecksum(pseudoHeader []byte, udp []byte) uint16 {
+	checksum := ^getOnesComplementSum(uint32(getOnesComplementSum(0, pseudoHeader)), udp)
+
+	// a checksum of 0 means "no checksum" (for IPv4), so a real 0 is sent as all ones
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+
+	return checksum
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MaxDSCP is the largest DSCP (it's 6 bits of the IPv4 TOS / IPv6 traffic class, the other 2 being ECN); 0 is best effort
+// (i.e. unmarked)
+const MaxDSCP = 63
+
+func CheckDSCP(dscp int) error {
+	if dscp < 0 || dscp > MaxDSCP {
+		return fmt.Errorf("DSCP %v not between 0 and %v", dscp, MaxDSCP)
+	}
+
+	return nil
+}
+
+// setDSCP marks everything sent from the socket with the given DSCP
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	var err error
+
+	if GetNetwork(conn.LocalAddr().String()) == UDPv6 {
+		err = ipv6.NewConn(conn).SetTrafficClass(dscp << 2)
+	} else {
+		err = ipv4.NewConn(conn).SetTOS(dscp << 2)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set DSCP to %v because %v", dscp, err)
+	}
+
+	return nil
+}
+
+// dscpManager is a Manager that marks everything it sends with a DSCP (see Manager.WithDSCP)
+type dscpManager struct {
+	*Manager
+	dscp int
+}
+
+func (d *dscpManager) Send(dstAddr *net.UDPAddr, b []byte) error {
+	return d.Manager.send(dstAddr, b, d.dscp)
+}
+
+func (d *dscpManager) SendBatch(dstAddr *net.UDPAddr, bs [][]byte) error {
+	return d.Manager.sendBatch(dstAddr, bs, d.dscp)
+}
+
+func (d *dscpManager) SendFrom(listenAddr *net.UDPAddr, interfaceName string, dstAddr *net.UDPAddr, b []byte) error {
+	return d.Manager.sendFrom(listenAddr, interfaceName, dstAddr, b, d.dscp)
+}
+
+func (d *dscpManager) WithDSCP(dscp int) Network {
+	return d.Manager.WithDSCP(dscp)
+}
+
+// Start and Stop are the underlying Manager's business
+func (d *dscpManager) Start() {
+	// noop
+}
+
+func (d *dscpManager) Stop() {
+	// noop
+}
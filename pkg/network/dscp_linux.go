@@ -0,0 +1,29 @@
+//go:build linux
+
+package network
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getDSCPControlMessage is the control message to mark a single datagram with the given DSCP (for sockets that send to
+// many destinations in many classes, like a shared socket, so can't just be marked as a whole)
+func getDSCPControlMessage(network string, dscp int) []byte {
+	b := make([]byte, unix.CmsgSpace(4))
+
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	if network == UDPv6 {
+		h.Level = unix.IPPROTO_IPV6
+		h.Type = unix.IPV6_TCLASS
+	} else {
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_TOS
+	}
+	h.SetLen(unix.CmsgLen(4))
+
+	*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(dscp << 2)
+
+	return b
+}
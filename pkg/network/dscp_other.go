@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+// getDSCPControlMessage has no portable equivalent here, so datagrams sent from sockets that can't be marked as a whole
+// (like a shared socket) go unmarked
+func getDSCPControlMessage(network string, dscp int) []byte {
+	return nil
+}
@@ -0,0 +1,558 @@
+package network
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// fabricSendPort is the source port of everything a FabricNode sends (other than via SendFrom)
+const fabricSendPort = 32768
+
+// LinkConfig is how a (one-way) link between two FabricNodes behaves; the probabilities are from 0 to 1
+type LinkConfig struct {
+	// every datagram takes this long
+	Latency time.Duration
+
+	// plus a random amount up to this
+	Jitter time.Duration
+
+	// a datagram is dropped
+	Loss float64
+
+	// a datagram arrives twice
+	Duplication float64
+
+	// a datagram is held back (by up to another Latency + Jitter) so that those sent after it can overtake it; otherwise
+	// datagrams on a link arrive in the order they were sent
+	Reordering float64
+
+	// nothing gets through (i.e. a one-way partition)
+	Down bool
+}
+
+type fabricLinkKey struct {
+	srcIP string
+	dstIP string
+}
+
+type fabricCallback struct {
+	listenAddr *net.UDPAddr
+	callback   func(*net.UDPAddr, *net.UDPAddr, []byte)
+}
+
+type fabricDelivery struct {
+	at      time.Time
+	seq     uint64
+	srcAddr *net.UDPAddr
+	dstAddr *net.UDPAddr
+	dstNode *FabricNode
+	data    []byte
+}
+
+type fabricDeliveries []*fabricDelivery
+
+func (d fabricDeliveries) Len() int { return len(d) }
+
+func (d fabricDeliveries) Less(i, j int) bool {
+	if d[i].at.Equal(d[j].at) {
+		return d[i].seq < d[j].seq
+	}
+
+	return d[i].at.Before(d[j].at)
+}
+
+func (d fabricDeliveries) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+func (d *fabricDeliveries) Push(x any) { *d = append(*d, x.(*fabricDelivery)) }
+
+func (d *fabricDeliveries) Pop() any {
+	old := *d
+	n := len(old)
+	x := old[n-1]
+	*d = old[:n-1]
+	return x
+}
+
+// Fabric is an in-memory network of FabricNodes (each of which stands in for a Manager on a host with a single IP);
+// links between nodes can be given latency, jitter, loss, duplication, reordering and partitions; the randomness comes
+// from the seed, but it's drawn in whatever order the senders' goroutines get to it and delivery runs on the wall clock,
+// so the same seed gives the same kind of impairment rather than the same packets being dropped every run
+//
+// datagrams are delivered one at a time, in order, from a single goroutine; so callbacks shouldn't block for long
+type Fabric struct {
+	mu                    sync.Mutex
+	rand                  *rand.Rand
+	defaultLink           LinkConfig
+	linkByLinkKey         map[fabricLinkKey]LinkConfig
+	partitionedByLinkKey  map[fabricLinkKey]bool
+	lastAtByLinkKey       map[fabricLinkKey]time.Time
+	nodes                 []*FabricNode
+	deliveries            fabricDeliveries
+	seq                   uint64
+	wake                  chan struct{}
+	done                  chan struct{}
+	started               bool
+	stopped               bool
+	sentCount             int64
+	deliveredCount        int64
+	droppedCount          int64
+	duplicatedCount       int64
+	reorderedCount        int64
+	partitionDroppedCount int64
+}
+
+func NewFabric(
+	seed int64,
+	defaultLink LinkConfig,
+) *Fabric {
+	return &Fabric{
+		rand:                 rand.New(rand.NewSource(seed)),
+		defaultLink:          defaultLink,
+		linkByLinkKey:        make(map[fabricLinkKey]LinkConfig),
+		partitionedByLinkKey: make(map[fabricLinkKey]bool),
+		lastAtByLinkKey:      make(map[fabricLinkKey]time.Time),
+		deliveries:           make(fabricDeliveries, 0),
+		wake:                 make(chan struct{}, 1),
+		done:                 make(chan struct{}),
+	}
+}
+
+// NewNode adds a node with the given IP (which must be unique within the fabric)
+func (f *Fabric) NewNode(ip net.IP) *FabricNode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := &FabricNode{
+		fabric:           f,
+		ip:               ip,
+		callbacks:        make([]*fabricCallback, 0),
+		multicastOptions: DefaultMulticastOptions(),
+	}
+
+	f.nodes = append(f.nodes, n)
+
+	return n
+}
+
+// SetLink changes how the link from srcIP to dstIP behaves (everything else uses the default link)
+func (f *Fabric) SetLink(srcIP net.IP, dstIP net.IP, link LinkConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.linkByLinkKey[fabricLinkKey{srcIP: srcIP.String(), dstIP: dstIP.String()}] = link
+}
+
+// Partition cuts every link (both ways) between the IPs in a and the IPs in b
+func (f *Fabric) Partition(a []net.IP, b []net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, ipA := range a {
+		for _, ipB := range b {
+			f.partitionedByLinkKey[fabricLinkKey{srcIP: ipA.String(), dstIP: ipB.String()}] = true
+			f.partitionedByLinkKey[fabricLinkKey{srcIP: ipB.String(), dstIP: ipA.String()}] = true
+		}
+	}
+}
+
+// Heal undoes every Partition (but not links set Down with SetLink)
+func (f *Fabric) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.partitionedByLinkKey = make(map[fabricLinkKey]bool)
+}
+
+// FabricStats is how many datagrams the fabric has seen and what happened to them
+type FabricStats struct {
+	Sent             int64
+	Delivered        int64
+	Dropped          int64
+	Duplicated       int64
+	Reordered        int64
+	PartitionDropped int64
+}
+
+func (f *Fabric) Stats() FabricStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return FabricStats{
+		Sent:             f.sentCount,
+		Delivered:        f.deliveredCount,
+		Dropped:          f.droppedCount,
+		Duplicated:       f.duplicatedCount,
+		Reordered:        f.reorderedCount,
+		PartitionDropped: f.partitionDroppedCount,
+	}
+}
+
+// be sure you're holding the mutex before calling this
+func (f *Fabric) getDstNodes(srcNode *FabricNode, dstAddr *net.UDPAddr) []*FabricNode {
+	if dstAddr.IP.IsMulticast() || dstAddr.IP.Equal(net.IPv4bcast) {
+		return f.nodes
+	}
+
+	if dstAddr.IP.IsLoopback() {
+		return []*FabricNode{srcNode}
+	}
+
+	for _, n := range f.nodes {
+		if n.ip.Equal(dstAddr.IP) {
+			return []*FabricNode{n}
+		}
+	}
+
+	return nil
+}
+
+// be sure you're holding the mutex before calling this
+func (f *Fabric) schedule(at time.Time, srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, dstNode *FabricNode, data []byte) {
+	f.seq++
+
+	heap.Push(&f.deliveries, &fabricDelivery{
+		at:      at,
+		seq:     f.seq,
+		srcAddr: srcAddr,
+		dstAddr: dstAddr,
+		dstNode: dstNode,
+		data:    data,
+	})
+}
+
+func (f *Fabric) send(srcNode *FabricNode, srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, b []byte) error {
+	f.mu.Lock()
+
+	if f.stopped {
+		f.mu.Unlock()
+		return fmt.Errorf("cannot send to %v from %v; fabric stopped", dstAddr.String(), srcAddr.String())
+	}
+
+	now := time.Now()
+
+	for _, dstNode := range f.getDstNodes(srcNode, dstAddr) {
+		// as with IP_MULTICAST_LOOP, our own multicast needn't come back to us
+		if dstNode == srcNode && dstAddr.IP.IsMulticast() && !srcNode.getMulticastOptions().Loopback {
+			continue
+		}
+
+		f.sentCount++
+
+		// the datagram is the receiver's to keep
+		data := make([]byte, len(b))
+		copy(data, b)
+
+		// talking to ourselves doesn't go over a link
+		if dstNode == srcNode {
+			f.schedule(now, srcAddr, dstAddr, dstNode, data)
+			continue
+		}
+
+		linkKey := fabricLinkKey{srcIP: srcNode.ip.String(), dstIP: dstNode.ip.String()}
+
+		link, ok := f.linkByLinkKey[linkKey]
+		if !ok {
+			link = f.defaultLink
+		}
+
+		if f.partitionedByLinkKey[linkKey] || link.Down {
+			f.partitionDroppedCount++
+			continue
+		}
+
+		if link.Loss > 0 && f.rand.Float64() < link.Loss {
+			f.droppedCount++
+			continue
+		}
+
+		copies := 1
+		if link.Duplication > 0 && f.rand.Float64() < link.Duplication {
+			f.duplicatedCount++
+			copies++
+		}
+
+		for i := 0; i < copies; i++ {
+			delay := link.Latency
+			if link.Jitter > 0 {
+				delay += time.Duration(f.rand.Int63n(int64(link.Jitter)))
+			}
+
+			at := now.Add(delay)
+
+			if link.Reordering > 0 && f.rand.Float64() < link.Reordering {
+				f.reorderedCount++
+				at = at.Add(time.Duration(f.rand.Int63n(int64(link.Latency+link.Jitter) + int64(time.Millisecond))))
+			} else {
+				// everything else stays in order
+				lastAt := f.lastAtByLinkKey[linkKey]
+				if at.Before(lastAt) {
+					at = lastAt
+				}
+				f.lastAtByLinkKey[linkKey] = at
+			}
+
+			f.schedule(at, srcAddr, dstAddr, dstNode, data)
+		}
+	}
+
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// deliver hands a datagram to every callback on the node listening for it
+func (f *Fabric) deliver(d *fabricDelivery) {
+	callbacks := d.dstNode.getCallbacks(d.dstAddr)
+
+	f.mu.Lock()
+	f.deliveredCount++
+	f.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(d.srcAddr, d.dstAddr, d.data)
+	}
+}
+
+func (f *Fabric) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		f.mu.Lock()
+
+		due := make([]*fabricDelivery, 0)
+		now := time.Now()
+		for f.deliveries.Len() > 0 && !f.deliveries[0].at.After(now) {
+			due = append(due, heap.Pop(&f.deliveries).(*fabricDelivery))
+		}
+
+		wait := time.Hour
+		if f.deliveries.Len() > 0 {
+			wait = f.deliveries[0].at.Sub(now)
+		}
+
+		f.mu.Unlock()
+
+		for _, d := range due {
+			f.deliver(d)
+		}
+
+		if len(due) > 0 {
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-f.done:
+			return
+		case <-f.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+func (f *Fabric) Start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.started {
+		return
+	}
+
+	f.started = true
+
+	go f.run()
+}
+
+func (f *Fabric) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.started || f.stopped {
+		return
+	}
+
+	f.stopped = true
+
+	close(f.done)
+}
+
+// FabricNode is a Network on a Fabric; it stands in for a Manager on a host with a single IP (interface names are
+// ignored)
+type FabricNode struct {
+	mu               sync.Mutex
+	fabric           *Fabric
+	ip               net.IP
+	callbacks        []*fabricCallback
+	multicastOptions MulticastOptions
+}
+
+var _ Network = &FabricNode{}
+
+func (n *FabricNode) IP() net.IP {
+	return n.ip
+}
+
+// UseMulticastOptions is Manager.UseMulticastOptions; only Loopback means anything on a Fabric (which is a single hop
+// with a single interface)
+func (n *FabricNode) UseMulticastOptions(multicastOptions MulticastOptions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.multicastOptions = multicastOptions
+}
+
+func (n *FabricNode) getMulticastOptions() MulticastOptions {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.multicastOptions
+}
+
+// WithDSCP is Manager.WithDSCP; a Fabric has no headers to mark, so it's the node itself
+func (n *FabricNode) WithDSCP(dscp int) Network {
+	return n
+}
+
+func (n *FabricNode) getSrcIP(dstAddr *net.UDPAddr) net.IP {
+	if dstAddr.IP.IsLoopback() {
+		return dstAddr.IP
+	}
+
+	return n.ip
+}
+
+func (n *FabricNode) getCallbacks(dstAddr *net.UDPAddr) []func(*net.UDPAddr, *net.UDPAddr, []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	callbacks := make([]func(*net.UDPAddr, *net.UDPAddr, []byte), 0)
+
+	for _, c := range n.callbacks {
+		if c.listenAddr.Port != dstAddr.Port {
+			continue
+		}
+
+		listenIP := c.listenAddr.IP
+
+		if dstAddr.IP.IsMulticast() {
+			if !listenIP.Equal(dstAddr.IP) {
+				continue
+			}
+		} else if dstAddr.IP.Equal(net.IPv4bcast) {
+			if !(listenIP == nil || listenIP.IsUnspecified()) {
+				continue
+			}
+		} else if !(listenIP == nil || listenIP.IsUnspecified() || listenIP.Equal(dstAddr.IP)) {
+			continue
+		}
+
+		callbacks = append(callbacks, c.callback)
+	}
+
+	return callbacks
+}
+
+func (n *FabricNode) GetRawSrcAddr(dstAddr *net.UDPAddr) (*net.UDPAddr, error) {
+	return &net.UDPAddr{IP: n.getSrcIP(dstAddr), Port: fabricSendPort}, nil
+}
+
+func (n *FabricNode) Send(dstAddr *net.UDPAddr, b []byte) error {
+	srcAddr, _ := n.GetRawSrcAddr(dstAddr)
+
+	return n.fabric.send(n, srcAddr, dstAddr, b)
+}
+
+func (n *FabricNode) SendBatch(dstAddr *net.UDPAddr, bs [][]byte) error {
+	for _, b := range bs {
+		err := n.Send(dstAddr, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *FabricNode) SendFrom(listenAddr *net.UDPAddr, interfaceName string, dstAddr *net.UDPAddr, b []byte) error {
+	srcAddr := &net.UDPAddr{IP: n.getSrcIP(dstAddr), Port: listenAddr.Port}
+
+	return n.fabric.send(n, srcAddr, dstAddr, b)
+}
+
+func (n *FabricNode) RegisterCallback(
+	dstAddr *net.UDPAddr,
+	interfaceName string,
+	callback func(*net.UDPAddr, *net.UDPAddr, []byte),
+) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, c := range n.callbacks {
+		if c.listenAddr.String() == dstAddr.String() && reflect.ValueOf(c.callback).Pointer() == reflect.ValueOf(callback).Pointer() {
+			return fmt.Errorf(
+				"cannot register callback %#+v; already registered",
+				runtime.FuncForPC(reflect.ValueOf(callback).Pointer()).Name(),
+			)
+		}
+	}
+
+	n.callbacks = append(n.callbacks, &fabricCallback{
+		listenAddr: dstAddr,
+		callback:   callback,
+	})
+
+	return nil
+}
+
+func (n *FabricNode) UnregisterCallback(
+	dstAddr *net.UDPAddr,
+	interfaceName string,
+	callback func(*net.UDPAddr, *net.UDPAddr, []byte),
+) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, c := range n.callbacks {
+		if c.listenAddr.String() == dstAddr.String() && reflect.ValueOf(c.callback).Pointer() == reflect.ValueOf(callback).Pointer() {
+			n.callbacks = append(n.callbacks[:i], n.callbacks[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"cannot unregister callback %#+v; not registered",
+		runtime.FuncForPC(reflect.ValueOf(callback).Pointer()).Name(),
+	)
+}
+
+// Start does nothing (the Fabric is started as a whole)
+func (n *FabricNode) Start() {
+	// noop
+}
+
+// Stop drops all the node's callbacks (as if its sockets were closed)
+func (n *FabricNode) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.callbacks = make([]*fabricCallback, 0)
+}
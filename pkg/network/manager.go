@@ -8,6 +8,7 @@ import (
 
 type senderKey struct {
 	rawDstAddr string
+	dscp       int
 }
 
 type receiverKey struct {
@@ -19,20 +20,188 @@ type Manager struct {
 	mu                    sync.Mutex
 	senderBySenderKey     map[senderKey]*Sender
 	receiverByReceiverKey map[receiverKey]*Receiver
+	sharedListenAddr      *net.UDPAddr
+	sharedInterfaceName   string
+	multicastOptions      MulticastOptions
+	srcIPByRawDstAddr     map[string]net.IP
+	monitor               *Monitor
+	onInterfaceChange     func()
+	capture               *Capture
 }
 
 func NewManager() *Manager {
-	return &Manager{
+	m := Manager{
 		senderBySenderKey:     make(map[senderKey]*Sender),
 		receiverByReceiverKey: make(map[receiverKey]*Receiver),
+		srcIPByRawDstAddr:     make(map[string]net.IP),
+		multicastOptions:      DefaultMulticastOptions(),
+	}
+
+	m.monitor = NewMonitor(
+		MonitorPollRate,
+		m.handleInterfaceChange,
+	)
+
+	return &m
+}
+
+// OnInterfaceChange sets a callback for after the manager has recovered from an interface or address change (e.g. so
+// that we can tell everyone where we are now); it should be called before Start
+func (m *Manager) OnInterfaceChange(onInterfaceChange func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onInterfaceChange = onInterfaceChange
+}
+
+// handleInterfaceChange rebinds every receiver and has every sender reconnect; sockets bound to (or joined to groups on)
+// an interface that's gone or changed address otherwise stay broken, and a connected socket keeps sending from the old
+// source address
+func (m *Manager) handleInterfaceChange() {
+	m.mu.Lock()
+
+	for _, sender := range m.senderBySenderKey {
+		sender.Reset()
+	}
+
+	for _, receiver := range m.receiverByReceiverKey {
+		receiver.Reset()
+	}
+
+	// routes may have changed too
+	m.srcIPByRawDstAddr = make(map[string]net.IP)
+
+	onInterfaceChange := m.onInterfaceChange
+
+	m.mu.Unlock()
+
+	if onInterfaceChange != nil {
+		onInterfaceChange()
 	}
 }
 
+// UseSharedSocket makes everything go out from the (unconnected) socket listening on the given listen address / interface
+// rather than from a connected socket per destination; so the source port of everything we send is our listen port (which
+// is kinder to firewalls and NAT) and there are no per-destination sockets to hold open; it should be called before Start
+func (m *Manager) UseSharedSocket(
+	listenAddr *net.UDPAddr,
+	interfaceName string,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sharedListenAddr = listenAddr
+	m.sharedInterfaceName = interfaceName
+}
+
+// UseMulticastOptions sets the TTL, loopback and outbound interface for multicast we send (see MulticastOptions); it
+// should be called before Start
+func (m *Manager) UseMulticastOptions(multicastOptions MulticastOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.multicastOptions = multicastOptions
+}
+
+// UseCapture has every datagram we send or receive written to the capture (see Capture); it should be called before Start
+func (m *Manager) UseCapture(capture *Capture) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.capture = capture
+}
+
+// captureSent records datagrams we've sent from the given socket address (see UseCapture); an unspecified address (e.g.
+// a shared socket listening on all interfaces) is recorded as the address the route to the destination is via
+func (m *Manager) captureSent(
+	srcAddr *net.UDPAddr,
+	dstAddr *net.UDPAddr,
+	bs ...[]byte,
+) {
+	m.mu.Lock()
+	capture := m.capture
+	m.mu.Unlock()
+
+	if capture == nil {
+		return
+	}
+
+	if srcAddr.IP == nil || srcAddr.IP.IsUnspecified() {
+		srcIP, err := m.getSrcIP(dstAddr)
+		if err == nil {
+			srcAddr = &net.UDPAddr{IP: srcIP, Port: srcAddr.Port}
+		}
+	}
+
+	for _, b := range bs {
+		capture.Write(CaptureOutbound, srcAddr, dstAddr, b)
+	}
+}
+
+// getSharedReceiver returns the receiver for the shared socket (if there is one and it can reach the destination)
+func (m *Manager) getSharedReceiver(
+	dstAddr *net.UDPAddr,
+) (*Receiver, bool, error) {
+	m.mu.Lock()
+	sharedListenAddr := m.sharedListenAddr
+	sharedInterfaceName := m.sharedInterfaceName
+	m.mu.Unlock()
+
+	// an IPv4 socket can't send to an IPv6 destination (and vice versa); that falls back to a sender
+	if sharedListenAddr == nil || GetNetwork(sharedListenAddr.String()) != GetNetwork(dstAddr.String()) {
+		return nil, false, nil
+	}
+
+	receiver, err := m.GetReceiver(sharedListenAddr, sharedInterfaceName)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return receiver, true, nil
+}
+
+// getSrcIP is the source IP the kernel would pick for the destination (i.e. the IP of the interface the route is via); it's
+// remembered so that it only costs a socket the first time
+func (m *Manager) getSrcIP(
+	dstAddr *net.UDPAddr,
+) (net.IP, error) {
+	m.mu.Lock()
+	srcIP, ok := m.srcIPByRawDstAddr[dstAddr.String()]
+	m.mu.Unlock()
+
+	if ok {
+		return srcIP, nil
+	}
+
+	conn, err := GetSenderConn(dstAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	srcIP = conn.LocalAddr().(*net.UDPAddr).IP
+	_ = conn.Close()
+
+	m.mu.Lock()
+	m.srcIPByRawDstAddr[dstAddr.String()] = srcIP
+	m.mu.Unlock()
+
+	return srcIP, nil
+}
+
 func (m *Manager) GetSender(
 	dstAddr *net.UDPAddr,
+) (*Sender, error) {
+	return m.getSender(dstAddr, 0)
+}
+
+// getSender is GetSender for a class of traffic; each class gets its own socket, marked with its DSCP
+func (m *Manager) getSender(
+	dstAddr *net.UDPAddr,
+	dscp int,
 ) (*Sender, error) {
 	senderKey := senderKey{
 		rawDstAddr: dstAddr.String(),
+		dscp:       dscp,
 	}
 
 	m.mu.Lock()
@@ -42,7 +211,7 @@ func (m *Manager) GetSender(
 
 	sender, ok := m.senderBySenderKey[senderKey]
 	if !ok || sender == nil {
-		sender = NewSender(dstAddr)
+		sender = NewSender(dstAddr, m.multicastOptions, dscp)
 
 		err = sender.Open()
 		if err != nil {
@@ -71,7 +240,8 @@ func (m *Manager) GetReceiver(
 
 	receiver, ok := m.receiverByReceiverKey[receiverKey]
 	if !ok || receiver == nil {
-		receiver = NewReceiver(dstAddr, interfaceName)
+		receiver = NewReceiver(dstAddr, interfaceName, m.multicastOptions)
+		receiver.capture = m.capture
 
 		err = receiver.Open()
 		if err != nil {
@@ -87,6 +257,26 @@ func (m *Manager) GetReceiver(
 func (m *Manager) GetRawSrcAddr(
 	dstAddr *net.UDPAddr,
 ) (*net.UDPAddr, error) {
+	receiver, ok, err := m.getSharedReceiver(dstAddr)
+	if err != nil {
+		return nil, fmt.Errorf("network manager failed to get shared receiver while getting src addr for %v: %v", dstAddr.String(), err)
+	}
+
+	if ok {
+		srcAddr := receiver.GetListenAddr()
+
+		if srcAddr.IP == nil || srcAddr.IP.IsUnspecified() {
+			srcIP, err := m.getSrcIP(dstAddr)
+			if err != nil {
+				return nil, fmt.Errorf("network manager failed to get src ip for %v: %v", dstAddr.String(), err)
+			}
+
+			srcAddr.IP = srcIP
+		}
+
+		return srcAddr, nil
+	}
+
 	sender, err := m.GetSender(dstAddr)
 	if err != nil {
 		return nil, fmt.Errorf("network manager failed to get sender while getting src addr for %v: %v", dstAddr.String(), err)
@@ -100,11 +290,49 @@ func (m *Manager) GetRawSrcAddr(
 	return srcAddr, nil
 }
 
+// WithDSCP is the manager as seen by a class of traffic (e.g. discovery, or a time-critical topic); everything sent via
+// what it returns is marked with the given DSCP, so that switches and routers can prioritise it; a DSCP of 0 (best
+// effort) is the manager itself
+func (m *Manager) WithDSCP(dscp int) Network {
+	if dscp == 0 {
+		return m
+	}
+
+	return &dscpManager{
+		Manager: m,
+		dscp:    dscp,
+	}
+}
+
 func (m *Manager) Send(
 	dstAddr *net.UDPAddr,
 	b []byte,
 ) error {
-	sender, err := m.GetSender(dstAddr)
+	return m.send(dstAddr, b, 0)
+}
+
+func (m *Manager) send(
+	dstAddr *net.UDPAddr,
+	b []byte,
+	dscp int,
+) error {
+	receiver, ok, err := m.getSharedReceiver(dstAddr)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		err = receiver.sendTo(dstAddr, b, dscp)
+		if err != nil {
+			return err
+		}
+
+		m.captureSent(receiver.GetListenAddr(), dstAddr, b)
+
+		return nil
+	}
+
+	sender, err := m.getSender(dstAddr, dscp)
 	if err != nil {
 		return err
 	}
@@ -112,9 +340,96 @@ func (m *Manager) Send(
 	err = sender.Send(b)
 	if err != nil {
 		sender.Close()
+		return err
+	}
+
+	srcAddr, err := sender.GetRawSrcAddr()
+	if err == nil {
+		m.captureSent(srcAddr, dstAddr, b)
+	}
+
+	return nil
+}
+
+// SendBatch is Send for several datagrams to the same destination, with as few syscalls as possible
+func (m *Manager) SendBatch(
+	dstAddr *net.UDPAddr,
+	bs [][]byte,
+) error {
+	return m.sendBatch(dstAddr, bs, 0)
+}
+
+func (m *Manager) sendBatch(
+	dstAddr *net.UDPAddr,
+	bs [][]byte,
+	dscp int,
+) error {
+	receiver, ok, err := m.getSharedReceiver(dstAddr)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		err = receiver.sendToBatch(dstAddr, bs, dscp)
+		if err != nil {
+			return err
+		}
+
+		m.captureSent(receiver.GetListenAddr(), dstAddr, bs...)
+
+		return nil
+	}
+
+	sender, err := m.getSender(dstAddr, dscp)
+	if err != nil {
+		return err
+	}
+
+	err = sender.SendBatch(bs)
+	if err != nil {
+		sender.Close()
+		return err
+	}
+
+	srcAddr, err := sender.GetRawSrcAddr()
+	if err == nil {
+		m.captureSent(srcAddr, dstAddr, bs...)
+	}
+
+	return nil
+}
+
+// SendFrom sends using the socket of the receiver for the given listen address / interface (e.g. for protocols like
+// mDNS where the source port matters)
+func (m *Manager) SendFrom(
+	listenAddr *net.UDPAddr,
+	interfaceName string,
+	dstAddr *net.UDPAddr,
+	b []byte,
+) error {
+	return m.sendFrom(listenAddr, interfaceName, dstAddr, b, 0)
+}
+
+func (m *Manager) sendFrom(
+	listenAddr *net.UDPAddr,
+	interfaceName string,
+	dstAddr *net.UDPAddr,
+	b []byte,
+	dscp int,
+) error {
+	receiver, err := m.GetReceiver(listenAddr, interfaceName)
+	if err != nil {
+		return err
+	}
+
+	err = receiver.sendTo(dstAddr, b, dscp)
+	if err != nil {
+		return err
 	}
 
-	return err
+	m.captureSent(receiver.GetListenAddr(), dstAddr, b)
+
+	return nil
 }
 
 func (m *Manager) RegisterCallback(
@@ -145,10 +460,12 @@ func (m *Manager) UnregisterCallback(
 }
 
 func (m *Manager) Start() {
-	// noop
+	m.monitor.Start()
 }
 
 func (m *Manager) Stop() {
+	m.monitor.Stop()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
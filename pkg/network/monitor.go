@@ -0,0 +1,161 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MonitorPollRate is how often interfaces and addresses are checked where there's nothing to tell us they've changed
+// (and, as a safety net, how often they're checked anyway where there is)
+const MonitorPollRate = time.Second * 2
+
+// monitorSettlePeriod is how long to wait after being told something's changing before looking (a single change, like a
+// DHCP renewal, tends to come as a flurry of events)
+const monitorSettlePeriod = time.Millisecond * 500
+
+// getInterfaceSnapshot describes every interface that's up and the addresses on it; two snapshots differ if anything that
+// would change what we bind to or send from has
+func getInterfaceSnapshot() (string, error) {
+	intfcs, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0)
+
+	for _, intfc := range intfcs {
+		if intfc.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := intfc.Addrs()
+		if err != nil {
+			return "", err
+		}
+
+		rawAddrs := make([]string, 0)
+		for _, addr := range addrs {
+			rawAddrs = append(rawAddrs, addr.String())
+		}
+
+		sort.Strings(rawAddrs)
+
+		lines = append(lines, fmt.Sprintf("%v/%v/%v", intfc.Index, intfc.Name, strings.Join(rawAddrs, ",")))
+	}
+
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Monitor watches for interfaces coming and going and addresses changing (e.g. a laptop moving between networks, or a
+// DHCP lease changing an address); it's told about changes by netlink on Linux and polls elsewhere
+type Monitor struct {
+	mu          sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	pollRate    time.Duration
+	onChange    func()
+	getSnapshot func() (string, error)
+}
+
+// NewMonitor calls onChange (from its own goroutine) whenever an interface or address has changed since it last looked
+func NewMonitor(
+	pollRate time.Duration,
+	onChange func(),
+) *Monitor {
+	return &Monitor{
+		pollRate:    pollRate,
+		onChange:    onChange,
+		getSnapshot: getInterfaceSnapshot,
+	}
+}
+
+func (m *Monitor) run(ctx context.Context, lastSnapshot string) {
+	defer m.wg.Done()
+
+	changes, err := watchInterfaces(ctx)
+	if err != nil {
+		log.Printf("warning: monitor failed to watch interfaces (polling every %v instead): %v", m.pollRate, err)
+	}
+
+	ticker := time.NewTicker(m.pollRate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(monitorSettlePeriod):
+			}
+
+			// anything that came in while we waited is covered by the look we're about to take
+			select {
+			case <-changes:
+			default:
+			}
+		}
+
+		snapshot, err := m.getSnapshot()
+		if err != nil {
+			log.Printf("warning: monitor failed to get interfaces: %v", err)
+			continue
+		}
+
+		if snapshot == lastSnapshot {
+			continue
+		}
+
+		lastSnapshot = snapshot
+
+		log.Printf("interfaces or addresses changed")
+
+		m.onChange()
+	}
+}
+
+func (m *Monitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel != nil {
+		return
+	}
+
+	snapshot, err := m.getSnapshot()
+	if err != nil {
+		log.Printf("warning: monitor failed to get interfaces: %v", err)
+	}
+
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run(m.ctx, snapshot)
+}
+
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.cancel = nil
+	m.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+
+	m.wg.Wait()
+}
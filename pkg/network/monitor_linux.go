@@ -0,0 +1,66 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchInterfaces signals (at least once) whenever the kernel tells us about a link or address change, by subscribing to
+// the relevant rtnetlink groups; the messages themselves aren't parsed, as Monitor looks for itself
+func watchInterfaces(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	})
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	// closing the socket doesn't wake a blocked read, so the read times out instead to notice the context is done
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1})
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer func() {
+			_ = unix.Close(fd)
+		}()
+
+		b := make([]byte, 65536)
+
+		for ctx.Err() == nil {
+			_, _, err := unix.Recvfrom(fd, b, 0)
+			if err != nil {
+				if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+					continue
+				}
+
+				// e.g. ENOBUFS if we fell behind; we've missed something, so have a look anyway
+				if !errors.Is(err, unix.ENOBUFS) {
+					return
+				}
+			}
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes, nil
+}
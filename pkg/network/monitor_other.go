@@ -0,0 +1,12 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+)
+
+// watchInterfaces has nothing to watch here (the nil channel never fires), so Monitor just polls
+func watchInterfaces(ctx context.Context) (<-chan struct{}, error) {
+	return nil, nil
+}
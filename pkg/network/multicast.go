@@ -0,0 +1,89 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MulticastOptions control how multicast (e.g. discovery announcements) is sent
+type MulticastOptions struct {
+	// how many hops multicast may take; 1 keeps it on the local network, more lets it cross routers set up for multicast
+	// routing
+	TTL int
+
+	// whether multicast we send is also delivered to sockets on this host (ours included); turning it off keeps an
+	// endpoint from hearing its own announcements (and other endpoints on the same host from hearing them at all)
+	Loopback bool
+
+	// the interface multicast goes out of; empty for the listen interface of the socket it's sent from (or the
+	// interface of the default route for a socket that isn't listening on one)
+	InterfaceName string
+}
+
+// DefaultMulticastOptions are the same as the system defaults (i.e. what you get if you don't set anything)
+func DefaultMulticastOptions() MulticastOptions {
+	return MulticastOptions{
+		TTL:      1,
+		Loopback: true,
+	}
+}
+
+// setMulticastOptions applies the options to a socket that sends multicast; intfc is the interface to send from unless
+// options.InterfaceName says otherwise (nil leaves it to the routing table)
+func setMulticastOptions(conn *net.UDPConn, intfc *net.Interface, options MulticastOptions) error {
+	if options.InterfaceName != "" {
+		var err error
+
+		intfc, err = net.InterfaceByName(options.InterfaceName)
+		if err != nil {
+			return fmt.Errorf("failed to get multicast interface because %v", err)
+		}
+	}
+
+	if GetNetwork(conn.LocalAddr().String()) == UDPv6 {
+		packetConn := ipv6.NewPacketConn(conn)
+
+		err := packetConn.SetMulticastHopLimit(options.TTL)
+		if err != nil {
+			return fmt.Errorf("failed to set multicast hop limit to %v because %v", options.TTL, err)
+		}
+
+		err = packetConn.SetMulticastLoopback(options.Loopback)
+		if err != nil {
+			return fmt.Errorf("failed to set multicast loopback to %v because %v", options.Loopback, err)
+		}
+
+		if intfc != nil {
+			err = packetConn.SetMulticastInterface(intfc)
+			if err != nil {
+				return fmt.Errorf("failed to set multicast interface to %v because %v", intfc.Name, err)
+			}
+		}
+
+		return nil
+	}
+
+	packetConn := ipv4.NewPacketConn(conn)
+
+	err := packetConn.SetMulticastTTL(options.TTL)
+	if err != nil {
+		return fmt.Errorf("failed to set multicast TTL to %v because %v", options.TTL, err)
+	}
+
+	err = packetConn.SetMulticastLoopback(options.Loopback)
+	if err != nil {
+		return fmt.Errorf("failed to set multicast loopback to %v because %v", options.Loopback, err)
+	}
+
+	if intfc != nil {
+		err = packetConn.SetMulticastInterface(intfc)
+		if err != nil {
+			return fmt.Errorf("failed to set multicast interface to %v because %v", intfc.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package network
+
+import (
+	"net"
+)
+
+// Network is what the layers above need from the network; Manager is the real (UDP) thing and Fabric provides in-memory
+// ones for tests
+type Network interface {
+	GetRawSrcAddr(dstAddr *net.UDPAddr) (*net.UDPAddr, error)
+	Send(dstAddr *net.UDPAddr, b []byte) error
+	SendBatch(dstAddr *net.UDPAddr, bs [][]byte) error
+	SendFrom(listenAddr *net.UDPAddr, interfaceName string, dstAddr *net.UDPAddr, b []byte) error
+	RegisterCallback(dstAddr *net.UDPAddr, interfaceName string, callback func(*net.UDPAddr, *net.UDPAddr, []byte)) error
+	UnregisterCallback(dstAddr *net.UDPAddr, interfaceName string, callback func(*net.UDPAddr, *net.UDPAddr, []byte)) error
+	WithDSCP(dscp int) Network
+	Start()
+	Stop()
+}
+
+var _ Network = &Manager{}
@@ -1,12 +1,17 @@
 package network
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
 )
 
 func TestIntegration_Manager(t *testing.T) {
@@ -102,3 +107,787 @@ func TestGetDefaultInterface(t *testing.T) {
 
 	assert.NotEmpty(t, addr)
 }
+
+func TestManager_SharedSocket(t *testing.T) {
+	listenAddr1, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27331")
+	listenAddr2, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27332")
+
+	received := make(chan *net.UDPAddr, 16)
+
+	m1 := NewManager()
+	m1.UseSharedSocket(listenAddr1, "lo")
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := NewManager()
+	m2.UseSharedSocket(listenAddr2, "lo")
+	m2.Start()
+	defer m2.Stop()
+
+	err := m1.RegisterCallback(listenAddr1, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = m2.RegisterCallback(listenAddr2, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received <- srcAddr
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srcAddr, err := m1.GetRawSrcAddr(listenAddr2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, listenAddr1.String(), srcAddr.String())
+
+	err = m1.Send(listenAddr2, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case srcAddr := <-received:
+		assert.Equal(t, listenAddr1.String(), srcAddr.String())
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting to receive")
+	}
+
+	// no per-destination sockets
+	assert.Equal(t, 0, len(m1.senderBySenderKey))
+}
+
+func TestManager_DSCP(t *testing.T) {
+	listenAddr1, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27333")
+	listenAddr2, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27334")
+
+	received := make(chan []byte, 16)
+
+	m1 := NewManager()
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := NewManager()
+	m2.UseSharedSocket(listenAddr2, "lo")
+	m2.Start()
+	defer m2.Stop()
+
+	err := m1.RegisterCallback(listenAddr1, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received <- data
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = m2.RegisterCallback(listenAddr2, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// callbacks are called concurrently, so a batch may be received in any order
+	expect := func(expected ...string) {
+		actual := make([]string, 0)
+
+		for range expected {
+			select {
+			case data := <-received:
+				actual = append(actual, string(data))
+			case <-time.After(time.Second):
+				assert.Fail(t, "timed out waiting to receive")
+			}
+		}
+
+		assert.ElementsMatch(t, expected, actual)
+	}
+
+	// a class gets its own marked socket...
+	err = m1.WithDSCP(46).Send(listenAddr1, []byte("Expedited"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect("Expedited")
+
+	err = m1.Send(listenAddr1, []byte("Best effort"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect("Best effort")
+
+	sender, err := m1.getSender(listenAddr1, 46)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := sender.getConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tos, err := ipv4.NewConn(conn).TOS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, 46<<2, tos)
+	assert.Equal(t, 2, len(m1.senderBySenderKey))
+
+	// ... whereas a shared socket marks each datagram
+	err = m2.WithDSCP(46).Send(listenAddr1, []byte("Shared"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect("Shared")
+
+	err = m2.WithDSCP(46).SendBatch(listenAddr1, [][]byte{[]byte("Shared 1"), []byte("Shared 2")})
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect("Shared 1", "Shared 2")
+
+	assert.Equal(t, 0, len(m2.senderBySenderKey))
+}
+
+func TestReadBatch(t *testing.T) {
+	b := newReadBatch()
+	assert.Equal(t, 1, len(b.messages))
+
+	// grows while reads fill it...
+	for _, expected := range []int{2, 4, 8, 16, 32, 64, 64} {
+		b.update(len(b.messages))
+		assert.Equal(t, expected, len(b.messages))
+	}
+
+	for _, message := range b.messages {
+		assert.Equal(t, MaxDatagramSize, len(message.Buffers[0]))
+	}
+
+	// ... and isn't shrunk by the odd quiet read...
+	for i := 0; i < readBatchShrinkAfter-1; i++ {
+		b.update(0)
+	}
+	b.update(BatchSize / 2)
+	assert.Equal(t, BatchSize, len(b.messages))
+
+	// ... but halves when reads stay quiet (and never goes below one)
+	for _, expected := range []int{32, 16, 8, 4, 2, 1, 1} {
+		for i := 0; i < readBatchShrinkAfter; i++ {
+			b.update(0)
+		}
+		assert.Equal(t, expected, len(b.messages))
+	}
+
+	// the dropped messages don't keep hold of their buffers (they've gone back to the pool)...
+	for _, message := range b.messages[1:BatchSize] {
+		assert.Nil(t, message.Buffers)
+	}
+
+	for _, buffer := range b.buffers[1:BatchSize] {
+		assert.Nil(t, buffer)
+	}
+
+	// ... and growing again reuses the same messages
+	messages := b.messages[:BatchSize]
+	b.resize(BatchSize)
+	assert.Same(t, &messages[0], &b.messages[0])
+	assert.Equal(t, MaxDatagramSize, len(b.messages[BatchSize-1].Buffers[0]))
+}
+
+// benchmarkManager sends packets to itself over loopback a window at a time (waiting for each window to be received so
+// that the socket buffer never overflows); each op is one packet sent and received
+func benchmarkManager(b *testing.B, listenPort int, batched bool) {
+	listenAddr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", listenPort))
+
+	received := make(chan struct{}, 65536)
+
+	m := NewManager()
+	m.Start()
+	defer m.Stop()
+
+	err := m.RegisterCallback(listenAddr, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received <- struct{}{}
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const window = 16
+
+	payload := make([]byte, 1024)
+
+	bs := make([][]byte, window)
+	for i := range bs {
+		bs[i] = payload
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	started := time.Now()
+
+	for i := 0; i < b.N; i += window {
+		n := window
+		if b.N-i < n {
+			n = b.N - i
+		}
+
+		if batched {
+			err = m.SendBatch(listenAddr, bs[:n])
+			if err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			for j := 0; j < n; j++ {
+				err = m.Send(listenAddr, payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+
+		for j := 0; j < n; j++ {
+			select {
+			case <-received:
+			case <-time.After(time.Second):
+				b.Fatal("timed out waiting to receive")
+			}
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/time.Since(started).Seconds(), "packets/s")
+}
+
+func BenchmarkManager_Send(b *testing.B) {
+	benchmarkManager(b, 27341, false)
+}
+
+func BenchmarkManager_SendBatch(b *testing.B) {
+	benchmarkManager(b, 27342, true)
+}
+
+// getMulticastInterfaceName is the first interface that's up and can do multicast (the test is skipped if there isn't one)
+func getMulticastInterfaceName(t *testing.T) string {
+	intfcs, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("failed to get interfaces: %v", err)
+	}
+
+	for _, intfc := range intfcs {
+		if intfc.Flags&net.FlagUp != 0 && intfc.Flags&net.FlagMulticast != 0 && intfc.Flags&net.FlagLoopback == 0 {
+			return intfc.Name
+		}
+	}
+
+	t.Skip("no interface that can do multicast")
+
+	return ""
+}
+
+func TestManager_SharedPort(t *testing.T) {
+	multicastAddr, _ := net.ResolveUDPAddr("udp4", "239.192.137.1:27351")
+	interfaceName := getMulticastInterfaceName(t)
+
+	// as if two processes on one host were listening for discovery announcements on the same port
+	received1 := make(chan []byte, 16)
+	received2 := make(chan []byte, 16)
+
+	m1 := NewManager()
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := NewManager()
+	m2.Start()
+	defer m2.Stop()
+
+	m3 := NewManager()
+	m3.Start()
+	defer m3.Stop()
+
+	err := m1.RegisterCallback(multicastAddr, interfaceName, func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received1 <- data
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = m2.RegisterCallback(multicastAddr, interfaceName, func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received2 <- data
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = m3.Send(multicastAddr, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, received := range []chan []byte{received1, received2} {
+		select {
+		case data := <-received:
+			assert.Equal(t, []byte("Hello, world!"), data)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting to receive")
+		}
+	}
+}
+
+func TestGetReceiverConn_Unshared(t *testing.T) {
+	listenAddr, _ := net.ResolveUDPAddr("udp4", "0.0.0.0:27352")
+
+	conn1, err := GetReceiverConn(listenAddr, nil, DefaultMulticastOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		_ = conn1.Close()
+	}()
+
+	// unicast would be split between the sockets rather than copied to both, so the second can't have it
+	conn2, err := GetReceiverConn(listenAddr, nil, DefaultMulticastOptions())
+	if err == nil {
+		_ = conn2.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestSender_MulticastOptions(t *testing.T) {
+	multicastAddr, _ := net.ResolveUDPAddr("udp4", "239.192.137.1:27363")
+
+	for _, multicastOptions := range []MulticastOptions{
+		DefaultMulticastOptions(),
+		{TTL: 8, Loopback: false},
+	} {
+		s := NewSender(multicastAddr, multicastOptions, 0)
+
+		err := s.Open()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		conn, err := s.getConn()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		packetConn := ipv4.NewPacketConn(conn)
+
+		ttl, err := packetConn.MulticastTTL()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		loopback, err := packetConn.MulticastLoopback()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		assert.Equal(t, multicastOptions.TTL, ttl)
+		assert.Equal(t, multicastOptions.Loopback, loopback)
+
+		s.Close()
+	}
+}
+
+func TestFabric(t *testing.T) {
+	ipA := net.ParseIP("10.0.0.1")
+	ipB := net.ParseIP("10.0.0.2")
+	ipC := net.ParseIP("10.0.0.3")
+
+	listenAddr, _ := net.ResolveUDPAddr("udp4", "0.0.0.0:27361")
+	multicastAddr, _ := net.ResolveUDPAddr("udp4", "239.192.137.1:27362")
+
+	f := NewFabric(1, LinkConfig{Latency: time.Millisecond})
+	f.Start()
+	defer f.Stop()
+
+	received := make(map[string]chan *net.UDPAddr)
+
+	for _, ip := range []net.IP{ipA, ipB, ipC} {
+		n := f.NewNode(ip)
+		c := make(chan *net.UDPAddr, 16)
+		received[ip.String()] = c
+
+		callback := func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+			c <- srcAddr
+		}
+
+		err := n.RegisterCallback(listenAddr, "", callback)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = n.RegisterCallback(multicastAddr, "", callback)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	nodeA := f.nodes[0]
+
+	expect := func(ip net.IP, srcIP net.IP) {
+		select {
+		case srcAddr := <-received[ip.String()]:
+			assert.Equal(t, srcIP.String(), srcAddr.IP.String())
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting to receive", ip.String())
+		}
+	}
+
+	expectNothing := func(ip net.IP) {
+		select {
+		case srcAddr := <-received[ip.String()]:
+			assert.Fail(t, "unexpectedly received", "%v from %v", ip.String(), srcAddr.String())
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	// unicast only reaches the node with that IP
+	err := nodeA.Send(&net.UDPAddr{IP: ipB, Port: listenAddr.Port}, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect(ipB, ipA)
+	expectNothing(ipC)
+
+	// multicast reaches everyone listening (including the sender)
+	err = nodeA.Send(multicastAddr, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect(ipA, ipA)
+	expect(ipB, ipA)
+	expect(ipC, ipA)
+
+	f.Partition([]net.IP{ipA}, []net.IP{ipB})
+
+	err = nodeA.Send(multicastAddr, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect(ipA, ipA)
+	expect(ipC, ipA)
+	expectNothing(ipB)
+
+	f.Heal()
+
+	err = nodeA.Send(&net.UDPAddr{IP: ipB, Port: listenAddr.Port}, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect(ipB, ipA)
+
+	// without multicast loopback the sender no longer hears itself
+	nodeA.UseMulticastOptions(MulticastOptions{TTL: 1, Loopback: false})
+
+	err = nodeA.Send(multicastAddr, []byte("Hello, world!"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect(ipB, ipA)
+	expect(ipC, ipA)
+	expectNothing(ipA)
+
+	assert.Equal(t, int64(1), f.Stats().PartitionDropped)
+}
+
+func TestFabric_Link(t *testing.T) {
+	ipA := net.ParseIP("10.0.0.1")
+	ipB := net.ParseIP("10.0.0.2")
+
+	listenAddr := &net.UDPAddr{IP: ipB, Port: 27363}
+
+	run := func(link LinkConfig) ([]int, FabricStats) {
+		f := NewFabric(1, link)
+		f.Start()
+		defer f.Stop()
+
+		nodeA := f.NewNode(ipA)
+		nodeB := f.NewNode(ipB)
+
+		received := make(chan int, 1024)
+
+		err := nodeB.RegisterCallback(listenAddr, "", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+			received <- int(data[0])<<8 | int(data[1])
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for i := 0; i < 256; i++ {
+			err = nodeA.Send(listenAddr, []byte{byte(i >> 8), byte(i)})
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		time.Sleep(link.Latency*4 + link.Jitter*4 + time.Millisecond*100)
+
+		order := make([]int, 0)
+		for len(received) > 0 {
+			order = append(order, <-received)
+		}
+
+		return order, f.Stats()
+	}
+
+	// a perfect link keeps everything in order
+	order, stats := run(LinkConfig{Latency: time.Millisecond, Jitter: time.Millisecond})
+	assert.Equal(t, 256, len(order))
+	for i := range order {
+		assert.Equal(t, i, order[i])
+	}
+	assert.Equal(t, int64(256), stats.Delivered)
+
+	link := LinkConfig{
+		Latency:     time.Millisecond * 5,
+		Jitter:      time.Millisecond,
+		Loss:        0.1,
+		Duplication: 0.1,
+		Reordering:  0.1,
+	}
+
+	order1, stats1 := run(link)
+	order2, stats2 := run(link)
+
+	// the same seed does the same thing to the same traffic (although reordered datagrams may land differently)
+	assert.Equal(t, stats1, stats2)
+	assert.Equal(t, len(order1), len(order2))
+
+	assert.Greater(t, stats1.Dropped, int64(0))
+	assert.Greater(t, stats1.Duplicated, int64(0))
+	assert.Greater(t, stats1.Reordered, int64(0))
+	assert.Equal(t, stats1.Sent-stats1.Dropped+stats1.Duplicated, stats1.Delivered)
+	assert.Equal(t, int(stats1.Delivered), len(order1))
+}
+
+func TestStreamManager(t *testing.T) {
+	socketDir := t.TempDir()
+
+	received := make(chan []byte, 16)
+
+	m1 := NewStreamManager("unix", filepath.Join(socketDir, "1.sock"), func(srcAddress string, data []byte) {})
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := NewStreamManager("unix", filepath.Join(socketDir, "2.sock"), func(srcAddress string, data []byte) {
+		received <- data
+	})
+	m2.Start()
+
+	payload := make([]byte, MaxDatagramSize*4)
+	payload[len(payload)-1] = 1
+
+	// the first send only starts connecting (and fails straight away, rather than waiting for it)...
+	err := m1.Send(m2.GetListenAddress(), payload)
+	assert.Error(t, err)
+
+	// ... and later ones go once it's connected
+	assert.Eventually(t, func() bool {
+		return m1.Send(m2.GetListenAddress(), payload) == nil
+	}, time.Second, time.Millisecond*10)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, payload, data)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting to receive")
+	}
+
+	// the peer going away fails sends (rather than them silently going nowhere)...
+	dstAddress := m2.GetListenAddress()
+	m2.Stop()
+
+	assert.Eventually(t, func() bool {
+		return m1.Send(dstAddress, payload) != nil
+	}, time.Second, time.Millisecond*10)
+
+	// ... until it comes back
+	m2.Start()
+	defer m2.Stop()
+
+	assert.Eventually(t, func() bool {
+		return m1.Send(dstAddress, []byte("Hello, world!")) == nil
+	}, time.Second*5, time.Millisecond*100)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, []byte("Hello, world!"), data)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting to receive")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	changed := make(chan struct{}, 16)
+
+	snapshots := make(chan string, 16)
+	snapshots <- "eth0/192.168.1.2"
+
+	m := NewMonitor(time.Millisecond*10, func() {
+		changed <- struct{}{}
+	})
+
+	lastSnapshot := ""
+	m.getSnapshot = func() (string, error) {
+		select {
+		case lastSnapshot = <-snapshots:
+		default:
+		}
+
+		return lastSnapshot, nil
+	}
+
+	m.Start()
+	defer m.Stop()
+
+	// nothing's changed since we started
+	select {
+	case <-changed:
+		assert.Fail(t, "unexpected change")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	snapshots <- "eth0/192.168.1.3"
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for change")
+	}
+
+	// and only once per change
+	select {
+	case <-changed:
+		assert.Fail(t, "unexpected change")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestManager_InterfaceChange(t *testing.T) {
+	listenAddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27352")
+
+	received := make(chan []byte, 16)
+	changed := make(chan struct{}, 16)
+
+	m1 := NewManager()
+	m1.OnInterfaceChange(func() {
+		changed <- struct{}{}
+	})
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := NewManager()
+	m2.Start()
+	defer m2.Stop()
+
+	err := m1.RegisterCallback(listenAddr, "lo", func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+		received <- data
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = m2.Send(listenAddr, []byte("Before"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		assert.Equal(t, []byte("Before"), data)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting to receive")
+	}
+
+	// as if the monitor had seen a change; the receiver is rebound (and the sender reconnected) behind the scenes
+	m1.handleInterfaceChange()
+	m2.handleInterfaceChange()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for change")
+	}
+
+	assert.Eventually(t, func() bool {
+		err = m2.Send(listenAddr, []byte("After"))
+		if err != nil {
+			return false
+		}
+
+		select {
+		case data := <-received:
+			return assert.Equal(t, []byte("After"), data)
+		case <-time.After(time.Millisecond * 100):
+			return false
+		}
+	}, time.Second*5, time.Millisecond*100)
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glue.pcapng")
+
+	capture := NewCapture(path, 1024, func(b []byte) string {
+		return fmt.Sprintf("glue: %v", string(b))
+	})
+
+	err := capture.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srcAddr, _ := net.ResolveUDPAddr("udp4", "192.168.1.2:27321")
+	dstAddr, _ := net.ResolveUDPAddr("udp4", "239.192.137.1:27320")
+
+	capture.Write(CaptureOutbound, srcAddr, dstAddr, []byte("Hello, world!"))
+	capture.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// section header, interface description and one enhanced packet block; each starts with its type and then its length
+	assert.Equal(t, uint32(0x0A0D0D0A), binary.LittleEndian.Uint32(data[0:4]))
+	data = data[binary.LittleEndian.Uint32(data[4:8]):]
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(data[0:4]))
+	assert.Equal(t, uint16(101), binary.LittleEndian.Uint16(data[8:10]))
+	data = data[binary.LittleEndian.Uint32(data[4:8]):]
+	assert.Equal(t, uint32(6), binary.LittleEndian.Uint32(data[0:4]))
+	assert.Equal(t, int(binary.LittleEndian.Uint32(data[4:8])), len(data))
+	assert.Contains(t, string(data), "glue: Hello, world!")
+
+	packet := data[28 : 28+binary.LittleEndian.Uint32(data[20:24])]
+	assert.Equal(t, 20+8+len("Hello, world!"), len(packet))
+
+	// a header with a correct checksum sums to all ones
+	assert.Equal(t, uint16(0xFFFF), getOnesComplementSum(0, packet[:20]))
+	assert.Equal(t, net.ParseIP("192.168.1.2").To4(), net.IP(packet[12:16]))
+	assert.Equal(t, net.ParseIP("239.192.137.1").To4(), net.IP(packet[16:20]))
+
+	pseudoHeader := append(append([]byte{}, packet[12:20]...), 0, 17, 0, byte(len(packet)-20))
+	assert.Equal(t, uint16(0xFFFF), getOnesComplementSum(uint32(getOnesComplementSum(0, pseudoHeader)), packet[20:]))
+	assert.Equal(t, uint16(27321), binary.BigEndian.Uint16(packet[20:22]))
+	assert.Equal(t, uint16(27320), binary.BigEndian.Uint16(packet[22:24]))
+	assert.Equal(t, []byte("Hello, world!"), packet[28:])
+
+	// past the max size, the file is rotated
+	err = capture.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < 32; i++ {
+		capture.Write(CaptureInbound, dstAddr, srcAddr, []byte("Hello, world!"))
+	}
+	capture.Close()
+
+	for _, rotatedPath := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(rotatedPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		assert.LessOrEqual(t, info.Size(), int64(1024))
+	}
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -11,27 +12,62 @@ import (
 	"time"
 
 	"github.com/segmentio/ksuid"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 
 	"github.com/initialed85/glue/pkg/worker"
 )
 
 const Timeout = time.Second * 1
 
-func GetReceiverConn(addr *net.UDPAddr, intfc *net.Interface) (conn *net.UDPConn, err error) {
+// isShareable is true for addresses that several sockets (e.g. several endpoints on one host) may bind at once and each
+// still get every datagram; i.e. multicast groups and the limited broadcast address; for anything else (including the
+// unspecified address) the kernel would spread unicast datagrams across the sockets rather than copying them, so that's
+// left to fail to bind as usual
+func isShareable(addr *net.UDPAddr) bool {
+	return addr.IP.IsMulticast() || addr.IP.Equal(net.IPv4bcast)
+}
+
+func GetReceiverConn(addr *net.UDPAddr, intfc *net.Interface, multicastOptions MulticastOptions) (conn *net.UDPConn, err error) {
 	network := GetNetwork(addr.String())
 
+	listenConfig := net.ListenConfig{}
+	if isShareable(addr) {
+		listenConfig.Control = setReuse
+	}
+
+	packetConn, err := listenConfig.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		err = fmt.Errorf("failed to ListenPacket because %v", err)
+		return
+	}
+
+	conn = packetConn.(*net.UDPConn)
+
 	if addr.IP.IsMulticast() {
-		conn, err = net.ListenMulticastUDP(network, intfc, addr)
-		if err != nil {
-			err = fmt.Errorf("failed to ListenMulticastUDP because %v", err)
-			return
+		group := &net.UDPAddr{IP: addr.IP}
+
+		if network == UDPv6 {
+			err = ipv6.NewPacketConn(conn).JoinGroup(intfc, group)
+		} else {
+			err = ipv4.NewPacketConn(conn).JoinGroup(intfc, group)
 		}
-	} else {
-		conn, err = net.ListenUDP(network, addr)
 		if err != nil {
-			err = fmt.Errorf("failed to ListenUDP because %v", err)
+			_ = conn.Close()
+			err = fmt.Errorf("failed to join multicast group %v because %v", addr.String(), err)
 			return
 		}
+
+		// anything sent from this socket goes out of the interface we joined on
+		err = setMulticastOptions(conn, intfc, multicastOptions)
+	} else {
+		// this socket may still send multicast (e.g. as a shared socket); where it goes out is left to the routing table
+		// unless we've been told otherwise
+		err = setMulticastOptions(conn, nil, multicastOptions)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return
 	}
 
 	err = conn.SetReadBuffer(MaxDatagramSize)
@@ -40,45 +76,35 @@ func GetReceiverConn(addr *net.UDPAddr, intfc *net.Interface) (conn *net.UDPConn
 		return
 	}
 
-	// TODO: seems to cause SetDeadline to be ignored by ReadFromUDP (blocks forever)
-	// /*
-	// 	file, err := conn.File()
-	// 	if err != nil {
-	// 		err = fmt.Errorf("failed to File for the socket because %v", err)
-	// 		return
-	// 	}
-	//
-	// 	fd := int(file.Fd())
-	//
-	// 	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-	// 	if err != nil {
-	// 		err = fmt.Errorf("failed to set SO_REUSADDR on the socket's file descriptor because %v", err)
-	// 		return
-	// 	}
-	// */
-
 	return
 }
 
 type Receiver struct {
-	interfaceName string
-	dstAddr       *net.UDPAddr
-	srcAddr       *net.UDPAddr
-	conn          *net.UDPConn
-	mu            sync.Mutex
-	opened        bool
-	worker        *worker.BlockedWorker
-	callbacks     map[ksuid.KSUID]func(*net.UDPAddr, *net.UDPAddr, []byte)
+	interfaceName    string
+	multicastOptions MulticastOptions
+	dstAddr          *net.UDPAddr
+	srcAddr          *net.UDPAddr
+	conn             *net.UDPConn
+	batchConn        batchConn
+	readBatch        *readBatch
+	mu               sync.Mutex
+	opened           bool
+	worker           *worker.BlockedWorker
+	callbacks        map[ksuid.KSUID]func(*net.UDPAddr, *net.UDPAddr, []byte)
+	capture          *Capture
 }
 
 func NewReceiver(
 	dstAddr *net.UDPAddr,
 	interfaceName string,
+	multicastOptions MulticastOptions,
 ) *Receiver {
 	r := Receiver{
-		dstAddr:       dstAddr,
-		interfaceName: interfaceName,
-		callbacks:     make(map[ksuid.KSUID]func(*net.UDPAddr, *net.UDPAddr, []byte)),
+		dstAddr:          dstAddr,
+		interfaceName:    interfaceName,
+		multicastOptions: multicastOptions,
+		readBatch:        newReadBatch(),
+		callbacks:        make(map[ksuid.KSUID]func(*net.UDPAddr, *net.UDPAddr, []byte)),
 	}
 
 	r.worker = worker.NewBlockedWorker(
@@ -93,6 +119,7 @@ func NewReceiver(
 func (r *Receiver) work() {
 	r.mu.Lock()
 	conn := r.conn
+	batchConn := r.batchConn
 
 	if conn == nil {
 		r.close()
@@ -109,6 +136,7 @@ func (r *Receiver) work() {
 			return
 		}
 		conn = r.conn
+		batchConn = r.batchConn
 	}
 	r.mu.Unlock()
 
@@ -117,9 +145,12 @@ func (r *Receiver) work() {
 		panic(fmt.Errorf("caught %#+v during SetDeadline; cannot continue", err))
 	}
 
-	b := make([]byte, MaxDatagramSize)
+	// the read batch is only ever touched here (so it's safe from close, even mid-read) and is read into again next time,
+	// so each datagram is copied out before it's handed on to the callbacks
+	messages := r.readBatch.messages
 
-	n, srcAddr, err := conn.ReadFromUDP(b)
+	n, err := batchConn.ReadBatch(messages, 0)
+	r.readBatch.update(n)
 	if err != nil {
 		if !strings.Contains(err.Error(), "timeout") {
 			log.Printf("warning: Receive had error trying to read: %v", err)
@@ -127,14 +158,42 @@ func (r *Receiver) work() {
 		return
 	}
 
-	data := b[:n]
-
 	r.mu.Lock()
-	for _, callback := range r.callbacks {
-		// TODO: fix unbounded goroutine use
-		go callback(srcAddr, r.dstAddr, data)
+	defer r.mu.Unlock()
+
+	// closed while we were reading
+	if r.conn != conn {
+		return
 	}
-	r.mu.Unlock()
+
+	for _, message := range messages[:n] {
+		srcAddr, ok := message.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, message.N)
+		copy(data, message.Buffers[0][:message.N])
+
+		if r.capture != nil {
+			r.capture.Write(CaptureInbound, srcAddr, r.getCaptureDstAddr(), data)
+		}
+
+		for _, callback := range r.callbacks {
+			// TODO: fix unbounded goroutine use
+			go callback(srcAddr, r.dstAddr, data)
+		}
+	}
+}
+
+// getCaptureDstAddr is where received datagrams were sent to, as far as a capture is concerned; for a socket listening
+// on all interfaces that's taken to be the address of the listen interface
+func (r *Receiver) getCaptureDstAddr() *net.UDPAddr {
+	if (r.dstAddr.IP == nil || r.dstAddr.IP.IsUnspecified()) && r.srcAddr != nil && r.srcAddr.IP != nil {
+		return &net.UDPAddr{IP: r.srcAddr.IP, Port: r.conn.LocalAddr().(*net.UDPAddr).Port}
+	}
+
+	return r.dstAddr
 }
 
 func (r *Receiver) RegisterCallback(
@@ -192,13 +251,80 @@ func (r *Receiver) UnregisterCallback(
 	return nil
 }
 
+// GetListenAddr is the address the receiver's socket is actually bound to (e.g. with the real port if it was asked for
+// port 0)
+func (r *Receiver) GetListenAddr() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil {
+		listenAddr := *r.conn.LocalAddr().(*net.UDPAddr)
+		return &listenAddr
+	}
+
+	listenAddr := *r.dstAddr
+	return &listenAddr
+}
+
+// SendTo sends from the receiver's own socket (i.e. with the receiver's port as the source port); it fails if the
+// receiver hasn't managed to open its socket yet
+func (r *Receiver) SendTo(dstAddr *net.UDPAddr, b []byte) error {
+	return r.sendTo(dstAddr, b, 0)
+}
+
+// sendTo is SendTo with each datagram marked with the given DSCP (the socket itself being shared by every class)
+func (r *Receiver) sendTo(dstAddr *net.UDPAddr, b []byte, dscp int) error {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("cannot send to %v from %v; receiver not yet opened", dstAddr.String(), r.dstAddr.String())
+	}
+
+	var err error
+
+	if dscp != 0 {
+		_, _, err = conn.WriteMsgUDP(b, getDSCPControlMessage(GetNetwork(dstAddr.String()), dscp), dstAddr)
+	} else {
+		_, err = conn.WriteToUDP(b, dstAddr)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendToBatch is SendTo for several datagrams at once (see BatchSize)
+func (r *Receiver) SendToBatch(dstAddr *net.UDPAddr, bs [][]byte) error {
+	return r.sendToBatch(dstAddr, bs, 0)
+}
+
+func (r *Receiver) sendToBatch(dstAddr *net.UDPAddr, bs [][]byte, dscp int) error {
+	r.mu.Lock()
+	batchConn := r.batchConn
+	r.mu.Unlock()
+
+	if batchConn == nil {
+		return fmt.Errorf("cannot send to %v from %v; receiver not yet opened", dstAddr.String(), r.dstAddr.String())
+	}
+
+	var oob []byte
+	if dscp != 0 {
+		oob = getDSCPControlMessage(GetNetwork(dstAddr.String()), dscp)
+	}
+
+	return writeBatch(batchConn, dstAddr, bs, oob)
+}
+
 func (r *Receiver) open() error {
 	dstAddr, intfc, srcAddr, err := GetAddressesAndInterfaces(r.interfaceName, r.dstAddr.String())
 	if err != nil {
 		return err
 	}
 
-	conn, err := GetReceiverConn(dstAddr, intfc)
+	conn, err := GetReceiverConn(dstAddr, intfc, r.multicastOptions)
 	if err != nil {
 		return err
 	}
@@ -206,6 +332,7 @@ func (r *Receiver) open() error {
 	r.dstAddr = dstAddr
 	r.srcAddr = srcAddr
 	r.conn = conn
+	r.batchConn = getBatchConn(conn)
 
 	log.Printf("receiver opened: dst=%+#v, src=%#+v", r.dstAddr.String(), r.srcAddr.String())
 
@@ -219,6 +346,14 @@ func (r *Receiver) Open() error {
 		return fmt.Errorf("cannot open, already opened")
 	}
 	r.opened = true
+
+	// try to open straight away so that the socket is usable (e.g. by SendTo) as soon as we return; if this fails, the
+	// worker will keep trying
+	err := r.open()
+	if err != nil {
+		log.Printf("warning: failed to open receiver for %v: %v", r.dstAddr.String(), err)
+		r.close()
+	}
 	r.mu.Unlock()
 
 	r.worker.Start()
@@ -234,6 +369,20 @@ func (r *Receiver) close() {
 
 	r.srcAddr = nil
 	r.conn = nil
+	r.batchConn = nil
+}
+
+// Reset closes the receiver's socket (if it has one) without closing the receiver; the worker opens a new one (i.e.
+// binding and joining any multicast group afresh, e.g. after an interface change)
+func (r *Receiver) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.opened {
+		return
+	}
+
+	r.close()
 }
 
 func (r *Receiver) Close() {
@@ -20,18 +20,25 @@ func GetSenderConn(addr *net.UDPAddr, srcAddr *net.UDPAddr) (conn *net.UDPConn,
 }
 
 type Sender struct {
-	srcAddr *net.UDPAddr
-	dstAddr *net.UDPAddr
-	mu      sync.Mutex
-	conn    *net.UDPConn
-	opened  bool
+	srcAddr          *net.UDPAddr
+	dstAddr          *net.UDPAddr
+	multicastOptions MulticastOptions
+	dscp             int
+	mu               sync.Mutex
+	conn             *net.UDPConn
+	batchConn        batchConn
+	opened           bool
 }
 
 func NewSender(
 	dstAddr *net.UDPAddr,
+	multicastOptions MulticastOptions,
+	dscp int,
 ) *Sender {
 	s := Sender{
-		dstAddr: dstAddr,
+		dstAddr:          dstAddr,
+		multicastOptions: multicastOptions,
+		dscp:             dscp,
 	}
 
 	return &s
@@ -43,7 +50,24 @@ func (s *Sender) open() error {
 		return err
 	}
 
+	if s.dstAddr.IP.IsMulticast() {
+		err = setMulticastOptions(conn, nil, s.multicastOptions)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
+	if s.dscp != 0 {
+		err = setDSCP(conn, s.dscp)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
 	s.conn = conn
+	s.batchConn = getBatchConn(conn)
 	s.srcAddr = conn.LocalAddr().(*net.UDPAddr)
 
 	log.Printf("sender opened: dst=%#+v", s.dstAddr.String())
@@ -107,6 +131,24 @@ func (s *Sender) Send(b []byte) error {
 	return nil
 }
 
+// SendBatch is Send for several datagrams at once (see BatchSize)
+func (s *Sender) SendBatch(bs [][]byte) error {
+	_, err := s.getConn()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	batchConn := s.batchConn
+	s.mu.Unlock()
+
+	if batchConn == nil {
+		return fmt.Errorf("cannot send to %v; sender closed", s.dstAddr.String())
+	}
+
+	return writeBatch(batchConn, nil, bs, nil)
+}
+
 func (s *Sender) close() {
 	if s.conn != nil {
 		_ = s.conn.Close()
@@ -115,6 +157,16 @@ func (s *Sender) close() {
 
 	s.srcAddr = nil
 	s.conn = nil
+	s.batchConn = nil
+}
+
+// Reset closes the sender's socket (if it has one) without closing the sender; the next send opens a new one (e.g. from a
+// new source address after an interface change)
+func (s *Sender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.close()
 }
 
 func (s *Sender) Close() {
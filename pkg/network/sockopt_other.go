@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package network
+
+import (
+	"syscall"
+)
+
+// setReuse does nothing here; several sockets binding the same address and port is left to the platform's defaults
+func setReuse(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package network
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReuse lets several sockets (e.g. several endpoints on one host) bind the same address and port; it's done through
+// net.ListenConfig.Control (i.e. before bind and without going via File, which would put the socket in blocking mode and
+// so break deadlines)
+func setReuse(network, address string, c syscall.RawConn) error {
+	var sockoptErr error
+
+	err := c.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockoptErr != nil {
+			return
+		}
+
+		sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockoptErr
+}
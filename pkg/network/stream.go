@@ -0,0 +1,343 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaxStreamMessageSize is the largest message a StreamManager will send or receive (a sanity check on the length prefix
+// rather than anything the stream needs)
+const MaxStreamMessageSize = 256 * 1024 * 1024
+
+// streamWriteTimeout is how long a write may block (e.g. on a peer that has stopped reading) before the connection is
+// given up on
+const streamWriteTimeout = time.Second * 1
+
+// streamDialTimeout is how long connecting to a peer may take (generous, for a peer at the far end of a WAN)
+const streamDialTimeout = time.Second * 5
+
+// streamRedialPeriod is how long to wait after failing to connect to a peer before trying again (until then sends to it
+// fail straight away, so that the caller can fall back to something else)
+const streamRedialPeriod = time.Second * 1
+
+type streamConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// StreamManager sends and receives whole messages (each prefixed with its length) over stream sockets, a connection per
+// peer; the stream is reliable and ordered, so messages need no fragmenting (though a message in flight when a connection
+// goes away is lost)
+type StreamManager struct {
+	mu                              sync.Mutex
+	network                         string
+	listenAddress                   string
+	listener                        net.Listener
+	connByDstAddress                map[string]*streamConn
+	inboundConns                    map[net.Conn]struct{}
+	dialingDstAddresses             map[string]struct{}
+	dialFailedTimestampByDstAddress map[string]time.Time
+	ctx                             context.Context
+	cancel                          context.CancelFunc
+	onReceive                       func(string, []byte)
+	wg                              sync.WaitGroup
+}
+
+// NewStreamManager listens on (and dials) the given network ("unix" for Unix domain sockets, where the address is a path,
+// or "tcp"); onReceive is called with the remote address and the message for every message received
+func NewStreamManager(
+	network string,
+	listenAddress string,
+	onReceive func(string, []byte),
+) *StreamManager {
+	return &StreamManager{
+		network:                         network,
+		listenAddress:                   listenAddress,
+		connByDstAddress:                make(map[string]*streamConn),
+		inboundConns:                    make(map[net.Conn]struct{}),
+		dialingDstAddresses:             make(map[string]struct{}),
+		dialFailedTimestampByDstAddress: make(map[string]time.Time),
+		onReceive:                       onReceive,
+	}
+}
+
+// GetListenAddress is the address peers should connect to; it's empty if we're not listening
+func (m *StreamManager) GetListenAddress() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.listener == nil {
+		return ""
+	}
+
+	return m.listener.Addr().String()
+}
+
+func writeMessage(w io.Writer, data []byte) error {
+	if len(data) > MaxStreamMessageSize {
+		return fmt.Errorf("cannot send %v bytes; more than %v", len(data), MaxStreamMessageSize)
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+
+	buffers := net.Buffers{header, data}
+
+	_, err := buffers.WriteTo(w)
+
+	return err
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxStreamMessageSize {
+		return nil, fmt.Errorf("cannot receive %v bytes; more than %v", size, MaxStreamMessageSize)
+	}
+
+	data := make([]byte, size)
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (m *StreamManager) getConn(dstAddress string) (*streamConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.listener == nil {
+		return nil, fmt.Errorf("cannot send to %v; not started", dstAddress)
+	}
+
+	c, ok := m.connByDstAddress[dstAddress]
+	if ok {
+		return c, nil
+	}
+
+	_, ok = m.dialingDstAddresses[dstAddress]
+	if ok {
+		return nil, fmt.Errorf("cannot send to %v; still connecting", dstAddress)
+	}
+
+	dialFailedTimestamp, ok := m.dialFailedTimestampByDstAddress[dstAddress]
+	if ok && time.Since(dialFailedTimestamp) < streamRedialPeriod {
+		return nil, fmt.Errorf("cannot send to %v; recently failed to connect", dstAddress)
+	}
+
+	// connecting can take as long as streamDialTimeout, which the caller (likely holding locks of its own) shouldn't
+	// have to wait for; it falls back to something else until the connection is up
+	m.dialingDstAddresses[dstAddress] = struct{}{}
+
+	m.wg.Add(1)
+	go m.dial(m.ctx, dstAddress)
+
+	return nil, fmt.Errorf("cannot send to %v; connecting", dstAddress)
+}
+
+func (m *StreamManager) dial(ctx context.Context, dstAddress string) {
+	defer m.wg.Done()
+
+	dialer := net.Dialer{
+		Timeout: streamDialTimeout,
+	}
+
+	conn, err := dialer.DialContext(ctx, m.network, dstAddress)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dialingDstAddresses, dstAddress)
+
+	if err != nil {
+		m.dialFailedTimestampByDstAddress[dstAddress] = time.Now()
+		return
+	}
+
+	delete(m.dialFailedTimestampByDstAddress, dstAddress)
+
+	// we've been stopped in the meantime
+	if ctx.Err() != nil {
+		_ = conn.Close()
+		return
+	}
+
+	c := &streamConn{
+		conn: conn,
+	}
+
+	m.connByDstAddress[dstAddress] = c
+
+	// nothing is ever sent back on an outbound connection; reading only tells us when the peer goes away
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		_, _ = io.Copy(io.Discard, conn)
+		m.dropConn(dstAddress, c)
+	}()
+}
+
+// IsConnected is whether Send to the given address would go straight away (rather than only start connecting)
+func (m *StreamManager) IsConnected(dstAddress string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.connByDstAddress[dstAddress]
+
+	return ok
+}
+
+func (m *StreamManager) dropConn(dstAddress string, c *streamConn) {
+	m.mu.Lock()
+	if m.connByDstAddress[dstAddress] == c {
+		delete(m.connByDstAddress, dstAddress)
+	}
+	m.mu.Unlock()
+
+	_ = c.conn.Close()
+}
+
+// Send sends a whole message to the peer listening on the given address; if there's no connection to it yet, Send starts
+// connecting in the background and fails straight away (so the caller can use something else in the meantime); an error
+// means it may not have arrived
+func (m *StreamManager) Send(dstAddress string, data []byte) error {
+	c, err := m.getConn(dstAddress)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	err = writeMessage(c.conn, data)
+	c.mu.Unlock()
+
+	if err != nil {
+		// a partial message has poisoned the stream; the peer sees it close and we connect again next time
+		m.dropConn(dstAddress, c)
+		return err
+	}
+
+	return nil
+}
+
+func (m *StreamManager) read(conn net.Conn) {
+	defer m.wg.Done()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.inboundConns, conn)
+		m.mu.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		data, err := readMessage(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("warning: stream from %v failed: %v", conn.RemoteAddr().String(), err)
+			}
+
+			return
+		}
+
+		m.onReceive(conn.RemoteAddr().String(), data)
+	}
+}
+
+func (m *StreamManager) accept(listener net.Listener) {
+	defer m.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("warning: stream listener on %v failed: %v", listener.Addr().String(), err)
+			}
+
+			return
+		}
+
+		m.mu.Lock()
+		m.inboundConns[conn] = struct{}{}
+		m.mu.Unlock()
+
+		m.wg.Add(1)
+		go m.read(conn)
+	}
+}
+
+func (m *StreamManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.listener != nil {
+		return
+	}
+
+	// a socket file left behind by a process that died would otherwise stop us listening
+	if m.network == "unix" {
+		_ = os.Remove(m.listenAddress)
+	}
+
+	listener, err := net.Listen(m.network, m.listenAddress)
+	if err != nil {
+		log.Printf("warning: failed to listen on %v %v: %v", m.network, m.listenAddress, err)
+		return
+	}
+
+	m.listener = listener
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.accept(listener)
+}
+
+func (m *StreamManager) Stop() {
+	m.mu.Lock()
+
+	if m.listener == nil {
+		m.mu.Unlock()
+		return
+	}
+
+	// for a Unix domain socket this removes the socket file too
+	_ = m.listener.Close()
+	m.listener = nil
+
+	// abandons any connecting still going on
+	m.cancel()
+
+	for _, c := range m.connByDstAddress {
+		_ = c.conn.Close()
+	}
+	m.connByDstAddress = make(map[string]*streamConn)
+
+	for conn := range m.inboundConns {
+		_ = conn.Close()
+	}
+
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
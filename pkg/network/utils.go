@@ -3,6 +3,7 @@ package network
 import (
 	"fmt"
 	"net"
+	"os"
 	"strings"
 )
 
@@ -128,3 +129,26 @@ func GetDefaultInterfaceName() (string, error) {
 
 	return interfaceName, nil
 }
+
+// GetHostID identifies the host we're running on (so that endpoints can tell which of their peers are on the same host);
+// it's the machine ID where there is one, otherwise the hostname
+func GetHostID() (string, error) {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		hostID := strings.TrimSpace(string(data))
+		if hostID != "" {
+			return hostID, nil
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get host ID because %v", err)
+	}
+
+	return hostname, nil
+}
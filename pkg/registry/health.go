@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+type PeerHealth struct {
+	RegistryID   ksuid.KSUID `json:"registry_id"`
+	RegistryName string      `json:"registry_name"`
+	LastSeen     time.Time   `json:"last_seen"`
+}
+
+type Health struct {
+	RegistryID   ksuid.KSUID   `json:"registry_id"`
+	RegistryName string        `json:"registry_name"`
+	Uptime       time.Duration `json:"uptime"`
+	MemberCount  int           `json:"member_count"`
+	ClientCount  int           `json:"client_count"`
+
+	// the last time we pushed heartbeats to our clients and peers
+	LastPush time.Time `json:"last_push"`
+
+	// the peers we're hearing from (out of how many we've been told about)
+	Peers             []PeerHealth `json:"peers"`
+	ExpectedPeerCount int          `json:"expected_peer_count"`
+
+	// what's wrong (if anything); clients can't rely on a registry that's stopped pushing
+	Healthy  bool     `json:"healthy"`
+	Problems []string `json:"problems"`
+
+	// what's worth knowing about but doesn't make the registry unhealthy; one that's lost all its peers can't tell its
+	// clients about anybody else's, but it's still serving its own (and its peers may just be restarting)
+	Warnings []string `json:"warnings"`
+}
+
+func (m *Manager) GetHealth() Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	health := Health{
+		RegistryID:        m.registryID,
+		RegistryName:      m.registryName,
+		MemberCount:       len(m.memberByEndpointID),
+		LastPush:          m.lastPushTimestamp,
+		Peers:             make([]PeerHealth, 0),
+		ExpectedPeerCount: len(m.peerAddresses),
+		Problems:          make([]string, 0),
+		Warnings:          make([]string, 0),
+	}
+
+	if !m.startedTimestamp.IsZero() {
+		health.Uptime = now.Sub(m.startedTimestamp)
+	}
+
+	for _, member := range m.memberByEndpointID {
+		if member.client {
+			health.ClientCount++
+		}
+	}
+
+	for _, p := range m.peerByRegistryID {
+		health.Peers = append(health.Peers, PeerHealth{
+			RegistryID:   p.registryID,
+			RegistryName: p.registryName,
+			LastSeen:     p.lastSeen,
+		})
+	}
+
+	timeout := m.getTimeout(m.rate)
+
+	if m.lastPushTimestamp.IsZero() {
+		health.Problems = append(health.Problems, "not pushed to clients yet")
+	} else if now.Sub(m.lastPushTimestamp) > timeout {
+		health.Problems = append(health.Problems, fmt.Sprintf("not pushed to clients for %v", now.Sub(m.lastPushTimestamp)))
+	}
+
+	// a peer has had a chance to be heard from once we've been up as long as it takes one to time out
+	if len(m.peerAddresses) > 0 && len(m.peerByRegistryID) == 0 && health.Uptime > timeout {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("not heard from any of %v peer(s)", len(m.peerAddresses)))
+	}
+
+	health.Healthy = len(health.Problems) == 0
+
+	return health
+}
+
+// ServeHTTP exposes the health of the registry as JSON (e.g. for a Kubernetes readiness probe); it's a 503 if there are
+// any problems (see Health.Problems) but not for warnings (see Health.Warnings), so a registry stays ready while its
+// peers restart
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := m.GetHealth()
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statusCode := http.StatusOK
+	if !health.Healthy {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	_, err = w.Write(data)
+	if err != nil {
+		log.Printf("warning: failed to write health response: %v", err)
+	}
+}
@@ -0,0 +1,467 @@
+package registry
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/discovery"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+// every this many heartbeats, send a full snapshot to clients and peers in case some deltas were lost
+const resyncMultiplier = 10
+
+type member struct {
+	// as last received (with Forwarded etc cleared)
+	container *types.Container
+
+	// it announced directly to us (vs we heard about it from a peer registry)
+	client bool
+
+	// the peer registry we heard about it from (if not a client)
+	peerRegistryID ksuid.KSUID
+
+	lastSeen time.Time
+}
+
+type peer struct {
+	registryID   ksuid.KSUID
+	registryName string
+	lastSeen     time.Time
+}
+
+// Manager is a registry; endpoints announce directly to it (GLUE_DISCOVERY_REGISTRY_ADDRESSES) and it pushes them
+// membership deltas (rather than a full flush on every announcement) and heartbeats; registries gossip their clients
+// among themselves so that clients can fail over between them
+type Manager struct {
+	scheduledWorker       *worker.ScheduledWorker
+	listener              *discovery.Listener
+	mu                    sync.Mutex
+	memberByEndpointID    map[ksuid.KSUID]*member
+	peerByRegistryID      map[ksuid.KSUID]*peer
+	workCount             int64
+	startedTimestamp      time.Time
+	lastPushTimestamp     time.Time
+	networkID             int64
+	registryID            ksuid.KSUID
+	registryName          string
+	listenAddress         *net.UDPAddr
+	interfaceName         string
+	peerAddresses         []*net.UDPAddr
+	rate                  time.Duration
+	rateTimeoutMultiplier float64
+	networkManager        network.Network
+}
+
+func NewManager(
+	networkID int64,
+	registryID ksuid.KSUID,
+	registryName string,
+	listenAddress *net.UDPAddr,
+	interfaceName string,
+	peerAddresses []*net.UDPAddr,
+	rate time.Duration,
+	rateTimeoutMultiplier float64,
+	networkManager network.Network,
+) *Manager {
+	m := Manager{
+		memberByEndpointID:    make(map[ksuid.KSUID]*member),
+		peerByRegistryID:      make(map[ksuid.KSUID]*peer),
+		networkID:             networkID,
+		registryID:            registryID,
+		registryName:          registryName,
+		listenAddress:         listenAddress,
+		interfaceName:         interfaceName,
+		peerAddresses:         peerAddresses,
+		rate:                  rate,
+		rateTimeoutMultiplier: rateTimeoutMultiplier,
+		networkManager:        networkManager,
+	}
+
+	m.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		m.work,
+		func() {},
+		rate,
+	)
+
+	m.listener = discovery.NewListener(
+		m.networkID,
+		m.listenAddress,
+		m.interfaceName,
+		m.networkManager,
+		m.onReceive,
+	)
+
+	return &m
+}
+
+func (m *Manager) getTimeout(rate time.Duration) time.Duration {
+	return time.Millisecond * time.Duration(float64(rate.Milliseconds())*m.rateTimeoutMultiplier)
+}
+
+func isChanged(a *types.Container, b *types.Container) bool {
+	return a.SourceEndpointName != b.SourceEndpointName ||
+		a.Announcement.SentRate != b.Announcement.SentRate ||
+		a.Announcement.ListenAddr.String() != b.Announcement.ListenAddr.String() ||
+		a.Announcement.DiscoveryListenAddress != b.Announcement.DiscoveryListenAddress
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) getClientAddresses(excludeEndpointID ksuid.KSUID) []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0)
+
+	for endpointID, member := range m.memberByEndpointID {
+		if !member.client || endpointID == excludeEndpointID {
+			continue
+		}
+
+		if member.container.Announcement.DiscoveryListenAddr == nil {
+			continue
+		}
+
+		addrs = append(addrs, member.container.Announcement.DiscoveryListenAddr)
+	}
+
+	return addrs
+}
+
+func (m *Manager) getForwardedContainer(container *types.Container, withdrawn bool) *types.Container {
+	forwardedContainer := container.Copy()
+	forwardedContainer.Announcement.Forwarded = true
+	forwardedContainer.Announcement.ForwardedBy = m.registryID
+	forwardedContainer.Announcement.Withdrawn = withdrawn
+
+	return forwardedContainer
+}
+
+func (m *Manager) send(container *types.Container, dstAddrs []*net.UDPAddr) {
+	data, err := serialization.Serialize(container)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	for _, dstAddr := range dstAddrs {
+		err = m.networkManager.Send(dstAddr, data)
+		if err != nil {
+			log.Printf("warning: registry failed to send to %v: %v", dstAddr.String(), err)
+		}
+	}
+}
+
+// be sure you're holding the mutex before calling this
+func (m *Manager) getSnapshot(excludeEndpointID ksuid.KSUID, clientsOnly bool) []*types.Container {
+	containers := make([]*types.Container, 0)
+
+	for endpointID, member := range m.memberByEndpointID {
+		if endpointID == excludeEndpointID || (clientsOnly && !member.client) {
+			continue
+		}
+
+		containers = append(containers, m.getForwardedContainer(member.container, false))
+	}
+
+	return containers
+}
+
+func (m *Manager) getHeartbeat(knownEndpointIDs []ksuid.KSUID) *types.Container {
+	srcAddr := m.listenAddress
+	if srcAddr.IP == nil || srcAddr.IP.IsUnspecified() {
+		_, _, interfaceAddr, err := network.GetAddressesAndInterfaces(m.interfaceName, m.listenAddress.String())
+		if err == nil && interfaceAddr.IP != nil {
+			srcAddr = &net.UDPAddr{IP: interfaceAddr.IP, Port: m.listenAddress.Port, Zone: interfaceAddr.Zone}
+		}
+	}
+
+	container := types.GetAnnouncementContainer(
+		time.Now(),
+		srcAddr.String(),
+		m.networkID,
+		m.registryID,
+		m.registryName,
+		m.rate,
+		srcAddr,
+		srcAddr,
+		srcAddr,
+	)
+
+	container.Announcement.Registry = true
+	container.Announcement.KnownEndpointIDs = knownEndpointIDs
+
+	return container
+}
+
+func (m *Manager) handlePeerHeartbeat(container *types.Container) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.peerByRegistryID[container.SourceEndpointID]
+	if !ok {
+		p = &peer{registryID: container.SourceEndpointID}
+		m.peerByRegistryID[container.SourceEndpointID] = p
+
+		log.Printf("peer registry added: %v (%v)", container.SourceEndpointName, container.SourceEndpointID)
+	}
+
+	p.registryName = container.SourceEndpointName
+	p.lastSeen = container.ReceivedTimestamp
+
+	for _, endpointID := range container.Announcement.KnownEndpointIDs {
+		member, ok := m.memberByEndpointID[endpointID]
+		if !ok || member.client || member.peerRegistryID != container.SourceEndpointID {
+			continue
+		}
+
+		member.lastSeen = container.ReceivedTimestamp
+	}
+}
+
+func (m *Manager) handlePeerDelta(container *types.Container) {
+	m.mu.Lock()
+
+	existingMember, ok := m.memberByEndpointID[container.SourceEndpointID]
+
+	// what we hear directly always beats what we hear second-hand (but remember the peer has it too in case the client
+	// has failed over to that peer)
+	if ok && existingMember.client {
+		if !container.Announcement.Withdrawn {
+			existingMember.peerRegistryID = container.Announcement.ForwardedBy
+		}
+
+		m.mu.Unlock()
+		return
+	}
+
+	if container.Announcement.Withdrawn {
+		if !ok || existingMember.peerRegistryID != container.Announcement.ForwardedBy {
+			m.mu.Unlock()
+			return
+		}
+
+		delete(m.memberByEndpointID, container.SourceEndpointID)
+		clientAddrs := m.getClientAddresses(ksuid.Nil)
+		m.mu.Unlock()
+
+		log.Printf("member withdrawn by peer: %v", container.String())
+
+		m.send(m.getForwardedContainer(existingMember.container, true), clientAddrs)
+
+		return
+	}
+
+	memberContainer := container.Copy()
+	memberContainer.Announcement.Forwarded = false
+	memberContainer.Announcement.ForwardedBy = ksuid.Nil
+
+	m.memberByEndpointID[container.SourceEndpointID] = &member{
+		container:      memberContainer,
+		client:         false,
+		peerRegistryID: container.Announcement.ForwardedBy,
+		lastSeen:       container.ReceivedTimestamp,
+	}
+
+	changed := !ok || isChanged(existingMember.container, memberContainer)
+
+	clientAddrs := m.getClientAddresses(container.SourceEndpointID)
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if !ok {
+		log.Printf("member added by peer: %v", container.String())
+	}
+
+	m.send(m.getForwardedContainer(memberContainer, false), clientAddrs)
+}
+
+func (m *Manager) handleClientAnnouncement(container *types.Container) {
+	m.mu.Lock()
+
+	existingMember, ok := m.memberByEndpointID[container.SourceEndpointID]
+
+	m.memberByEndpointID[container.SourceEndpointID] = &member{
+		container: container,
+		client:    true,
+		lastSeen:  container.ReceivedTimestamp,
+	}
+
+	newClient := !ok || !existingMember.client
+	changed := !ok || isChanged(existingMember.container, container)
+
+	var snapshot []*types.Container
+	if newClient {
+		snapshot = m.getSnapshot(container.SourceEndpointID, false)
+	}
+
+	clientAddrs := m.getClientAddresses(container.SourceEndpointID)
+	m.mu.Unlock()
+
+	if newClient {
+		log.Printf("client added: %v", container.String())
+
+		if container.Announcement.DiscoveryListenAddr != nil {
+			dstAddrs := []*net.UDPAddr{container.Announcement.DiscoveryListenAddr}
+
+			// a heartbeat first so that the client knows it has found us
+			m.send(m.getHeartbeat([]ksuid.KSUID{}), dstAddrs)
+
+			for _, snapshotContainer := range snapshot {
+				m.send(snapshotContainer, dstAddrs)
+			}
+		}
+	}
+
+	// the peers need to know we're now responsible for it (even if nothing has changed)
+	if newClient || changed {
+		m.send(m.getForwardedContainer(container, false), m.peerAddresses)
+	}
+
+	if changed {
+		m.send(m.getForwardedContainer(container, false), clientAddrs)
+	}
+}
+
+func (m *Manager) onReceive(container *types.Container) {
+	if container.SourceEndpointID == m.registryID {
+		return
+	}
+
+	if container.Announcement.Registry {
+		m.handlePeerHeartbeat(container)
+		return
+	}
+
+	if container.Announcement.Forwarded {
+		// a delta from a peer registry; anything else forwarded (e.g. by an old-style rendezvous) is of no use to us
+		if container.Announcement.ForwardedBy != ksuid.Nil && container.Announcement.ForwardedBy != m.registryID {
+			m.handlePeerDelta(container)
+		}
+
+		return
+	}
+
+	m.handleClientAnnouncement(container)
+}
+
+func (m *Manager) work() {
+	now := time.Now()
+
+	toWithdraw := make([]*member, 0)
+
+	m.mu.Lock()
+
+	m.workCount++
+	resync := m.workCount%resyncMultiplier == 0
+
+	for _, p := range m.peerByRegistryID {
+		if now.Sub(p.lastSeen) > m.getTimeout(m.rate) {
+			log.Printf("peer registry removed: %v (%v)", p.registryName, p.registryID)
+			delete(m.peerByRegistryID, p.registryID)
+		}
+	}
+
+	for endpointID, member := range m.memberByEndpointID {
+		timeout := m.getTimeout(member.container.Announcement.SentRate)
+
+		// give clients of a peer that has gone quiet a chance to fail over to us
+		if !member.client {
+			timeout *= discovery.RegistryGraceMultiplier
+		}
+
+		if now.Sub(member.lastSeen) <= timeout {
+			continue
+		}
+
+		// a client that has failed over to a live peer isn't gone; it's just second-hand now
+		if member.client && member.peerRegistryID != ksuid.Nil {
+			_, ok := m.peerByRegistryID[member.peerRegistryID]
+			if ok {
+				member.client = false
+				member.lastSeen = now
+				continue
+			}
+		}
+
+		delete(m.memberByEndpointID, endpointID)
+		toWithdraw = append(toWithdraw, member)
+	}
+
+	clientAddrs := m.getClientAddresses(ksuid.Nil)
+
+	knownEndpointIDs := make([]ksuid.KSUID, 0)
+	clientEndpointIDs := make([]ksuid.KSUID, 0)
+	for endpointID, member := range m.memberByEndpointID {
+		knownEndpointIDs = append(knownEndpointIDs, endpointID)
+
+		if member.client {
+			clientEndpointIDs = append(clientEndpointIDs, endpointID)
+		}
+	}
+
+	var clientSnapshot, peerSnapshot []*types.Container
+	if resync {
+		clientSnapshot = m.getSnapshot(ksuid.Nil, false)
+		peerSnapshot = m.getSnapshot(ksuid.Nil, true)
+	}
+
+	m.mu.Unlock()
+
+	for _, member := range toWithdraw {
+		log.Printf("member removed: %v", member.container.String())
+
+		withdrawnContainer := m.getForwardedContainer(member.container, true)
+
+		m.send(withdrawnContainer, clientAddrs)
+
+		if member.client {
+			m.send(withdrawnContainer, m.peerAddresses)
+		}
+	}
+
+	m.send(m.getHeartbeat(knownEndpointIDs), clientAddrs)
+	m.send(m.getHeartbeat(clientEndpointIDs), m.peerAddresses)
+
+	for _, container := range clientSnapshot {
+		m.send(container, clientAddrs)
+	}
+
+	for _, container := range peerSnapshot {
+		m.send(container, m.peerAddresses)
+	}
+
+	m.mu.Lock()
+	m.lastPushTimestamp = now
+	m.mu.Unlock()
+}
+
+func (m *Manager) RegistryID() ksuid.KSUID {
+	return m.registryID
+}
+
+func (m *Manager) RegistryName() string {
+	return m.registryName
+}
+
+func (m *Manager) Start() {
+	m.mu.Lock()
+	m.startedTimestamp = time.Now()
+	m.mu.Unlock()
+
+	m.listener.Start()
+	m.scheduledWorker.Start()
+}
+
+func (m *Manager) Stop() {
+	m.scheduledWorker.Stop()
+	m.listener.Stop()
+}
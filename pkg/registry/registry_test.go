@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/initialed85/glue/pkg/discovery"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/types"
+)
+
+func getClient(endpointName string, discoveryListenPort int, registryAddresses []*net.UDPAddr) (*network.Manager, *discovery.Manager, chan *types.Container, chan *types.Container) {
+	networkManager := network.NewManager()
+
+	added := make(chan *types.Container, 65536)
+	removed := make(chan *types.Container, 65536)
+
+	listenAddress, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", discoveryListenPort+100))
+	discoveryListenAddress, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", discoveryListenPort))
+
+	discoveryManager := discovery.NewManager(
+		1,
+		ksuid.New(),
+		endpointName,
+		listenAddress,
+		discoveryListenAddress,
+		nil,
+		"lo",
+		time.Millisecond*100,
+		3,
+		networkManager,
+		func(container *types.Container) {
+			added <- container
+		},
+		func(container *types.Container) {
+			removed <- container
+		},
+		&discovery.ManagerOptions{
+			RegistryAddresses: registryAddresses,
+		},
+	)
+
+	return networkManager, discoveryManager, added, removed
+}
+
+func getRegistry(registryName string, listenAddress *net.UDPAddr, peerAddresses []*net.UDPAddr) (*network.Manager, *Manager) {
+	networkManager := network.NewManager()
+
+	registryManager := NewManager(
+		1,
+		ksuid.New(),
+		registryName,
+		listenAddress,
+		"lo",
+		peerAddresses,
+		time.Millisecond*100,
+		3,
+		networkManager,
+	)
+
+	return networkManager, registryManager
+}
+
+func TestManager(t *testing.T) {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	registryAddress, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27390")
+
+	registryNetworkManager, registryManager := getRegistry("R", registryAddress, nil)
+
+	// not pushing to anybody yet
+	w := httptest.NewRecorder()
+	registryManager.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 503, w.Code)
+
+	registryNetworkManager.Start()
+	defer registryNetworkManager.Stop()
+
+	registryManager.Start()
+	defer registryManager.Stop()
+
+	networkManager1, discoveryManager1, added1, _ := getClient("A", 27391, []*net.UDPAddr{registryAddress})
+	networkManager1.Start()
+	discoveryManager1.Start()
+	defer networkManager1.Stop()
+	defer discoveryManager1.Stop()
+
+	networkManager2, discoveryManager2, added2, _ := getClient("B", 27392, []*net.UDPAddr{registryAddress})
+	networkManager2.Start()
+	discoveryManager2.Start()
+	defer networkManager2.Stop()
+	defer discoveryManager2.Stop()
+
+	select {
+	case added := <-added1:
+		assert.Equal(t, "B", added.SourceEndpointName)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timed out waiting for A to learn about B")
+	}
+
+	select {
+	case added := <-added2:
+		assert.Equal(t, "A", added.SourceEndpointName)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timed out waiting for B to learn about A")
+	}
+
+	health := registryManager.GetHealth()
+	assert.Equal(t, "R", health.RegistryName)
+	assert.Equal(t, 2, health.MemberCount)
+	assert.Equal(t, 2, health.ClientCount)
+	assert.True(t, health.Healthy)
+	assert.False(t, health.LastPush.IsZero())
+
+	w = httptest.NewRecorder()
+	registryManager.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"client_count":2`))
+}
+
+func TestManager_Failover(t *testing.T) {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	registryAddress1, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27393")
+	registryAddress2, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:27394")
+
+	registryNetworkManager1, registryManager1 := getRegistry("R1", registryAddress1, []*net.UDPAddr{registryAddress2})
+	registryNetworkManager1.Start()
+	registryManager1.Start()
+
+	registryNetworkManager2, registryManager2 := getRegistry("R2", registryAddress2, []*net.UDPAddr{registryAddress1})
+	registryNetworkManager2.Start()
+	registryManager2.Start()
+	defer registryNetworkManager2.Stop()
+	defer registryManager2.Stop()
+
+	// A starts out with R1 and B with R2, so they only know about each other because the registries replicate
+	networkManager1, discoveryManager1, added1, removed1 := getClient("A", 27395, []*net.UDPAddr{registryAddress1, registryAddress2})
+	networkManager1.Start()
+	discoveryManager1.Start()
+	defer networkManager1.Stop()
+	defer discoveryManager1.Stop()
+
+	networkManager2, discoveryManager2, added2, removed2 := getClient("B", 27396, []*net.UDPAddr{registryAddress2, registryAddress1})
+	networkManager2.Start()
+	discoveryManager2.Start()
+	defer networkManager2.Stop()
+	defer discoveryManager2.Stop()
+
+	select {
+	case added := <-added1:
+		assert.Equal(t, "B", added.SourceEndpointName)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timed out waiting for A to learn about B")
+	}
+
+	select {
+	case added := <-added2:
+		assert.Equal(t, "A", added.SourceEndpointName)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timed out waiting for B to learn about A")
+	}
+
+	assert.Equal(t, 1, registryManager1.GetHealth().ClientCount)
+	assert.Equal(t, 1, registryManager2.GetHealth().ClientCount)
+	assert.True(t, registryManager2.GetHealth().Healthy)
+
+	// R1 goes away, so A has to fail over to R2
+	registryManager1.Stop()
+	registryNetworkManager1.Stop()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for registryManager2.GetHealth().ClientCount != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	health := registryManager2.GetHealth()
+	assert.Equal(t, 2, health.ClientCount)
+
+	// R2 can't hear its peer any more, but that's no reason for it to stop being ready (R1 may only be restarting)
+	assert.Empty(t, health.Peers)
+	assert.Equal(t, []string{"not heard from any of 1 peer(s)"}, health.Warnings)
+	assert.True(t, health.Healthy)
+
+	w := httptest.NewRecorder()
+	registryManager2.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+
+	// give anything that was going to time out the chance to (i.e. past the grace period for R1's members)
+	time.Sleep(time.Millisecond * 100 * 3 * discovery.RegistryGraceMultiplier * 2)
+
+	// and all along, A and B still see each other
+	assert.Equal(t, 0, len(removed1))
+	assert.Equal(t, 0, len(removed2))
+}
@@ -0,0 +1,332 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/initialed85/glue/pkg/discovery"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/serialization"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/initialed85/glue/pkg/worker"
+)
+
+// Side is one of the two networks a relay sits on; the relay is an ordinary endpoint as far as each side is concerned
+type Side struct {
+	name                   string
+	listenAddress          *net.UDPAddr
+	discoveryListenAddress *net.UDPAddr
+	discoveryTargetAddress *net.UDPAddr
+	seedAddresses          []*net.UDPAddr
+	interfaceName          string
+	discoveryManager       *discovery.Manager
+	other                  *Side
+	callback               func(*net.UDPAddr, *net.UDPAddr, []byte)
+}
+
+func NewSide(
+	name string,
+	listenAddress *net.UDPAddr,
+	discoveryListenAddress *net.UDPAddr,
+	discoveryTargetAddress *net.UDPAddr,
+	seedAddresses []*net.UDPAddr,
+	interfaceName string,
+) *Side {
+	return &Side{
+		name:                   name,
+		listenAddress:          listenAddress,
+		discoveryListenAddress: discoveryListenAddress,
+		discoveryTargetAddress: discoveryTargetAddress,
+		seedAddresses:          seedAddresses,
+		interfaceName:          interfaceName,
+	}
+}
+
+// getTargetAddresses is everywhere announcements on this side go
+func (s *Side) getTargetAddresses() []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0)
+
+	if s.discoveryTargetAddress != nil {
+		addrs = append(addrs, s.discoveryTargetAddress)
+	}
+
+	return append(addrs, s.seedAddresses...)
+}
+
+// Manager bridges two networks that can't otherwise reach each other; the endpoints on each side are announced on the
+// other side as reachable via the relay (marked Forwarded so that they're never mistaken for first-hand announcements,
+// and ForwardedBy the relay so that no relay relays them again) and transport frames are forwarded between the sides
+type Manager struct {
+	scheduledWorker       *worker.ScheduledWorker
+	ctx                   context.Context
+	cancel                context.CancelFunc
+	networkID             int64
+	relayID               ksuid.KSUID
+	relayName             string
+	sides                 []*Side
+	rate                  time.Duration
+	rateTimeoutMultiplier float64
+	networkManager        network.Network
+}
+
+func NewManager(
+	networkID int64,
+	relayID ksuid.KSUID,
+	relayName string,
+	sideA *Side,
+	sideB *Side,
+	rate time.Duration,
+	rateTimeoutMultiplier float64,
+	networkManager network.Network,
+) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := Manager{
+		ctx:                   ctx,
+		cancel:                cancel,
+		networkID:             networkID,
+		relayID:               relayID,
+		relayName:             relayName,
+		sides:                 []*Side{sideA, sideB},
+		rate:                  rate,
+		rateTimeoutMultiplier: rateTimeoutMultiplier,
+		networkManager:        networkManager,
+	}
+
+	sideA.other = sideB
+	sideB.other = sideA
+
+	for _, side := range m.sides {
+		side := side
+
+		side.discoveryManager = discovery.NewManager(
+			m.networkID,
+			m.relayID,
+			m.relayName,
+			side.listenAddress,
+			side.discoveryListenAddress,
+			side.discoveryTargetAddress,
+			side.interfaceName,
+			m.rate,
+			m.rateTimeoutMultiplier,
+			m.networkManager,
+			func(container *types.Container) {},
+			func(container *types.Container) {},
+			&discovery.ManagerOptions{
+				SeedAddresses: side.seedAddresses,
+			},
+		)
+
+		side.callback = func(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+			m.forward(side, srcAddr, data)
+		}
+	}
+
+	m.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		m.work,
+		func() {},
+		m.rate,
+	)
+
+	return &m
+}
+
+// isRelayable is true for endpoints the relay learned about on the side itself (i.e. not from this or any other relay,
+// or from a registry)
+func (m *Manager) isRelayable(container *types.Container) bool {
+	return container.SourceEndpointID != m.relayID && container.Announcement.ForwardedBy == ksuid.Nil
+}
+
+func (m *Manager) getRelayablePeer(side *Side, endpointID ksuid.KSUID) *types.Container {
+	for _, container := range side.discoveryManager.GetAllAnnouncementContainers() {
+		if container.SourceEndpointID == endpointID && m.isRelayable(container) {
+			return container
+		}
+	}
+
+	return nil
+}
+
+// getRelayedContainer is the announcement for a peer on the other side, as if it were listening where we are on this side
+func (m *Manager) getRelayedContainer(side *Side, container *types.Container, targetAddress *net.UDPAddr, withdrawn bool) (*types.Container, error) {
+	srcAddr, err := m.networkManager.GetRawSrcAddr(targetAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := side.listenAddress.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = srcAddr.IP
+	}
+
+	listenAddr := &net.UDPAddr{
+		IP:   ip,
+		Port: side.listenAddress.Port,
+		Zone: srcAddr.Zone,
+	}
+
+	discoveryListenAddr := &net.UDPAddr{
+		IP:   ip,
+		Port: side.discoveryListenAddress.Port,
+		Zone: srcAddr.Zone,
+	}
+
+	relayedContainer := container.Copy()
+	relayedContainer.SentTimestamp = time.Now()
+	relayedContainer.SentBy = srcAddr.String()
+	relayedContainer.SentTo = targetAddress.String()
+	relayedContainer.Announcement.SentRate = m.rate
+	relayedContainer.Announcement.ListenPort = listenAddr.Port
+	relayedContainer.Announcement.ListenAddr = listenAddr
+	relayedContainer.Announcement.DiscoveryListenAddress = discoveryListenAddr.String()
+	relayedContainer.Announcement.DiscoveryListenAddr = discoveryListenAddr
+	relayedContainer.Announcement.DiscoveryTargetAddress = targetAddress.String()
+	relayedContainer.Announcement.DiscoveryTargetAddr = targetAddress
+	relayedContainer.Announcement.Forwarded = true
+	relayedContainer.Announcement.ForwardedBy = m.relayID
+	relayedContainer.Announcement.Withdrawn = withdrawn
+	relayedContainer.Announcement.KnownEndpointIDs = nil
+	relayedContainer.Announcement.KnownEndpointsDigest = nil
+
+	// only reachable via the relay
+	relayedContainer.Announcement.HostID = ""
+	relayedContainer.Announcement.LocalAddress = ""
+	relayedContainer.Announcement.StreamAddress = ""
+
+	return relayedContainer, nil
+}
+
+// announce tells everyone on this side about a peer on the other side
+func (m *Manager) announce(side *Side, container *types.Container, withdrawn bool) {
+	for _, targetAddress := range side.getTargetAddresses() {
+		relayedContainer, err := m.getRelayedContainer(side, container, targetAddress, withdrawn)
+		if err != nil {
+			log.Printf("warning: relay failed to build announcement for %v: %v", container.String(), err)
+			continue
+		}
+
+		data, err := serialization.Serialize(relayedContainer)
+		if err != nil {
+			log.Printf("warning: %v", err)
+			continue
+		}
+
+		err = m.networkManager.Send(targetAddress, data)
+		if err != nil {
+			log.Printf("warning: relay failed to send to %v: %v", targetAddress.String(), err)
+		}
+	}
+}
+
+func (m *Manager) work() {
+	for _, side := range m.sides {
+		for _, container := range side.other.discoveryManager.GetAllAnnouncementContainers() {
+			if !m.isRelayable(container) {
+				continue
+			}
+
+			m.announce(side, container, false)
+		}
+	}
+}
+
+// watch passes on changes to the other side as they happen (rather than waiting for the next announcement / expiry)
+func (m *Manager) watch(side *Side) {
+	for event := range side.other.discoveryManager.Watch(m.ctx) {
+		if event.Container == nil || !m.isRelayable(event.Container) {
+			continue
+		}
+
+		switch event.Type {
+		case discovery.EventTypeAdded, discovery.EventTypeUpdated:
+			log.Printf("relaying %v to side %v", event.Container.String(), side.name)
+			m.announce(side, event.Container, false)
+		case discovery.EventTypeRemoved:
+			log.Printf("withdrawing %v from side %v", event.Container.String(), side.name)
+			m.announce(side, event.Container, true)
+		}
+	}
+}
+
+// forward passes frames that arrived on one side to the peer on the other side they're destined for
+func (m *Manager) forward(side *Side, srcAddr *net.UDPAddr, data []byte) {
+	container, err := serialization.Deserialize(data)
+	if err != nil {
+		log.Printf("warning: relay failed to deserialize %v bytes from %v: %v", len(data), srcAddr.String(), err)
+		return
+	}
+
+	if container.NetworkID != m.networkID {
+		return
+	}
+
+	// probes are for the relay itself (relayed peers aren't probed, as they're only ever second-hand)
+	if container.Probe != nil {
+		side.discoveryManager.HandleProbe(container)
+		return
+	}
+
+	if container.Frame == nil {
+		log.Printf("warning: relay unexpectedly received non-frame %v", container.String())
+		return
+	}
+
+	if container.Frame.DestinationEndpointID == m.relayID {
+		return
+	}
+
+	peer := m.getRelayablePeer(side.other, container.Frame.DestinationEndpointID)
+	if peer == nil {
+		log.Printf("warning: relay has no route from side %v for %v", side.name, container.String())
+		return
+	}
+
+	err = m.networkManager.Send(peer.Announcement.ListenAddr, data)
+	if err != nil {
+		log.Printf("warning: relay failed to forward %v: %v", container.String(), err)
+	}
+}
+
+// HandleNetworkChange is for when the relay's interfaces or addresses have changed (see network.Manager.OnInterfaceChange);
+// both sides hear about the relay, and everything it relays, at its new address straight away
+func (m *Manager) HandleNetworkChange() {
+	for _, side := range m.sides {
+		side.discoveryManager.HandleNetworkChange()
+	}
+
+	m.work()
+}
+
+func (m *Manager) Start() {
+	for _, side := range m.sides {
+		err := m.networkManager.RegisterCallback(side.listenAddress, side.interfaceName, side.callback)
+		if err != nil {
+			log.Printf("warning: attempt to register callback failed stating: %v", err)
+		}
+
+		side.discoveryManager.Start()
+
+		go m.watch(side)
+	}
+
+	m.scheduledWorker.Start()
+}
+
+func (m *Manager) Stop() {
+	m.cancel()
+	m.scheduledWorker.Stop()
+
+	for _, side := range m.sides {
+		side.discoveryManager.Stop()
+
+		err := m.networkManager.UnregisterCallback(side.listenAddress, side.interfaceName, side.callback)
+		if err != nil {
+			log.Printf("warning: attempt to unregister callback failed stating: %v", err)
+		}
+	}
+}
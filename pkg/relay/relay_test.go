@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/initialed85/glue/pkg/discovery"
+	"github.com/initialed85/glue/pkg/network"
+	"github.com/initialed85/glue/pkg/transport"
+	"github.com/initialed85/glue/pkg/types"
+)
+
+func getAddr(port int) *net.UDPAddr {
+	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%v", port))
+	return addr
+}
+
+type endpoint struct {
+	endpointID       ksuid.KSUID
+	networkManager   *network.Manager
+	discoveryManager *discovery.Manager
+	transportManager *transport.Manager
+	added            chan *types.Container
+	removed          chan *types.Container
+	received         chan *types.Container
+}
+
+func getEndpoint(endpointName string, listenPort int, discoveryListenPort int, seedPort int) *endpoint {
+	e := endpoint{
+		endpointID:     ksuid.New(),
+		networkManager: network.NewManager(),
+		added:          make(chan *types.Container, 65536),
+		removed:        make(chan *types.Container, 65536),
+		received:       make(chan *types.Container, 65536),
+	}
+
+	e.discoveryManager = discovery.NewManager(
+		1,
+		e.endpointID,
+		endpointName,
+		getAddr(listenPort),
+		getAddr(discoveryListenPort),
+		nil,
+		"lo",
+		time.Millisecond*100,
+		3,
+		e.networkManager,
+		func(container *types.Container) {
+			e.added <- container
+		},
+		func(container *types.Container) {
+			e.removed <- container
+		},
+		&discovery.ManagerOptions{
+			SeedAddresses: []*net.UDPAddr{getAddr(seedPort)},
+		},
+	)
+
+	e.transportManager = transport.NewManager(
+		1,
+		e.endpointID,
+		endpointName,
+		getAddr(listenPort),
+		"lo",
+		e.discoveryManager,
+		e.networkManager,
+		func(container *types.Container) {
+			e.received <- container
+		},
+	)
+
+	return &e
+}
+
+func (e *endpoint) start() {
+	e.networkManager.Start()
+	e.discoveryManager.Start()
+	e.transportManager.Start()
+}
+
+func (e *endpoint) stop() {
+	e.transportManager.Stop()
+	e.discoveryManager.Stop()
+	e.networkManager.Stop()
+}
+
+func TestManager(t *testing.T) {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	// X and Y only know about the relay (and vice versa); they never talk directly
+	x := getEndpoint("X", 27501, 27401, 27411)
+	y := getEndpoint("Y", 27502, 27402, 27412)
+
+	relayNetworkManager := network.NewManager()
+	relayManager := NewManager(
+		1,
+		ksuid.New(),
+		"R",
+		NewSide("A", getAddr(27511), getAddr(27411), nil, []*net.UDPAddr{getAddr(27401)}, "lo"),
+		NewSide("B", getAddr(27512), getAddr(27412), nil, []*net.UDPAddr{getAddr(27402)}, "lo"),
+		time.Millisecond*100,
+		3,
+		relayNetworkManager,
+	)
+	relayNetworkManager.Start()
+	relayManager.Start()
+	defer func() {
+		relayManager.Stop()
+		relayNetworkManager.Stop()
+	}()
+
+	x.start()
+	defer x.stop()
+
+	y.start()
+
+	waitForAdded := func(e *endpoint, endpointName string) *types.Container {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case added := <-e.added:
+				if added.SourceEndpointName == endpointName {
+					return added
+				}
+			case <-timeout:
+				assert.Fail(t, fmt.Sprintf("timed out waiting to see %v", endpointName))
+				return nil
+			}
+		}
+	}
+
+	addedY := waitForAdded(x, "Y")
+	if addedY == nil {
+		return
+	}
+	assert.True(t, addedY.Announcement.Forwarded)
+	assert.Equal(t, 27511, addedY.Announcement.ListenAddr.Port)
+
+	addedX := waitForAdded(y, "X")
+	if addedX == nil {
+		return
+	}
+	assert.Equal(t, 27512, addedX.Announcement.ListenAddr.Port)
+
+	err := x.transportManager.Send(
+		time.Millisecond*100,
+		time.Second,
+		ksuid.New(),
+		1,
+		0,
+		y.endpointID,
+		"Y",
+		true,
+		false,
+		[]byte("Some payload"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case received := <-y.received:
+		assert.Equal(t, "X", received.SourceEndpointName)
+		assert.Equal(t, []byte("Some payload"), received.Frame.Payload)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for Y to receive from X via the relay")
+	}
+
+	y.stop()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case removed := <-x.removed:
+			if removed.SourceEndpointName != "Y" {
+				continue
+			}
+			return
+		case <-timeout:
+			assert.Fail(t, "timed out waiting for X to stop seeing Y")
+			return
+		}
+	}
+}
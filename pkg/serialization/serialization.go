@@ -48,5 +48,49 @@ func Deserialize(data []byte) (*types.Container, error) {
 		)
 	}
 
+	if base.Probe != nil && base.Probe.TargetAddress != "" {
+		base.Probe.TargetAddr, _ = net.ResolveUDPAddr(
+			network.GetNetwork(base.Probe.TargetAddress),
+			base.Probe.TargetAddress,
+		)
+	}
+
 	return base, err
 }
+
+// Describe is a one-line summary of what kind of container a datagram holds (e.g. for a capture annotation); it doesn't
+// fail, a datagram that isn't a container just says so
+func Describe(data []byte) string {
+	base, err := Deserialize(data)
+	if err != nil {
+		return fmt.Sprintf("glue: not a container (%v)", err)
+	}
+
+	content := "empty"
+
+	if base.Announcement != nil {
+		content = "announcement"
+		if base.Announcement.Withdrawn {
+			content = "announcement (withdrawn)"
+		} else if base.Announcement.Registry {
+			content = "announcement (registry)"
+		}
+	} else if base.Frame != nil {
+		content = "frame"
+		if base.Frame.IsAck {
+			content = "ack"
+		}
+
+		content = fmt.Sprintf(
+			"%v %v/%v correlation %v",
+			content,
+			base.Frame.FragmentIndex+1,
+			base.Frame.FragmentCount,
+			base.Frame.CorrelationID,
+		)
+	} else if base.Probe != nil {
+		content = fmt.Sprintf("probe %v", base.Probe.Type)
+	}
+
+	return fmt.Sprintf("glue: %v from %v (%v)", content, base.SourceEndpointName, base.SourceEndpointID)
+}
@@ -91,3 +91,23 @@ func TestSerializeAndDeserializeAnnouncement(t *testing.T) {
 func TestSerializeAndDeserializeFrame(t *testing.T) {
 	testSerializeAndDeserializeContainer(t, getFrameContainer())
 }
+
+func TestDescribe(t *testing.T) {
+	data, err := Serialize(getAnnouncementContainer())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Contains(t, Describe(data), "glue: announcement from some-endpoint-1")
+
+	frameContainer := getFrameContainer()
+
+	data, err = Serialize(frameContainer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Contains(t, Describe(data), fmt.Sprintf("glue: frame 1/1 correlation %v", frameContainer.Frame.CorrelationID))
+
+	assert.Contains(t, Describe([]byte("Hello, world!")), "glue: not a container")
+}
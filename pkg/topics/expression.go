@@ -0,0 +1,486 @@
+package topics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expressions are over the fields of a decoded payload (see decodePayload), e.g.
+//
+//	device == "kitchen" && (reading.celsius > 20 || !healthy)
+//
+// fields are dotted paths (with array indexes as levels, e.g. readings.0.celsius) and a missing field is null; literals
+// are numbers, strings (double-quoted with Go escapes or single-quoted as is), true, false and null; the operators are
+// ==, !=, <, <=, >, >= (numbers with numbers, strings with strings), &&, || and !, and a bare operand is true if it's
+// true, non-zero or non-empty
+
+type expression interface {
+	evaluate(fields map[string]any) any
+}
+
+type literalExpression struct {
+	value any
+}
+
+func (e *literalExpression) evaluate(fields map[string]any) any {
+	return e.value
+}
+
+type fieldExpression struct {
+	path []string
+}
+
+func (e *fieldExpression) evaluate(fields map[string]any) any {
+	var value any = fields
+
+	for _, level := range e.path {
+		switch container := value.(type) {
+		case map[string]any:
+			value = container[level]
+		case []any:
+			i, err := strconv.Atoi(level)
+			if err != nil || i < 0 || i >= len(container) {
+				return nil
+			}
+
+			value = container[i]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+type notExpression struct {
+	operand expression
+}
+
+func (e *notExpression) evaluate(fields map[string]any) any {
+	return !isTruthy(e.operand.evaluate(fields))
+}
+
+type logicalExpression struct {
+	operator string
+	left     expression
+	right    expression
+}
+
+func (e *logicalExpression) evaluate(fields map[string]any) any {
+	left := isTruthy(e.left.evaluate(fields))
+
+	if e.operator == "&&" {
+		return left && isTruthy(e.right.evaluate(fields))
+	}
+
+	return left || isTruthy(e.right.evaluate(fields))
+}
+
+type comparisonExpression struct {
+	operator string
+	left     expression
+	right    expression
+}
+
+func (e *comparisonExpression) evaluate(fields map[string]any) any {
+	left := normalize(e.left.evaluate(fields))
+	right := normalize(e.right.evaluate(fields))
+
+	switch e.operator {
+	case "==":
+		return isEqual(left, right)
+	case "!=":
+		return !isEqual(left, right)
+	}
+
+	var comparison int
+
+	switch left := left.(type) {
+	case float64:
+		right, ok := right.(float64)
+		if !ok {
+			return false
+		}
+
+		comparison = compare(left, right)
+	case string:
+		right, ok := right.(string)
+		if !ok {
+			return false
+		}
+
+		comparison = compare(left, right)
+	default:
+		return false
+	}
+
+	switch e.operator {
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	case ">=":
+		return comparison >= 0
+	}
+
+	return false
+}
+
+func compare[T float64 | string](a T, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// normalize makes all numbers float64 (JSON gives us float64 but msgpack gives us whatever was sent)
+func normalize(value any) any {
+	switch value := value.(type) {
+	case int:
+		return float64(value)
+	case int8:
+		return float64(value)
+	case int16:
+		return float64(value)
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint:
+		return float64(value)
+	case uint8:
+		return float64(value)
+	case uint16:
+		return float64(value)
+	case uint32:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case float32:
+		return float64(value)
+	}
+
+	return value
+}
+
+func isEqual(a any, b any) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case float64, string, bool:
+		return a == b
+	}
+
+	// maps and arrays are never equal to anything we can write down
+	return false
+}
+
+func isTruthy(value any) bool {
+	switch value := normalize(value).(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	case map[string]any:
+		return len(value) > 0
+	case []any:
+		return len(value) > 0
+	}
+
+	return true
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenOperator
+	tokenField
+	tokenLiteral
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	value    any
+	position int
+}
+
+func tokenize(source string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	i := 0
+	for i < len(source) {
+		c := rune(source[i])
+
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+
+		start := i
+
+		switch {
+		case strings.ContainsRune("=!<>&|", c):
+			text := source[i : i+1]
+			if i+1 < len(source) {
+				pair := source[i : i+2]
+				if pair == "==" || pair == "!=" || pair == "<=" || pair == ">=" || pair == "&&" || pair == "||" {
+					text = pair
+				}
+			}
+
+			if text == "=" || text == "&" || text == "|" {
+				return nil, fmt.Errorf("unexpected %#v at %v (did you mean %#v?)", text, start, text+text)
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, text: text, position: start})
+			i += len(text)
+
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{kind: tokenOperator, text: string(c), position: start})
+			i++
+
+		case c == '"':
+			i++
+			for i < len(source) && source[i] != '"' {
+				if source[i] == '\\' {
+					i++
+				}
+				i++
+			}
+
+			if i >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+
+			i++
+
+			value, err := strconv.Unquote(source[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %v: %v", start, err)
+			}
+
+			tokens = append(tokens, token{kind: tokenLiteral, text: source[start:i], value: value, position: start})
+
+		case c == '\'':
+			end := strings.IndexByte(source[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+
+			i += end + 2
+
+			tokens = append(tokens, token{kind: tokenLiteral, text: source[start:i], value: source[start+1 : i-1], position: start})
+
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			i++
+			for i < len(source) && (strings.ContainsRune(".eE+-", rune(source[i])) || unicode.IsDigit(rune(source[i]))) {
+				// a sign only belongs to the number straight after an exponent
+				if (source[i] == '+' || source[i] == '-') && source[i-1] != 'e' && source[i-1] != 'E' {
+					break
+				}
+				i++
+			}
+
+			value, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %#v at %v", source[start:i], start)
+			}
+
+			tokens = append(tokens, token{kind: tokenLiteral, text: source[start:i], value: value, position: start})
+
+		case c == '_' || unicode.IsLetter(c):
+			for i < len(source) && (source[i] == '_' || source[i] == '.' || unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i]))) {
+				i++
+			}
+
+			text := source[start:i]
+
+			switch text {
+			case "true":
+				tokens = append(tokens, token{kind: tokenLiteral, text: text, value: true, position: start})
+			case "false":
+				tokens = append(tokens, token{kind: tokenLiteral, text: text, value: false, position: start})
+			case "null":
+				tokens = append(tokens, token{kind: tokenLiteral, text: text, value: nil, position: start})
+			default:
+				tokens = append(tokens, token{kind: tokenField, text: text, position: start})
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected %#v at %v", string(c), start)
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEnd, text: "end of expression", position: len(source)})
+
+	return tokens, nil
+}
+
+// parser is recursive descent; || binds loosest, then &&, then the comparisons, then !
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEnd {
+		p.i++
+	}
+
+	return t
+}
+
+func (p *parser) isOperator(texts ...string) bool {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return false
+	}
+
+	for _, text := range texts {
+		if t.text == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("||") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalExpression{operator: "||", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expression, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("&&") {
+		p.next()
+
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &logicalExpression{operator: "&&", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseComparison() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.isOperator("==", "!=", "<", "<=", ">", ">=") {
+		return left, nil
+	}
+
+	operator := p.next().text
+
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &comparisonExpression{operator: operator, left: left, right: right}, nil
+}
+
+func (p *parser) parseUnary() (expression, error) {
+	t := p.next()
+
+	switch {
+	case t.kind == tokenOperator && t.text == "!":
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notExpression{operand: operand}, nil
+
+	case t.kind == tokenOperator && t.text == "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		closing := p.next()
+		if closing.kind != tokenOperator || closing.text != ")" {
+			return nil, fmt.Errorf("expected \")\" at %v but got %#v", closing.position, closing.text)
+		}
+
+		return inner, nil
+
+	case t.kind == tokenField:
+		path := strings.Split(t.text, ".")
+		for _, level := range path {
+			if level == "" {
+				return nil, fmt.Errorf("bad field %#v at %v", t.text, t.position)
+			}
+		}
+
+		return &fieldExpression{path: path}, nil
+
+	case t.kind == tokenLiteral:
+		return &literalExpression{value: t.value}, nil
+	}
+
+	return nil, fmt.Errorf("expected a field, a value, \"!\" or \"(\" at %v but got %#v", t.position, t.text)
+}
+
+func parseExpression(source string) (expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, fmt.Errorf("expression %#v invalid; %v", source, err)
+	}
+
+	p := parser{tokens: tokens}
+
+	e, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEnd {
+		err = fmt.Errorf("unexpected %#v at %v", p.peek().text, p.peek().position)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("expression %#v invalid; %v", source, err)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,254 @@
+package topics
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// InterestExpiry is how long a publisher holds on to an endpoint's Interest without hearing it again (they're resent every
+// scheduledWorkerRate while there are pushed filters); after that the endpoint gets everything again
+const InterestExpiry = scheduledWorkerRate * 5
+
+// Filter narrows down which messages on a topic a subscription handle gets; every part that's set must match (so the zero
+// value matches everything)
+type Filter struct {
+	// published by any of these endpoints (by EndpointName)
+	EndpointNames []string `json:"endpoint_names"`
+
+	// published by an endpoint with all of these labels (see Manager.UseLabels)
+	Labels map[string]string `json:"labels"`
+
+	// published with all of these headers (see Manager.PublishWithHeaders)
+	Headers map[string]string `json:"headers"`
+
+	// true for the payload's fields (the payload being a JSON or msgpack object), e.g. `device == "kitchen" && celsius > 20`
+	// (see expression.go for the rest of the syntax)
+	Expression string `json:"expression"`
+
+	// also send the filter to publishers, so they don't send us what doesn't match it in the first place
+	Push bool `json:"push"`
+}
+
+// Check is an error if the filter's expression doesn't parse (it's checked when subscribing, so there's no need to call
+// it first)
+func (f *Filter) Check() error {
+	_, err := compileFilter(f)
+
+	return err
+}
+
+// Match is true if the message gets through the filter
+func (f *Filter) Match(message *Message) bool {
+	c, err := compileFilter(f)
+	if err != nil {
+		return false
+	}
+
+	return c.match(message, newPayloadFields(message))
+}
+
+// compiledFilter is a filter with its expression parsed once up front
+type compiledFilter struct {
+	filter     Filter
+	expression expression
+}
+
+func compileFilter(filter *Filter) (*compiledFilter, error) {
+	c := compiledFilter{
+		filter: *filter,
+	}
+
+	if filter.Expression != "" {
+		var err error
+
+		c.expression, err = parseExpression(filter.Expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
+
+func (c *compiledFilter) match(message *Message, payloadFields *payloadFields) bool {
+	if len(c.filter.EndpointNames) > 0 && !slices.Contains(c.filter.EndpointNames, message.EndpointName) {
+		return false
+	}
+
+	for key, value := range c.filter.Labels {
+		otherValue, ok := message.Labels[key]
+		if !ok || otherValue != value {
+			return false
+		}
+	}
+
+	for key, value := range c.filter.Headers {
+		otherValue, ok := message.Headers[key]
+		if !ok || otherValue != value {
+			return false
+		}
+	}
+
+	if c.expression == nil {
+		return true
+	}
+
+	return isTruthy(c.expression.evaluate(payloadFields.get()))
+}
+
+// payloadFields decodes a message's payload at most once, however many filters look at it
+type payloadFields struct {
+	message *Message
+	decoded bool
+	fields  map[string]any
+}
+
+func newPayloadFields(message *Message) *payloadFields {
+	return &payloadFields{
+		message: message,
+	}
+}
+
+func (p *payloadFields) get() map[string]any {
+	if !p.decoded {
+		p.fields = decodePayload(p.message.Payload)
+		p.decoded = true
+	}
+
+	return p.fields
+}
+
+// decodePayload is the fields of a JSON or msgpack object (nil for anything else)
+func decodePayload(payload []byte) map[string]any {
+	var fields map[string]any
+
+	err := json.Unmarshal(payload, &fields)
+	if err == nil {
+		return fields
+	}
+
+	fields = nil
+
+	err = msgpack.Unmarshal(payload, &fields)
+	if err == nil {
+		return fields
+	}
+
+	return nil
+}
+
+type remoteSubscription struct {
+	topicName string
+	filters   []*compiledFilter
+}
+
+type remoteInterest struct {
+	subscriptions []*remoteSubscription
+	lastSeen      time.Time
+}
+
+// interests are what other endpoints have told us they want (see Filter.Push); an endpoint that hasn't told us anything
+// (or not lately) is assumed to want everything
+type interests struct {
+	mu                         sync.Mutex
+	remoteInterestByEndpointID map[ksuid.KSUID]*remoteInterest
+}
+
+func newInterests() *interests {
+	return &interests{
+		remoteInterestByEndpointID: make(map[ksuid.KSUID]*remoteInterest),
+	}
+}
+
+func (i *interests) handle(endpointID ksuid.KSUID, interest *Interest) {
+	thisRemoteInterest := remoteInterest{
+		subscriptions: make([]*remoteSubscription, 0, len(interest.Subscriptions)),
+		lastSeen:      time.Now(),
+	}
+
+	for _, subscription := range interest.Subscriptions {
+		thisRemoteSubscription := remoteSubscription{
+			topicName: subscription.TopicName,
+			filters:   make([]*compiledFilter, 0, len(subscription.Filters)),
+		}
+
+		for j := range subscription.Filters {
+			c, err := compileFilter(&subscription.Filters[j])
+			if err != nil {
+				log.Printf("warning: ignoring interest from %v in %#+v because %v", endpointID, subscription.TopicName, err)
+
+				// we can't tell what it wants on this topic, so it gets everything on it
+				thisRemoteSubscription.filters = nil
+				break
+			}
+
+			thisRemoteSubscription.filters = append(thisRemoteSubscription.filters, c)
+		}
+
+		thisRemoteInterest.subscriptions = append(thisRemoteInterest.subscriptions, &thisRemoteSubscription)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(thisRemoteInterest.subscriptions) == 0 {
+		delete(i.remoteInterestByEndpointID, endpointID)
+		return
+	}
+
+	i.remoteInterestByEndpointID[endpointID] = &thisRemoteInterest
+}
+
+func (i *interests) get(endpointID ksuid.KSUID) *remoteInterest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	thisRemoteInterest, ok := i.remoteInterestByEndpointID[endpointID]
+	if !ok {
+		return nil
+	}
+
+	if time.Since(thisRemoteInterest.lastSeen) > InterestExpiry {
+		delete(i.remoteInterestByEndpointID, endpointID)
+		return nil
+	}
+
+	return thisRemoteInterest
+}
+
+// wants is true if the endpoint wants the message (or hasn't said what it wants, either at all or for the message's topic;
+// e.g. it's only just subscribed and we've yet to hear about it)
+func (i *interests) wants(endpointID ksuid.KSUID, message *Message, payloadFields *payloadFields) bool {
+	thisRemoteInterest := i.get(endpointID)
+	if thisRemoteInterest == nil {
+		return true
+	}
+
+	mentioned := false
+
+	for _, subscription := range thisRemoteInterest.subscriptions {
+		if !MatchTopic(subscription.topicName, message.TopicName) {
+			continue
+		}
+
+		mentioned = true
+
+		if len(subscription.filters) == 0 {
+			return true
+		}
+
+		for _, c := range subscription.filters {
+			if c.match(message, payloadFields) {
+				return true
+			}
+		}
+	}
+
+	return !mentioned
+}
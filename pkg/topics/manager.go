@@ -49,6 +49,8 @@ func (m *Manager) HandleReceive(container *types.Container) {
 	m.subscriber.HandleReceive(container)
 }
 
+// Publish sends the payload to everything subscribed to the topic (or a pattern that matches it); the topic name can't
+// have the wildcards "+" or "#" in it (see CheckTopicName)
 func (m *Manager) Publish(
 	topicName string,
 	topicType string,
@@ -63,11 +65,49 @@ func (m *Manager) Publish(
 	)
 }
 
+// PublishWithHeaders is Publish with some headers for subscribers to filter on (see Filter.Headers)
+func (m *Manager) PublishWithHeaders(
+	topicName string,
+	topicType string,
+	expiry time.Duration,
+	headers map[string]string,
+	payload []byte,
+) error {
+	return m.publisher.PublishWithHeaders(
+		topicName,
+		topicType,
+		expiry,
+		headers,
+		payload,
+	)
+}
+
+// UseLabels has everything we publish carry the given labels (for subscribers to filter on, see Filter.Labels)
+func (m *Manager) UseLabels(
+	labels map[string]string,
+) {
+	m.publisher.UseLabels(labels)
+}
+
+// SetDSCP marks what's published to the topic with the given DSCP (see Publisher.SetDSCP)
+func (m *Manager) SetDSCP(
+	topicName string,
+	dscp int,
+) error {
+	return m.publisher.SetDSCP(
+		topicName,
+		dscp,
+	)
+}
+
+// Subscribe has messages on the topic (or on every topic matching the pattern, see CheckTopicPattern) of the given type
+// (or of any type, if empty) passed to onReceive, until the returned handle is unsubscribed; any number of handles may
+// share a topic
 func (m *Manager) Subscribe(
 	topicName string,
 	topicType string,
 	onReceive func(*Message),
-) error {
+) (*SubscriptionHandle, error) {
 	return m.subscriber.Subscribe(
 		topicName,
 		topicType,
@@ -75,6 +115,42 @@ func (m *Manager) Subscribe(
 	)
 }
 
+// SubscribeWithFilter is Subscribe for only the messages that get through the filter (see Filter); a filter with Push
+// set is also sent to publishers, so they don't send us what doesn't match it
+func (m *Manager) SubscribeWithFilter(
+	topicName string,
+	topicType string,
+	filter *Filter,
+	onReceive func(*Message),
+) (*SubscriptionHandle, error) {
+	return m.subscriber.SubscribeWithFilter(
+		topicName,
+		topicType,
+		filter,
+		onReceive,
+	)
+}
+
+// SubscribeWithOptions is Subscribe with a filter, ordered delivery and / or a callback for lost messages (see
+// SubscriptionOptions)
+func (m *Manager) SubscribeWithOptions(
+	topicName string,
+	topicType string,
+	options *SubscriptionOptions,
+	onReceive func(*Message),
+) (*SubscriptionHandle, error) {
+	return m.subscriber.SubscribeWithOptions(
+		topicName,
+		topicType,
+		options,
+		onReceive,
+	)
+}
+
+// Unsubscribe tears the topic down for every handle (including those belonging to other parts of the program, whose
+// callbacks just stop being called)
+//
+// Deprecated: use SubscriptionHandle.Unsubscribe, which only removes the one handle
 func (m *Manager) Unsubscribe(
 	topicName string,
 ) error {
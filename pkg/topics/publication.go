@@ -8,7 +8,6 @@ import (
 	"github.com/segmentio/ksuid"
 	"github.com/vmihailenco/msgpack/v5"
 
-	"github.com/initialed85/glue/pkg/fragmentation"
 	"github.com/initialed85/glue/pkg/transport"
 	"github.com/initialed85/glue/pkg/worker"
 )
@@ -17,17 +16,24 @@ import (
 const MessageTimeout = time.Millisecond * 100
 const MessageExpiry = time.Millisecond * 500
 
+// messages bigger than this are fragmented (except for endpoints on the same host, which get them whole)
+const FragmentSize = 8192
+
 type Publication struct {
 	scheduleWorker             *worker.ScheduledWorker
 	mu                         sync.Mutex
 	messageByMessageIdentifier map[MessageIdentifier]*Message
 	sequenceNumber             int64
+	incarnation                int64
 	endpointID                 ksuid.KSUID
 	endpointName               string
 	topicName                  string
 	topicType                  string
 	transportManager           *transport.Manager
 	subscriber                 **Subscriber
+	publisher                  *Publisher
+	dscp                       int
+	labels                     map[string]string
 }
 
 func NewPublication(
@@ -37,16 +43,23 @@ func NewPublication(
 	topicType string,
 	transportManager *transport.Manager,
 	subscriber **Subscriber,
+	publisher *Publisher,
+	dscp int,
+	labels map[string]string,
 ) *Publication {
 	p := Publication{
 		messageByMessageIdentifier: make(map[MessageIdentifier]*Message),
 		sequenceNumber:             1,
+		incarnation:                time.Now().UnixNano(),
 		endpointID:                 endpointID,
 		endpointName:               endpointName,
 		topicName:                  topicName,
 		topicType:                  topicType,
 		transportManager:           transportManager,
 		subscriber:                 subscriber,
+		publisher:                  publisher,
+		dscp:                       dscp,
+		labels:                     labels,
 	}
 
 	p.scheduleWorker = worker.NewScheduledWorker(
@@ -86,25 +99,54 @@ func (p *Publication) TopicType() string {
 	return p.topicType
 }
 
+// SetDSCP marks what's published from now on with the given DSCP (see network.Manager.WithDSCP)
+func (p *Publication) SetDSCP(dscp int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dscp = dscp
+}
+
+// SetLabels has what's published from now on carry the given labels (see Publisher.UseLabels)
+func (p *Publication) SetLabels(labels map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.labels = labels
+}
+
 func (p *Publication) Publish(
 	expiry time.Duration,
+	headers map[string]string,
 	payload []byte,
 ) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	// one sequence number per message (however many fragments it goes out in), so subscribers can spot gaps
+	sequenceNumber := p.sequenceNumber
+	p.sequenceNumber += 1
+
 	message := &Message{
 		Timestamp:      time.Now(),
 		Expiry:         expiry,
 		EndpointID:     p.endpointID,
 		EndpointName:   p.endpointName,
-		SequenceNumber: p.sequenceNumber,
+		Labels:         p.labels,
+		SequenceNumber: sequenceNumber,
+		Incarnation:    p.incarnation,
 		TopicName:      p.topicName,
 		TopicType:      p.topicType,
 		MessageType:    StandardMessageType,
+		Headers:        headers,
 		Payload:        payload,
 	}
 
+	p.messageByMessageIdentifier[MessageIdentifier{
+		EndpointID:     p.endpointID,
+		SequenceNumber: sequenceNumber,
+	}] = message
+
 	// TODO: is this gross? this is gross.
 	subscriber := *p.subscriber
 	if subscriber != nil {
@@ -116,33 +158,30 @@ func (p *Publication) Publish(
 		return err
 	}
 
-	fragments, err := fragmentation.Fragment(payload, 8192)
-	if err != nil {
-		return err
-	}
-
-	fragmentCount := len(fragments)
-
 	correlationID := ksuid.New()
 
-	for i, fragment := range fragments {
+	// endpoints that have pushed filters to us only get what matches them (see Filter.Push)
+	var where func(endpointID ksuid.KSUID) bool
+	if p.publisher != nil {
+		payloadFields := newPayloadFields(message)
 
-		p.transportManager.Broadcast(
-			MessageTimeout,
-			MessageExpiry,
-			correlationID,
-			int64(fragmentCount),
-			int64(i),
-			true,
-			fragment,
-		)
-
-		p.messageByMessageIdentifier[MessageIdentifier{
-			EndpointID:     p.endpointID,
-			SequenceNumber: p.sequenceNumber,
-		}] = message
+		where = func(endpointID ksuid.KSUID) bool {
+			return p.publisher.interests.wants(endpointID, message, payloadFields)
+		}
+	}
 
-		p.sequenceNumber += 1
+	err = p.transportManager.BroadcastPayloadWhere(
+		where,
+		MessageTimeout,
+		MessageExpiry,
+		correlationID,
+		true,
+		payload,
+		FragmentSize,
+		p.dscp,
+	)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -7,12 +7,16 @@ import (
 
 	"github.com/segmentio/ksuid"
 
+	"github.com/initialed85/glue/pkg/network"
 	"github.com/initialed85/glue/pkg/transport"
 )
 
 type Publisher struct {
 	mu                     sync.Mutex
 	publicationByTopicName map[string]*Publication
+	dscpByTopicName        map[string]int
+	labels                 map[string]string
+	interests              *interests
 	endpointID             ksuid.KSUID
 	endpointName           string
 	transportManager       *transport.Manager
@@ -27,6 +31,8 @@ func NewPublisher(
 ) *Publisher {
 	p := Publisher{
 		publicationByTopicName: make(map[string]*Publication),
+		dscpByTopicName:        make(map[string]int),
+		interests:              newInterests(),
 		endpointID:             endpointID,
 		endpointName:           endpointName,
 		transportManager:       transportManager,
@@ -36,12 +42,36 @@ func NewPublisher(
 	return &p
 }
 
+// Publish sends the payload to everything subscribed to the topic (or a pattern that matches it); the topic name can't
+// have the wildcards "+" or "#" in it (see CheckTopicName)
 func (p *Publisher) Publish(
 	topicName string,
 	topicType string,
 	expiry time.Duration,
 	payload []byte,
 ) error {
+	return p.PublishWithHeaders(
+		topicName,
+		topicType,
+		expiry,
+		nil,
+		payload,
+	)
+}
+
+// PublishWithHeaders is Publish with some headers for subscribers to filter on (see Filter.Headers)
+func (p *Publisher) PublishWithHeaders(
+	topicName string,
+	topicType string,
+	expiry time.Duration,
+	headers map[string]string,
+	payload []byte,
+) error {
+	err := CheckTopicName(topicName)
+	if err != nil {
+		return err
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -54,6 +84,9 @@ func (p *Publisher) Publish(
 			topicType,
 			p.transportManager,
 			p.subscriber,
+			p,
+			p.dscpByTopicName[topicName],
+			p.labels,
 		)
 		publication.Start()
 		p.publicationByTopicName[topicName] = publication
@@ -69,10 +102,58 @@ func (p *Publisher) Publish(
 
 	return publication.Publish(
 		expiry,
+		headers,
 		payload,
 	)
 }
 
+// SetDSCP marks what's published to the topic (from now on, whether or not it's been published to yet) with the given
+// DSCP; 0 is best effort
+func (p *Publisher) SetDSCP(
+	topicName string,
+	dscp int,
+) error {
+	err := network.CheckDSCP(dscp)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dscpByTopicName[topicName] = dscp
+
+	publication, ok := p.publicationByTopicName[topicName]
+	if ok {
+		publication.SetDSCP(dscp)
+	}
+
+	return nil
+}
+
+// UseLabels has everything we publish from now on carry the given labels (for subscribers to filter on, see
+// Filter.Labels)
+func (p *Publisher) UseLabels(
+	labels map[string]string,
+) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.labels = labels
+
+	for _, publication := range p.publicationByTopicName {
+		publication.SetLabels(labels)
+	}
+}
+
+// handleInterest keeps what an endpoint has told us it wants (see Filter.Push)
+func (p *Publisher) handleInterest(
+	endpointID ksuid.KSUID,
+	interest *Interest,
+) {
+	p.interests.handle(endpointID, interest)
+}
+
 func (p *Publisher) Start() {
 	// noop
 }
@@ -0,0 +1,226 @@
+package topics
+
+import (
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// a gap in a publisher's sequence numbers is given this many messages or this long (as long as the transport keeps
+// resending) to be filled before the missing messages are declared lost (and anything held back behind them delivered)
+const ReorderWindow = 64
+const ReorderTimeout = MessageExpiry
+
+// a publisher we've not heard from in this long is forgotten (so it starts afresh if it turns up again)
+const sequenceExpiry = time.Minute
+
+// SampleLost is a run of messages from a publisher that never turned up
+type SampleLost struct {
+	EndpointID   ksuid.KSUID
+	EndpointName string
+	TopicName    string
+
+	// inclusive
+	FirstSequenceNumber int64
+	LastSequenceNumber  int64
+}
+
+// Count is how many messages were lost
+func (s *SampleLost) Count() int64 {
+	return s.LastSequenceNumber - s.FirstSequenceNumber + 1
+}
+
+// each publication has its own sequence numbers, so a publisher is tracked per topic (which matters for patterns)
+type sequenceKey struct {
+	endpointID ksuid.KSUID
+	topicName  string
+}
+
+type pendingMessage struct {
+	message *Message
+	arrived time.Time
+}
+
+// skippedRun is a gap that was given up on; anything from it that turns up afterwards is late (so it's too late for ordered
+// delivery, but not for the rest)
+type skippedRun struct {
+	first int64
+	last  int64
+}
+
+// sequence tracks one publisher's messages on one topic; messages that arrive with a gap before them are held until the
+// gap's filled or given up on
+type sequence struct {
+	incarnation int64
+	next        int64
+	pending     map[int64]*pendingMessage
+	skipped     []*skippedRun
+	lastSeen    time.Time
+}
+
+func newSequence() *sequence {
+	return &sequence{
+		pending: make(map[int64]*pendingMessage),
+	}
+}
+
+// receive returns whether the message has arrived for the first time (i.e. it's not a duplicate, though it may be late)
+// along with the messages that can now be delivered in order and any that have been given up on
+func (q *sequence) receive(message *Message, now time.Time) (bool, []*Message, []*SampleLost) {
+	q.lastSeen = now
+
+	released := make([]*Message, 0)
+	lost := make([]*SampleLost, 0)
+
+	if message.Incarnation != q.incarnation {
+		// a straggler from before the publisher restarted; its sequence numbers mean nothing to us now
+		if message.Incarnation < q.incarnation {
+			return false, nil, nil
+		}
+
+		// the publisher restarted, so whatever was held back from before is as complete as it's going to get
+		for len(q.pending) > 0 {
+			thisLost, thisReleased := q.skip()
+			lost = append(lost, thisLost)
+			released = append(released, thisReleased...)
+		}
+
+		q.incarnation = message.Incarnation
+		q.next = 0
+		q.skipped = nil
+	}
+
+	sequenceNumber := message.SequenceNumber
+
+	// the first we've seen (we may have joined late, so there's no gap to speak of)
+	if q.next == 0 {
+		q.next = sequenceNumber
+	}
+
+	if sequenceNumber < q.next {
+		return q.receiveLate(sequenceNumber), released, lost
+	}
+
+	_, ok := q.pending[sequenceNumber]
+	if ok {
+		return false, released, lost
+	}
+
+	q.pending[sequenceNumber] = &pendingMessage{
+		message: message,
+		arrived: now,
+	}
+
+	released = append(released, q.drain()...)
+
+	// give up on a gap that's gone on too long (in messages)
+	for len(q.pending) > 0 && sequenceNumber-q.next >= ReorderWindow {
+		thisLost, thisReleased := q.skip()
+		lost = append(lost, thisLost)
+		released = append(released, thisReleased...)
+	}
+
+	return true, released, lost
+}
+
+// receiveLate is true if the message was given up on (rather than already delivered), in which case it's forgotten
+// about so that a second copy isn't late as well
+func (q *sequence) receiveLate(sequenceNumber int64) bool {
+	for i, run := range q.skipped {
+		if sequenceNumber < run.first || sequenceNumber > run.last {
+			continue
+		}
+
+		before := &skippedRun{first: run.first, last: sequenceNumber - 1}
+		after := &skippedRun{first: sequenceNumber + 1, last: run.last}
+
+		q.skipped = append(q.skipped[:i], q.skipped[i+1:]...)
+
+		for _, thisRun := range []*skippedRun{before, after} {
+			if thisRun.first <= thisRun.last {
+				q.skipped = append(q.skipped, thisRun)
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// expire gives up on gaps that have gone on too long (in time)
+func (q *sequence) expire(now time.Time) ([]*Message, []*SampleLost) {
+	released := make([]*Message, 0)
+	lost := make([]*SampleLost, 0)
+
+	for len(q.pending) > 0 && now.Sub(q.getOldestArrival()) >= ReorderTimeout {
+		thisLost, thisReleased := q.skip()
+		lost = append(lost, thisLost)
+		released = append(released, thisReleased...)
+	}
+
+	return released, lost
+}
+
+func (q *sequence) getOldestArrival() time.Time {
+	var oldest time.Time
+
+	for _, pending := range q.pending {
+		if oldest.IsZero() || pending.arrived.Before(oldest) {
+			oldest = pending.arrived
+		}
+	}
+
+	return oldest
+}
+
+// drain releases what's next in line
+func (q *sequence) drain() []*Message {
+	released := make([]*Message, 0)
+
+	for {
+		pending, ok := q.pending[q.next]
+		if !ok {
+			return released
+		}
+
+		released = append(released, pending.message)
+
+		delete(q.pending, q.next)
+		q.next++
+	}
+}
+
+// skip gives up on the gap before the earliest held message (be sure there is one)
+func (q *sequence) skip() (*SampleLost, []*Message) {
+	var earliest *Message
+
+	for sequenceNumber, pending := range q.pending {
+		if earliest == nil || sequenceNumber < earliest.SequenceNumber {
+			earliest = pending.message
+		}
+	}
+
+	lost := &SampleLost{
+		EndpointID:          earliest.EndpointID,
+		EndpointName:        earliest.EndpointName,
+		TopicName:           earliest.TopicName,
+		FirstSequenceNumber: q.next,
+		LastSequenceNumber:  earliest.SequenceNumber - 1,
+	}
+
+	q.next = earliest.SequenceNumber
+
+	q.skipped = append(q.skipped, &skippedRun{
+		first: lost.FirstSequenceNumber,
+		last:  lost.LastSequenceNumber,
+	})
+
+	// a publisher that's losing a lot is only remembered for its most recent gaps (anything older than that turning up is
+	// treated as a duplicate)
+	if len(q.skipped) > ReorderWindow {
+		q.skipped = q.skipped[len(q.skipped)-ReorderWindow:]
+	}
+
+	return lost, q.drain()
+}
@@ -1,9 +1,11 @@
 package topics
 
 import (
+	"fmt"
 	"log"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/segmentio/ksuid"
 	"github.com/vmihailenco/msgpack/v5"
@@ -12,11 +14,16 @@ import (
 	"github.com/initialed85/glue/pkg/fragmentation"
 	"github.com/initialed85/glue/pkg/transport"
 	"github.com/initialed85/glue/pkg/types"
+	"github.com/initialed85/glue/pkg/worker"
 )
 
 type Subscriber struct {
+	scheduledWorker                         *worker.ScheduledWorker
 	mu                                      sync.Mutex
+	advertiseMu                             sync.Mutex
+	advertising                             bool
 	subscriptionByTopicName                 map[string]*Subscription
+	subscriptionTree                        *topicTree
 	containerByFragmentIndexByCorrelationID map[ksuid.KSUID]map[int64]*types.Container
 	endpointID                              ksuid.KSUID
 	endpointName                            string
@@ -32,6 +39,7 @@ func NewSubscriber(
 ) *Subscriber {
 	s := Subscriber{
 		subscriptionByTopicName:                 make(map[string]*Subscription),
+		subscriptionTree:                        newTopicTree(),
 		containerByFragmentIndexByCorrelationID: make(map[ksuid.KSUID]map[int64]*types.Container),
 		endpointID:                              endpointID,
 		endpointName:                            endpointName,
@@ -39,6 +47,14 @@ func NewSubscriber(
 		publisher:                               publisher,
 	}
 
+	// pushed filters are resent while there are any, so publishers that missed them (or that turn up later) get them
+	s.scheduledWorker = worker.NewScheduledWorker(
+		func() {},
+		s.advertise,
+		func() {},
+		scheduledWorkerRate,
+	)
+
 	return &s
 }
 
@@ -48,37 +64,36 @@ func (s *Subscriber) handleInternalReceive(message *Message) {
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	subscription, ok := s.subscriptionByTopicName[message.TopicName]
-
-	// if we don't have a subscription, see if we're listening for the wildcard topic
-	usingWildcard := false
-	if !ok {
-		subscription, ok = s.subscriptionByTopicName["#"]
-		usingWildcard = ok
+	if message.MessageType == InterestMessageType {
+		s.handleInterest(message)
+		return
 	}
 
+	s.mu.Lock()
+	subscriptions := s.subscriptionTree.match(message.TopicName)
+	s.mu.Unlock()
+
 	// TODO: here's where we'd put the late joiner / persistence stuff
-	if !ok {
-		return
-	}
+	for _, subscription := range subscriptions {
+		// each subscription checks the type for itself; an empty type is any type
+		// TODO: fix hack usage for the bridge
+		if subscription.topicType != "" && message.TopicType != "__mqtt_to_glue_bridge__" && message.TopicType != subscription.topicType {
+			// a pattern can easily span topics of different types, so that's not worth a warning
+			if !IsTopicPattern(subscription.topicName) {
+				log.Printf(
+					"warning: expected type %#v for topic %#v but got %#v; message was %#+v",
+					subscription.topicType,
+					subscription.topicName,
+					message.TopicType,
+					message,
+				)
+			}
 
-	// TODO: not sure how to handle type safety and wildcard topics
-	// TODO: fix hack usage for the bridge
-	if !usingWildcard && message.TopicType != "__mqtt_to_glue_bridge__" && message.TopicType != subscription.topicType {
-		log.Printf(
-			"warning: expected type %#v for topic %#v but got %#v; message was %#+v",
-			subscription.topicType,
-			subscription.topicName,
-			message.TopicType,
-			message,
-		)
-		return
-	}
+			continue
+		}
 
-	subscription.HandleReceive(message)
+		subscription.HandleReceive(message)
+	}
 }
 
 func (s *Subscriber) HandleReceive(container *types.Container) {
@@ -146,69 +161,311 @@ func (s *Subscriber) HandleReceive(container *types.Container) {
 	s.handleInternalReceive(message)
 }
 
+func (s *Subscriber) handleInterest(message *Message) {
+	publisher := *s.publisher
+	if publisher == nil {
+		return
+	}
+
+	var interest Interest
+
+	err := msgpack.Unmarshal(message.Payload, &interest)
+	if err != nil {
+		log.Printf("warning: attempt to unmarshal interest returned %#+v from %v", err, message.EndpointID)
+		return
+	}
+
+	publisher.handleInterest(message.EndpointID, &interest)
+}
+
+// getInterest is what we'd push to publishers and whether there's anything to push (i.e. any pushed filters); a topic
+// with any handle that doesn't push its filter has no filters (as that handle wants everything on it)
+func (s *Subscriber) getInterest() (*Interest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interest := Interest{
+		Subscriptions: make([]InterestSubscription, 0, len(s.subscriptionByTopicName)),
+	}
+
+	pushing := false
+
+	for topicName, subscription := range s.subscriptionByTopicName {
+		filters := make([]Filter, 0)
+
+		for _, handle := range subscription.getHandles() {
+			if handle.filter == nil || !handle.filter.filter.Push {
+				filters = nil
+				break
+			}
+
+			filters = append(filters, handle.filter.filter)
+		}
+
+		if len(filters) > 0 {
+			pushing = true
+		}
+
+		interest.Subscriptions = append(interest.Subscriptions, InterestSubscription{
+			TopicName: topicName,
+			Filters:   filters,
+		})
+	}
+
+	return &interest, pushing
+}
+
+// advertise sends our interest to everyone while we have pushed filters (and an empty one when we stop having them, to
+// take them back)
+func (s *Subscriber) advertise() {
+	if s.transportManager == nil {
+		return
+	}
+
+	s.advertiseMu.Lock()
+	defer s.advertiseMu.Unlock()
+
+	interest, pushing := s.getInterest()
+
+	if !pushing {
+		if !s.advertising {
+			return
+		}
+
+		interest = &Interest{}
+	}
+
+	s.advertising = pushing
+
+	payload, err := msgpack.Marshal(interest)
+	if err != nil {
+		log.Printf("warning: failed to marshal interest: %v", err)
+		return
+	}
+
+	payload, err = msgpack.Marshal(&Message{
+		Timestamp:    time.Now(),
+		Expiry:       InterestExpiry,
+		EndpointID:   s.endpointID,
+		EndpointName: s.endpointName,
+		MessageType:  InterestMessageType,
+		Payload:      payload,
+	})
+	if err != nil {
+		log.Printf("warning: failed to marshal interest: %v", err)
+		return
+	}
+
+	err = s.transportManager.BroadcastPayload(
+		MessageTimeout,
+		MessageExpiry,
+		ksuid.New(),
+		true,
+		payload,
+		FragmentSize,
+		0,
+	)
+	if err != nil {
+		log.Printf("warning: failed to broadcast interest: %v", err)
+	}
+}
+
 // be sure you're holding the mutex before calling this
 func (s *Subscriber) subscribe(
 	topicName string,
 	topicType string,
+	options *SubscriptionOptions,
 	onReceive func(*Message),
-) error {
+) (*SubscriptionHandle, error) {
+	err := CheckTopicPattern(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	var thisCompiledFilter *compiledFilter
+	if options.Filter != nil {
+		thisCompiledFilter, err = compileFilter(options.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	subscription, ok := s.subscriptionByTopicName[topicName]
 	if !ok {
-		subscription := NewSubscription(
+		subscription = NewSubscription(
 			s.endpointID,
 			s.endpointName,
 			topicName,
 			topicType,
 			s.transportManager,
-			onReceive,
 		)
 		subscription.Start()
 		s.subscriptionByTopicName[topicName] = subscription
-	} else {
-		subscription.OnReceive(onReceive)
+		s.subscriptionTree.add(topicName, subscription)
+	} else if subscription.topicType != topicType {
+		return nil, fmt.Errorf(
+			"subscription for topic %#+v already exists with type %#+v; cannot subscribe with type %#+v",
+			topicName,
+			subscription.topicType,
+			topicType,
+		)
 	}
 
-	return nil
+	handle := &SubscriptionHandle{
+		subscriber:   s,
+		subscription: subscription,
+		filter:       thisCompiledFilter,
+		ordered:      options.Ordered,
+		onSampleLost: options.OnSampleLost,
+		onReceive:    onReceive,
+	}
+
+	subscription.addHandle(handle)
+
+	return handle, nil
 }
 
+// Subscribe adds a handler for the topic (see SubscriptionHandle); every handle for a topic must agree on its type
 func (s *Subscriber) Subscribe(
 	topicName string,
 	topicType string,
 	onReceive func(*Message),
-) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+) (*SubscriptionHandle, error) {
+	return s.SubscribeWithFilter(
+		topicName,
+		topicType,
+		nil,
+		onReceive,
+	)
+}
 
-	return s.subscribe(
+// SubscribeWithFilter is Subscribe for only the messages that get through the filter (see Filter)
+func (s *Subscriber) SubscribeWithFilter(
+	topicName string,
+	topicType string,
+	filter *Filter,
+	onReceive func(*Message),
+) (*SubscriptionHandle, error) {
+	return s.SubscribeWithOptions(
 		topicName,
 		topicType,
+		&SubscriptionOptions{
+			Filter: filter,
+		},
 		onReceive,
 	)
 }
 
-func (s *Subscriber) Unsubscribe(
+// SubscribeWithOptions is Subscribe with a filter, ordered delivery and / or a callback for lost messages (see
+// SubscriptionOptions)
+func (s *Subscriber) SubscribeWithOptions(
 	topicName string,
+	topicType string,
+	options *SubscriptionOptions,
+	onReceive func(*Message),
+) (*SubscriptionHandle, error) {
+	if options == nil {
+		options = &SubscriptionOptions{}
+	}
+
+	s.mu.Lock()
+	handle, err := s.subscribe(
+		topicName,
+		topicType,
+		options,
+		onReceive,
+	)
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.advertise()
+
+	return handle, nil
+}
+
+// be sure you're holding the mutex before calling this
+func (s *Subscriber) removeHandle(
+	handle *SubscriptionHandle,
+) {
+	subscription := handle.subscription
+
+	if subscription.removeHandle(handle) != 0 {
+		return
+	}
+
+	// may since have been torn down (and maybe subscribed to afresh) by Unsubscribe
+	if s.subscriptionByTopicName[subscription.topicName] != subscription {
+		return
+	}
+
+	subscription.Stop()
+
+	delete(s.subscriptionByTopicName, subscription.topicName)
+	s.subscriptionTree.remove(subscription.topicName)
+}
+
+// unsubscribe removes a handle and tears the topic down if it was the last one
+func (s *Subscriber) unsubscribe(
+	handle *SubscriptionHandle,
 ) error {
+	s.mu.Lock()
+	s.removeHandle(handle)
+	s.mu.Unlock()
+
+	s.advertise()
+
+	return nil
+}
+
+// IsSubscribed is true if the topic (or pattern) has any handles
+func (s *Subscriber) IsSubscribed(
+	topicName string,
+) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	_, ok := s.subscriptionByTopicName[topicName]
+
+	return ok
+}
+
+// Unsubscribe tears the topic down, whatever handles it has (including those belonging to other parts of the program,
+// whose callbacks just stop being called)
+//
+// Deprecated: use SubscriptionHandle.Unsubscribe, which only removes the one handle
+func (s *Subscriber) Unsubscribe(
+	topicName string,
+) error {
+	s.mu.Lock()
+
 	subscription, ok := s.subscriptionByTopicName[topicName]
 	if !ok {
+		s.mu.Unlock()
 		return nil
 	}
 
 	subscription.Stop()
 
-	s.subscriptionByTopicName[topicName] = nil
+	delete(s.subscriptionByTopicName, topicName)
+	s.subscriptionTree.remove(topicName)
+
+	s.mu.Unlock()
+
+	s.advertise()
 
 	return nil
 }
 
 func (s *Subscriber) Start() {
-	// noop
+	s.scheduledWorker.Start()
 }
 
 func (s *Subscriber) Stop() {
+	s.scheduledWorker.Stop()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
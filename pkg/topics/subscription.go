@@ -3,16 +3,76 @@ package topics
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/ksuid"
+	"golang.org/x/exp/maps"
 
 	"github.com/initialed85/glue/pkg/transport"
 	"github.com/initialed85/glue/pkg/worker"
 )
 
+// SubscriptionOptions are the extras for a subscription handle; the zero value is a plain Subscribe
+type SubscriptionOptions struct {
+	// only the messages that get through this (see Filter)
+	Filter *Filter
+
+	// each publisher's messages in the order they were published (those that arrive early are held back until the gap
+	// before them is filled or given up on, see ReorderWindow and ReorderTimeout); otherwise they're delivered as they
+	// arrive
+	Ordered bool
+
+	// called for each run of messages that's given up on (see SubscriptionHandle.SampleLostCount)
+	OnSampleLost func(*SampleLost)
+}
+
+// SubscriptionHandle is one subscriber's interest in a topic (see Subscriber.Subscribe); a topic can have any number of
+// them (e.g. from different parts of a program), each with its own callback
+type SubscriptionHandle struct {
+	subscriber      *Subscriber
+	subscription    *Subscription
+	filter          *compiledFilter
+	ordered         bool
+	onSampleLost    func(*SampleLost)
+	onReceive       func(*Message)
+	sampleLostCount int64
+}
+
+func (h *SubscriptionHandle) TopicName() string {
+	return h.subscription.topicName
+}
+
+func (h *SubscriptionHandle) TopicType() string {
+	return h.subscription.topicType
+}
+
+// Filter is the handle's filter (nil if it hasn't got one)
+func (h *SubscriptionHandle) Filter() *Filter {
+	if h.filter == nil {
+		return nil
+	}
+
+	filter := h.filter.filter
+
+	return &filter
+}
+
+// SampleLostCount is how many messages have been given up on since the handle was subscribed (gaps in a publisher's
+// sequence numbers that weren't filled in time)
+func (h *SubscriptionHandle) SampleLostCount() int64 {
+	return atomic.LoadInt64(&h.sampleLostCount)
+}
+
+// Unsubscribe stops this handle's callback from being called; the topic itself is unsubscribed from when its last handle
+// goes (it's harmless to call more than once)
+func (h *SubscriptionHandle) Unsubscribe() error {
+	return h.subscriber.unsubscribe(h)
+}
+
 type Subscription struct {
 	scheduleWorker             *worker.ScheduledWorker
+	deliveryMu                 sync.Mutex
 	mu                         sync.Mutex
 	messageByMessageIdentifier map[MessageIdentifier]*Message
 	endpointID                 ksuid.KSUID
@@ -20,7 +80,21 @@ type Subscription struct {
 	topicName                  string
 	topicType                  string
 	transportManager           *transport.Manager
-	onReceive                  func(*Message)
+	handles                    map[*SubscriptionHandle]struct{}
+	sequenceByKey              map[sequenceKey]*sequence
+	expireTimer                *time.Timer
+	stopped                    bool
+}
+
+// delivery is what's come of a message (or of a gap being given up on)
+type delivery struct {
+	// for handles that take messages as they arrive
+	arrived []*Message
+
+	// for handles that take each publisher's messages in order
+	released []*Message
+
+	lost []*SampleLost
 }
 
 func NewSubscription(
@@ -29,7 +103,6 @@ func NewSubscription(
 	topicName string,
 	topicType string,
 	transportManager *transport.Manager,
-	onReceive func(*Message),
 ) *Subscription {
 	s := Subscription{
 		messageByMessageIdentifier: make(map[MessageIdentifier]*Message),
@@ -38,7 +111,8 @@ func NewSubscription(
 		topicName:                  topicName,
 		topicType:                  topicType,
 		transportManager:           transportManager,
-		onReceive:                  onReceive,
+		handles:                    make(map[*SubscriptionHandle]struct{}),
+		sequenceByKey:              make(map[sequenceKey]*sequence),
 	}
 
 	s.scheduleWorker = worker.NewScheduledWorker(
@@ -71,11 +145,42 @@ func (s *Subscription) work() {
 		delete(s.messageByMessageIdentifier, messageIdentifier)
 	}
 
+	for key, thisSequence := range s.sequenceByKey {
+		if len(thisSequence.pending) == 0 && now.Sub(thisSequence.lastSeen) > sequenceExpiry {
+			delete(s.sequenceByKey, key)
+		}
+	}
+
 	s.mu.Unlock()
 }
 
-func (s *Subscription) OnReceive(onReceive func(*Message)) {
-	s.onReceive = onReceive
+func (s *Subscription) addHandle(handle *SubscriptionHandle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handles[handle] = struct{}{}
+}
+
+// removeHandle returns how many handles are left (or -1 if the handle wasn't one of ours)
+func (s *Subscription) removeHandle(handle *SubscriptionHandle) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.handles[handle]
+	if !ok {
+		return -1
+	}
+
+	delete(s.handles, handle)
+
+	return len(s.handles)
+}
+
+func (s *Subscription) getHandles() []*SubscriptionHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Keys(s.handles)
 }
 
 func (s *Subscription) HandleReceive(message *Message) {
@@ -83,8 +188,26 @@ func (s *Subscription) HandleReceive(message *Message) {
 
 	messages = append(messages, message)
 
+	thisDelivery := delivery{}
+
+	// held until delivered, so that what's released here isn't overtaken by what's released from another goroutine
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+
+	handles := maps.Keys(s.handles)
+
+	// publishers leave out what doesn't match pushed filters, so there'd be gaps that aren't losses
+	sequenced := true
+	for _, handle := range handles {
+		if handle.filter != nil && handle.filter.filter.Push {
+			sequenced = false
+			break
+		}
+	}
+
+	now := time.Now()
 
 	for _, message := range messages {
 		if message.MessageType != StandardMessageType && message.MessageType != ForwardedMessageType {
@@ -92,12 +215,121 @@ func (s *Subscription) HandleReceive(message *Message) {
 			continue
 		}
 
-		s.onReceive(message)
-
 		s.messageByMessageIdentifier[MessageIdentifier{
 			EndpointID:     message.EndpointID,
 			SequenceNumber: message.SequenceNumber,
 		}] = message
+
+		if !sequenced {
+			thisDelivery.arrived = append(thisDelivery.arrived, message)
+			thisDelivery.released = append(thisDelivery.released, message)
+			continue
+		}
+
+		key := sequenceKey{
+			endpointID: message.EndpointID,
+			topicName:  message.TopicName,
+		}
+
+		thisSequence, ok := s.sequenceByKey[key]
+		if !ok {
+			thisSequence = newSequence()
+			s.sequenceByKey[key] = thisSequence
+		}
+
+		// a late message (one whose gap was given up on) has arrived but isn't released, as ordered handles have moved on
+		arrived, released, lost := thisSequence.receive(message, now)
+		if arrived {
+			thisDelivery.arrived = append(thisDelivery.arrived, message)
+		}
+
+		thisDelivery.released = append(thisDelivery.released, released...)
+		thisDelivery.lost = append(thisDelivery.lost, lost...)
+
+		if len(thisSequence.pending) > 0 && s.expireTimer == nil && !s.stopped {
+			s.expireTimer = time.AfterFunc(ReorderTimeout, s.expire)
+		}
+	}
+
+	s.mu.Unlock()
+
+	s.deliver(handles, &thisDelivery)
+}
+
+// expire gives up on gaps that haven't been filled in time (and delivers what was held back behind them)
+func (s *Subscription) expire() {
+	thisDelivery := delivery{}
+
+	s.deliveryMu.Lock()
+	defer s.deliveryMu.Unlock()
+
+	s.mu.Lock()
+
+	s.expireTimer = nil
+
+	now := time.Now()
+
+	var oldest time.Time
+
+	for _, thisSequence := range s.sequenceByKey {
+		released, lost := thisSequence.expire(now)
+		thisDelivery.released = append(thisDelivery.released, released...)
+		thisDelivery.lost = append(thisDelivery.lost, lost...)
+
+		if len(thisSequence.pending) > 0 {
+			arrived := thisSequence.getOldestArrival()
+			if oldest.IsZero() || arrived.Before(oldest) {
+				oldest = arrived
+			}
+		}
+	}
+
+	// still waiting on some more recent gaps
+	if !oldest.IsZero() && !s.stopped {
+		s.expireTimer = time.AfterFunc(oldest.Add(ReorderTimeout).Sub(now), s.expire)
+	}
+
+	handles := maps.Keys(s.handles)
+
+	s.mu.Unlock()
+
+	s.deliver(handles, &thisDelivery)
+}
+
+// deliver is outside the lock so a callback can unsubscribe (or subscribe) without deadlocking; the caller holds deliveryMu
+// though, so deliveries happen one at a time (and in the order they were worked out)
+func (s *Subscription) deliver(handles []*SubscriptionHandle, thisDelivery *delivery) {
+	payloadFieldsByMessage := make(map[*Message]*payloadFields)
+
+	for _, handle := range handles {
+		messages := thisDelivery.arrived
+		if handle.ordered {
+			messages = thisDelivery.released
+		}
+
+		for _, message := range messages {
+			if handle.filter != nil {
+				thisPayloadFields, ok := payloadFieldsByMessage[message]
+				if !ok {
+					thisPayloadFields = newPayloadFields(message)
+					payloadFieldsByMessage[message] = thisPayloadFields
+				}
+
+				if !handle.filter.match(message, thisPayloadFields) {
+					continue
+				}
+			}
+
+			handle.onReceive(message)
+		}
+
+		for _, lost := range thisDelivery.lost {
+			atomic.AddInt64(&handle.sampleLostCount, lost.Count())
+
+			if handle.onSampleLost != nil {
+				handle.onSampleLost(lost)
+			}
+		}
 	}
 }
 
@@ -108,5 +340,13 @@ func (s *Subscription) Start() {
 
 func (s *Subscription) Stop() {
 	s.scheduleWorker.Stop()
+
+	s.mu.Lock()
+	s.stopped = true
+	if s.expireTimer != nil {
+		s.expireTimer.Stop()
+	}
+	s.mu.Unlock()
+
 	log.Printf("subscription stopped: name=%#+v, type=%#+v", s.topicName, s.topicType)
 }
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/segmentio/ksuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/initialed85/glue/pkg/discovery"
 	"github.com/initialed85/glue/pkg/network"
@@ -16,9 +18,7 @@ import (
 	"github.com/initialed85/glue/pkg/types"
 )
 
-func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSUID, *discovery.Manager, chan *types.Container, chan *types.Container, *transport.Manager, *Manager) {
-	networkManager := network.NewManager()
-
+func getThings(endpointName string, listenPort int, networkManager network.Network, interfaceName string) (network.Network, ksuid.KSUID, *discovery.Manager, chan *types.Container, chan *types.Container, *transport.Manager, *Manager) {
 	added := make(chan *types.Container, 65536)
 	removed := make(chan *types.Container, 65536)
 
@@ -34,7 +34,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		unicastListenAddr,
 		multicastAddr,
 		multicastAddr,
-		"en0",
+		interfaceName,
 		time.Millisecond*100,
 		3,
 		networkManager,
@@ -44,6 +44,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		func(container *types.Container) {
 			removed <- container
 		},
+		nil,
 	)
 
 	var topicsManager *Manager
@@ -53,7 +54,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		endpointID,
 		endpointName,
 		unicastListenAddr,
-		"en0",
+		interfaceName,
 		discoveryManager,
 		networkManager,
 		func(container *types.Container) {
@@ -70,14 +71,14 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 	return networkManager, endpointID, discoveryManager, added, removed, transportManager, topicsManager
 }
 
-func startThings(networkManager *network.Manager, discoveryManager *discovery.Manager, transportManager *transport.Manager, topicsManager *Manager) {
+func startThings(networkManager network.Network, discoveryManager *discovery.Manager, transportManager *transport.Manager, topicsManager *Manager) {
 	networkManager.Start()
 	discoveryManager.Start()
 	transportManager.Start()
 	topicsManager.Start()
 }
 
-func stopThings(networkManager *network.Manager, discoveryManager *discovery.Manager, transportManager *transport.Manager, topicsManager *Manager) {
+func stopThings(networkManager network.Network, discoveryManager *discovery.Manager, transportManager *transport.Manager, topicsManager *Manager) {
 	networkManager.Stop()
 	discoveryManager.Stop()
 	transportManager.Stop()
@@ -87,10 +88,10 @@ func stopThings(networkManager *network.Manager, discoveryManager *discovery.Man
 func TestIntegration_Manager(t *testing.T) {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
-	networkManager1, _, discoveryManager1, added1, removed1, transportManager1, topicsManager1 := getThings("A", 27321)
+	networkManager1, _, discoveryManager1, added1, removed1, transportManager1, topicsManager1 := getThings("A", 27321, network.NewManager(), "en0")
 	startThings(networkManager1, discoveryManager1, transportManager1, topicsManager1)
 
-	networkManager2, _, discoveryManager2, added2, _, transportManager2, topicsManager2 := getThings("B", 27322)
+	networkManager2, _, discoveryManager2, added2, _, transportManager2, topicsManager2 := getThings("B", 27322, network.NewManager(), "en0")
 	startThings(networkManager2, discoveryManager2, transportManager2, topicsManager2)
 
 	select {
@@ -109,7 +110,7 @@ func TestIntegration_Manager(t *testing.T) {
 
 	consumed1 := make(chan []byte, 65536)
 
-	err := topicsManager1.Subscribe(
+	_, err := topicsManager1.Subscribe(
 		"some_topic",
 		"some_type",
 		func(message *Message) {
@@ -155,3 +156,858 @@ func TestIntegration_Manager(t *testing.T) {
 
 	stopThings(networkManager1, discoveryManager1, transportManager1, topicsManager1)
 }
+
+func TestManager_Resubscribe(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager, _, discoveryManager, _, _, transportManager, topicsManager := getThings("A", 27323, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	startThings(networkManager, discoveryManager, transportManager, topicsManager)
+	defer stopThings(networkManager, discoveryManager, transportManager, topicsManager)
+
+	consumed := make(chan []byte, 65536)
+
+	subscribe := func() {
+		_, err := topicsManager.Subscribe(
+			"some_topic",
+			"some_type",
+			func(message *Message) {
+				consumed <- message.Payload
+			},
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	publish := func() {
+		err := topicsManager.Publish(
+			"some_topic",
+			"some_type",
+			time.Second,
+			[]byte("Some payload"),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	subscribe()
+	publish()
+	assert.Equal(t, []byte("Some payload"), <-consumed)
+
+	err := topicsManager.Unsubscribe("some_topic")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// nothing for a topic we've unsubscribed from (and no panic either)
+	publish()
+
+	select {
+	case payload := <-consumed:
+		assert.Fail(t, "unexpectedly consumed", "%#+v", string(payload))
+	case <-time.After(MessageTimeout * 5):
+	}
+
+	subscribe()
+	publish()
+	assert.Equal(t, []byte("Some payload"), <-consumed)
+}
+
+func TestPublisher_SetDSCP(t *testing.T) {
+	var subscriber *Subscriber
+
+	publisher := NewPublisher(ksuid.New(), "A", nil, &subscriber)
+
+	assert.Error(t, publisher.SetDSCP("some_topic", -1))
+	assert.Error(t, publisher.SetDSCP("some_topic", 64))
+
+	// before the topic's published to...
+	assert.NoError(t, publisher.SetDSCP("some_topic", 46))
+
+	publication := NewPublication(ksuid.New(), "A", "some_topic", "some_type", nil, &subscriber, publisher, publisher.dscpByTopicName["some_topic"], nil)
+	publisher.publicationByTopicName["some_topic"] = publication
+	assert.Equal(t, 46, publication.dscp)
+
+	// ... and after
+	assert.NoError(t, publisher.SetDSCP("some_topic", 10))
+	assert.Equal(t, 10, publication.dscp)
+}
+
+func TestCheckTopicPattern(t *testing.T) {
+	for _, pattern := range []string{"a", "a/b", "+", "#", "a/+/c", "a/#", "+/+/#"} {
+		assert.NoError(t, CheckTopicPattern(pattern), pattern)
+	}
+
+	for _, pattern := range []string{"", "a+", "a/#/c", "a/b#", "#/a", "a/++"} {
+		assert.Error(t, CheckTopicPattern(pattern), pattern)
+	}
+
+	assert.NoError(t, CheckTopicName("a/b"))
+	assert.Error(t, CheckTopicName("a/+"))
+	assert.Error(t, CheckTopicName(""))
+}
+
+func TestTopicTree(t *testing.T) {
+	patterns := []string{
+		"sensors/kitchen/temperature",
+		"sensors/+/temperature",
+		"sensors/#",
+		"site/a/#",
+		"+",
+		"#",
+	}
+
+	tree := newTopicTree()
+
+	subscriptionByPattern := make(map[string]*Subscription)
+	for _, pattern := range patterns {
+		subscription := &Subscription{topicName: pattern}
+		subscriptionByPattern[pattern] = subscription
+		tree.add(pattern, subscription)
+	}
+
+	match := func(topicName string) []string {
+		matched := make([]string, 0)
+		for _, subscription := range tree.match(topicName) {
+			matched = append(matched, subscription.topicName)
+		}
+
+		// the tree and the simple matcher should always agree
+		expected := make([]string, 0)
+		for _, pattern := range patterns {
+			if subscriptionByPattern[pattern] != nil && MatchTopic(pattern, topicName) {
+				expected = append(expected, pattern)
+			}
+		}
+		assert.ElementsMatch(t, expected, matched, topicName)
+
+		return matched
+	}
+
+	assert.ElementsMatch(t, []string{"sensors/kitchen/temperature", "sensors/+/temperature", "sensors/#", "#"}, match("sensors/kitchen/temperature"))
+	assert.ElementsMatch(t, []string{"sensors/+/temperature", "sensors/#", "#"}, match("sensors/lounge/temperature"))
+	assert.ElementsMatch(t, []string{"sensors/#", "#"}, match("sensors/lounge/humidity"))
+	assert.ElementsMatch(t, []string{"sensors/#", "+", "#"}, match("sensors"))
+	assert.ElementsMatch(t, []string{"site/a/#", "#"}, match("site/a"))
+	assert.ElementsMatch(t, []string{"site/a/#", "#"}, match("site/a/b/c"))
+	assert.ElementsMatch(t, []string{"#"}, match("site/b"))
+	assert.ElementsMatch(t, []string{"+", "#"}, match("some_topic"))
+
+	tree.remove("sensors/#")
+	subscriptionByPattern["sensors/#"] = nil
+	tree.remove("#")
+	subscriptionByPattern["#"] = nil
+
+	assert.ElementsMatch(t, []string{"sensors/kitchen/temperature", "sensors/+/temperature"}, match("sensors/kitchen/temperature"))
+	assert.ElementsMatch(t, []string{}, match("sensors/lounge/humidity"))
+
+	// removing something that isn't there is harmless
+	tree.remove("not/there")
+	tree.remove("sensors/kitchen/temperature")
+	subscriptionByPattern["sensors/kitchen/temperature"] = nil
+
+	assert.ElementsMatch(t, []string{"sensors/+/temperature"}, match("sensors/kitchen/temperature"))
+}
+
+func TestManager_Wildcards(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager, _, discoveryManager, _, _, transportManager, topicsManager := getThings("A", 27324, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	startThings(networkManager, discoveryManager, transportManager, topicsManager)
+	defer stopThings(networkManager, discoveryManager, transportManager, topicsManager)
+
+	consumed := make(chan string, 65536)
+
+	subscribe := func(pattern string, topicType string) {
+		_, err := topicsManager.Subscribe(
+			pattern,
+			topicType,
+			func(message *Message) {
+				consumed <- fmt.Sprintf("%v <- %v", pattern, message.TopicName)
+			},
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	subscribe("sensors/+/temperature", "reading")
+	subscribe("sensors/#", "")
+	subscribe("sensors/kitchen/temperature", "reading")
+
+	_, err := topicsManager.Subscribe("sensors/#/temperature", "reading", func(message *Message) {})
+	assert.Error(t, err)
+	assert.Error(t, topicsManager.Publish("sensors/+/temperature", "reading", time.Second, []byte("Some payload")))
+
+	publish := func(topicName string, topicType string) {
+		err := topicsManager.Publish(topicName, topicType, time.Second, []byte("Some payload"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	received := func() []string {
+		values := make([]string, 0)
+		for len(consumed) > 0 {
+			values = append(values, <-consumed)
+		}
+
+		return values
+	}
+
+	publish("sensors/kitchen/temperature", "reading")
+	assert.ElementsMatch(t, []string{
+		"sensors/+/temperature <- sensors/kitchen/temperature",
+		"sensors/# <- sensors/kitchen/temperature",
+		"sensors/kitchen/temperature <- sensors/kitchen/temperature",
+	}, received())
+
+	// each pattern checks the type for itself ("sensors/#" takes any)
+	publish("sensors/lounge/temperature", "other")
+	assert.ElementsMatch(t, []string{
+		"sensors/# <- sensors/lounge/temperature",
+	}, received())
+
+	err = topicsManager.Unsubscribe("sensors/#")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publish("sensors/bedroom/temperature", "reading")
+	assert.ElementsMatch(t, []string{
+		"sensors/+/temperature <- sensors/bedroom/temperature",
+	}, received())
+}
+
+func TestManager_SubscriptionHandles(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager, _, discoveryManager, _, _, transportManager, topicsManager := getThings("A", 27325, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	startThings(networkManager, discoveryManager, transportManager, topicsManager)
+	defer stopThings(networkManager, discoveryManager, transportManager, topicsManager)
+
+	consumed := make(chan string, 65536)
+
+	subscribe := func(name string) *SubscriptionHandle {
+		handle, err := topicsManager.Subscribe(
+			"some_topic",
+			"some_type",
+			func(message *Message) {
+				consumed <- name
+			},
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return handle
+	}
+
+	publish := func() {
+		err := topicsManager.Publish("some_topic", "some_type", time.Second, []byte("Some payload"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	received := func() []string {
+		values := make([]string, 0)
+		for len(consumed) > 0 {
+			values = append(values, <-consumed)
+		}
+
+		return values
+	}
+
+	handle1 := subscribe("handle1")
+	handle2 := subscribe("handle2")
+
+	assert.Equal(t, "some_topic", handle1.TopicName())
+	assert.Equal(t, "some_type", handle1.TopicType())
+
+	// every handle must agree on the type
+	_, err := topicsManager.Subscribe("some_topic", "some_other_type", func(message *Message) {})
+	assert.Error(t, err)
+
+	publish()
+	assert.ElementsMatch(t, []string{"handle1", "handle2"}, received())
+
+	err = handle1.Unsubscribe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// harmless the second time
+	assert.NoError(t, handle1.Unsubscribe())
+
+	publish()
+	assert.ElementsMatch(t, []string{"handle2"}, received())
+	assert.True(t, topicsManager.subscriber.IsSubscribed("some_topic"))
+
+	// a callback can let go of its own handle
+	var handle3 *SubscriptionHandle
+	handle3, err = topicsManager.Subscribe("some_topic", "some_type", func(message *Message) {
+		consumed <- "handle3"
+		_ = handle3.Unsubscribe()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publish()
+	assert.ElementsMatch(t, []string{"handle2", "handle3"}, received())
+
+	err = handle2.Unsubscribe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the last handle going takes the topic with it
+	assert.False(t, topicsManager.subscriber.IsSubscribed("some_topic"))
+
+	publish()
+	assert.ElementsMatch(t, []string{}, received())
+
+	// and after that it's free to take on a new type
+	_, err = topicsManager.Subscribe("some_topic", "some_other_type", func(message *Message) {})
+	assert.NoError(t, err)
+}
+
+func TestFilter_Check(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"a",
+		"a.b.0 == 1",
+		`device == "kitchen" && (celsius > 20 || !healthy)`,
+		"x != null",
+		"x >= -1.5e3",
+		"'single' == name",
+	} {
+		assert.NoError(t, (&Filter{Expression: expression}).Check(), expression)
+	}
+
+	for _, expression := range []string{
+		"a = 1",
+		"a & b",
+		"(a == 1",
+		"a == 1)",
+		"a ==",
+		`"unterminated`,
+		"a.. == 1",
+		"a == 1 b",
+		"$a",
+	} {
+		assert.Error(t, (&Filter{Expression: expression}).Check(), expression)
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	jsonPayload := []byte(`{"device": "kitchen", "celsius": 21.5, "healthy": false, "readings": [{"celsius": 19}], "status": "warming"}`)
+
+	msgpackPayload, err := msgpack.Marshal(map[string]any{
+		"device":   "kitchen",
+		"celsius":  int64(21),
+		"healthy":  false,
+		"readings": []any{map[string]any{"celsius": uint8(19)}},
+		"status":   "warming",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, payload := range [][]byte{jsonPayload, msgpackPayload} {
+		message := &Message{
+			EndpointName: "Sensor_1",
+			Labels:       map[string]string{"site": "a", "role": "sensor"},
+			Headers:      map[string]string{"device": "kitchen"},
+			Payload:      payload,
+		}
+
+		for expression, expected := range map[string]bool{
+			"":                                     true,
+			`device == "kitchen"`:                  true,
+			`device == 'lounge'`:                   false,
+			"celsius > 20":                         true,
+			"celsius > 20 && healthy":              false,
+			"celsius > 20 && !healthy":             true,
+			`healthy || status == "warming"`:       true,
+			"readings.0.celsius < 20":              true,
+			"readings.1.celsius < 20":              false,
+			"missing == null":                      true,
+			"missing":                              false,
+			"device > 1":                           false,
+			`device >= "kitchen"`:                  true,
+			"!(celsius > 20) || device == 'other'": false,
+			"celsius == 21 || celsius == 21.5":     true,
+		} {
+			assert.Equal(t, expected, (&Filter{Expression: expression}).Match(message), expression)
+		}
+
+		assert.True(t, (&Filter{EndpointNames: []string{"Sensor_2", "Sensor_1"}}).Match(message))
+		assert.False(t, (&Filter{EndpointNames: []string{"Sensor_2"}}).Match(message))
+		assert.True(t, (&Filter{Labels: map[string]string{"site": "a"}}).Match(message))
+		assert.False(t, (&Filter{Labels: map[string]string{"site": "b"}}).Match(message))
+		assert.False(t, (&Filter{Labels: map[string]string{"site": "a", "floor": "1"}}).Match(message))
+		assert.True(t, (&Filter{Headers: map[string]string{"device": "kitchen"}}).Match(message))
+		assert.False(t, (&Filter{Headers: map[string]string{"device": "lounge"}}).Match(message))
+
+		// every part must match
+		assert.False(t, (&Filter{Headers: map[string]string{"device": "kitchen"}, Expression: "healthy"}).Match(message))
+	}
+
+	// a payload that isn't an object has no fields
+	assert.False(t, (&Filter{Expression: "a == 1"}).Match(&Message{Payload: []byte("Some payload")}))
+	assert.True(t, (&Filter{Expression: "a == null"}).Match(&Message{Payload: []byte("Some payload")}))
+}
+
+func TestInterests_Wants(t *testing.T) {
+	endpointID := ksuid.New()
+
+	i := newInterests()
+
+	getMessage := func(topicName string, payload string) *Message {
+		return &Message{TopicName: topicName, Payload: []byte(payload)}
+	}
+
+	wants := func(message *Message) bool {
+		return i.wants(endpointID, message, newPayloadFields(message))
+	}
+
+	i.handle(endpointID, &Interest{Subscriptions: []InterestSubscription{
+		{TopicName: "some_topic", Filters: []Filter{{Expression: "a == 1", Push: true}}},
+		{TopicName: "broken_topic", Filters: []Filter{{Expression: "a ==", Push: true}}},
+	}})
+
+	// a bad filter only costs its own topic (which gets everything), not the rest of the interest
+	assert.True(t, wants(getMessage("some_topic", `{"a": 1}`)))
+	assert.False(t, wants(getMessage("some_topic", `{"a": 2}`)))
+	assert.True(t, wants(getMessage("broken_topic", `{"a": 2}`)))
+
+	// a topic that isn't mentioned (e.g. it's only just been subscribed to) gets everything until we hear otherwise
+	assert.True(t, wants(getMessage("other_topic", `{"a": 2}`)))
+
+	// an empty interest withdraws it
+	i.handle(endpointID, &Interest{})
+	assert.True(t, wants(getMessage("some_topic", `{"a": 2}`)))
+}
+
+func TestManager_Filters(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager1, _, discoveryManager1, added1, _, transportManager1, topicsManager1 := getThings("A", 27326, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	topicsManager1.UseLabels(map[string]string{"site": "a"})
+	startThings(networkManager1, discoveryManager1, transportManager1, topicsManager1)
+	defer stopThings(networkManager1, discoveryManager1, transportManager1, topicsManager1)
+
+	networkManager2, endpointID2, discoveryManager2, added2, _, transportManager2, topicsManager2 := getThings("B", 27327, fabric.NewNode(net.ParseIP("10.0.0.2")), "")
+	startThings(networkManager2, discoveryManager2, transportManager2, topicsManager2)
+	defer stopThings(networkManager2, discoveryManager2, transportManager2, topicsManager2)
+
+	for _, added := range []chan *types.Container{added1, added2} {
+		select {
+		case <-added:
+		case <-time.After(time.Second * 5):
+			log.Fatal("timed out waiting for A and B to see each other")
+		}
+	}
+
+	consumed := make(chan *Message, 65536)
+
+	handle, err := topicsManager2.SubscribeWithFilter(
+		"readings",
+		"reading",
+		&Filter{
+			Labels:     map[string]string{"site": "a"},
+			Headers:    map[string]string{"device": "kitchen"},
+			Expression: "celsius > 20",
+			Push:       true,
+		},
+		func(message *Message) {
+			consumed <- message
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = topicsManager2.SubscribeWithFilter("readings", "reading", &Filter{Expression: "celsius >"}, func(message *Message) {})
+	assert.Error(t, err)
+
+	waitForInterest := func(expected bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for (topicsManager1.publisher.interests.get(endpointID2) != nil) != expected {
+			if time.Now().After(deadline) {
+				log.Fatalf("timed out waiting for A to have B's interest = %v", expected)
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	waitForInterest(true)
+
+	publish := func(device string, celsius float64) {
+		payload := make([]byte, 0, 65536)
+		payload = append(payload, []byte(fmt.Sprintf(`{"celsius": %v, "padding": "`, celsius))...)
+		for len(payload) < 65536 {
+			payload = append(payload, 'x')
+		}
+		payload = append(payload, []byte(`"}`)...)
+
+		err := topicsManager1.PublishWithHeaders("readings", "reading", time.Second, map[string]string{"device": device}, payload)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// A doesn't even send B what B's pushed filter doesn't match (each of these would be 9 fragments and 9 acks)
+	sentBefore := fabric.Stats().Sent
+
+	for i := 0; i < 10; i++ {
+		publish("lounge", 25)
+		publish("kitchen", 15)
+	}
+
+	assert.Less(t, fabric.Stats().Sent-sentBefore, int64(40))
+
+	publish("kitchen", 25)
+
+	select {
+	case message := <-consumed:
+		assert.Equal(t, "A", message.EndpointName)
+		assert.Equal(t, map[string]string{"site": "a"}, message.Labels)
+		assert.Equal(t, map[string]string{"device": "kitchen"}, message.Headers)
+	case <-time.After(time.Second):
+		log.Fatal("timed out waiting for B to receive from A")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, len(consumed))
+
+	// a handle that doesn't push its filter (or has none) wants everything on the topic, so B gets sent everything again
+	other, err := topicsManager2.Subscribe("readings", "reading", func(message *Message) {})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	interest, pushing := topicsManager2.subscriber.getInterest()
+	assert.False(t, pushing)
+	assert.Equal(t, []InterestSubscription{{TopicName: "readings"}}, interest.Subscriptions)
+
+	waitForInterest(false)
+
+	err = other.Unsubscribe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	waitForInterest(true)
+
+	// and when the last pushed filter goes, B takes it back
+	err = handle.Unsubscribe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	waitForInterest(false)
+}
+
+func TestSequence(t *testing.T) {
+	endpointID := ksuid.New()
+	incarnation := time.Now().UnixNano()
+
+	getMessage := func(sequenceNumber int64) *Message {
+		return &Message{EndpointID: endpointID, EndpointName: "A", TopicName: "some_topic", SequenceNumber: sequenceNumber, Incarnation: incarnation}
+	}
+
+	getSequenceNumbers := func(messages []*Message) []int64 {
+		sequenceNumbers := make([]int64, 0)
+		for _, message := range messages {
+			sequenceNumbers = append(sequenceNumbers, message.SequenceNumber)
+		}
+
+		return sequenceNumbers
+	}
+
+	now := time.Now()
+
+	q := newSequence()
+
+	// we may join late, so wherever we start is the start
+	isNew, released, lost := q.receive(getMessage(5), now)
+	assert.True(t, isNew)
+	assert.Equal(t, []int64{5}, getSequenceNumbers(released))
+	assert.Empty(t, lost)
+
+	// early ones are held until the gap's filled
+	isNew, released, _ = q.receive(getMessage(7), now)
+	assert.True(t, isNew)
+	assert.Empty(t, released)
+
+	isNew, _, _ = q.receive(getMessage(7), now)
+	assert.False(t, isNew)
+
+	isNew, released, _ = q.receive(getMessage(6), now)
+	assert.True(t, isNew)
+	assert.Equal(t, []int64{6, 7}, getSequenceNumbers(released))
+
+	// duplicates are dropped
+	isNew, _, _ = q.receive(getMessage(6), now)
+	assert.False(t, isNew)
+
+	// a gap is given up on after a while...
+	_, released, _ = q.receive(getMessage(10), now)
+	assert.Empty(t, released)
+
+	released, lost = q.expire(now.Add(ReorderTimeout / 2))
+	assert.Empty(t, released)
+	assert.Empty(t, lost)
+
+	released, lost = q.expire(now.Add(ReorderTimeout))
+	assert.Equal(t, []int64{10}, getSequenceNumbers(released))
+	assert.Equal(t, []*SampleLost{{EndpointID: endpointID, EndpointName: "A", TopicName: "some_topic", FirstSequenceNumber: 8, LastSequenceNumber: 9}}, lost)
+	assert.Equal(t, int64(2), lost[0].Count())
+
+	// ... and anything from it that turns up afterwards is late (so it's only for unordered delivery), but only the once
+	isNew, released, lost = q.receive(getMessage(9), now)
+	assert.True(t, isNew)
+	assert.Empty(t, released)
+	assert.Empty(t, lost)
+
+	isNew, _, _ = q.receive(getMessage(9), now)
+	assert.False(t, isNew)
+
+	isNew, _, _ = q.receive(getMessage(8), now)
+	assert.True(t, isNew)
+
+	// ... or once it's too far behind
+	_, released, _ = q.receive(getMessage(13), now)
+	assert.Empty(t, released)
+
+	_, released, lost = q.receive(getMessage(12+ReorderWindow), now)
+	assert.Equal(t, []int64{13}, getSequenceNumbers(released))
+	assert.Equal(t, []*SampleLost{{EndpointID: endpointID, EndpointName: "A", TopicName: "some_topic", FirstSequenceNumber: 11, LastSequenceNumber: 12}}, lost)
+
+	_, released, lost = q.receive(getMessage(13+ReorderWindow), now)
+	assert.Empty(t, released)
+	assert.Empty(t, lost)
+
+	_, released, lost = q.receive(getMessage(14+ReorderWindow), now)
+	assert.Equal(t, []int64{12 + ReorderWindow, 13 + ReorderWindow, 14 + ReorderWindow}, getSequenceNumbers(released))
+	assert.Equal(t, int64(ReorderWindow-2), lost[0].Count())
+
+	// the publisher restarting (with the same EndpointID) starts afresh, giving up on anything that was held back
+	_, released, _ = q.receive(getMessage(16+ReorderWindow), now)
+	assert.Empty(t, released)
+
+	incarnation++
+
+	isNew, released, lost = q.receive(getMessage(1), now)
+	assert.True(t, isNew)
+	assert.Equal(t, []int64{16 + ReorderWindow, 1}, getSequenceNumbers(released))
+	assert.Equal(t, []*SampleLost{{EndpointID: endpointID, EndpointName: "A", TopicName: "some_topic", FirstSequenceNumber: 15 + ReorderWindow, LastSequenceNumber: 15 + ReorderWindow}}, lost)
+
+	// stragglers from before the restart are dropped
+	incarnation--
+
+	isNew, _, _ = q.receive(getMessage(15+ReorderWindow), now)
+	assert.False(t, isNew)
+}
+
+func TestSubscriber_Ordering(t *testing.T) {
+	var publisher *Publisher
+
+	subscriber := NewSubscriber(ksuid.New(), "B", nil, &publisher)
+	defer subscriber.Stop()
+
+	endpointID := ksuid.New()
+
+	receive := func(sequenceNumber int64) {
+		subscriber.handleInternalReceive(&Message{
+			EndpointID:     endpointID,
+			EndpointName:   "A",
+			SequenceNumber: sequenceNumber,
+			TopicName:      "some_topic",
+			TopicType:      "some_type",
+			MessageType:    StandardMessageType,
+		})
+	}
+
+	var mu sync.Mutex
+	unordered := make([]int64, 0)
+	ordered := make([]int64, 0)
+	lost := make([]*SampleLost, 0)
+
+	unorderedHandle, err := subscriber.Subscribe("some_topic", "some_type", func(message *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		unordered = append(unordered, message.SequenceNumber)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	orderedHandle, err := subscriber.SubscribeWithOptions(
+		"some_topic",
+		"some_type",
+		&SubscriptionOptions{
+			Ordered: true,
+			OnSampleLost: func(thisLost *SampleLost) {
+				mu.Lock()
+				defer mu.Unlock()
+				lost = append(lost, thisLost)
+			},
+		},
+		func(message *Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			ordered = append(ordered, message.SequenceNumber)
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, sequenceNumber := range []int64{1, 3, 2, 2, 5, 6} {
+		receive(sequenceNumber)
+	}
+
+	mu.Lock()
+	assert.Equal(t, []int64{1, 3, 2, 5, 6}, unordered)
+	assert.Equal(t, []int64{1, 2, 3}, ordered)
+	assert.Empty(t, lost)
+	mu.Unlock()
+
+	// nothing turns up to fill the gap, so it's given up on and what was held back comes through
+	time.Sleep(ReorderTimeout * 2)
+
+	mu.Lock()
+	assert.Equal(t, []int64{1, 2, 3, 5, 6}, ordered)
+	assert.Equal(t, []*SampleLost{{EndpointID: endpointID, EndpointName: "A", TopicName: "some_topic", FirstSequenceNumber: 4, LastSequenceNumber: 4}}, lost)
+	mu.Unlock()
+
+	assert.Equal(t, int64(1), orderedHandle.SampleLostCount())
+	assert.Equal(t, int64(1), unorderedHandle.SampleLostCount())
+
+	// too late for ordered delivery, but not for the rest
+	receive(4)
+	receive(4)
+
+	mu.Lock()
+	assert.Equal(t, []int64{1, 3, 2, 5, 6, 4}, unordered)
+	assert.Equal(t, []int64{1, 2, 3, 5, 6}, ordered)
+	mu.Unlock()
+}
+
+func TestSubscriber_OrderingConcurrent(t *testing.T) {
+	var publisher *Publisher
+
+	subscriber := NewSubscriber(ksuid.New(), "B", nil, &publisher)
+	defer subscriber.Stop()
+
+	endpointID := ksuid.New()
+
+	receive := func(sequenceNumber int64) {
+		subscriber.handleInternalReceive(&Message{
+			EndpointID:     endpointID,
+			EndpointName:   "A",
+			SequenceNumber: sequenceNumber,
+			TopicName:      "some_topic",
+			TopicType:      "some_type",
+			MessageType:    StandardMessageType,
+		})
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	ordered := make([]int64, 0)
+
+	_, err := subscriber.SubscribeWithOptions(
+		"some_topic",
+		"some_type",
+		&SubscriptionOptions{
+			Ordered: true,
+		},
+		func(message *Message) {
+			if message.SequenceNumber == 1 {
+				close(entered)
+				<-release
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			ordered = append(ordered, message.SequenceNumber)
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// as though from two of the transport's receive goroutines; 2 is released while 1 is still being delivered
+	wg := sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		receive(1)
+	}()
+
+	<-entered
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		receive(2)
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	assert.Equal(t, []int64{1, 2}, ordered)
+	mu.Unlock()
+}
+
+func TestPublication_SequenceNumber(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager, _, discoveryManager, _, _, transportManager, topicsManager := getThings("A", 27328, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	startThings(networkManager, discoveryManager, transportManager, topicsManager)
+	defer stopThings(networkManager, discoveryManager, transportManager, topicsManager)
+
+	sequenceNumbers := make(chan int64, 65536)
+
+	handle, err := topicsManager.SubscribeWithOptions("some_topic", "some_type", &SubscriptionOptions{Ordered: true}, func(message *Message) {
+		sequenceNumbers <- message.SequenceNumber
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// several fragments each, but one sequence number each
+	for i := 0; i < 3; i++ {
+		err = topicsManager.Publish("some_topic", "some_type", time.Second, make([]byte, FragmentSize*3))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, int64(1), <-sequenceNumbers)
+	assert.Equal(t, int64(2), <-sequenceNumbers)
+	assert.Equal(t, int64(3), <-sequenceNumbers)
+	assert.Equal(t, int64(0), handle.SampleLostCount())
+}
@@ -0,0 +1,189 @@
+package topics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// topic names are hierarchical (e.g. "sensors/kitchen/temperature") and subscriptions may be to MQTT-style patterns of
+// them; "+" matches any one level (e.g. "sensors/+/temperature") and "#" (last level only) matches any number of levels,
+// none included (e.g. "site/a/#" matches "site/a" and everything under it)
+const (
+	TopicLevelSeparator = "/"
+	SingleLevelWildcard = "+"
+	MultiLevelWildcard  = "#"
+)
+
+// CheckTopicPattern is an error if the pattern isn't a valid subscription (i.e. a wildcard that doesn't occupy a whole
+// level, or a "#" that isn't the last level)
+func CheckTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("topic pattern cannot be empty")
+	}
+
+	levels := strings.Split(pattern, TopicLevelSeparator)
+
+	for i, level := range levels {
+		if level == SingleLevelWildcard || (level == MultiLevelWildcard && i == len(levels)-1) {
+			continue
+		}
+
+		if strings.Contains(level, SingleLevelWildcard) || strings.Contains(level, MultiLevelWildcard) {
+			return fmt.Errorf(
+				"topic pattern %#v invalid; %#v and %#v must be a whole level (and %#v the last level)",
+				pattern,
+				SingleLevelWildcard,
+				MultiLevelWildcard,
+				MultiLevelWildcard,
+			)
+		}
+	}
+
+	return nil
+}
+
+// CheckTopicName is an error if the topic name can't be published to (i.e. it's empty or has wildcards in it, as
+// subscribers would mistake it for a pattern)
+func CheckTopicName(topicName string) error {
+	if topicName == "" {
+		return fmt.Errorf("topic name cannot be empty")
+	}
+
+	if IsTopicPattern(topicName) {
+		return fmt.Errorf("topic name %#v invalid; cannot publish to a wildcard", topicName)
+	}
+
+	return nil
+}
+
+// IsTopicPattern is true if the topic name has wildcards in it
+func IsTopicPattern(topicName string) bool {
+	return strings.Contains(topicName, SingleLevelWildcard) || strings.Contains(topicName, MultiLevelWildcard)
+}
+
+// MatchTopic is true if the topic name matches the pattern (see CheckTopicPattern)
+func MatchTopic(pattern string, topicName string) bool {
+	patternLevels := strings.Split(pattern, TopicLevelSeparator)
+	topicLevels := strings.Split(topicName, TopicLevelSeparator)
+
+	for i, patternLevel := range patternLevels {
+		if patternLevel == MultiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if patternLevel != SingleLevelWildcard && patternLevel != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+type topicNode struct {
+	children     map[string]*topicNode
+	subscription *Subscription
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+	}
+}
+
+// topicTree finds the subscriptions whose patterns match a topic name a level at a time (so it costs the depth of the
+// topic name rather than the number of subscriptions); it's not safe for concurrent use
+type topicTree struct {
+	root *topicNode
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{
+		root: newTopicNode(),
+	}
+}
+
+func (t *topicTree) add(pattern string, subscription *Subscription) {
+	node := t.root
+
+	for _, level := range strings.Split(pattern, TopicLevelSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+
+		node = child
+	}
+
+	node.subscription = subscription
+}
+
+func (t *topicTree) remove(pattern string) {
+	levels := strings.Split(pattern, TopicLevelSeparator)
+
+	nodes := []*topicNode{t.root}
+
+	node := t.root
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+
+		nodes = append(nodes, child)
+		node = child
+	}
+
+	node.subscription = nil
+
+	// prune the branch back to where it's still needed
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := nodes[i+1]
+		if child.subscription != nil || len(child.children) > 0 {
+			break
+		}
+
+		delete(nodes[i].children, levels[i])
+	}
+}
+
+// match is every subscription whose pattern matches the topic name
+func (t *topicTree) match(topicName string) []*Subscription {
+	subscriptions := make([]*Subscription, 0)
+
+	var walk func(node *topicNode, levels []string)
+
+	walk = func(node *topicNode, levels []string) {
+		// "#" matches whatever's left (even nothing)
+		child, ok := node.children[MultiLevelWildcard]
+		if ok && child.subscription != nil {
+			subscriptions = append(subscriptions, child.subscription)
+		}
+
+		if len(levels) == 0 {
+			if node.subscription != nil {
+				subscriptions = append(subscriptions, node.subscription)
+			}
+
+			return
+		}
+
+		child, ok = node.children[levels[0]]
+		if ok {
+			walk(child, levels[1:])
+		}
+
+		child, ok = node.children[SingleLevelWildcard]
+		if ok {
+			walk(child, levels[1:])
+		}
+	}
+
+	walk(t.root, strings.Split(topicName, TopicLevelSeparator))
+
+	return subscriptions
+}
@@ -23,6 +23,9 @@ const (
 
 	// the new endpoint sends this in response
 	LateJoinerMessagesResponseType MessageType = 4
+
+	// an endpoint with pushed filters sends this so publishers only send it what it wants (see Filter.Push)
+	InterestMessageType MessageType = 5
 )
 
 type Message struct {
@@ -36,9 +39,16 @@ type Message struct {
 	EndpointID   ksuid.KSUID `json:"endpoint_id"`
 	EndpointName string      `json:"endpoint_name"`
 
+	// the sending endpoint's labels (see Manager.UseLabels)
+	Labels map[string]string `json:"labels"`
+
 	// incremented by sending endpoint
 	SequenceNumber int64 `json:"sequence_number"`
 
+	// when the sending endpoint set up the topic's publication (in Unix nanoseconds), so subscribers can tell it's
+	// restarted (and its sequence numbers have started afresh)
+	Incarnation int64 `json:"incarnation"`
+
 	// topic
 	TopicName string `json:"topic_name"`
 	TopicType string `json:"topic_type"`
@@ -46,6 +56,9 @@ type Message struct {
 	// to identify and route the payload
 	MessageType MessageType `json:"message_type"`
 
+	// set by the publisher per message (see Manager.PublishWithHeaders)
+	Headers map[string]string `json:"headers"`
+
 	// the actual user payload / control message content
 	Payload []byte `json:"payload"`
 }
@@ -64,3 +77,16 @@ type LateJoinerMessagesResponse struct {
 	// messages that the endpoint is holding that the late joiner doesn't have already
 	HeldMessages []Message `json:"held_messages"`
 }
+
+type Interest struct {
+	// everything the endpoint is subscribed to; an empty Interest withdraws any earlier one (i.e. send it everything)
+	Subscriptions []InterestSubscription `json:"subscriptions"`
+}
+
+type InterestSubscription struct {
+	// topic name or pattern
+	TopicName string `json:"topic_name"`
+
+	// a message matching any of these is wanted; none means everything on the topic is
+	Filters []Filter `json:"filters"`
+}
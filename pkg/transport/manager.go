@@ -20,8 +20,10 @@ type Manager struct {
 	listenAddress    *net.UDPAddr
 	listenInterface  string
 	discoveryManager *discovery.Manager
-	networkManager   *network.Manager
+	networkManager   network.Network
 	onReceive        func(*types.Container)
+	localManager     *network.StreamManager
+	streamManager    *network.StreamManager
 }
 
 func NewManager(
@@ -31,7 +33,7 @@ func NewManager(
 	listenAddress *net.UDPAddr,
 	listenInterface string,
 	discoveryManager *discovery.Manager,
-	networkManager *network.Manager,
+	networkManager network.Network,
 	onReceive func(*types.Container),
 ) *Manager {
 	m := Manager{
@@ -59,12 +61,50 @@ func NewManager(
 		m.listenInterface,
 		m.networkManager,
 		m.sender,
+		m.discoveryManager.HandleProbe,
 		m.onReceive,
 	)
 
 	return &m
 }
 
+// UseLocal sends to endpoints on the same host via their Unix domain socket (see Sender.UseLocal); localManager's
+// onReceive should call HandleLocalReceive
+func (m *Manager) UseLocal(hostID string, localManager *network.StreamManager) {
+	m.localManager = localManager
+	m.sender.UseLocal(hostID, localManager)
+}
+
+func (m *Manager) HandleLocalReceive(srcAddress string, data []byte) {
+	dstAddress := ""
+	if m.localManager != nil {
+		dstAddress = m.localManager.GetListenAddress()
+	}
+
+	m.receiver.HandleStreamReceive(srcAddress, dstAddress, data)
+}
+
+// UseAckDSCP marks acks with the given DSCP (see Sender.UseAckDSCP); it should be called before Start
+func (m *Manager) UseAckDSCP(dscp int) {
+	m.sender.UseAckDSCP(dscp)
+}
+
+// UseStream sends to endpoints that announce a stream address via TCP (see Sender.UseStream); streamManager's onReceive
+// should call HandleStreamReceive
+func (m *Manager) UseStream(streamManager *network.StreamManager) {
+	m.streamManager = streamManager
+	m.sender.UseStream(streamManager)
+}
+
+func (m *Manager) HandleStreamReceive(srcAddress string, data []byte) {
+	dstAddress := ""
+	if m.streamManager != nil {
+		dstAddress = m.streamManager.GetListenAddress()
+	}
+
+	m.receiver.HandleStreamReceive(srcAddress, dstAddress, data)
+}
+
 func (m *Manager) Send(
 	resendPeriod time.Duration,
 	resendExpiry time.Duration,
@@ -111,6 +151,65 @@ func (m *Manager) Broadcast(
 	)
 }
 
+func (m *Manager) BroadcastBatch(
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payloads [][]byte,
+) {
+	m.sender.BroadcastBatch(
+		resendTimeout,
+		resendExpiry,
+		correlationID,
+		needsAck,
+		payloads,
+	)
+}
+
+func (m *Manager) BroadcastPayload(
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payload []byte,
+	fragmentSize int,
+	dscp int,
+) error {
+	return m.sender.BroadcastPayload(
+		resendTimeout,
+		resendExpiry,
+		correlationID,
+		needsAck,
+		payload,
+		fragmentSize,
+		dscp,
+	)
+}
+
+// BroadcastPayloadWhere is BroadcastPayload for only the endpoints that where is true for (see Sender.BroadcastPayloadWhere)
+func (m *Manager) BroadcastPayloadWhere(
+	where func(endpointID ksuid.KSUID) bool,
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payload []byte,
+	fragmentSize int,
+	dscp int,
+) error {
+	return m.sender.BroadcastPayloadWhere(
+		where,
+		resendTimeout,
+		resendExpiry,
+		correlationID,
+		needsAck,
+		payload,
+		fragmentSize,
+		dscp,
+	)
+}
+
 func (m *Manager) Start() {
 	m.sender.Start()
 	m.receiver.Start()
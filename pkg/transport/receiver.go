@@ -14,8 +14,9 @@ type Receiver struct {
 	networkID      int64
 	listenAddress  *net.UDPAddr
 	interfaceName  string
-	networkManager *network.Manager
+	networkManager network.Network
 	sender         *Sender
+	onProbe        func(*types.Container)
 	onReceive      func(*types.Container)
 }
 
@@ -23,8 +24,9 @@ func NewReceiver(
 	networkID int64,
 	listenAddress *net.UDPAddr,
 	interfaceName string,
-	networkManager *network.Manager,
+	networkManager network.Network,
 	sender *Sender,
+	onProbe func(*types.Container),
 	onReceive func(*types.Container),
 ) *Receiver {
 	r := Receiver{
@@ -33,6 +35,7 @@ func NewReceiver(
 		interfaceName:  interfaceName,
 		networkManager: networkManager,
 		sender:         sender,
+		onProbe:        onProbe,
 		onReceive:      onReceive,
 	}
 
@@ -40,27 +43,43 @@ func NewReceiver(
 }
 
 func (r *Receiver) handleReceive(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte) {
+	r.handle(srcAddr.String(), dstAddr.String(), data)
+}
+
+// HandleStreamReceive is for frames that arrived over a stream (see Sender.UseLocal and Sender.UseStream)
+func (r *Receiver) HandleStreamReceive(srcAddress string, dstAddress string, data []byte) {
+	r.handle(srcAddress, dstAddress, data)
+}
+
+func (r *Receiver) handle(receivedFrom string, receivedBy string, data []byte) {
 	var err error
 
 	receivedTimestamp := time.Now()
 
 	container, err := serialization.Deserialize(data)
 	if err != nil {
-		log.Printf("warning: attempt to deserialize returned %#+v for %#+v from %#+v", err, string(data), srcAddr)
+		log.Printf("warning: attempt to deserialize returned %#+v for %#+v from %#+v", err, string(data), receivedFrom)
 		return
 	}
 
 	container.ReceivedTimestamp = receivedTimestamp
-	container.ReceivedFrom = srcAddr.String()
-	container.ReceivedBy = dstAddr.String()
+	container.ReceivedFrom = receivedFrom
+	container.ReceivedBy = receivedBy
 
 	if container.NetworkID != r.networkID {
 		log.Printf("warning: ignoring container because NetworkID %v unknown in %v", r.networkID, container.String())
 		return
 	}
 
+	// failure detector probes share the data listen address
+	if container.Probe != nil {
+		r.onProbe(container)
+		return
+	}
+
 	if container.Frame == nil {
 		log.Printf("error: unexpectedly received non-frame %#+v", container)
+		return
 	}
 
 	// in all cases sendAck marks a NeedsAck so that the sender stops trying to sendAck it (even if it's not for us,
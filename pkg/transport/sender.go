@@ -2,12 +2,14 @@ package transport
 
 import (
 	"log"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/segmentio/ksuid"
 
 	"github.com/initialed85/glue/pkg/discovery"
+	"github.com/initialed85/glue/pkg/fragmentation"
 	"github.com/initialed85/glue/pkg/network"
 	"github.com/initialed85/glue/pkg/serialization"
 	"github.com/initialed85/glue/pkg/types"
@@ -20,11 +22,16 @@ type Sender struct {
 	scheduledWorker        *worker.ScheduledWorker
 	mu                     sync.Mutex
 	sentContainerByFrameID map[ksuid.KSUID]*types.Container
+	dscpByFrameID          map[ksuid.KSUID]int
 	networkID              int64
 	endpointID             ksuid.KSUID
 	endpointName           string
 	discoveryManager       *discovery.Manager
-	networkManager         *network.Manager
+	networkManager         network.Network
+	hostID                 string
+	localManager           *network.StreamManager
+	streamManager          *network.StreamManager
+	ackDSCP                int
 }
 
 func NewSender(
@@ -32,10 +39,11 @@ func NewSender(
 	endpointID ksuid.KSUID,
 	endpointName string,
 	discoveryManager *discovery.Manager,
-	networkManager *network.Manager,
+	networkManager network.Network,
 ) *Sender {
 	s := Sender{
 		sentContainerByFrameID: make(map[ksuid.KSUID]*types.Container),
+		dscpByFrameID:          make(map[ksuid.KSUID]int),
 		networkID:              networkID,
 		endpointID:             endpointID,
 		endpointName:           endpointName,
@@ -53,10 +61,93 @@ func NewSender(
 	return &s
 }
 
+// UseLocal sends to endpoints on the same host (i.e. that announce our host ID) via their Unix domain socket rather than
+// via UDP; it should be called before Start
+func (s *Sender) UseLocal(hostID string, localManager *network.StreamManager) {
+	s.hostID = hostID
+	s.localManager = localManager
+}
+
+// UseAckDSCP marks acks with the given DSCP (so that they can be prioritised over the data they're acking); it should be
+// called before Start
+func (s *Sender) UseAckDSCP(dscp int) {
+	s.ackDSCP = dscp
+}
+
+// UseStream sends to endpoints that announce a stream address via TCP rather than via UDP (better suited to routed or lossy
+// paths, as TCP does the retransmitting; frames are still acked, in case the connection goes away with them in it); it
+// should be called before Start
+func (s *Sender) UseStream(streamManager *network.StreamManager) {
+	s.streamManager = streamManager
+}
+
+// getStream is how to reach the endpoint that made the announcement over a stream (if at all); via its Unix domain socket if
+// it's on the same host, otherwise via TCP if we both do that
+func (s *Sender) getStream(announcementContainer *types.Container) (*network.StreamManager, string) {
+	announcement := announcementContainer.Announcement
+
+	if s.localManager != nil && s.hostID != "" && announcement.HostID == s.hostID && announcement.LocalAddress != "" {
+		return s.localManager, announcement.LocalAddress
+	}
+
+	if s.streamManager != nil && announcement.StreamAddress != "" {
+		return s.streamManager, announcement.StreamAddress
+	}
+
+	return nil, ""
+}
+
+// sendStream sends a frame (of any size) over a stream; it's remembered for resends (if permitted) like any other frame,
+// as the connection can go away with the frame still in it
+func (s *Sender) sendStream(streamManager *network.StreamManager, dstAddress string, container *types.Container, permitResend bool, isResend bool, dscp int) error {
+	container.SentBy = streamManager.GetListenAddress()
+	container.SentTo = dstAddress
+
+	now := time.Now()
+
+	if !isResend {
+		container.SentTimestamp = now
+		container.LastSentTimestamp = now
+	} else {
+		container.LastSentTimestamp = now
+	}
+
+	if permitResend {
+		s.mu.Lock()
+		s.sentContainerByFrameID[container.Frame.FrameID] = container
+		s.dscpByFrameID[container.Frame.FrameID] = dscp
+		s.mu.Unlock()
+	}
+
+	data, err := serialization.Serialize(container)
+	if err != nil {
+		return err
+	}
+
+	return streamManager.Send(dstAddress, data)
+}
+
+// tryStream sends a frame over a stream if the destination can be reached that way; false means it has to go via UDP
+func (s *Sender) tryStream(announcementContainer *types.Container, container *types.Container, permitResend bool, isResend bool, dscp int) bool {
+	streamManager, dstAddress := s.getStream(announcementContainer)
+	if streamManager == nil {
+		return false
+	}
+
+	err := s.sendStream(streamManager, dstAddress, container, permitResend, isResend, dscp)
+	if err != nil {
+		log.Printf("warning: failed stream send to %v (falling back to UDP) because %v", dstAddress, err)
+		return false
+	}
+
+	return true
+}
+
 func (s *Sender) work() {
 	now := time.Now()
 
 	toResend := make([]*types.Container, 0)
+	toResendDSCP := make([]int, 0)
 	toDelete := make([]*types.Container, 0)
 
 	s.mu.Lock()
@@ -66,20 +157,27 @@ func (s *Sender) work() {
 			toDelete = append(toDelete, frame)
 		} else if now.After(frame.LastSentTimestamp.Add(frame.Frame.ResendPeriod)) {
 			toResend = append(toResend, frame)
+			toResendDSCP = append(toResendDSCP, s.dscpByFrameID[frame.Frame.FrameID])
 		}
 	}
 
 	for _, container := range toDelete {
 		delete(s.sentContainerByFrameID, container.Frame.FrameID)
+		delete(s.dscpByFrameID, container.Frame.FrameID)
 	}
 
 	s.mu.Unlock()
 
+	// the destination never acknowledged these; discovery uses that to spot endpoints that can't hear us
+	for _, container := range toDelete {
+		s.discoveryManager.ReportAckTimeout(container.Frame.DestinationEndpointID)
+	}
+
 	var err error
 
-	for _, container := range toResend {
+	for i, container := range toResend {
 		// TODO: backoff multiplier if we get failures here?
-		err = s.send(container, true, true)
+		err = s.send(container, true, true, toResendDSCP[i])
 		if err != nil {
 			log.Printf("warning: failed resend of frame trying to send for %v because of %v", container.String(), err)
 			continue
@@ -87,15 +185,17 @@ func (s *Sender) work() {
 	}
 }
 
-func (s *Sender) send(container *types.Container, permitResend bool, isResend bool) error {
+// prepare gets a frame ready to go (and remembers it, and its DSCP, for resends if permitted); it returns where to send it
+// and what to send
+func (s *Sender) prepare(container *types.Container, permitResend bool, isResend bool, dscp int) (*net.UDPAddr, []byte, error) {
 	announcementContainer, err := s.discoveryManager.GetLastAnnouncementContainerByEndpointName(container.Frame.DestinationEndpointName)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	rawSrcAddr, err := s.networkManager.GetRawSrcAddr(announcementContainer.Announcement.ListenAddr)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	container.SentBy = rawSrcAddr.String()
@@ -113,12 +213,13 @@ func (s *Sender) send(container *types.Container, permitResend bool, isResend bo
 	if permitResend {
 		s.mu.Lock()
 		s.sentContainerByFrameID[container.Frame.FrameID] = container
+		s.dscpByFrameID[container.Frame.FrameID] = dscp
 		s.mu.Unlock()
 	}
 
 	data, err := serialization.Serialize(container)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// attemptType := "sent"
@@ -133,7 +234,33 @@ func (s *Sender) send(container *types.Container, permitResend bool, isResend bo
 
 	// log.Printf("%v -> %v; %v %v frame to %v", attemptType, frameType, rawSrcAddr.String(), announcementContainer.Announcement.ListenAddr.String(), container.SourceEndpointName)
 
-	return s.networkManager.Send(announcementContainer.Announcement.ListenAddr, data)
+	return announcementContainer.Announcement.ListenAddr, data, nil
+}
+
+func (s *Sender) send(container *types.Container, permitResend bool, isResend bool, dscp int) error {
+	if s.localManager != nil || s.streamManager != nil {
+		announcementContainer, err := s.discoveryManager.GetLastAnnouncementContainerByEndpointName(container.Frame.DestinationEndpointName)
+		if err != nil {
+			return err
+		}
+
+		if s.tryStream(announcementContainer, container, permitResend, isResend, dscp) {
+			return nil
+		}
+	}
+
+	dstAddr, data, err := s.prepare(container, permitResend, isResend, dscp)
+	if err != nil {
+		return err
+	}
+
+	// a whole payload that first went over a (since dropped) stream is too big for UDP; it's still remembered, so it goes
+	// again once the stream is back (or expires if it never is)
+	if isResend && len(data) > network.MaxDatagramSize {
+		return nil
+	}
+
+	return s.networkManager.WithDSCP(dscp).Send(dstAddr, data)
 }
 
 func (s *Sender) Send(
@@ -164,7 +291,12 @@ func (s *Sender) Send(
 		payload,
 	)
 
-	return s.send(frame, needsAck && !isAck, false)
+	dscp := 0
+	if isAck {
+		dscp = s.ackDSCP
+	}
+
+	return s.send(frame, needsAck && !isAck, false, dscp)
 }
 
 func (s *Sender) Broadcast(
@@ -200,6 +332,171 @@ func (s *Sender) Broadcast(
 	}
 }
 
+// broadcastBatchTo sends all the fragments of something to a single endpoint in a single batch
+func (s *Sender) broadcastBatchTo(
+	announcementContainer *types.Container,
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payloads [][]byte,
+	dscp int,
+) {
+	var dstAddr *net.UDPAddr
+	datas := make([][]byte, 0, len(payloads))
+
+	for i, payload := range payloads {
+		container := types.GetFrameContainer(
+			resendTimeout,
+			resendExpiry,
+			s.networkID,
+			s.endpointID,
+			s.endpointName,
+			correlationID,
+			int64(len(payloads)),
+			int64(i),
+			announcementContainer.SourceEndpointID,
+			announcementContainer.SourceEndpointName,
+			needsAck,
+			false, // doesn't make sense to broadcast an ack
+			payload,
+		)
+
+		thisDstAddr, data, err := s.prepare(container, needsAck, false, dscp)
+		if err != nil {
+			log.Printf("warning: failed to broadcast %v bytes because %v for %v", len(payload), err, announcementContainer.String())
+			continue
+		}
+
+		dstAddr = thisDstAddr
+		datas = append(datas, data)
+	}
+
+	if len(datas) == 0 {
+		return
+	}
+
+	err := s.networkManager.WithDSCP(dscp).SendBatch(dstAddr, datas)
+	if err != nil {
+		log.Printf("warning: failed to broadcast %v fragments because %v for %v", len(datas), err, announcementContainer.String())
+	}
+}
+
+// BroadcastBatch is Broadcast for all the fragments of something at once; each endpoint gets them in a single batch
+func (s *Sender) BroadcastBatch(
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payloads [][]byte,
+) {
+	for _, announcementContainer := range s.discoveryManager.GetAllAnnouncementContainers() {
+		if announcementContainer.SourceEndpointID == s.endpointID {
+			continue
+		}
+
+		s.broadcastBatchTo(
+			announcementContainer,
+			resendTimeout,
+			resendExpiry,
+			correlationID,
+			needsAck,
+			payloads,
+			0,
+		)
+	}
+}
+
+// BroadcastPayload is BroadcastBatch for something not yet fragmented; endpoints reached over a stream get it whole (see
+// UseLocal and UseStream) and the rest get it in fragments of the given size, marked with the given DSCP (0 for best
+// effort)
+func (s *Sender) BroadcastPayload(
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payload []byte,
+	fragmentSize int,
+	dscp int,
+) error {
+	return s.BroadcastPayloadWhere(
+		nil,
+		resendTimeout,
+		resendExpiry,
+		correlationID,
+		needsAck,
+		payload,
+		fragmentSize,
+		dscp,
+	)
+}
+
+// BroadcastPayloadWhere is BroadcastPayload for only the endpoints that where is true for (nil for all of them)
+func (s *Sender) BroadcastPayloadWhere(
+	where func(endpointID ksuid.KSUID) bool,
+	resendTimeout time.Duration,
+	resendExpiry time.Duration,
+	correlationID ksuid.KSUID,
+	needsAck bool,
+	payload []byte,
+	fragmentSize int,
+	dscp int,
+) error {
+	var fragments [][]byte
+
+	for _, announcementContainer := range s.discoveryManager.GetAllAnnouncementContainers() {
+		if announcementContainer.SourceEndpointID == s.endpointID {
+			continue
+		}
+
+		if where != nil && !where(announcementContainer.SourceEndpointID) {
+			continue
+		}
+
+		container := types.GetFrameContainer(
+			resendTimeout,
+			resendExpiry,
+			s.networkID,
+			s.endpointID,
+			s.endpointName,
+			correlationID,
+			1,
+			0,
+			announcementContainer.SourceEndpointID,
+			announcementContainer.SourceEndpointName,
+			needsAck,
+			false, // doesn't make sense to broadcast an ack
+			payload,
+		)
+
+		if s.tryStream(announcementContainer, container, needsAck, false, dscp) {
+			continue
+		}
+
+		// only fragmented if someone needs it fragmented
+		if fragments == nil {
+			var err error
+
+			fragments, err = fragmentation.Fragment(payload, fragmentSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.broadcastBatchTo(
+			announcementContainer,
+			resendTimeout,
+			resendExpiry,
+			correlationID,
+			needsAck,
+			fragments,
+			dscp,
+		)
+	}
+
+	return nil
+}
+
 func (s *Sender) SendAck(container *types.Container) error {
 	ackContainer := types.GetFrameAckContainer(
 		s.networkID,
@@ -208,7 +505,7 @@ func (s *Sender) SendAck(container *types.Container) error {
 		container,
 	)
 
-	return s.send(ackContainer, false, false)
+	return s.send(ackContainer, false, false, s.ackDSCP)
 }
 
 func (s *Sender) MarkAck(container *types.Container) {
@@ -222,6 +519,9 @@ func (s *Sender) MarkAck(container *types.Container) {
 	}
 
 	delete(s.sentContainerByFrameID, container.Frame.FrameID)
+	delete(s.dscpByFrameID, container.Frame.FrameID)
+
+	s.discoveryManager.ReportAck(container.SourceEndpointID)
 }
 
 func (s *Sender) Start() {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -15,9 +16,7 @@ import (
 	"github.com/initialed85/glue/pkg/types"
 )
 
-func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSUID, *discovery.Manager, chan *types.Container, chan *types.Container, *Manager, chan *types.Container) {
-	networkManager := network.NewManager()
-
+func getThings(endpointName string, listenPort int, networkManager network.Network, interfaceName string) (network.Network, ksuid.KSUID, *discovery.Manager, chan *types.Container, chan *types.Container, *Manager, chan *types.Container) {
 	added := make(chan *types.Container, 65536)
 	removed := make(chan *types.Container, 65536)
 	received := make(chan *types.Container, 65536)
@@ -34,7 +33,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		unicastListenAddr,
 		multicastAddr,
 		multicastAddr,
-		"en0",
+		interfaceName,
 		time.Millisecond*100,
 		3,
 		networkManager,
@@ -44,6 +43,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		func(container *types.Container) {
 			removed <- container
 		},
+		nil,
 	)
 
 	transportManager := NewManager(
@@ -51,7 +51,7 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 		endpointID,
 		endpointName,
 		unicastListenAddr,
-		"en0",
+		interfaceName,
 		discoveryManager,
 		networkManager,
 		func(container *types.Container) {
@@ -62,13 +62,13 @@ func getThings(endpointName string, listenPort int) (*network.Manager, ksuid.KSU
 	return networkManager, endpointID, discoveryManager, added, removed, transportManager, received
 }
 
-func startThings(networkManager *network.Manager, discoveryManager *discovery.Manager, transportManager *Manager) {
+func startThings(networkManager network.Network, discoveryManager *discovery.Manager, transportManager *Manager) {
 	networkManager.Start()
 	discoveryManager.Start()
 	transportManager.Start()
 }
 
-func stopThings(networkManager *network.Manager, discoveryManager *discovery.Manager, transportManager *Manager) {
+func stopThings(networkManager network.Network, discoveryManager *discovery.Manager, transportManager *Manager) {
 	transportManager.Stop()
 	discoveryManager.Stop()
 	networkManager.Stop()
@@ -77,10 +77,10 @@ func stopThings(networkManager *network.Manager, discoveryManager *discovery.Man
 func TestIntegration_Manager(t *testing.T) {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
-	networkManager1, _, discoveryManager1, added1, removed1, transportManager1, _ := getThings("A", 27321)
+	networkManager1, _, discoveryManager1, added1, removed1, transportManager1, _ := getThings("A", 27321, network.NewManager(), "en0")
 	startThings(networkManager1, discoveryManager1, transportManager1)
 
-	networkManager2, endpointID2, discoveryManager2, added2, _, transportManager2, received2 := getThings("B", 27322)
+	networkManager2, endpointID2, discoveryManager2, added2, _, transportManager2, received2 := getThings("B", 27322, network.NewManager(), "en0")
 	startThings(networkManager2, discoveryManager2, transportManager2)
 
 	select {
@@ -138,3 +138,289 @@ func TestIntegration_Manager(t *testing.T) {
 
 	stopThings(networkManager1, discoveryManager1, transportManager1)
 }
+
+func TestManager_Fabric(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{
+		Latency:     time.Millisecond * 5,
+		Jitter:      time.Millisecond * 5,
+		Loss:        0.2,
+		Duplication: 0.1,
+		Reordering:  0.1,
+	})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager1, _, discoveryManager1, added1, _, transportManager1, _ := getThings("A", 27323, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	startThings(networkManager1, discoveryManager1, transportManager1)
+	defer stopThings(networkManager1, discoveryManager1, transportManager1)
+
+	networkManager2, endpointID2, discoveryManager2, _, _, transportManager2, received2 := getThings("B", 27324, fabric.NewNode(net.ParseIP("10.0.0.2")), "")
+	startThings(networkManager2, discoveryManager2, transportManager2)
+	defer stopThings(networkManager2, discoveryManager2, transportManager2)
+
+	select {
+	case added := <-added1:
+		assert.Equal(t, "B", added.SourceEndpointName)
+	case <-time.After(time.Second * 5):
+		log.Fatal("timed out waiting for A to see B")
+	}
+
+	// everything gets through a lossy link eventually (at least once) thanks to acks and resends
+	correlationIDs := make(map[ksuid.KSUID]bool)
+	for i := 0; i < 32; i++ {
+		correlationID := ksuid.New()
+		correlationIDs[correlationID] = true
+
+		err := transportManager1.Send(
+			time.Millisecond*50,
+			time.Second*5,
+			correlationID,
+			1,
+			0,
+			endpointID2,
+			"B",
+			true,
+			false,
+			[]byte("Some payload"),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	timeout := time.After(time.Second * 5)
+	for len(correlationIDs) > 0 {
+		select {
+		case received := <-received2:
+			delete(correlationIDs, received.Frame.CorrelationID)
+		case <-timeout:
+			log.Fatalf("timed out waiting for B to receive from A; %v missing", len(correlationIDs))
+		}
+	}
+
+	assert.Greater(t, fabric.Stats().Dropped, int64(0))
+}
+
+func getSentCount(transportManager *Manager) int {
+	transportManager.sender.mu.Lock()
+	defer transportManager.sender.mu.Unlock()
+
+	return len(transportManager.sender.sentContainerByFrameID)
+}
+
+func waitForStream(t *testing.T, transportManager *Manager, received chan *types.Container, streamManager *network.StreamManager, dstAddress string) {
+	err := transportManager.BroadcastPayload(
+		time.Millisecond*100,
+		time.Second,
+		ksuid.New(),
+		true,
+		[]byte("Hello, world!"),
+		8192,
+		0,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		log.Fatal("timed out waiting to receive")
+	}
+
+	assert.Eventually(t, func() bool {
+		return streamManager.IsConnected(dstAddress) && getSentCount(transportManager) == 0
+	}, time.Second*5, time.Millisecond*10)
+
+	// resends (from acks lost on the way back) may have been received more than once (or still be on their way)
+	time.Sleep(time.Millisecond * 50)
+
+	for {
+		select {
+		case <-received:
+		default:
+			return
+		}
+	}
+}
+
+func TestManager_Local(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{})
+	fabric.Start()
+	defer fabric.Stop()
+
+	socketDir := t.TempDir()
+
+	networkManager1, _, discoveryManager1, _, _, transportManager1, _ := getThings("A", 27325, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	localManager1 := network.NewStreamManager("unix", filepath.Join(socketDir, "A.sock"), transportManager1.HandleLocalReceive)
+	discoveryManager1.UseLocal("some-host", localManager1)
+	transportManager1.UseLocal("some-host", localManager1)
+	localManager1.Start()
+	defer localManager1.Stop()
+	startThings(networkManager1, discoveryManager1, transportManager1)
+	defer stopThings(networkManager1, discoveryManager1, transportManager1)
+
+	networkManager2, _, discoveryManager2, added2, _, transportManager2, received2 := getThings("B", 27326, fabric.NewNode(net.ParseIP("10.0.0.2")), "")
+	localManager2 := network.NewStreamManager("unix", filepath.Join(socketDir, "B.sock"), transportManager2.HandleLocalReceive)
+	discoveryManager2.UseLocal("some-host", localManager2)
+	transportManager2.UseLocal("some-host", localManager2)
+	localManager2.Start()
+	defer localManager2.Stop()
+	startThings(networkManager2, discoveryManager2, transportManager2)
+	defer stopThings(networkManager2, discoveryManager2, transportManager2)
+
+	select {
+	case added := <-added2:
+		assert.Equal(t, "A", added.SourceEndpointName)
+		assert.Equal(t, "some-host", added.Announcement.HostID)
+		assert.Equal(t, localManager1.GetListenAddress(), added.Announcement.LocalAddress)
+	case <-time.After(time.Second * 5):
+		log.Fatal("timed out waiting for B to see A")
+	}
+
+	// wait for A to see B too
+	time.Sleep(time.Millisecond * 200)
+
+	// the first send to B only starts connecting (going via UDP in the meantime)
+	waitForStream(t, transportManager1, received2, localManager1, localManager2.GetListenAddress())
+
+	sentBefore := fabric.Stats().Sent
+
+	payload := make([]byte, 1024*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	err := transportManager1.BroadcastPayload(
+		time.Millisecond*100,
+		time.Second,
+		ksuid.New(),
+		true,
+		payload,
+		8192,
+		0,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// whole (rather than in 128 fragments) and without touching the (UDP) network
+	select {
+	case received := <-received2:
+		assert.Equal(t, "A", received.SourceEndpointName)
+		assert.Equal(t, int64(1), received.Frame.FragmentCount)
+		assert.True(t, received.Frame.NeedsAck)
+		assert.Equal(t, payload, received.Frame.Payload)
+	case <-time.After(time.Second):
+		log.Fatal("timed out waiting for B to receive from A")
+	}
+
+	// the ack comes back the same way
+	assert.Eventually(t, func() bool {
+		return getSentCount(transportManager1) == 0
+	}, time.Second, time.Millisecond*10)
+
+	// announcements carry on regardless, but there'd be 128 fragments and 128 acks if it had gone via UDP
+	assert.Less(t, fabric.Stats().Sent-sentBefore, int64(16))
+}
+
+func TestManager_Stream(t *testing.T) {
+	fabric := network.NewFabric(1, network.LinkConfig{
+		Latency: time.Millisecond * 5,
+		Loss:    0.2,
+	})
+	fabric.Start()
+	defer fabric.Stop()
+
+	networkManager1, _, discoveryManager1, _, _, transportManager1, _ := getThings("A", 27327, fabric.NewNode(net.ParseIP("10.0.0.1")), "")
+	streamManager1 := network.NewStreamManager("tcp", "127.0.0.1:27327", transportManager1.HandleStreamReceive)
+	discoveryManager1.UseStream(streamManager1)
+	transportManager1.UseStream(streamManager1)
+	streamManager1.Start()
+	defer streamManager1.Stop()
+	startThings(networkManager1, discoveryManager1, transportManager1)
+	defer stopThings(networkManager1, discoveryManager1, transportManager1)
+
+	networkManager2, endpointID2, discoveryManager2, added2, _, transportManager2, received2 := getThings("B", 27328, fabric.NewNode(net.ParseIP("10.0.0.2")), "")
+	streamManager2 := network.NewStreamManager("tcp", "127.0.0.1:27328", transportManager2.HandleStreamReceive)
+	discoveryManager2.UseStream(streamManager2)
+	transportManager2.UseStream(streamManager2)
+	streamManager2.Start()
+	startThings(networkManager2, discoveryManager2, transportManager2)
+	defer stopThings(networkManager2, discoveryManager2, transportManager2)
+
+	select {
+	case added := <-added2:
+		assert.Equal(t, "A", added.SourceEndpointName)
+		assert.Equal(t, "127.0.0.1:27327", added.Announcement.StreamAddress)
+	case <-time.After(time.Second * 5):
+		log.Fatal("timed out waiting for B to see A")
+	}
+
+	assert.Eventually(t, func() bool {
+		_, err := discoveryManager1.GetLastAnnouncementContainerByEndpointName("B")
+		return err == nil
+	}, time.Second*5, time.Millisecond*10)
+
+	waitForStream(t, transportManager1, received2, streamManager1, "127.0.0.1:27328")
+
+	payload := make([]byte, 1024*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	err := transportManager1.BroadcastPayload(
+		time.Millisecond*100,
+		time.Second,
+		ksuid.New(),
+		true,
+		payload,
+		8192,
+		0,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// whole, in spite of the lossy (UDP) network
+	select {
+	case received := <-received2:
+		assert.Equal(t, int64(1), received.Frame.FragmentCount)
+		assert.True(t, received.Frame.NeedsAck)
+		assert.Equal(t, payload, received.Frame.Payload)
+	case <-time.After(time.Second):
+		log.Fatal("timed out waiting for B to receive from A")
+	}
+
+	assert.Eventually(t, func() bool {
+		return getSentCount(transportManager1) == 0
+	}, time.Second, time.Millisecond*10)
+
+	// B no longer listening on TCP; anything A sends before it notices the connection has gone is lost with it, but
+	// isn't acked, so it's resent (via UDP)
+	streamManager2.Stop()
+
+	err = transportManager1.Send(
+		time.Millisecond*50,
+		time.Second*5,
+		ksuid.New(),
+		1,
+		0,
+		endpointID2,
+		"B",
+		true,
+		false,
+		[]byte("Some payload"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case received := <-received2:
+		assert.True(t, received.Frame.NeedsAck)
+		assert.Equal(t, []byte("Some payload"), received.Frame.Payload)
+	case <-time.After(time.Second * 5):
+		log.Fatal("timed out waiting for B to receive from A")
+	}
+}
@@ -96,3 +96,36 @@ func GetFrameAckContainer(
 		},
 	}
 }
+
+func GetProbeContainer(
+	networkID int64,
+	sourceEndpointID ksuid.KSUID,
+	sourceEndpointName string,
+	probeType ProbeType,
+	sequenceNumber uint64,
+	incarnation uint64,
+	targetEndpointID ksuid.KSUID,
+	targetAddress *net.UDPAddr,
+	updates []*MemberUpdate,
+) *Container {
+	rawTargetAddress := ""
+	if targetAddress != nil {
+		rawTargetAddress = targetAddress.String()
+	}
+
+	return &Container{
+		SentTimestamp:      time.Now(),
+		NetworkID:          networkID,
+		SourceEndpointID:   sourceEndpointID,
+		SourceEndpointName: sourceEndpointName,
+		Probe: &Probe{
+			SequenceNumber:   sequenceNumber,
+			Type:             probeType,
+			Incarnation:      incarnation,
+			TargetEndpointID: targetEndpointID,
+			TargetAddress:    rawTargetAddress,
+			TargetAddr:       targetAddress,
+			Updates:          updates,
+		},
+	}
+}
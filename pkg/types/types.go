@@ -26,6 +26,37 @@ type Announcement struct {
 
 	// used to avoid announcement forwarding loops
 	Forwarded bool
+
+	// the registry (or relay) that forwarded this announcement (if any)
+	ForwardedBy ksuid.KSUID `json:"forwarded_by"`
+
+	// the announced endpoint is a registry (rather than a normal endpoint) and this announcement is its heartbeat
+	Registry bool `json:"registry"`
+
+	// the announced endpoint has gone away (a registry tells its clients this)
+	Withdrawn bool `json:"withdrawn"`
+
+	// for a registry's heartbeat, the endpoints it vouches for
+	KnownEndpointIDs []ksuid.KSUID `json:"known_endpoint_ids"`
+
+	// a digest (a bloom filter, so it stays bounded however big the network gets) of the endpoints the announcing endpoint
+	// knows about other than via a registry or relay, itself included
+	KnownEndpointsDigest []byte `json:"known_endpoints_digest"`
+
+	// the announcing endpoint's view of its own incarnation (see Probe)
+	Incarnation uint64 `json:"incarnation"`
+
+	// used to settle EndpointName clashes; the higher priority wins (and then the older endpoint)
+	Priority int64 `json:"priority"`
+
+	// identifies the host the announced endpoint is running on
+	HostID string `json:"host_id"`
+
+	// Unix domain socket the announced endpoint is listening on for data communications from endpoints on the same host
+	LocalAddress string `json:"local_address"`
+
+	// TCP address the announced endpoint is listening on for data communications (if it does that)
+	StreamAddress string `json:"stream_address"`
 }
 
 func (a *Announcement) String() string {
@@ -48,6 +79,16 @@ func (a *Announcement) Copy() *Announcement {
 		DiscoveryTargetAddress: a.DiscoveryTargetAddress,
 		DiscoveryTargetAddr:    a.DiscoveryTargetAddr,
 		Forwarded:              a.Forwarded,
+		ForwardedBy:            a.ForwardedBy,
+		Registry:               a.Registry,
+		Withdrawn:              a.Withdrawn,
+		KnownEndpointIDs:       a.KnownEndpointIDs,
+		KnownEndpointsDigest:   a.KnownEndpointsDigest,
+		Incarnation:            a.Incarnation,
+		Priority:               a.Priority,
+		HostID:                 a.HostID,
+		LocalAddress:           a.LocalAddress,
+		StreamAddress:          a.StreamAddress,
 	}
 }
 
@@ -115,6 +156,102 @@ func (f *Frame) Copy() *Frame {
 	}
 }
 
+type ProbeType int
+
+const (
+	ProbeTypePing ProbeType = iota
+	ProbeTypePingReq
+	ProbeTypeAck
+)
+
+func (p ProbeType) String() string {
+	switch p {
+	case ProbeTypePing:
+		return "ping"
+	case ProbeTypePingReq:
+		return "ping-req"
+	case ProbeTypeAck:
+		return "ack"
+	}
+
+	return fmt.Sprintf("ProbeType(%d)", int(p))
+}
+
+type MemberState int
+
+const (
+	MemberStateAlive MemberState = iota
+	MemberStateSuspect
+	MemberStateDead
+)
+
+func (m MemberState) String() string {
+	switch m {
+	case MemberStateAlive:
+		return "alive"
+	case MemberStateSuspect:
+		return "suspect"
+	case MemberStateDead:
+		return "dead"
+	}
+
+	return fmt.Sprintf("MemberState(%d)", int(m))
+}
+
+// MemberUpdate is a piece of membership gossip; a higher Incarnation (which only the member itself can raise) always
+// wins and at the same Incarnation Dead beats Suspect beats Alive
+type MemberUpdate struct {
+	EndpointID  ksuid.KSUID `json:"endpoint_id"`
+	Incarnation uint64      `json:"incarnation"`
+	State       MemberState `json:"state"`
+}
+
+func (m *MemberUpdate) String() string {
+	return fmt.Sprintf("MemberUpdate[%v @ %v is %v]", m.EndpointID, m.Incarnation, m.State)
+}
+
+// Probe is a failure detector message, sent to (and from) the unicast data listen address
+type Probe struct {
+	// a ping-req and the ack (relayed or not) that answers it share this
+	SequenceNumber uint64 `json:"sequence_number"`
+
+	Type ProbeType `json:"type"`
+
+	// the sending endpoint's view of its own incarnation
+	Incarnation uint64 `json:"incarnation"`
+
+	// for a ping-req; the member to ping on the sender's behalf (for an ack; the member that was pinged)
+	TargetEndpointID ksuid.KSUID `json:"target_endpoint_id"`
+	TargetAddress    string      `json:"target_address"`
+	TargetAddr       *net.UDPAddr
+
+	// membership gossip piggybacked on the probe
+	Updates []*MemberUpdate `json:"updates"`
+}
+
+func (p *Probe) String() string {
+	return fmt.Sprintf(
+		"Probe[%v %v for %v @ %v; %v updates]",
+		p.Type,
+		p.SequenceNumber,
+		p.TargetEndpointID,
+		p.TargetAddress,
+		len(p.Updates),
+	)
+}
+
+func (p *Probe) Copy() *Probe {
+	return &Probe{
+		SequenceNumber:   p.SequenceNumber,
+		Type:             p.Type,
+		Incarnation:      p.Incarnation,
+		TargetEndpointID: p.TargetEndpointID,
+		TargetAddress:    p.TargetAddress,
+		TargetAddr:       p.TargetAddr,
+		Updates:          p.Updates,
+	}
+}
+
 type Container struct {
 	// timestamp the sender originally sent the container
 	SentTimestamp time.Time `json:"sent_timestamp"`
@@ -155,6 +292,9 @@ type Container struct {
 
 	// content for a frame
 	Frame *Frame `json:"frame"`
+
+	// content for a failure detector probe
+	Probe *Probe `json:"probe"`
 }
 
 func (c *Container) String() string {
@@ -164,6 +304,8 @@ func (c *Container) String() string {
 		content = c.Announcement.String()
 	} else if c.Frame != nil {
 		content = c.Frame.String()
+	} else if c.Probe != nil {
+		content = c.Probe.String()
 	}
 
 	return fmt.Sprintf(
@@ -190,6 +332,11 @@ func (c *Container) Copy() *Container {
 		frame = c.Frame.Copy()
 	}
 
+	var probe *Probe
+	if c.Probe != nil {
+		probe = c.Probe.Copy()
+	}
+
 	return &Container{
 		SentTimestamp:      c.SentTimestamp,
 		LastSentTimestamp:  c.LastSentTimestamp,
@@ -207,5 +354,6 @@ func (c *Container) Copy() *Container {
 		SourceEndpointName: c.SourceEndpointName,
 		Announcement:       announcement,
 		Frame:              frame,
+		Probe:              probe,
 	}
 }
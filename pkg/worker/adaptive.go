@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// AdaptiveWorker is like a ScheduledWorker that starts out fast (minDuration) and doubles the duration after each bit
+// of work until it gets to maxDuration; Trigger puts it back to the start
+type AdaptiveWorker struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	mu           sync.Mutex
+	trigger      chan struct{}
+	onStart      func()
+	work         func()
+	onStop       func()
+	minDuration  time.Duration
+	maxDuration  time.Duration
+	nextDuration time.Duration
+}
+
+func NewAdaptiveWorker(
+	onStart func(),
+	work func(),
+	onStop func(),
+	minDuration time.Duration,
+	maxDuration time.Duration,
+) *AdaptiveWorker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if minDuration <= 0 || minDuration > maxDuration {
+		minDuration = maxDuration
+	}
+
+	return &AdaptiveWorker{
+		ctx:          ctx,
+		cancel:       cancel,
+		trigger:      make(chan struct{}, 1),
+		onStart:      onStart,
+		work:         work,
+		onStop:       onStop,
+		minDuration:  minDuration,
+		maxDuration:  maxDuration,
+		nextDuration: minDuration,
+	}
+}
+
+// NextDuration is how long until the next bit of work (at the latest); it's intended to be called from within work
+func (l *AdaptiveWorker) NextDuration() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.nextDuration
+}
+
+// MaxDuration is the steady-state duration
+func (l *AdaptiveWorker) MaxDuration() time.Duration {
+	return l.maxDuration
+}
+
+func (l *AdaptiveWorker) doWork() time.Duration {
+	l.work()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	duration := l.nextDuration
+
+	l.nextDuration *= 2
+	if l.nextDuration > l.maxDuration {
+		l.nextDuration = l.maxDuration
+	}
+
+	return duration
+}
+
+func (l *AdaptiveWorker) run() {
+	l.onStart()
+
+	timer := time.NewTimer(l.doWork())
+
+loop:
+	for {
+		select {
+		case <-l.ctx.Done():
+			break loop
+		case <-l.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+
+			// a little jitter so that everyone that saw the same change doesn't do their work at the same time
+			timer.Reset(time.Duration(rand.Int63n(int64(l.minDuration))))
+		case <-timer.C:
+			timer.Reset(l.doWork())
+		}
+	}
+
+	timer.Stop()
+
+	l.onStop()
+}
+
+// Trigger goes back to doing work at minDuration (starting almost immediately); it does nothing for a worker that has
+// the same minDuration and maxDuration
+func (l *AdaptiveWorker) Trigger() {
+	if l.minDuration == l.maxDuration {
+		return
+	}
+
+	l.mu.Lock()
+	l.nextDuration = l.minDuration
+	l.mu.Unlock()
+
+	select {
+	case l.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (l *AdaptiveWorker) Start() {
+	select {
+	case <-l.ctx.Done():
+		log.Panic("cannot start, already started and stopped")
+	default:
+	}
+
+	go l.run()
+}
+
+func (l *AdaptiveWorker) Stop() {
+	l.cancel()
+}
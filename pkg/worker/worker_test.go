@@ -84,3 +84,48 @@ func TestNewScheduledWorker(t *testing.T) {
 	w.Stop()
 	assert.True(t, m.mock.WaitForCall("onStop", time.Second))
 }
+
+func TestNewAdaptiveWorker(t *testing.T) {
+	m := NewMockThing()
+
+	var w *AdaptiveWorker
+
+	nextDurations := make(chan time.Duration, 1024)
+
+	w = NewAdaptiveWorker(
+		m.onStart,
+		func() {
+			nextDurations <- w.NextDuration()
+		},
+		m.onStop,
+		time.Millisecond*10,
+		time.Millisecond*80,
+	)
+
+	w.Start()
+	assert.True(t, m.mock.WaitForCall("onStart", time.Second))
+
+	for _, expected := range []time.Duration{10, 20, 40, 80, 80} {
+		select {
+		case nextDuration := <-nextDurations:
+			assert.Equal(t, expected*time.Millisecond, nextDuration)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for work")
+		}
+	}
+
+	w.Trigger()
+
+	for _, expected := range []time.Duration{10, 20} {
+		select {
+		case nextDuration := <-nextDurations:
+			assert.Equal(t, expected*time.Millisecond, nextDuration)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for work")
+		}
+	}
+
+	assert.False(t, m.mock.HasCall("onStop"))
+	w.Stop()
+	assert.True(t, m.mock.WaitForCall("onStop", time.Second))
+}